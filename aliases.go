@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// aliasedRequestTypes are the request bodies bound with FIELD_ALIASES applied
+var aliasedRequestTypes = []interface{}{ChatRequest{}, CompletionRequest{}, EmbeddingsRequest{}, RAGRequest{}, BatchJobRequest{}}
+
+// ValidateFieldAliases checks FIELD_ALIASES, whose aliases must each name another field, and not one that is
+// itself an alias, since aliases are renamed in a single pass. An alias can't be a field of a request body,
+// which it would rename away, and two aliases can't name the same field, since a body setting both would keep
+// whichever was renamed last.
+func ValidateFieldAliases(aliases map[string]string) error {
+	standard := make(map[string]bool)
+	for _, body := range aliasedRequestTypes {
+		addJSONFields(standard, reflect.TypeOf(body))
+	}
+
+	named := make(map[string]string, len(aliases))
+	for _, alias := range slices.Sorted(maps.Keys(aliases)) {
+		field := aliases[alias]
+		if alias == field {
+			return fmt.Errorf("field %q is an alias of itself", alias)
+		}
+		if _, ok := aliases[field]; ok {
+			return fmt.Errorf("alias %q names %q, which is itself an alias", alias, field)
+		}
+		if standard[alias] {
+			return fmt.Errorf("alias %q is already a request field", alias)
+		}
+		if other, ok := named[field]; ok {
+			return fmt.Errorf("aliases %q and %q both name %q", other, alias, field)
+		}
+		named[field] = alias
+	}
+	return nil
+}
+
+// addJSONFields adds the JSON names of a struct type's fields, including those of embedded structs, to names
+func addJSONFields(names map[string]bool, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch {
+		case field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct:
+			addJSONFields(names, field.Type)
+		case !field.IsExported() || name == "-":
+		case name != "":
+			names[name] = true
+		default:
+			names[field.Name] = true
+		}
+	}
+}
+
+// applyFieldAliases renames the top-level fields of a JSON request body that FIELD_ALIASES maps to the
+// gateway's field names, such as maxTokens to max_tokens, before it is bound. A field the body already sets
+// under its own name wins over its alias. Bodies that aren't JSON objects are left for binding to reject.
+func applyFieldAliases(req *http.Request) error {
+	if len(AppConfig.FieldAliases) == 0 || req == nil || req.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return nil
+	}
+	renamed := false
+	for alias, field := range AppConfig.FieldAliases {
+		value, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		delete(fields, alias)
+		if _, set := fields[field]; !set {
+			fields[field] = value
+		}
+		renamed = true
+	}
+	if !renamed {
+		return nil
+	}
+
+	normalized, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(normalized))
+	req.ContentLength = int64(len(normalized))
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFieldAliases(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.FieldAliases = map[string]string{"maxTokens": "max_tokens", "stopSequences": "stop"}
+	AppConfig.StrictRequestValidation = true
+
+	parse := func(body string) (ChatRequest, error) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body))
+		return parseChatRequest(c)
+	}
+
+	req, err := parse(`{"model":"anthropic.claude-3-haiku-20240307-v1:0","messages":[{"role":"user","content":"Hi"}],"maxTokens":100,"stopSequences":["END"]}`)
+	if err != nil || req.MaxTokens != 100 || len(req.Stop) != 1 || req.Stop[0] != "END" {
+		t.Errorf("got max_tokens %d and stop %v (%v), want the aliased fields applied", req.MaxTokens, req.Stop, err)
+	}
+	req, err = parse(`{"model":"anthropic.claude-3-haiku-20240307-v1:0","messages":[{"role":"user","content":"Hi"}],"maxTokens":100,"max_tokens":50}`)
+	if err != nil || req.MaxTokens != 50 {
+		t.Errorf("got max_tokens %d (%v), want the field's own name to win", req.MaxTokens, err)
+	}
+
+	if err := ValidateFieldAliases(map[string]string{"maxTokens": "max_tokens", "max_tokens": "maxOutputTokens"}); err == nil {
+		t.Error("chained aliases were accepted")
+	}
+	if err := ValidateFieldAliases(map[string]string{"maxTokens": "max_tokens", "maxOutputTokens": "max_tokens"}); err == nil {
+		t.Error("two aliases of the same field were accepted")
+	}
+	for _, alias := range []string{"stop", "query", "input"} {
+		if err := ValidateFieldAliases(map[string]string{alias: "max_tokens"}); err == nil {
+			t.Errorf("alias %q, a request field, was accepted", alias)
+		}
+	}
+	if err := ValidateFieldAliases(AppConfig.FieldAliases); err != nil {
+		t.Errorf("unexpected error for valid aliases: %v", err)
+	}
+}
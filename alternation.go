@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Message alternation policies, for models that require conversations to alternate between user and
+// assistant turns starting with the user
+const (
+	AlternationOff    = "off"    // send the messages as they are and let the model reject them
+	AlternationMerge  = "merge"  // merge consecutive messages of the same role into one
+	AlternationInsert = "insert" // insert a placeholder turn of the other role between them
+	AlternationReject = "reject" // reject the request before invoking the model
+)
+
+// alternationPolicies are the valid message alternation policies
+var alternationPolicies = map[string]bool{
+	AlternationOff:    true,
+	AlternationMerge:  true,
+	AlternationInsert: true,
+	AlternationReject: true,
+}
+
+// alternationPlaceholder is the content of inserted turns; models reject turns that are actually empty
+const alternationPlaceholder = "..."
+
+// errAlternation is reported for conversations that don't alternate under the reject policy, which is a bad request
+var errAlternation = errors.New("messages must alternate between user and assistant")
+
+// enforceAlternation makes a request's messages alternate between user and assistant turns according to the
+// policy, before they are formatted for a model that requires it. Tool results are user turns; consecutive tool
+// results, and user input following them, are one turn, since the formatters combine them. System messages and
+// messages without content or tool calls are not turns and are kept as they are. Under merge and insert, a
+// conversation that starts with an assistant turn is given a placeholder user turn first. Errors name the
+// offending message by its index in messages; the input slice and its messages are not modified.
+func enforceAlternation(messages []Message, policy string) ([]Message, error) {
+	if policy == AlternationOff || policy == "" {
+		return messages, nil
+	}
+
+	result := make([]Message, 0, len(messages))
+	last := -1 // index in result of the last turn
+	for i, msg := range messages {
+		if !isTurn(msg) {
+			result = append(result, msg)
+			continue
+		}
+
+		previous := "assistant" // the role the first turn must not have
+		if last >= 0 {
+			previous = turnRole(result[last])
+		}
+		role := turnRole(msg)
+		continues := last >= 0 && result[last].Role == "tool" && (msg.Role == "tool" || msg.Role == "user")
+		if role != previous || continues {
+			result = append(result, msg)
+			last = len(result) - 1
+			continue
+		}
+
+		switch {
+		case policy == AlternationReject && last < 0:
+			return nil, fmt.Errorf("%w: the conversation must start with a user message, but message %d is an assistant message", errAlternation, i)
+		case policy == AlternationReject:
+			return nil, fmt.Errorf("%w: message %d is a second consecutive %s turn", errAlternation, i, role)
+		case policy == AlternationMerge && last >= 0 && msg.Role == "tool":
+			// A tool result can't be merged into user input; it is sent as it is
+			result = append(result, msg)
+			last = len(result) - 1
+		case policy == AlternationMerge && last >= 0:
+			result[last] = mergeMessages(result[last], msg)
+		default:
+			result = append(result, Message{Role: otherRole(role), Content: alternationPlaceholder}, msg)
+			last = len(result) - 1
+		}
+	}
+	return result, nil
+}
+
+// isTurn reports whether a message takes a turn of the conversation
+func isTurn(msg Message) bool {
+	if msg.Role == "system" {
+		return false
+	}
+	return len(msg.ToolCalls) > 0 || msg.FunctionCall != nil || len(contentBlocks(msg.Content)) > 0
+}
+
+// turnRole returns the role of the turn a message takes: tool and function results are user turns
+func turnRole(msg Message) string {
+	if msg.Role == "assistant" {
+		return "assistant"
+	}
+	return "user"
+}
+
+// mergeMessages joins two consecutive messages of the same role into one: text content with a blank line
+// between, other content as a list of both messages' blocks, and the tool calls of both. Names of user
+// messages are kept by prefixing their content, as Claude's formatter does.
+func mergeMessages(first, second Message) Message {
+	named := func(msg Message) interface{} {
+		if msg.Name != "" && msg.Role == "user" {
+			return prefixContent(msg.Content, msg.Name+": ")
+		}
+		return msg.Content
+	}
+
+	merged := Message{Role: first.Role, FunctionCall: first.FunctionCall}
+	firstContent, secondContent := named(first), named(second)
+	firstText, firstIsText := firstContent.(string)
+	secondText, secondIsText := secondContent.(string)
+	switch {
+	case firstIsText && secondIsText && firstText != "" && secondText != "":
+		merged.Content = firstText + "\n\n" + secondText
+	case firstIsText && secondIsText:
+		merged.Content = firstText + secondText
+	default:
+		merged.Content = append(contentBlocks(firstContent), contentBlocks(secondContent)...)
+	}
+	merged.ToolCalls = append(append([]ToolCall{}, first.ToolCalls...), second.ToolCalls...)
+	if len(merged.ToolCalls) == 0 {
+		merged.ToolCalls = nil
+	}
+	return merged
+}
+
+// otherRole returns the role alternating with role
+func otherRole(role string) string {
+	if role == "user" {
+		return "assistant"
+	}
+	return "user"
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEnforceAlternation(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "assistant", Content: "Hello"},
+		{Role: "user", Content: "Hi"},
+		{Role: "user", Content: "Are you there?"},
+		{Role: "assistant", Content: "Yes."},
+	}
+	roles := func(messages []Message) string {
+		var roles []string
+		for _, msg := range messages {
+			roles = append(roles, msg.Role)
+		}
+		return strings.Join(roles, ",")
+	}
+
+	merged, err := enforceAlternation(messages, AlternationMerge)
+	if err != nil || roles(merged) != "system,user,assistant,user,assistant" {
+		t.Fatalf("merge = %v, %v; want alternating turns", merged, err)
+	}
+	if merged[3].Content != "Hi\n\nAre you there?" {
+		t.Errorf("merged content = %q, want both user messages", merged[3].Content)
+	}
+	if messages[2].Content != "Hi" {
+		t.Errorf("input was modified: %v", messages)
+	}
+
+	inserted, err := enforceAlternation(messages, AlternationInsert)
+	if err != nil || roles(inserted) != "system,user,assistant,user,assistant,user,assistant" || inserted[4].Content != alternationPlaceholder {
+		t.Errorf("insert = %v, %v; want placeholder turns", inserted, err)
+	}
+
+	// Errors name the client's message, counting system messages
+	_, err = enforceAlternation(messages[2:], AlternationReject)
+	if !errors.Is(err, errAlternation) || chatErrorStatus(err) != http.StatusBadRequest || !strings.Contains(err.Error(), "message 1 ") {
+		t.Errorf("reject err = %v, want an alternation error naming message 1, reported as 400", err)
+	}
+	if _, err := enforceAlternation(messages, AlternationReject); err == nil || !strings.Contains(err.Error(), "message 1 ") {
+		t.Errorf("reject err = %v, want the leading assistant message 1 named", err)
+	}
+	if off, _ := enforceAlternation(messages, AlternationOff); len(off) != len(messages) {
+		t.Errorf("off = %v, want the messages unchanged", off)
+	}
+
+	// Tool results, and user input following them, are one user turn
+	tools := []Message{
+		{Role: "user", Content: "Weather?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "weather", Arguments: "{}"}}}},
+		{Role: "tool", ToolCallID: "call_1", Content: "Sunny"},
+		{Role: "user", Content: "Thanks"},
+	}
+	if result, err := enforceAlternation(tools, AlternationReject); err != nil || len(result) != len(tools) {
+		t.Errorf("tool results = %v, %v; want the conversation accepted as it is", result, err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit content levels, from least to most detail
+const (
+	AuditLevelNone     = "none"     // who called what, when, and the outcome
+	AuditLevelMetadata = "metadata" // additionally body sizes and hashes, for correlation without content
+	AuditLevelFull     = "full"     // additionally the complete request and response bodies
+)
+
+// AuditEntry is a single audited request and its response
+type AuditEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Principal  string    `json:"principal"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Model      string    `json:"model,omitempty"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"duration_ms"`
+
+	// Set at the metadata level and above
+	RequestSummary  string `json:"request_summary,omitempty"`
+	ResponseSummary string `json:"response_summary,omitempty"`
+
+	// Set at the full level
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// AuditLogger records audit entries to a sink; implementations must be safe for concurrent use
+type AuditLogger interface {
+	Log(entry AuditEntry) error
+	Close() error
+}
+
+// FileAuditLogger writes audit entries as JSON lines to a file, rotating it when it exceeds a size limit
+type FileAuditLogger struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileAuditLogger opens, or creates, the audit log at path. The file is rotated to path.1, path.2, ...
+// once it reaches maxBytes, keeping at most maxBackups old files; a maxBytes of zero disables rotation.
+func NewFileAuditLogger(path string, maxBytes int64, maxBackups int) (*FileAuditLogger, error) {
+	l := &FileAuditLogger{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file for appending and records its current size
+func (l *FileAuditLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Log appends an entry to the audit log as a single JSON line
+func (l *FileAuditLogger) Log(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts existing backups up by one, moves the current file to path.1 and starts a new file
+func (l *FileAuditLogger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if l.maxBackups <= 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxBackups))
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+// Close closes the underlying file
+func (l *FileAuditLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// auditResponseWriter hashes the response body as it is written to the client, so long streams are summarized
+// without being held in memory; the body itself is only kept when it is audited in full
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	hash hash.Hash
+	size int
+	body *bytes.Buffer // nil unless the full body is audited
+}
+
+// newAuditResponseWriter wraps w, keeping a copy of the body if full is set
+func newAuditResponseWriter(w gin.ResponseWriter, full bool) *auditResponseWriter {
+	writer := &auditResponseWriter{ResponseWriter: w, hash: sha256.New()}
+	if full {
+		writer.body = &bytes.Buffer{}
+	}
+	return writer
+}
+
+// Write records the data and passes it through to the client
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	w.hash.Write(data)
+	w.size += len(data)
+	if w.body != nil {
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString records the data and passes it through to the client
+func (w *auditResponseWriter) WriteString(s string) (int, error) {
+	io.WriteString(w.hash, s)
+	w.size += len(s)
+	if w.body != nil {
+		w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// summary returns the length and hash of the response body written so far, as redactContent reports them
+func (w *auditResponseWriter) summary() string {
+	return contentSummary(w.size, w.hash.Sum(nil))
+}
+
+// Unwrap exposes the underlying http.ResponseWriter so capability checks such as supportsFlush see the real connection
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	if unwrapper, ok := w.ResponseWriter.(interface{ Unwrap() http.ResponseWriter }); ok {
+		return unwrapper.Unwrap()
+	}
+	return w.ResponseWriter
+}
+
+// AuditMiddleware records every request and its response to the audit logger, with content as set by level
+func AuditMiddleware(logger AuditLogger, level string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		// Read the body for auditing and restore it for the handler
+		var requestBody []byte
+		if c.Request.Body != nil {
+			requestBody, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(requestBody))
+		}
+
+		var writer *auditResponseWriter
+		if level != AuditLevelNone {
+			writer = newAuditResponseWriter(c.Writer, level == AuditLevelFull)
+			c.Writer = writer
+		}
+
+		c.Next()
+
+		var request struct {
+			Model string `json:"model"`
+		}
+		json.Unmarshal(requestBody, &request)
+
+		entry := AuditEntry{
+			Timestamp:  start.UTC(),
+			Principal:  requestPrincipal(c),
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.Path,
+			Model:      request.Model,
+			Status:     c.Writer.Status(),
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if writer != nil {
+			entry.RequestSummary = redactContent(string(requestBody))
+			entry.ResponseSummary = writer.summary()
+			if level == AuditLevelFull {
+				entry.Request = auditBody(requestBody)
+				entry.Response = auditBody(writer.body.Bytes())
+			}
+		}
+
+		if err := logger.Log(entry); err != nil {
+			log.Printf("Error writing audit log: %v", err)
+		}
+	}
+}
+
+// auditPrincipal identifies the caller in the audit log by a short fingerprint of their API key, so keys never
+// reach the log. It is for display only: 48 bits can be matched by brute force, so authorization decisions use
+// the full fingerprint of keyPrincipal.
+func auditPrincipal(authorization string) string {
+	principal := keyPrincipal(authorization)
+	if principal == "anonymous" {
+		return principal
+	}
+	return principal[:len("key:")+12]
+}
+
+// keyPrincipal identifies the caller by the full SHA-256 of their API key, hex encoded; its first 12 digits are
+// the fingerprint of the audit log
+func keyPrincipal(authorization string) string {
+	key := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	if key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:])
+}
+
+// requestPrincipal identifies the caller of a request by keyPrincipal, for binding resources such as batch jobs
+// to the caller that created them and for KNOWLEDGE_BASE_ACCESS grants
+func requestPrincipal(c *gin.Context) string {
+	return keyPrincipal(c.GetHeader("Authorization"))
+}
+
+// auditBody embeds a JSON body as-is, and anything else, such as a server-sent event stream, as a JSON string
+func auditBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	encoded, _ := json.Marshal(string(body))
+	return encoded
+}
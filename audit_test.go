@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordingAuditLogger is an AuditLogger that keeps the entries it is given
+type recordingAuditLogger struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (l *recordingAuditLogger) Log(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+func (l *recordingAuditLogger) Close() error { return nil }
+
+func TestAuditResponseSummary(t *testing.T) {
+	for _, level := range []string{AuditLevelMetadata, AuditLevelFull} {
+		logger := &recordingAuditLogger{}
+		router := gin.New()
+		router.Use(AuditMiddleware(logger, level))
+		router.GET("/stream", func(c *gin.Context) {
+			c.Writer.Write([]byte("data: hello\n\n"))
+			c.Writer.WriteString("data: [DONE]\n\n")
+		})
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stream", nil))
+
+		entry := logger.entries[0]
+		if want := redactContent("data: hello\n\ndata: [DONE]\n\n"); entry.ResponseSummary != want {
+			t.Errorf("%s: response summary = %q, want %q", level, entry.ResponseSummary, want)
+		}
+		if recorder.Body.String() != "data: hello\n\ndata: [DONE]\n\n" {
+			t.Errorf("%s: client received %q", level, recorder.Body)
+		}
+		if full := strings.Contains(string(entry.Response), "[DONE]"); full != (level == AuditLevelFull) {
+			t.Errorf("%s: response body audited = %t, want it only at the full level", level, full)
+		}
+	}
+}
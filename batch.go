@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+	"github.com/aws/smithy-go"
+	"github.com/gin-gonic/gin"
+)
+
+// BatchJobClient is the subset of the Bedrock control plane client used for batch inference jobs.
+// It is satisfied by *bedrock.Client and lets tests substitute canned responses.
+type BatchJobClient interface {
+	CreateModelInvocationJob(ctx context.Context, params *bedrock.CreateModelInvocationJobInput, optFns ...func(*bedrock.Options)) (*bedrock.CreateModelInvocationJobOutput, error)
+	GetModelInvocationJob(ctx context.Context, params *bedrock.GetModelInvocationJobInput, optFns ...func(*bedrock.Options)) (*bedrock.GetModelInvocationJobOutput, error)
+}
+
+// BatchJobRequest submits a batch inference job over a JSONL file of Bedrock batch records in S3, each
+// {"recordId": ..., "modelInput": {...}} with modelInput in the model's native InvokeModel format
+type BatchJobRequest struct {
+	Model      string `json:"model" binding:"required"`
+	InputS3URI string `json:"input_s3_uri" binding:"required"`
+
+	// OutputS3URI is where Bedrock writes the results; BATCH_OUTPUT_S3_URI when omitted
+	OutputS3URI string `json:"output_s3_uri,omitempty"`
+
+	// JobName names the job in Bedrock; a unique name is generated when omitted
+	JobName string `json:"job_name,omitempty"`
+
+	// TimeoutHours is how long the job may run, from 24 to 168 hours; Bedrock's default when omitted
+	TimeoutHours int `json:"timeout_hours,omitempty"`
+}
+
+// BatchJob reports the state of a batch inference job
+type BatchJob struct {
+	ID          string `json:"id"`
+	Object      string `json:"object"`
+	JobName     string `json:"job_name,omitempty"`
+	Model       string `json:"model,omitempty"`
+	Status      string `json:"status"`
+	Message     string `json:"message,omitempty"`
+	InputS3URI  string `json:"input_s3_uri,omitempty"`
+	OutputS3URI string `json:"output_s3_uri,omitempty"`
+
+	// Unix timestamps of the job's submission, completion and expiry, when known
+	SubmittedAt *int64 `json:"submitted_at,omitempty"`
+	EndedAt     *int64 `json:"ended_at,omitempty"`
+	ExpiresAt   *int64 `json:"expires_at,omitempty"`
+}
+
+// batchJobStatuses maps Bedrock's job statuses to the snake_case statuses of OpenAI's batch API
+var batchJobStatuses = map[types.ModelInvocationJobStatus]string{
+	types.ModelInvocationJobStatusSubmitted:          "submitted",
+	types.ModelInvocationJobStatusValidating:         "validating",
+	types.ModelInvocationJobStatusScheduled:          "scheduled",
+	types.ModelInvocationJobStatusInProgress:         "in_progress",
+	types.ModelInvocationJobStatusCompleted:          "completed",
+	types.ModelInvocationJobStatusPartiallyCompleted: "partially_completed",
+	types.ModelInvocationJobStatusFailed:             "failed",
+	types.ModelInvocationJobStatusStopping:           "stopping",
+	types.ModelInvocationJobStatusStopped:            "stopped",
+	types.ModelInvocationJobStatusExpired:            "expired",
+}
+
+// awsErrorStatuses maps errors of the Bedrock control plane and agent APIs to the HTTP status reported for them;
+// others are 500
+var awsErrorStatuses = map[string]int{
+	"ValidationException":           http.StatusBadRequest,
+	"AccessDeniedException":         http.StatusForbidden,
+	"ResourceNotFoundException":     http.StatusNotFound,
+	"ConflictException":             http.StatusConflict,
+	"ServiceQuotaExceededException": http.StatusTooManyRequests,
+	"ThrottlingException":           http.StatusTooManyRequests,
+}
+
+// batchJobOwnerTTL is how long a batch job stays bound to the caller that submitted it: the longest a job may
+// run, 168 hours, with a day to spare for polling its final status
+const batchJobOwnerTTL = 192 * time.Hour
+
+// batchJobOwners records the principal that submitted each batch job, by job ARN, so only that caller can poll it
+var batchJobOwners = newSessionOwners(batchJobOwnerTTL)
+
+// ValidateBatchS3Prefixes checks the S3 locations batch jobs are confined to: at least one is required, each must
+// be an s3:// URI naming a bucket, and the default output location must fall within them
+func ValidateBatchS3Prefixes(prefixes []string, defaultOutput string) error {
+	if len(prefixes) == 0 {
+		return errors.New("at least one S3 prefix is required when BATCH_ROLE_ARN is set")
+	}
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "s3://") || len(prefix) == len("s3://") {
+			return fmt.Errorf("%q must be an s3:// URI with a bucket", prefix)
+		}
+	}
+	if defaultOutput != "" && !batchS3URIAllowed(defaultOutput) {
+		return fmt.Errorf("BATCH_OUTPUT_S3_URI %q is not under any of the prefixes", defaultOutput)
+	}
+	return nil
+}
+
+// batchS3URIAllowed reports whether a batch job may use the S3 URI under BATCH_S3_PREFIXES. Prefixes match
+// whole bucket and path segments, so s3://bucket/team doesn't also allow s3://bucket-other or s3://bucket/team-b.
+func batchS3URIAllowed(uri string) bool {
+	for _, prefix := range AppConfig.BatchS3Prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if uri == prefix || strings.HasPrefix(uri, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the request for problems that should be reported to the client as a bad request
+func (r BatchJobRequest) Validate() error {
+	if !strings.HasPrefix(r.InputS3URI, "s3://") {
+		return errors.New("input_s3_uri must be an s3:// URI")
+	}
+	if r.OutputS3URI == "" && AppConfig.BatchOutputS3URI == "" {
+		return errors.New("output_s3_uri is required, since BATCH_OUTPUT_S3_URI is not configured")
+	}
+	if r.OutputS3URI != "" && !strings.HasPrefix(r.OutputS3URI, "s3://") {
+		return errors.New("output_s3_uri must be an s3:// URI")
+	}
+	if r.TimeoutHours != 0 && (r.TimeoutHours < 24 || r.TimeoutHours > 168) {
+		return fmt.Errorf("timeout_hours must be between 24 and 168; got %d", r.TimeoutHours)
+	}
+	return nil
+}
+
+// CreateBatchJob submits a batch inference job with the configured service role and returns it as submitted
+func (s *BedrockService) CreateBatchJob(ctx context.Context, req BatchJobRequest) (*BatchJob, error) {
+	if req.OutputS3URI == "" {
+		req.OutputS3URI = AppConfig.BatchOutputS3URI
+	}
+	if req.JobName == "" {
+		req.JobName = fmt.Sprintf("gateway-batch-%s-%s", time.Now().Format("20060102150405"), randomSuffix())
+	}
+
+	input := &bedrock.CreateModelInvocationJobInput{
+		JobName: aws.String(req.JobName),
+		ModelId: aws.String(req.Model),
+		RoleArn: aws.String(AppConfig.BatchRoleARN),
+		InputDataConfig: &types.ModelInvocationJobInputDataConfigMemberS3InputDataConfig{
+			Value: types.ModelInvocationJobS3InputDataConfig{S3Uri: aws.String(req.InputS3URI), S3InputFormat: types.S3InputFormatJsonl},
+		},
+		OutputDataConfig: &types.ModelInvocationJobOutputDataConfigMemberS3OutputDataConfig{
+			Value: types.ModelInvocationJobS3OutputDataConfig{S3Uri: aws.String(req.OutputS3URI)},
+		},
+	}
+	if req.TimeoutHours > 0 {
+		input.TimeoutDurationInHours = aws.Int32(int32(req.TimeoutHours))
+	}
+
+	resp, err := s.batchClient.CreateModelInvocationJob(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	submitted := time.Now().Unix()
+	return &BatchJob{
+		ID:          aws.ToString(resp.JobArn),
+		Object:      "batch_job",
+		JobName:     req.JobName,
+		Model:       req.Model,
+		Status:      batchJobStatuses[types.ModelInvocationJobStatusSubmitted],
+		InputS3URI:  req.InputS3URI,
+		OutputS3URI: req.OutputS3URI,
+		SubmittedAt: &submitted,
+	}, nil
+}
+
+// GetBatchJob returns the current state of the batch inference job with the given ARN
+func (s *BedrockService) GetBatchJob(ctx context.Context, id string) (*BatchJob, error) {
+	resp, err := s.batchClient.GetModelInvocationJob(ctx, &bedrock.GetModelInvocationJobInput{JobIdentifier: aws.String(id)})
+	if err != nil {
+		return nil, err
+	}
+
+	status, ok := batchJobStatuses[resp.Status]
+	if !ok {
+		status = strings.ToLower(string(resp.Status))
+	}
+	job := &BatchJob{
+		ID:          aws.ToString(resp.JobArn),
+		Object:      "batch_job",
+		JobName:     aws.ToString(resp.JobName),
+		Model:       aws.ToString(resp.ModelId),
+		Status:      status,
+		Message:     aws.ToString(resp.Message),
+		SubmittedAt: unixTime(resp.SubmitTime),
+		EndedAt:     unixTime(resp.EndTime),
+		ExpiresAt:   unixTime(resp.JobExpirationTime),
+	}
+	if input, ok := resp.InputDataConfig.(*types.ModelInvocationJobInputDataConfigMemberS3InputDataConfig); ok {
+		job.InputS3URI = aws.ToString(input.Value.S3Uri)
+	}
+	if output, ok := resp.OutputDataConfig.(*types.ModelInvocationJobOutputDataConfigMemberS3OutputDataConfig); ok {
+		job.OutputS3URI = aws.ToString(output.Value.S3Uri)
+	}
+	return job, nil
+}
+
+// unixTime returns t as a Unix timestamp, or nil if it is unset
+func unixTime(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	seconds := t.Unix()
+	return &seconds
+}
+
+// awsErrorStatus returns the HTTP status for a failed batch job or knowledge base call
+func awsErrorStatus(err error) int {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if status, ok := awsErrorStatuses[apiErr.ErrorCode()]; ok {
+			return status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// handleCreateBatchJob submits a batch inference job, answering 202 with the job to poll
+func handleCreateBatchJob(bedrockService *BedrockService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if AppConfig.BatchRoleARN == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "batch inference is not enabled"})
+			return
+		}
+
+		var batchReq BatchJobRequest
+		if err := bindJSON(c, &batchReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := batchReq.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkModelAllowed(c, batchReq.Model) {
+			return
+		}
+		for _, uri := range []string{batchReq.InputS3URI, batchReq.OutputS3URI} {
+			if uri != "" && !batchS3URIAllowed(uri) {
+				c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("S3 location %q is not allowed for batch jobs", uri)})
+				return
+			}
+		}
+
+		job, err := bedrockService.CreateBatchJob(c.Request.Context(), batchReq)
+		if err != nil {
+			log.Printf("Error creating batch job: %v", err)
+			c.JSON(awsErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		batchJobOwners.set(job.ID, requestPrincipal(c))
+		log.Printf("Submitted batch job %s for model %s", job.ID, job.Model)
+		c.JSON(http.StatusAccepted, job)
+	}
+}
+
+// handleGetBatchJob reports the state of a batch inference job by the job ARN returned when it was created
+func handleGetBatchJob(bedrockService *BedrockService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if AppConfig.BatchRoleARN == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "batch inference is not enabled"})
+			return
+		}
+
+		// Job ARNs contain a slash, so the ID is matched as the rest of the path
+		id := strings.TrimPrefix(c.Param("id"), "/")
+		if id == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a batch job id is required"})
+			return
+		}
+
+		// Jobs of other callers are reported as missing, so their ARNs can't be probed
+		if !batchJobOwners.owns(id, requestPrincipal(c)) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no batch job with id %q", id)})
+			return
+		}
+
+		job, err := bedrockService.GetBatchJob(c.Request.Context(), id)
+		if err != nil {
+			c.JSON(awsErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock"
+	bedrocktypes "github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+	"github.com/aws/smithy-go"
+	"github.com/gin-gonic/gin"
+)
+
+// mockBatchClient is a BatchJobClient that records the job it is given and reports it back as in progress
+type mockBatchClient struct {
+	created *bedrock.CreateModelInvocationJobInput
+}
+
+func (m *mockBatchClient) CreateModelInvocationJob(ctx context.Context, params *bedrock.CreateModelInvocationJobInput, optFns ...func(*bedrock.Options)) (*bedrock.CreateModelInvocationJobOutput, error) {
+	m.created = params
+	return &bedrock.CreateModelInvocationJobOutput{JobArn: aws.String("arn:aws:bedrock:us-east-1:123456789012:model-invocation-job/abc123")}, nil
+}
+
+func (m *mockBatchClient) GetModelInvocationJob(ctx context.Context, params *bedrock.GetModelInvocationJobInput, optFns ...func(*bedrock.Options)) (*bedrock.GetModelInvocationJobOutput, error) {
+	if m.created == nil || aws.ToString(params.JobIdentifier) != "arn:aws:bedrock:us-east-1:123456789012:model-invocation-job/abc123" {
+		return nil, &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: "job not found"}
+	}
+	submitted := time.Unix(1700000000, 0)
+	return &bedrock.GetModelInvocationJobOutput{
+		JobArn:           params.JobIdentifier,
+		JobName:          m.created.JobName,
+		ModelId:          m.created.ModelId,
+		Status:           bedrocktypes.ModelInvocationJobStatusInProgress,
+		SubmitTime:       &submitted,
+		InputDataConfig:  m.created.InputDataConfig,
+		OutputDataConfig: m.created.OutputDataConfig,
+	}, nil
+}
+
+func TestBatchJobs(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.BatchRoleARN = "arn:aws:iam::123456789012:role/bedrock-batch"
+	AppConfig.BatchOutputS3URI = "s3://results/"
+	AppConfig.BatchS3Prefixes = []string{"s3://inputs/", "s3://results/"}
+
+	batchClient := &mockBatchClient{}
+	router := gin.New()
+	SetupRoutes(router, &BedrockService{batchClient: batchClient})
+	sendAs := func(key, method, path, body string) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		router.ServeHTTP(recorder, req)
+		var response map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+	send := func(method, path, body string) (int, map[string]interface{}) {
+		return sendAs("owner-key", method, path, body)
+	}
+
+	if status, _ := send(http.MethodPost, "/batch/jobs", `{"model": "anthropic.claude-3-haiku-20240307-v1:0", "input_s3_uri": "https://example.com/input.jsonl"}`); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400 for an input outside S3", status)
+	}
+
+	if status, _ := send(http.MethodPost, "/batch/jobs", `{"model": "anthropic.claude-3-haiku-20240307-v1:0", "input_s3_uri": "s3://other-tenant/records.jsonl"}`); status != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 for an input outside BATCH_S3_PREFIXES", status)
+	}
+	if status, _ := send(http.MethodPost, "/batch/jobs", `{"model": "anthropic.claude-3-haiku-20240307-v1:0", "input_s3_uri": "s3://inputs/records.jsonl", "output_s3_uri": "s3://other-tenant/"}`); status != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 for an output outside BATCH_S3_PREFIXES", status)
+	}
+	if batchClient.created != nil {
+		t.Fatal("a job outside BATCH_S3_PREFIXES was submitted to Bedrock")
+	}
+
+	status, created := send(http.MethodPost, "/batch/jobs", `{"model": "anthropic.claude-3-haiku-20240307-v1:0", "input_s3_uri": "s3://inputs/records.jsonl"}`)
+	if status != http.StatusAccepted || created["status"] != "submitted" || created["output_s3_uri"] != "s3://results/" {
+		t.Fatalf("create = %d %v, want a submitted job writing to the default output", status, created)
+	}
+	if aws.ToString(batchClient.created.RoleArn) != AppConfig.BatchRoleARN || !strings.HasPrefix(aws.ToString(batchClient.created.JobName), "gateway-batch-") {
+		t.Errorf("job input = %+v, want the configured role and a generated name", batchClient.created)
+	}
+
+	status, job := send(http.MethodGet, "/batch/jobs/"+created["id"].(string), "")
+	if status != http.StatusOK || job["status"] != "in_progress" || job["input_s3_uri"] != "s3://inputs/records.jsonl" || job["submitted_at"] != float64(1700000000) {
+		t.Errorf("get = %d %v, want the job in progress", status, job)
+	}
+	if status, _ := sendAs("other-key", http.MethodGet, "/batch/jobs/"+created["id"].(string), ""); status != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 for another caller's job", status)
+	}
+	if status, _ := send(http.MethodGet, "/batch/jobs/arn:aws:bedrock:us-east-1:123456789012:model-invocation-job/missing", ""); status != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 for an unknown job", status)
+	}
+}
+
+func TestValidateBatchS3Prefixes(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.BatchS3Prefixes = []string{"s3://batch-bucket/jobs/"}
+
+	if err := ValidateBatchS3Prefixes(AppConfig.BatchS3Prefixes, "s3://batch-bucket/jobs/results/"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for name, prefixes := range map[string][]string{"none": nil, "not s3": {"https://example.com/"}, "no bucket": {"s3://"}} {
+		if err := ValidateBatchS3Prefixes(prefixes, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if err := ValidateBatchS3Prefixes(AppConfig.BatchS3Prefixes, "s3://elsewhere/"); err == nil {
+		t.Error("expected an error for a default output outside the prefixes")
+	}
+
+	// Prefixes match on segment boundaries, with or without a trailing slash
+	AppConfig.BatchS3Prefixes = []string{"s3://batch-bucket", "s3://shared/team-a"}
+	for uri, want := range map[string]bool{
+		"s3://batch-bucket":                  true,
+		"s3://batch-bucket/input.jsonl":      true,
+		"s3://batch-bucket-other/input.json": false,
+		"s3://shared/team-a/input.jsonl":     true,
+		"s3://shared/team-a-private/x.jsonl": false,
+		"s3://shared/team-b/input.jsonl":     false,
+	} {
+		if got := batchS3URIAllowed(uri); got != want {
+			t.Errorf("batchS3URIAllowed(%s) = %t, want %t", uri, got, want)
+		}
+	}
+}
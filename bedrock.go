@@ -2,58 +2,145 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrock"
 	"github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/smithy-go/middleware"
+	"golang.org/x/sync/singleflight"
 )
 
 // ChatRequest represents the incoming chat request
 type ChatRequest struct {
-	Messages         []Message   `json:"messages" binding:"required"`
-	Model            string      `json:"model" binding:"required"`
-	Temperature      float32     `json:"temperature,omitempty"`
-	TopP             float32     `json:"top_p,omitempty"`
-	MaxTokens        int         `json:"max_tokens,omitempty"`
-	Stop             []string    `json:"stop,omitempty"`
-	Stream           bool        `json:"stream,omitempty"`
-	N                int         `json:"n,omitempty"`
-	PresencePenalty  float32     `json:"presence_penalty,omitempty"`
-	FrequencyPenalty float32     `json:"frequency_penalty,omitempty"`
-	User             string      `json:"user,omitempty"`
-	Functions        []Function  `json:"functions,omitempty"`
-	FunctionCall     interface{} `json:"function_call,omitempty"`
-	ResponseFormat   *struct {
-		Type string `json:"type,omitempty"`
-	} `json:"response_format,omitempty"`
-	Seed       int64       `json:"seed,omitempty"`
-	Tools      []Tool      `json:"tools,omitempty"`
-	ToolChoice interface{} `json:"tool_choice,omitempty"`
+	Messages         []Message       `json:"messages" binding:"required"`
+	Model            string          `json:"model" binding:"required"`
+	Temperature      *float32        `json:"temperature,omitempty"`
+	TopP             *float32        `json:"top_p,omitempty"`
+	TopK             *int            `json:"top_k,omitempty"`
+	MaxTokens        int             `json:"max_tokens,omitempty"`
+	Stop             StopSequences   `json:"stop,omitempty"`
+	Stream           bool            `json:"stream,omitempty"`
+	StreamOptions    *StreamOptions  `json:"stream_options,omitempty"`
+	N                int             `json:"n,omitempty"`
+	PresencePenalty  *float32        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32        `json:"frequency_penalty,omitempty"`
+	User             string          `json:"user,omitempty"`
+	Functions        []Function      `json:"functions,omitempty"`
+	FunctionCall     interface{}     `json:"function_call,omitempty"`
+	ResponseFormat   *ResponseFormat `json:"response_format,omitempty"`
+	Seed             int64           `json:"seed,omitempty"`
+	Logprobs         bool            `json:"logprobs,omitempty"`
+	TopLogprobs      int             `json:"top_logprobs,omitempty"`
+	Tools            []Tool          `json:"tools,omitempty"`
+	ToolChoice       interface{}     `json:"tool_choice,omitempty"`
+	ServiceTier      string          `json:"service_tier,omitempty"`
+
+	// Store keeps the completed response for retrieval from GET /chat/completions/{id} when storage is enabled
+	Store bool `json:"store,omitempty"`
+
+	// Metadata carries cost allocation tags, with keys limited to COST_TAG_KEYS, recorded with the request's usage
+	// and, with COST_TAG_PROFILES, forwarded to AWS
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// SamplingProfile names a set of sampling parameters, such as "creative" or "precise", applied under explicit ones
+	SamplingProfile string `json:"sampling_profile,omitempty"`
+
+	// ContextOverflow overrides the configured context overflow policy for this request
+	ContextOverflow string `json:"context_overflow,omitempty"`
+
+	// ReasoningEffort enables Claude's extended thinking with a budget of "low", "medium" or "high"
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+
+	// AdditionalModelFields are model-specific parameters merged verbatim into the Bedrock payload
+	AdditionalModelFields map[string]interface{} `json:"additional_model_fields,omitempty"`
+
+	// targetModel, when set, is the model ID or ARN actually invoked in place of Model
+	targetModel string
+
+	// baseModel, when set, is the foundation model behind Model used to choose the payload format
+	baseModel string
+
+	// ctx is the context the request is formatted in, which bounds fetches of the documents it links to;
+	// formatters only receive the request, so it travels with it
+	ctx context.Context
+}
+
+// requestContext returns the context the request is formatted in, or the background context outside formatting
+func (r ChatRequest) requestContext() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// InvocationModel returns the model ID or ARN that should be sent to Bedrock for this request
+func (r ChatRequest) InvocationModel() string {
+	if r.targetModel != "" {
+		return r.targetModel
+	}
+	return r.Model
+}
+
+// StopSequences holds the stop field, which OpenAI allows as either a single string or an array of strings
+type StopSequences []string
+
+// UnmarshalJSON accepts a string, an array of strings or null
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*s = nil
+		} else {
+			*s = StopSequences{single}
+		}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return errors.New("stop must be a string or an array of strings")
+	}
+	*s = multiple
+	return nil
 }
 
 // StreamOptions represents options for streaming responses
 type StreamOptions struct {
 	IncludeUsage bool `json:"include_usage,omitempty"`
+
+	// IncludeUsageEstimate attaches a running, estimated usage to every content chunk
+	IncludeUsageEstimate bool `json:"include_usage_estimate,omitempty"`
 }
 
-// Message represents a single message in the conversation
+// Message represents a single message in the conversation.
+// Content may be null for assistant messages that only carry tool calls and for tool results.
 type Message struct {
 	Role         string      `json:"role" binding:"required"`
-	Content      interface{} `json:"content" binding:"required"`
+	Content      interface{} `json:"content"`
 	Name         string      `json:"name,omitempty"`
 	FunctionCall interface{} `json:"function_call,omitempty"`
+	ToolCalls    []ToolCall  `json:"tool_calls,omitempty"`
+	ToolCallID   string      `json:"tool_call_id,omitempty"`
 }
 
 // TextContent represents text content in a message
@@ -88,19 +175,70 @@ type Function struct {
 
 // ToolCall represents a tool call made by the model
 type ToolCall struct {
-	ID       string   `json:"id"`
-	Type     string   `json:"type"`
-	Function Function `json:"function"`
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+
+	// ValidationError describes why the arguments do not match the function's parameter schema
+	ValidationError string `json:"validation_error,omitempty"`
+}
+
+// ToolCallFunction represents the function name and JSON-encoded arguments of a tool call
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Object types of OpenAI's responses, which OBJECT_NAMES can rename for clients expecting others
+const (
+	objectChatCompletion      = "chat.completion"
+	objectChatCompletionChunk = "chat.completion.chunk"
+	objectTextCompletion      = "text_completion"
+	objectTextCompletionChunk = "text_completion.chunk"
+)
+
+// ValidateObjectNames checks that the object type overrides rename only known types, and to non-empty names
+func ValidateObjectNames(names map[string]string) error {
+	for standard, name := range names {
+		switch standard {
+		case objectChatCompletion, objectChatCompletionChunk, objectTextCompletion, objectTextCompletionChunk:
+		default:
+			return fmt.Errorf("unknown object type %q, must be one of %s, %s, %s, %s", standard,
+				objectChatCompletion, objectChatCompletionChunk, objectTextCompletion, objectTextCompletionChunk)
+		}
+		if name == "" {
+			return fmt.Errorf("object type %s must not be renamed to an empty name", standard)
+		}
+	}
+	return nil
+}
+
+// objectName returns the object type to report in place of one of OpenAI's standard ones
+func objectName(standard string) string {
+	if name, ok := AppConfig.ObjectNames[standard]; ok {
+		return name
+	}
+	return standard
 }
 
 // ChatResponse represents the response from the Bedrock service
 type ChatResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Choices []Choice `json:"choices"`
-	Usage   Usage    `json:"usage"`
+	ID          string   `json:"id"`
+	Object      string   `json:"object"`
+	Created     int64    `json:"created"`
+	Model       string   `json:"model"`
+	Choices     []Choice `json:"choices"`
+	Usage       Usage    `json:"usage"`
+	ServiceTier string   `json:"service_tier,omitempty"`
+
+	// SystemFingerprint changes whenever the model or gateway configuration serving the request changes
+	SystemFingerprint string `json:"system_fingerprint"`
+
+	// Seed echoes the request's seed
+	Seed int64 `json:"seed,omitempty"`
+
+	// Raw is the unmodified Bedrock response body, attached only on request in debug mode
+	Raw json.RawMessage `json:"_raw,omitempty"`
 }
 
 // Choice represents a choice in the response
@@ -112,8 +250,33 @@ type Choice struct {
 
 // ChatResponseMessage represents a message in the response
 type ChatResponseMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role             string     `json:"role"`
+	Content          *string    `json:"content"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+
+	// Refusal carries the model's or guardrail's explanation when it declined to answer; Content is then null
+	Refusal *string `json:"refusal"`
+}
+
+// ChatResult holds the parsed output of a model invocation
+type ChatResult struct {
+	Content          string
+	Refusal          string
+	ReasoningContent string
+	ToolCalls        []ToolCall
+	FinishReason     string
+	Usage            Usage
+	RawResponse      []byte
+
+	// Created is when the generation completed; results shared by deduplicated requests keep the original time
+	Created time.Time
+
+	// BedrockLatency is the time spent in InvokeModel calls, including any tool call repair
+	BedrockLatency time.Duration
+
+	// Retries counts the attempts the AWS SDK retried, after throttling or transient errors, in those calls
+	Retries int
 }
 
 // Usage represents token usage information
@@ -121,63 +284,324 @@ type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+
+	// Estimated marks counts computed by the gateway rather than reported by the model
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// BedrockInvoker is the subset of the Bedrock runtime client used to invoke models.
+// It is satisfied by *bedrockruntime.Client and lets tests substitute canned responses.
+type BedrockInvoker interface {
+	InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error)
+	InvokeModelWithResponseStream(ctx context.Context, params *bedrockruntime.InvokeModelWithResponseStreamInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelWithResponseStreamOutput, error)
+}
+
+// InferenceProfileClient is the subset of the Bedrock control plane client used to resolve application inference
+// profiles. It is satisfied by *bedrock.Client and lets tests substitute canned profiles.
+type InferenceProfileClient interface {
+	GetInferenceProfile(ctx context.Context, params *bedrock.GetInferenceProfileInput, optFns ...func(*bedrock.Options)) (*bedrock.GetInferenceProfileOutput, error)
+}
+
+// ModelCatalogClient is the subset of the Bedrock control plane client used to list the models the gateway
+// serves. It is satisfied by *bedrock.Client and lets tests substitute canned lists.
+type ModelCatalogClient interface {
+	ListFoundationModels(ctx context.Context, params *bedrock.ListFoundationModelsInput, optFns ...func(*bedrock.Options)) (*bedrock.ListFoundationModelsOutput, error)
+	ListInferenceProfiles(ctx context.Context, params *bedrock.ListInferenceProfilesInput, optFns ...func(*bedrock.Options)) (*bedrock.ListInferenceProfilesOutput, error)
 }
 
 // BedrockService handles interactions with AWS Bedrock
 type BedrockService struct {
-	client *bedrockruntime.Client
+	awsConfig     aws.Config
+	client        BedrockInvoker
+	controlClient *bedrock.Client
+
+	// regionClients caches runtime clients for regions other than the default, keyed by region
+	regionClients sync.Map
+
+	// profileClient resolves application inference profiles; the control plane client outside of tests
+	profileClient InferenceProfileClient
+
+	// catalogClient lists foundation models and inference profiles; the control plane client outside of tests
+	catalogClient ModelCatalogClient
+
+	// profileModels caches the foundation model ID behind each application inference profile ARN
+	profileModels sync.Map
+
+	// profileARNs caches the ARN of each cross-region inference profile ID, for APIs that only accept ARNs
+	profileARNs sync.Map
+
+	// costTagClient finds and creates the application inference profiles that carry cost tags; the control plane
+	// client outside of tests
+	costTagClient CostTagProfileClient
+
+	// costTagProfiles caches the ARN of each cost tag profile by name, counting them in costTagProfileCount
+	costTagProfiles     sync.Map
+	costTagProfileCount atomic.Int32
+
+	// inflight shares a single Bedrock invocation between identical concurrent deterministic requests
+	inflight singleflight.Group
+
+	// models caches the list served by the models endpoint
+	models modelListCache
+
+	// batchClient submits and polls batch inference jobs; the control plane client outside of tests
+	batchClient BatchJobClient
+
+	// ragClient answers queries from knowledge bases
+	ragClient RAGClient
 }
 
 // NewBedrockService creates a new instance of BedrockService
 func NewBedrockService(region string) (*BedrockService, error) {
-	// Load AWS configuration with specified region
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+	// Load AWS configuration with specified region and the SDK retryer settings, when configured
+	options := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if AppConfig.AWSRetryMode != "" {
+		mode, err := aws.ParseRetryMode(AppConfig.AWSRetryMode)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, config.WithRetryMode(mode))
+	}
+	if AppConfig.AWSMaxAttempts > 0 {
+		options = append(options, config.WithRetryMaxAttempts(AppConfig.AWSMaxAttempts))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), options...)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create Bedrock client
+	// Create Bedrock runtime and control plane clients
 	client := bedrockruntime.NewFromConfig(cfg)
+	controlClient := bedrock.NewFromConfig(cfg)
 
 	return &BedrockService{
-		client: client,
+		awsConfig:     cfg,
+		client:        client,
+		controlClient: controlClient,
+		profileClient: controlClient,
+		catalogClient: controlClient,
+		costTagClient: controlClient,
+		batchClient:   controlClient,
+		ragClient:     bedrockagentruntime.NewFromConfig(cfg),
 	}, nil
 }
 
-// ProcessChat sends the chat request to AWS Bedrock and returns the response
-func (s *BedrockService) ProcessChat(ctx context.Context, req ChatRequest) (string, error) {
+// runtimeClient returns the runtime client for a region, creating and caching it on first use.
+// An empty region selects the service's default client.
+func (s *BedrockService) runtimeClient(region string) BedrockInvoker {
+	if region == "" || region == s.awsConfig.Region {
+		return s.client
+	}
+
+	if client, ok := s.regionClients.Load(region); ok {
+		return client.(BedrockInvoker)
+	}
+
+	client := bedrockruntime.NewFromConfig(s.awsConfig, func(o *bedrockruntime.Options) {
+		o.Region = region
+	})
+	actual, _ := s.regionClients.LoadOrStore(region, client)
+	return actual.(BedrockInvoker)
+}
+
+// FormatModel returns the model ID whose request and response formats apply to this request
+func (r ChatRequest) FormatModel() string {
+	if r.baseModel != "" {
+		return r.baseModel
+	}
+	return r.Model
+}
+
+// resolveApplicationProfile looks up the foundation model behind an application inference profile ARN,
+// whose opaque ID otherwise gives no hint of which payload format the model expects
+func (s *BedrockService) resolveApplicationProfile(ctx context.Context, req ChatRequest) (ChatRequest, error) {
+	if !strings.Contains(req.Model, ":application-inference-profile/") {
+		return req, nil
+	}
+
+	if model, ok := s.profileModels.Load(req.Model); ok {
+		req.baseModel = model.(string)
+		return req, nil
+	}
+
+	profile, err := s.profileClient.GetInferenceProfile(ctx, &bedrock.GetInferenceProfileInput{
+		InferenceProfileIdentifier: aws.String(req.Model),
+	})
+	if err != nil {
+		return req, fmt.Errorf("unable to resolve application inference profile: %v", err)
+	}
+
+	model := foundationModelFromProfile(profile.Models)
+	if model == "" {
+		return req, fmt.Errorf("application inference profile %s has no foundation model", req.Model)
+	}
+	s.profileModels.Store(req.Model, model)
+	req.baseModel = model
+
+	return req, nil
+}
+
+// modelARN returns the ARN of a model, for APIs such as RetrieveAndGenerate and CreateInferenceProfile that only
+// accept ARNs: ARNs, such as those of inference profiles, are passed through, cross-region inference profile IDs
+// are looked up for their ARN, which names the account, and model IDs become foundation model ARNs in the
+// gateway's region
+func (s *BedrockService) modelARN(ctx context.Context, model string) (string, error) {
+	switch {
+	case strings.HasPrefix(model, "arn:"):
+		return model, nil
+	case InvocationPath(model) != "inference_profile":
+		return fmt.Sprintf("arn:aws:bedrock:%s::foundation-model/%s", s.awsConfig.Region, model), nil
+	}
+
+	if arn, ok := s.profileARNs.Load(model); ok {
+		return arn.(string), nil
+	}
+	profile, err := s.profileClient.GetInferenceProfile(ctx, &bedrock.GetInferenceProfileInput{
+		InferenceProfileIdentifier: aws.String(model),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve inference profile %s: %w", model, err)
+	}
+	arn := aws.ToString(profile.InferenceProfileArn)
+	if arn == "" {
+		return "", fmt.Errorf("inference profile %s has no ARN", model)
+	}
+	s.profileARNs.Store(model, arn)
+	return arn, nil
+}
+
+// foundationModelFromProfile extracts the model ID from the first foundation model ARN of an inference profile
+func foundationModelFromProfile(models []types.InferenceProfileModel) string {
+	for _, model := range models {
+		if model.ModelArn == nil {
+			continue
+		}
+		if _, id, found := strings.Cut(*model.ModelArn, "foundation-model/"); found {
+			return id
+		}
+	}
+	return ""
+}
+
+// ProcessChat sends the chat request to AWS Bedrock and returns the response. An application inference profile
+// must already be resolved, as ProcessChatWithFallback does for each model it tries.
+// With DEDUPLICATE_REQUESTS enabled, identical concurrent deterministic requests share one invocation.
+func (s *BedrockService) ProcessChat(ctx context.Context, req ChatRequest) (*ChatResult, error) {
+	if !AppConfig.DeduplicateRequests || !req.IsDeterministic() {
+		return s.invokeChat(ctx, req)
+	}
+
+	key, err := req.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	// Detach from the caller's cancellation so one client disconnecting doesn't fail the others, but keep a
+	// deadline, the first caller's or CHAT_TIMEOUT, so the shared call doesn't outlive them all unbounded
+	shared := s.inflight.DoChan(key, func() (interface{}, error) {
+		sharedCtx, cancel := withOperationTimeout(context.WithoutCancel(ctx), AppConfig.ChatTimeout)
+		defer cancel()
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancelDeadline context.CancelFunc
+			sharedCtx, cancelDeadline = context.WithDeadlineCause(sharedCtx, deadline, errOperationTimeout)
+			defer cancelDeadline()
+		}
+		return s.invokeChat(sharedCtx, req)
+	})
+
+	select {
+	case outcome := <-shared:
+		if outcome.Err != nil {
+			return nil, outcome.Err
+		}
+		if outcome.Shared {
+			log.Printf("Shared Bedrock invocation for deduplicated request %s", key[:12])
+		}
+
+		// Each caller gets its own copy, so one adjusting its result doesn't change the others'
+		result := *outcome.Val.(*ChatResult)
+		result.ToolCalls = slices.Clone(result.ToolCalls)
+		result.RawResponse = slices.Clone(result.RawResponse)
+		return &result, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// invokeChat invokes the model and validates any tool calls in its response
+func (s *BedrockService) invokeChat(ctx context.Context, req ChatRequest) (*ChatResult, error) {
+	result, err := s.invokeModel(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.ToolCalls) > 0 {
+		return s.validateToolCalls(ctx, req, result)
+	}
+	if err := checkStructuredOutput(req, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// invokeModel formats the request, invokes the model and parses its response
+func (s *BedrockService) invokeModel(ctx context.Context, req ChatRequest) (*ChatResult, error) {
 	// Convert the chat request to the appropriate format for the model
-	payload, err := formatPayloadForModel(req)
+	payload, err := formatPayloadForModel(ctx, req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Call Bedrock InvokeModel API
+	start := time.Now()
 	resp, err := s.client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
-		ModelId:     aws.String(req.Model),
+		ModelId:     aws.String(req.InvocationModel()),
 		ContentType: aws.String("application/json"),
+		Accept:      aws.String(AcceptType(req.FormatModel())),
 		Body:        payload,
 	})
+	latency := time.Since(start)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Parse the response based on the model
-	return parseResponseFromModel(resp.Body)
+	result, err := formatterFor(req.FormatModel()).ParseResponse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	result.RawResponse = resp.Body
+	result.Created = time.Now()
+	result.BedrockLatency = latency
+	result.Retries = sdkRetries(resp.ResultMetadata)
+
+	return result, nil
 }
 
-// ProcessChatStream sends the chat request to AWS Bedrock and returns a stream of responses
+// sdkRetries returns how many times the AWS SDK retried a call before it succeeded, from the call's metadata
+func sdkRetries(metadata middleware.Metadata) int {
+	attempts, ok := retry.GetAttemptResults(metadata)
+	if !ok || len(attempts.Results) == 0 {
+		return 0
+	}
+	return len(attempts.Results) - 1
+}
+
+// ProcessChatStream sends the chat request to AWS Bedrock and returns a stream of responses. An application
+// inference profile must already be resolved, as ProcessChatStreamWithFallback does for each model it tries.
 func (s *BedrockService) ProcessChatStream(ctx context.Context, req ChatRequest) (*bedrockruntime.InvokeModelWithResponseStreamOutput, error) {
 	// Convert the chat request to the appropriate format for the model
-	payload, err := formatPayloadForModel(req)
+	payload, err := formatPayloadForModel(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
 	// Call Bedrock InvokeModelWithResponseStream API
 	resp, err := s.client.InvokeModelWithResponseStream(ctx, &bedrockruntime.InvokeModelWithResponseStreamInput{
-		ModelId:     aws.String(req.Model),
+		ModelId:     aws.String(req.InvocationModel()),
 		ContentType: aws.String("application/json"),
+		Accept:      aws.String(AcceptType(req.FormatModel())),
 		Body:        payload,
 	})
 	if err != nil {
@@ -187,144 +611,605 @@ func (s *BedrockService) ProcessChatStream(ctx context.Context, req ChatRequest)
 	return resp, nil
 }
 
-// formatPayloadForModel formats the request payload based on the model
-func formatPayloadForModel(req ChatRequest) ([]byte, error) {
-	maxTokens := req.MaxTokens
-	if maxTokens == 0 {
-		maxTokens = 2048 // Default max tokens
-	}
-
-	temperature := req.Temperature
-	if temperature == 0 {
-		temperature = 0.7 // Default temperature
-	}
-
-	// Special handling for Claude models
-	if strings.Contains(req.Model, "anthropic.claude") || strings.Contains(req.Model, ".anthropic.") {
-		// Process messages for Claude
-		var systemContent string
-		var formattedMessages []Message
-
-		// Extract system messages and save other messages
-		for _, msg := range req.Messages {
-			if msg.Role == "system" {
-				// Extract system message content
-				switch c := msg.Content.(type) {
-				case string:
-					systemContent = c
-				case []interface{}:
-					// Handle content blocks (text)
-					for _, block := range c {
-						if contentMap, ok := block.(map[string]interface{}); ok {
-							if contentMap["type"] == "text" {
-								if text, ok := contentMap["text"].(string); ok {
-									systemContent += text
-								}
-							}
-						}
-					}
-				}
-			} else {
-				// Keep non-system messages
-				formattedMessages = append(formattedMessages, msg)
+// reservedModelFields are payload keys managed by the gateway that additional_model_fields may not set
+var reservedModelFields = map[string]bool{
+	"messages":          true,
+	"max_tokens":        true,
+	"temperature":       true,
+	"top_p":             true,
+	"top_k":             true,
+	"anthropic_version": true,
+	"system":            true,
+	"stream":            true,
+	"thinking":          true,
+	"stop_sequences":    true,
+	"tools":             true,
+	"tool_choice":       true,
+}
+
+// thinkingBudgets maps reasoning_effort values to Claude thinking budget tokens
+var thinkingBudgets = map[string]int{
+	"low":    minThinkingBudget,
+	"medium": 4096,
+	"high":   16384,
+}
+
+// minThinkingBudget is the smallest thinking budget Claude accepts
+const minThinkingBudget = 1024
+
+// Validate checks the request for problems that should be reported to the client as a bad request
+func (r ChatRequest) Validate() error {
+	// functions is OpenAI's deprecated predecessor of tools; accepting both would make translation ambiguous
+	if len(r.Tools) > 0 && len(r.Functions) > 0 {
+		return errors.New("tools and functions are mutually exclusive; use tools, functions is deprecated")
+	}
+	if r.ToolChoice != nil && r.FunctionCall != nil {
+		return errors.New("tool_choice and function_call are mutually exclusive; use tool_choice, function_call is deprecated")
+	}
+	if _, err := parseToolChoice(r); err != nil {
+		return err
+	}
+	if err := validateResponseFormat(r); err != nil {
+		return err
+	}
+	if r.TopLogprobs < 0 || r.TopLogprobs > 20 {
+		return fmt.Errorf("top_logprobs must be between 0 and 20; got %d", r.TopLogprobs)
+	}
+	if r.TopLogprobs > 0 && !r.Logprobs {
+		return errors.New("top_logprobs requires logprobs to be true")
+	}
+	if r.Logprobs {
+		if capabilities, _ := LookupCapabilities(r.Model); !capabilities.Logprobs {
+			return fmt.Errorf("logprobs are not supported for model %s", r.Model)
+		}
+	}
+	if r.MaxTokens < -1 {
+		return fmt.Errorf("max_tokens must be positive, or -1 for the model maximum; got %d", r.MaxTokens)
+	}
+
+	// Every tool result must answer a tool call made by an earlier assistant message
+	toolCallIDs := make(map[string]bool)
+	for i, msg := range r.Messages {
+		for _, toolCall := range msg.ToolCalls {
+			toolCallIDs[toolCall.ID] = true
+		}
+		if msg.Role == "tool" {
+			if msg.ToolCallID == "" {
+				return fmt.Errorf("messages[%d]: tool_call_id is required for role \"tool\"", i)
+			}
+			if !toolCallIDs[msg.ToolCallID] {
+				return fmt.Errorf("messages[%d]: tool_call_id %q does not match any earlier tool call", i, msg.ToolCallID)
 			}
 		}
 
-		// If we found a system message, add it to the first user message or add as a new message
-		if systemContent != "" {
-			// Format system message with Claude's format
-			systemInstruction := "Human: <system>\n" + systemContent + "\n</system>\n\n"
-
-			// Find first user message to prepend the system message to
-			foundUser := false
-			for i := range formattedMessages {
-				if formattedMessages[i].Role == "user" {
-					// Get user content
-					var userContent string
-					switch c := formattedMessages[i].Content.(type) {
-					case string:
-						userContent = c
-					case []interface{}:
-						for _, block := range c {
-							if contentMap, ok := block.(map[string]interface{}); ok {
-								if contentMap["type"] == "text" {
-									if text, ok := contentMap["text"].(string); ok {
-										userContent += text
-									}
-								}
-							}
-						}
+		switch c := msg.Content.(type) {
+		case nil:
+			if msg.Role != "assistant" && msg.Role != "tool" {
+				return fmt.Errorf("messages[%d]: content is required for role %q", i, msg.Role)
+			}
+		case string:
+		case []interface{}:
+			for j, part := range c {
+				partMap, ok := part.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("messages[%d].content[%d]: content part must be an object, got %s", i, j, jsonTypeName(part))
+				}
+				if partMap["type"] == "file" {
+					if _, err := parseFilePart(partMap); err != nil {
+						return fmt.Errorf("messages[%d].content[%d]: %v", i, j, err)
 					}
-
-					// Combine system and user content
-					formattedMessages[i].Content = systemInstruction + userContent
-					foundUser = true
-					break
 				}
 			}
+		default:
+			return fmt.Errorf("messages[%d]: content must be a string or an array of content parts, got %s", i, jsonTypeName(c))
+		}
+	}
 
-			// If no user message found, create one
-			if !foundUser {
-				formattedMessages = append([]Message{{
-					Role:    "user",
-					Content: systemInstruction,
-				}}, formattedMessages...)
-			}
+	if err := validateContentLimits(r.Messages); err != nil {
+		return err
+	}
+
+	for key := range r.AdditionalModelFields {
+		if reservedModelFields[key] {
+			return fmt.Errorf("additional_model_fields may not set reserved field %q", key)
+		}
+	}
+
+	if err := validateCostTags(r.Metadata); err != nil {
+		return err
+	}
+
+	var systemMessages int
+	for _, msg := range r.Messages {
+		if msg.Role == "system" {
+			systemMessages++
+		}
+	}
+	if err := checkSystemMessages(systemMessages, AppConfig.SystemMessageStrategy); err != nil {
+		return err
+	}
+
+	if r.SamplingProfile != "" {
+		if _, ok := LookupSamplingProfile(r.SamplingProfile); !ok {
+			return fmt.Errorf("unknown sampling_profile %q", r.SamplingProfile)
+		}
+	}
+
+	if r.ContextOverflow != "" && !overflowPolicies[r.ContextOverflow] {
+		return fmt.Errorf("invalid context_overflow %q, must be one of none, error, truncate-oldest, truncate-middle", r.ContextOverflow)
+	}
+
+	if r.ReasoningEffort != "" {
+		if _, ok := thinkingBudgets[r.ReasoningEffort]; !ok {
+			return fmt.Errorf("invalid reasoning_effort %q, must be one of low, medium, high", r.ReasoningEffort)
+		}
+		// The thinking budget must stay below max_tokens, which the server cap can leave no room for
+		if limit := AppConfig.ServerMaxOutputTokens; limit > 0 && limit <= minThinkingBudget {
+			return fmt.Errorf("reasoning_effort requires more than %d output tokens, but the server allows at most %d", minThinkingBudget, limit)
+		}
+	}
+
+	return nil
+}
+
+// IsDeterministic reports whether the request asks for greedy sampling, making identical requests interchangeable
+func (r ChatRequest) IsDeterministic() bool {
+	return r.Temperature != nil && *r.Temperature == 0
+}
+
+// Hash returns a stable hex digest identifying the request's content and invocation target
+func (r ChatRequest) Hash() (string, error) {
+	data, err := json.Marshal(struct {
+		ChatRequest
+		Target string `json:"target"`
+	}{r, r.InvocationModel()})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// crossRegionPrefixes are the geography prefixes of system-defined cross-region inference profile IDs
+var crossRegionPrefixes = []string{"us.", "us-gov.", "eu.", "apac.", "ca.", "jp.", "au.", "global."}
+
+// InvocationPath classifies how Bedrock bills an invocation of the given model ID or ARN:
+// "provisioned" for provisioned throughput, "inference_profile" for system-defined or application
+// inference profiles, and "foundation_model" for direct on-demand invocation of a base model.
+func InvocationPath(modelID string) string {
+	switch {
+	case strings.Contains(modelID, ":provisioned-model/"):
+		return "provisioned"
+	case strings.Contains(modelID, ":inference-profile/"), strings.Contains(modelID, ":application-inference-profile/"):
+		return "inference_profile"
+	}
+
+	for _, prefix := range crossRegionPrefixes {
+		if strings.HasPrefix(modelID, prefix) {
+			return "inference_profile"
 		}
+	}
+
+	return "foundation_model"
+}
+
+// jsonTypeName names the JSON type of a value decoded into an interface{}
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
 
-		// Create Claude-specific payload
-		payload := map[string]interface{}{
-			"messages":          formattedMessages,
-			"max_tokens":        maxTokens,
-			"temperature":       temperature,
-			"top_p":             req.TopP,
-			"anthropic_version": "bedrock-2023-05-31",
+// ApplyServiceTier maps the request's OpenAI service_tier onto a Bedrock invocation target and
+// returns the tier that is effectively applied. "flex" is routed to the model or profile configured
+// in FlexTierModels; unknown tiers and unconfigured flex fall back to "default".
+func (r *ChatRequest) ApplyServiceTier() string {
+	switch strings.ToLower(r.ServiceTier) {
+	case "":
+		return ""
+	case "flex":
+		if target, ok := AppConfig.FlexTierModels[r.Model]; ok {
+			r.targetModel = target
+			return "flex"
 		}
+		log.Printf("No flex tier route configured for model %s, using default tier", r.Model)
+	case "auto", "default":
+	default:
+		log.Printf("Ignoring unsupported service tier %q", r.ServiceTier)
+	}
+
+	return "default"
+}
+
+// defaultMaxTokens is the output token limit used when a request asks for the model maximum
+// but the model is not in the capability registry
+const defaultMaxTokens = 2048
+
+// EffectiveMaxTokens returns the output token limit that will be sent to the model for the request.
+// An absent max_tokens, or the -1 "unlimited" convention, means the model's maximum output tokens.
+// The result never exceeds SERVER_MAX_OUTPUT_TOKENS.
+func EffectiveMaxTokens(req ChatRequest) int {
+	if req.MaxTokens > 0 {
+		return clampServerMaxTokens(req.MaxTokens)
+	}
+	if capabilities, ok := LookupCapabilities(req.FormatModel()); ok && capabilities.MaxOutputTokens > 0 {
+		return clampServerMaxTokens(capabilities.MaxOutputTokens)
+	}
+	return clampServerMaxTokens(defaultMaxTokens)
+}
+
+// MaxTokensClamped reports whether the client explicitly asked for more output tokens than the server allows
+func MaxTokensClamped(req ChatRequest) bool {
+	return AppConfig.ServerMaxOutputTokens > 0 && req.MaxTokens > AppConfig.ServerMaxOutputTokens
+}
+
+// clampServerMaxTokens limits an output token count to the server-wide cap, if one is configured
+func clampServerMaxTokens(maxTokens int) int {
+	if limit := AppConfig.ServerMaxOutputTokens; limit > 0 && maxTokens > limit {
+		return limit
+	}
+	return maxTokens
+}
+
+// formatPayloadForModel formats the request payload with the model's formatter; ctx bounds fetching the
+// documents the request links to
+func formatPayloadForModel(ctx context.Context, req ChatRequest) ([]byte, error) {
+	if err := checkModelSupport(req.FormatModel()); err != nil {
+		return nil, err
+	}
+	if err := checkDocumentSupport(req); err != nil {
+		return nil, err
+	}
+	req.ctx = ctx
+
+	// Truncate oversized tool results before they reach the model, then fit the prompt to the context window
+	req.Messages = truncateToolResults(req.Messages, AppConfig.MaxToolResultChars)
+	req, err := applyOverflowPolicy(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return formatterFor(req.FormatModel()).FormatPayload(req)
+}
+
+// formatClaudePayload formats the request for Claude's Messages API
+func formatClaudePayload(req ChatRequest) ([]byte, error) {
+	maxTokens := EffectiveMaxTokens(req)
+
+	// Claude rejects conversations that don't alternate; fixing them up front lets errors name the client's messages
+	messages, err := enforceAlternation(req.Messages, AppConfig.MessageAlternation)
+	if err != nil {
+		return nil, err
+	}
+	req.Messages = messages
+
+	// Claude takes the system prompt as a top-level field rather than a turn
+	systemContent, formattedMessages, err := systemPrompt(req)
+	if err != nil {
+		return nil, err
+	}
+	claudeMessages, err := formatClaudeMessages(req.requestContext(), formattedMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create Claude-specific payload
+	payload := map[string]interface{}{
+		"messages":          claudeMessages,
+		"max_tokens":        maxTokens,
+		"anthropic_version": "bedrock-2023-05-31",
+	}
+	if systemContent != "" {
+		payload["system"] = systemContent
+	}
+	setSamplingParameters(payload, req)
+	if len(req.Stop) > 0 {
+		payload["stop_sequences"] = req.Stop
+	}
+	if tools := formatClaudeTools(req); tools != nil {
+		payload["tools"] = tools
+		if toolChoice := formatClaudeToolChoice(req); toolChoice != nil {
+			payload["tool_choice"] = toolChoice
+		}
+	}
+
+	// A json_schema response format is answered through a tool taking the schema as its input
+	if format := req.jsonSchemaFormat(); format != nil {
+		payload["tools"] = append(formatClaudeTools(req), structuredOutputClaudeTool(format))
+		payload["tool_choice"] = structuredToolChoice(req)
+	}
 
-		return json.Marshal(payload)
+	// Enable extended thinking; Claude requires temperature 1, no top_p and room for the budget in max_tokens
+	if budget, ok := thinkingBudgets[req.ReasoningEffort]; ok {
+		if maxTokens <= budget {
+			maxTokens = clampServerMaxTokens(budget + maxTokens)
+			payload["max_tokens"] = maxTokens
+		}
+		// The server cap can leave less room than the budget, which must stay below max_tokens; Validate
+		// guarantees the cap leaves room for at least the smallest budget
+		if budget >= maxTokens {
+			budget = maxTokens - 1
+		}
+		payload["thinking"] = map[string]interface{}{
+			"type":          "enabled",
+			"budget_tokens": budget,
+		}
+		payload["temperature"] = 1
+		delete(payload, "top_p")
+		delete(payload, "top_k")
 	}
 
-	// For non-Claude models, use the original message format
+	return json.Marshal(mergeAdditionalModelFields(payload, req.AdditionalModelFields))
+}
+
+// formatGenericPayload formats the request for models without a dedicated format, passing the messages through
+func formatGenericPayload(req ChatRequest) ([]byte, error) {
+	maxTokens := EffectiveMaxTokens(req)
 	payload := map[string]interface{}{
-		"messages":    req.Messages,
-		"max_tokens":  maxTokens,
-		"temperature": temperature,
-		"top_p":       req.TopP,
+		"messages":   req.Messages,
+		"max_tokens": maxTokens,
+	}
+	setSamplingParameters(payload, req)
+
+	return json.Marshal(mergeAdditionalModelFields(payload, req.AdditionalModelFields))
+}
+
+// setSamplingParameters copies the sampling parameters the client sent into the payload, with temperature
+// on the model's native scale. Omitted parameters are left out so the model applies its own defaults.
+func setSamplingParameters(payload map[string]interface{}, req ChatRequest) {
+	if req.Temperature != nil {
+		payload["temperature"] = ScaleTemperature(req.FormatModel(), *req.Temperature)
+	}
+	if req.TopP != nil {
+		payload["top_p"] = *req.TopP
+	}
+	if req.TopK != nil {
+		payload["top_k"] = *req.TopK
+	}
+	if req.IsDeterministic() {
+		setGreedySampling(payload, req)
+	}
+}
+
+// setGreedySampling configures the payload of a temperature 0 request for greedy decoding. Any top_p and top_k
+// the client sent are dropped, since they would keep sampling among several candidates, and newer Claude models
+// reject top_p alongside temperature; families in greedyTopK get their greedy top_k instead.
+func setGreedySampling(payload map[string]interface{}, req ChatRequest) {
+	delete(payload, "top_p")
+	delete(payload, "top_k")
+	if capabilities, ok := LookupCapabilities(req.FormatModel()); ok {
+		if topK, ok := greedyTopK[capabilities.StreamFormat]; ok {
+			payload["top_k"] = topK
+		}
+	}
+}
+
+// mergeAdditionalModelFields adds client-supplied model fields to the payload without replacing keys already set
+func mergeAdditionalModelFields(payload map[string]interface{}, fields map[string]interface{}) map[string]interface{} {
+	for key, value := range fields {
+		if _, exists := payload[key]; exists {
+			continue
+		}
+		payload[key] = value
 	}
+	return payload
+}
+
+// truncateToolResults shortens tool and function result messages whose content exceeds limit characters.
+// A limit of zero or less disables truncation. The input slice is not modified.
+func truncateToolResults(messages []Message, limit int) []Message {
+	if limit <= 0 {
+		return messages
+	}
+
+	result := make([]Message, len(messages))
+	copy(result, messages)
+
+	for i, msg := range result {
+		if msg.Role != "tool" && msg.Role != "function" {
+			continue
+		}
 
-	return json.Marshal(payload)
+		switch c := msg.Content.(type) {
+		case string:
+			if truncated, ok := truncateText(c, limit); ok {
+				log.Printf("Truncated %s result at message %d from %d to %d characters", msg.Role, i, utf8.RuneCountInString(c), limit)
+				result[i].Content = truncated
+			}
+		case []interface{}:
+			// Truncate text blocks against a shared budget for the whole message
+			remaining := limit
+			blocks := make([]interface{}, len(c))
+			for j, block := range c {
+				blocks[j] = block
+				contentMap, ok := block.(map[string]interface{})
+				if !ok || contentMap["type"] != "text" {
+					continue
+				}
+				text, ok := contentMap["text"].(string)
+				if !ok {
+					continue
+				}
+				length := utf8.RuneCountInString(text)
+				if truncated, ok := truncateText(text, remaining); ok {
+					log.Printf("Truncated %s result block %d at message %d from %d to %d characters", msg.Role, j, i, length, remaining)
+					newBlock := make(map[string]interface{}, len(contentMap))
+					for k, v := range contentMap {
+						newBlock[k] = v
+					}
+					newBlock["text"] = truncated
+					blocks[j] = newBlock
+				}
+				remaining -= length
+				if remaining < 0 {
+					remaining = 0
+				}
+			}
+			result[i].Content = blocks
+		}
+	}
+
+	return result
 }
 
-// parseResponseFromModel parses the response based on the model
-func parseResponseFromModel(responseBody []byte) (string, error) {
-	// Log the raw response for debugging
-	log.Printf("Raw response: %s", string(responseBody))
+// truncateText cuts text to limit characters and appends a truncation marker
+func truncateText(text string, limit int) (string, bool) {
+	if utf8.RuneCountInString(text) <= limit {
+		return text, false
+	}
+
+	cut, count := 0, 0
+	for i := range text {
+		if count == limit {
+			cut = i
+			break
+		}
+		count++
+	}
+
+	return text[:cut] + fmt.Sprintf("\n...[truncated %d characters]", utf8.RuneCountInString(text[cut:])), true
+}
+
+// truncateBytes cuts text to limit bytes, backing off to a rune boundary, and appends a truncation marker
+func truncateBytes(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+
+	return text[:cut] + fmt.Sprintf("\n...[truncated %d bytes]", len(text)-cut)
+}
+
+// errMalformedResponse is reported for model responses the gateway cannot make sense of, as opposed to
+// responses that are valid but empty, such as ones a guardrail filtered entirely
+var errMalformedResponse = errors.New("malformed model response")
+
+// parseResponseFromModel parses a response in Claude's Messages API format
+func parseResponseFromModel(responseBody []byte) (*ChatResult, error) {
+	// Log the raw response for debugging; it contains model output so only do so in debug mode
+	if AppConfig.Debug {
+		log.Printf("Raw response: %s", string(responseBody))
+	}
 
 	var response struct {
 		Content []struct {
-			Type string `json:"type"`
-			Text string `json:"text"`
+			Type     string          `json:"type"`
+			Text     string          `json:"text"`
+			Thinking string          `json:"thinking"`
+			ID       string          `json:"id"`
+			Name     string          `json:"name"`
+			Input    json.RawMessage `json:"input"`
 		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+		Usage      struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+		GuardrailAction string `json:"amazon-bedrock-guardrailAction"`
 	}
 
 	if err := json.Unmarshal(responseBody, &response); err != nil {
-		return "", fmt.Errorf("failed to parse response: %v", err)
+		return nil, fmt.Errorf("%w: failed to parse response: %v", errMalformedResponse, err)
 	}
 
-	if len(response.Content) > 0 {
-		return response.Content[0].Text, nil
+	// Without content, a stop reason or a guardrail action the response doesn't say what happened
+	if len(response.Content) == 0 && response.StopReason == "" && response.GuardrailAction == "" {
+		return nil, fmt.Errorf("%w: no content in response", errMalformedResponse)
 	}
 
-	return "", errors.New("no content in response")
+	// Separate reasoning from the final answer
+	result := &ChatResult{
+		FinishReason: ConvertFinishReason(response.StopReason),
+		Usage: Usage{
+			PromptTokens:     response.Usage.InputTokens,
+			CompletionTokens: response.Usage.OutputTokens,
+			TotalTokens:      response.Usage.InputTokens + response.Usage.OutputTokens,
+		},
+	}
+	var structured string
+	for _, block := range response.Content {
+		switch block.Type {
+		case "thinking":
+			result.ReasoningContent += block.Thinking
+		case "text":
+			result.Content += block.Text
+		case "tool_use":
+			arguments := string(block.Input)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			// The structured output tool's input is the answer to a json_schema response format
+			if block.Name == structuredOutputTool {
+				structured = arguments
+				continue
+			}
+			result.ToolCalls = append(result.ToolCalls, ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: ToolCallFunction{Name: block.Name, Arguments: arguments},
+			})
+		}
+	}
+
+	// Any text around a structured answer is the model's commentary on it, which the client did not ask for
+	if structured != "" {
+		result.Content = structured
+		if len(result.ToolCalls) == 0 {
+			result.FinishReason = "stop"
+		}
+	}
+
+	// A declined answer is a refusal rather than content; guardrail blocks are reported as content_filter
+	if strings.EqualFold(response.GuardrailAction, "INTERVENED") {
+		result.FinishReason = "content_filter"
+	}
+	// A refusal with nothing to show was filtered entirely, which leaves an empty message rather than an error
+	if response.StopReason == "refusal" && result.Content == "" && len(result.ToolCalls) == 0 {
+		result.FinishReason = "content_filter"
+	}
+	if result.FinishReason == "content_filter" || response.StopReason == "refusal" {
+		result.Refusal, result.Content = result.Content, ""
+	}
+
+	return result, nil
 }
 
 // GenerateMessageID generates a unique message ID
 func GenerateMessageID() string {
-	return fmt.Sprintf("chatcmpl-%s", time.Now().Format("20060102150405"))
+	return fmt.Sprintf("chatcmpl-%s%s", time.Now().Format("20060102150405"), randomSuffix())
+}
+
+// randomSuffix returns random hex characters that keep IDs generated in the same second distinct
+func randomSuffix() string {
+	raw := make([]byte, 6)
+	if _, err := rand.Read(raw); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(raw)
 }
 
-// ParseImage tries to get the raw data from an image URL
-func ParseImage(imageURL string) ([]byte, string, error) {
+// ParseImage tries to get the raw data from an image URL within ctx, given the bytes of the request's content already counted
+// towards MAX_CONTENT_BYTES. An image fetched from a URL counts towards the limit as it downloads, and fails with
+// errContentTooLarge once the request's content would exceed it.
+func ParseImage(ctx context.Context, imageURL string, used int) ([]byte, string, error) {
 	pattern := `^data:(image/[a-z]*);base64,\s*`
 	re := regexp.MustCompile(pattern)
 	matches := re.FindStringSubmatch(imageURL)
@@ -341,7 +1226,7 @@ func ParseImage(imageURL string) ([]byte, string, error) {
 	}
 
 	// Send a request to the image URL
-	resp, err := http.Get(imageURL)
+	resp, err := fetchURL(ctx, imageURL)
 	if err != nil {
 		return nil, "", err
 	}
@@ -356,7 +1241,12 @@ func ParseImage(imageURL string) ([]byte, string, error) {
 		contentType = "image/jpeg"
 	}
 
-	imageContent, err := io.ReadAll(resp.Body)
+	limit := 0
+	if total := AppConfig.MaxContentBytes; total > 0 {
+		limit = max(total-used, 1)
+	}
+	tooLarge := fmt.Errorf("%w: content parts exceed the limit of %d bytes per request", errContentTooLarge, AppConfig.MaxContentBytes)
+	imageContent, err := readLimited(resp, limit, tooLarge)
 	if err != nil {
 		return nil, "", err
 	}
@@ -373,11 +1263,15 @@ func ConvertFinishReason(finishReason string) string {
 	finishReasonMapping := map[string]string{
 		"tool_use":         "tool_calls",
 		"finished":         "stop",
+		"finish":           "stop",
 		"end_turn":         "stop",
 		"max_tokens":       "length",
 		"stop_sequence":    "stop",
 		"complete":         "stop",
 		"content_filtered": "content_filter",
+
+		"guardrail_intervened": "content_filter",
+		"refusal":              "stop",
 	}
 
 	if mapped, ok := finishReasonMapping[strings.ToLower(finishReason)]; ok {
@@ -387,14 +1281,9 @@ func ConvertFinishReason(finishReason string) string {
 	return strings.ToLower(finishReason)
 }
 
-// ListBedrockModels lists available Bedrock models
+// ListBedrockModels lists available Bedrock models, including system-defined and application inference profiles
 func (s *BedrockService) ListBedrockModels(ctx context.Context) ([]string, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config: %v", err)
-	}
-
-	bedrockClient := bedrock.NewFromConfig(cfg)
+	bedrockClient := s.catalogClient
 	var modelIDs []string
 
 	// Get foundation models
@@ -430,5 +1319,24 @@ func (s *BedrockService) ListBedrockModels(ctx context.Context) ([]string, error
 		}
 	}
 
+	// Get application inference profiles; these are invoked by ARN, so list the ARN
+	applicationResp, err := bedrockClient.ListInferenceProfiles(ctx, &bedrock.ListInferenceProfilesInput{
+		MaxResults: aws.Int32(1000),
+		TypeEquals: types.InferenceProfileTypeApplication,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list application inference profiles: %v", err)
+	}
+
+	for _, profile := range applicationResp.InferenceProfileSummaries {
+		if profile.InferenceProfileArn == nil {
+			continue
+		}
+		if model := foundationModelFromProfile(profile.Models); model != "" {
+			s.profileModels.Store(*profile.InferenceProfileArn, model)
+		}
+		modelIDs = append(modelIDs, *profile.InferenceProfileArn)
+	}
+
 	return modelIDs, nil
 }
@@ -0,0 +1,766 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/gin-gonic/gin"
+)
+
+// mockInvoker is a BedrockInvoker that returns canned responses and records the requests it receives
+type mockInvoker struct {
+	mu        sync.Mutex // invocations may be concurrent, as with the prompts of a completions request
+	responses [][]byte
+	err       error
+	failures  []error // returned, in order, by the first invocations
+	inputs    []*bedrockruntime.InvokeModelInput
+}
+
+func (m *mockInvoker) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputs = append(m.inputs, params)
+	if m.err != nil {
+		return nil, m.err
+	}
+	if len(m.failures) > 0 {
+		err := m.failures[0]
+		m.failures = m.failures[1:]
+		return nil, err
+	}
+	if len(m.responses) == 0 {
+		return nil, errors.New("mockInvoker: no canned response left")
+	}
+
+	body := m.responses[0]
+	m.responses = m.responses[1:]
+	return &bedrockruntime.InvokeModelOutput{Body: body, ContentType: aws.String("application/json")}, nil
+}
+
+func (m *mockInvoker) InvokeModelWithResponseStream(ctx context.Context, params *bedrockruntime.InvokeModelWithResponseStreamInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelWithResponseStreamOutput, error) {
+	return nil, errors.New("mockInvoker: streaming not supported")
+}
+
+// payload decodes the body of the nth recorded request
+func (m *mockInvoker) payload(t *testing.T, n int) map[string]interface{} {
+	t.Helper()
+	if n >= len(m.inputs) {
+		t.Fatalf("expected at least %d invocations, got %d", n+1, len(m.inputs))
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(m.inputs[n].Body, &payload); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	return payload
+}
+
+// newTestService creates a BedrockService backed by a mock invoker
+func newTestService(responses ...string) (*BedrockService, *mockInvoker) {
+	invoker := &mockInvoker{}
+	for _, response := range responses {
+		invoker.responses = append(invoker.responses, []byte(response))
+	}
+	return &BedrockService{client: invoker}, invoker
+}
+
+func float32Ptr(v float32) *float32 {
+	return &v
+}
+
+// restoreConfig saves AppConfig and restores it when the test ends, so the test can change any setting
+func restoreConfig(tb testing.TB) {
+	tb.Helper()
+	saved := *AppConfig
+	tb.Cleanup(func() { *AppConfig = saved })
+}
+
+func TestProcessChatClaude(t *testing.T) {
+	tests := []struct {
+		name             string
+		model            string
+		response         string
+		wantContent      string
+		wantRefusal      string
+		wantReasoning    string
+		wantToolCalls    int
+		wantFinishReason string
+	}{
+		{
+			name:             "text",
+			model:            "anthropic.claude-3-sonnet-20240229-v1:0",
+			response:         `{"content":[{"type":"text","text":"Hello!"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":3}}`,
+			wantContent:      "Hello!",
+			wantFinishReason: "stop",
+		},
+		{
+			name:             "cross-region profile",
+			model:            "us.anthropic.claude-3-5-haiku-20241022-v1:0",
+			response:         `{"content":[{"type":"text","text":"Hi"}],"stop_reason":"max_tokens","usage":{"input_tokens":5,"output_tokens":1}}`,
+			wantContent:      "Hi",
+			wantFinishReason: "length",
+		},
+		{
+			name:             "thinking",
+			model:            "anthropic.claude-3-7-sonnet-20250219-v1:0",
+			response:         `{"content":[{"type":"thinking","thinking":"Let me think."},{"type":"text","text":"42"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":20}}`,
+			wantContent:      "42",
+			wantReasoning:    "Let me think.",
+			wantFinishReason: "stop",
+		},
+		{
+			name:             "tool use",
+			model:            "anthropic.claude-3-haiku-20240307-v1:0",
+			response:         `{"content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":20}}`,
+			wantToolCalls:    1,
+			wantFinishReason: "tool_calls",
+		},
+		{
+			name:             "model refusal",
+			model:            "anthropic.claude-3-haiku-20240307-v1:0",
+			response:         `{"content":[{"type":"text","text":"I can't help with that."}],"stop_reason":"refusal","usage":{"input_tokens":10,"output_tokens":6}}`,
+			wantRefusal:      "I can't help with that.",
+			wantFinishReason: "stop",
+		},
+		{
+			name:             "guardrail block",
+			model:            "anthropic.claude-3-haiku-20240307-v1:0",
+			response:         `{"content":[{"type":"text","text":"Sorry, the model cannot answer this question."}],"stop_reason":"end_turn","amazon-bedrock-guardrailAction":"INTERVENED","usage":{"input_tokens":10,"output_tokens":0}}`,
+			wantRefusal:      "Sorry, the model cannot answer this question.",
+			wantFinishReason: "content_filter",
+		},
+		{
+			name:             "fully filtered",
+			model:            "anthropic.claude-3-haiku-20240307-v1:0",
+			response:         `{"content":[],"stop_reason":"guardrail_intervened","usage":{"input_tokens":10,"output_tokens":0}}`,
+			wantFinishReason: "content_filter",
+		},
+		{
+			name:             "empty refusal",
+			model:            "anthropic.claude-3-haiku-20240307-v1:0",
+			response:         `{"content":[],"stop_reason":"refusal","usage":{"input_tokens":10,"output_tokens":0}}`,
+			wantFinishReason: "content_filter",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, invoker := newTestService(tt.response)
+			result, err := service.ProcessChat(context.Background(), ChatRequest{
+				Model:    tt.model,
+				Messages: []Message{{Role: "user", Content: "Hello"}},
+			})
+			if err != nil {
+				t.Fatalf("ProcessChat returned error: %v", err)
+			}
+
+			if result.Content != tt.wantContent {
+				t.Errorf("content = %q, want %q", result.Content, tt.wantContent)
+			}
+			if result.Refusal != tt.wantRefusal {
+				t.Errorf("refusal = %q, want %q", result.Refusal, tt.wantRefusal)
+			}
+			if result.ReasoningContent != tt.wantReasoning {
+				t.Errorf("reasoning = %q, want %q", result.ReasoningContent, tt.wantReasoning)
+			}
+			if len(result.ToolCalls) != tt.wantToolCalls {
+				t.Errorf("tool calls = %d, want %d", len(result.ToolCalls), tt.wantToolCalls)
+			}
+			if result.FinishReason != tt.wantFinishReason {
+				t.Errorf("finish reason = %q, want %q", result.FinishReason, tt.wantFinishReason)
+			}
+			if result.Usage.TotalTokens != result.Usage.PromptTokens+result.Usage.CompletionTokens {
+				t.Errorf("total tokens = %d, want sum of prompt and completion", result.Usage.TotalTokens)
+			}
+
+			if got := aws.ToString(invoker.inputs[0].ModelId); got != tt.model {
+				t.Errorf("invoked model = %q, want %q", got, tt.model)
+			}
+			if got := aws.ToString(invoker.inputs[0].Accept); got != "application/json" {
+				t.Errorf("accept = %q, want application/json", got)
+			}
+			if payload := invoker.payload(t, 0); payload["anthropic_version"] != "bedrock-2023-05-31" {
+				t.Errorf("payload is not in Claude format: %v", payload)
+			}
+		})
+	}
+}
+
+func TestProcessChatToolCallArguments(t *testing.T) {
+	service, _ := newTestService(`{"content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}],"stop_reason":"tool_use"}`)
+	result, err := service.ProcessChat(context.Background(), ChatRequest{
+		Model:    "anthropic.claude-3-haiku-20240307-v1:0",
+		Messages: []Message{{Role: "user", Content: "Weather in Paris?"}},
+		Tools:    []Tool{{Type: "function", Function: Function{Name: "get_weather"}}},
+	})
+	if err != nil {
+		t.Fatalf("ProcessChat returned error: %v", err)
+	}
+
+	toolCall := result.ToolCalls[0]
+	if toolCall.ID != "toolu_1" || toolCall.Type != "function" || toolCall.Function.Name != "get_weather" {
+		t.Errorf("unexpected tool call: %+v", toolCall)
+	}
+	if toolCall.Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("arguments = %s, want the tool input as JSON", toolCall.Function.Arguments)
+	}
+}
+
+func TestProcessChatNonClaude(t *testing.T) {
+	service, invoker := newTestService(`{"output":{"message":{"role":"assistant","content":[{"text":"Hello"}]}}}`)
+	_, err := service.ProcessChat(context.Background(), ChatRequest{
+		Model:    "amazon.nova-pro-v1:0",
+		Messages: []Message{{Role: "user", Content: "Hello"}},
+	})
+	if err == nil {
+		t.Fatal("expected an error parsing a non-Claude response")
+	}
+
+	payload := invoker.payload(t, 0)
+	if _, ok := payload["anthropic_version"]; ok {
+		t.Error("non-Claude payload should not carry anthropic_version")
+	}
+	if _, ok := payload["messages"]; !ok {
+		t.Error("non-Claude payload should carry messages")
+	}
+}
+
+func TestProcessChatInvokeError(t *testing.T) {
+	service, invoker := newTestService()
+	invoker.err = errors.New("ThrottlingException")
+
+	if _, err := service.ProcessChat(context.Background(), ChatRequest{
+		Model:    "anthropic.claude-3-haiku-20240307-v1:0",
+		Messages: []Message{{Role: "user", Content: "Hello"}},
+	}); err == nil || !strings.Contains(err.Error(), "ThrottlingException") {
+		t.Fatalf("expected invoke error, got %v", err)
+	}
+}
+
+func TestFormatPayloadForModelSamplingParameters(t *testing.T) {
+	tests := []struct {
+		name            string
+		temperature     *float32
+		topP            *float32
+		wantTemperature interface{}
+		wantTopP        interface{}
+	}{
+		{name: "omitted", wantTemperature: nil, wantTopP: nil},
+		{name: "explicit zero", temperature: float32Ptr(0), topP: float32Ptr(0), wantTemperature: 0.0, wantTopP: nil}, // greedy decoding drops top_p
+		{name: "zero top_p", temperature: float32Ptr(0.5), topP: float32Ptr(0), wantTemperature: 0.5, wantTopP: 0.0},
+		{name: "set", temperature: float32Ptr(0.5), topP: float32Ptr(0.9), wantTemperature: 0.5, wantTopP: 0.9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := formatPayloadForModel(context.Background(), ChatRequest{
+				Model:       "anthropic.claude-3-haiku-20240307-v1:0",
+				Messages:    []Message{{Role: "user", Content: "Hello"}},
+				Temperature: tt.temperature,
+				TopP:        tt.topP,
+			})
+			if err != nil {
+				t.Fatalf("formatPayloadForModel returned error: %v", err)
+			}
+
+			var payload map[string]interface{}
+			if err := json.Unmarshal(data, &payload); err != nil {
+				t.Fatal(err)
+			}
+			assertPayloadNumber(t, payload, "temperature", tt.wantTemperature)
+			assertPayloadNumber(t, payload, "top_p", tt.wantTopP)
+		})
+	}
+}
+
+// assertPayloadNumber checks a numeric payload field, where a nil want means the field must be absent
+func assertPayloadNumber(t *testing.T, payload map[string]interface{}, key string, want interface{}) {
+	t.Helper()
+	got, ok := payload[key]
+	if want == nil {
+		if ok {
+			t.Errorf("%s = %v, want it omitted", key, got)
+		}
+		return
+	}
+	if number, isNumber := got.(float64); !isNumber || float32(number) != float32(want.(float64)) {
+		t.Errorf("%s = %v, want %v", key, got, want)
+	}
+}
+
+func TestFormatPayloadForModelClaudeMessages(t *testing.T) {
+	var stop StopSequences
+	if err := json.Unmarshal([]byte(`"\n"`), &stop); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := formatPayloadForModel(context.Background(), ChatRequest{
+		Model: "anthropic.claude-3-haiku-20240307-v1:0",
+		Messages: []Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Name: "alice", Content: "Hi"},
+			{Role: "assistant", Content: nil},
+		},
+		Stop: stop,
+	})
+	if err != nil {
+		t.Fatalf("formatPayloadForModel returned error: %v", err)
+	}
+
+	var payload struct {
+		System        string          `json:"system"`
+		Messages      []claudeMessage `json:"messages"`
+		StopSequences []string        `json:"stop_sequences"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.System != "Be brief." {
+		t.Errorf("system = %q, want the system message", payload.System)
+	}
+	if len(payload.Messages) != 2 {
+		t.Fatalf("messages = %d, want system message removed", len(payload.Messages))
+	}
+	if payload.Messages[0].Content != "alice: Hi" {
+		t.Errorf("user content = %v, want the name folded in", payload.Messages[0].Content)
+	}
+	if payload.Messages[1].Content != "" {
+		t.Errorf("null assistant content = %v, want empty string", payload.Messages[1].Content)
+	}
+	if len(payload.StopSequences) != 1 || payload.StopSequences[0] != "\n" {
+		t.Errorf("stop_sequences = %v, want the single stop string", payload.StopSequences)
+	}
+}
+
+func TestEffectiveMaxTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		maxTokens int
+		want      int
+	}{
+		{name: "explicit", model: "anthropic.claude-3-haiku-20240307-v1:0", maxTokens: 100, want: 100},
+		{name: "absent", model: "anthropic.claude-3-5-sonnet-20240620-v1:0", want: 8192},
+		{name: "unlimited", model: "us.anthropic.claude-3-7-sonnet-20250219-v1:0", maxTokens: -1, want: 64000},
+		{name: "unknown model", model: "acme.model-v1", maxTokens: -1, want: defaultMaxTokens},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EffectiveMaxTokens(ChatRequest{Model: tt.model, MaxTokens: tt.maxTokens}); got != tt.want {
+				t.Errorf("EffectiveMaxTokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateToolCallID(t *testing.T) {
+	req := ChatRequest{
+		Model: "anthropic.claude-3-haiku-20240307-v1:0",
+		Messages: []Message{
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", ToolCalls: []ToolCall{{ID: "toolu_1", Function: ToolCallFunction{Name: "f", Arguments: "{}"}}}},
+			{Role: "tool", ToolCallID: "toolu_9", Content: "done"},
+		},
+	}
+	if err := req.Validate(); err == nil {
+		t.Error("expected an error for a tool result without a matching tool call")
+	}
+
+	req.Messages[2].ToolCallID = "toolu_1"
+	if err := req.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEffectiveMaxTokensServerCap(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.ServerMaxOutputTokens = 1000
+
+	req := ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", MaxTokens: 4000}
+	if got := EffectiveMaxTokens(req); got != 1000 {
+		t.Errorf("EffectiveMaxTokens = %d, want the server cap", got)
+	}
+	if !MaxTokensClamped(req) {
+		t.Error("expected an explicit max_tokens above the cap to be reported as clamped")
+	}
+	if got := EffectiveMaxTokens(ChatRequest{Model: req.Model, MaxTokens: -1}); got != 1000 {
+		t.Errorf("EffectiveMaxTokens(-1) = %d, want the server cap", got)
+	}
+}
+
+func TestValidateReasoningEffortServerCap(t *testing.T) {
+	restoreConfig(t)
+	req := ChatRequest{Model: "anthropic.claude-3-7-sonnet-20250219-v1:0", Messages: []Message{{Role: "user", Content: "Hi"}}, ReasoningEffort: "low"}
+
+	AppConfig.ServerMaxOutputTokens = 1024
+	if err := req.Validate(); err == nil || !strings.Contains(err.Error(), "at most 1024") {
+		t.Errorf("error = %v, want reasoning_effort rejected for a cap with no room for the budget", err)
+	}
+
+	AppConfig.ServerMaxOutputTokens = 1025
+	if err := req.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, err := formatClaudePayload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload struct {
+		MaxTokens int `json:"max_tokens"`
+		Thinking  struct {
+			BudgetTokens int `json:"budget_tokens"`
+		} `json:"thinking"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.MaxTokens != 1025 || payload.Thinking.BudgetTokens != minThinkingBudget {
+		t.Errorf("max_tokens = %d, budget_tokens = %d, want 1025 and %d", payload.MaxTokens, payload.Thinking.BudgetTokens, minThinkingBudget)
+	}
+}
+
+func TestValidateLogprobs(t *testing.T) {
+	base := ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", Messages: []Message{{Role: "user", Content: "Hi"}}}
+	tests := []struct {
+		logprobs    bool
+		topLogprobs int
+		wantErr     string
+	}{
+		{},
+		{topLogprobs: 21, wantErr: "between 0 and 20"},
+		{topLogprobs: 5, wantErr: "requires logprobs"},
+		{logprobs: true, topLogprobs: 5, wantErr: "not supported for model anthropic.claude-3-haiku"},
+	}
+
+	for _, tt := range tests {
+		req := base
+		req.Logprobs, req.TopLogprobs = tt.logprobs, tt.topLogprobs
+		err := req.Validate()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tt, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%+v: error = %v, want it to mention %q", tt, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTruncateToolResults(t *testing.T) {
+	messages := []Message{
+		{Role: "tool", Content: "héllo wörld"},
+		{Role: "tool", Content: []interface{}{
+			map[string]interface{}{"type": "text", "text": "ééé"},
+			map[string]interface{}{"type": "text", "text": "üüü"},
+		}},
+	}
+
+	// Limits count characters, not bytes, so multi-byte text is cut at the same length as ASCII
+	truncated := truncateToolResults(messages, 5)
+	if want := "héllo\n...[truncated 6 characters]"; truncated[0].Content != want {
+		t.Errorf("content = %q, want %q", truncated[0].Content, want)
+	}
+	blocks := truncated[1].Content.([]interface{})
+	if text := blocks[0].(map[string]interface{})["text"]; text != "ééé" {
+		t.Errorf("first block = %q, want it within the limit", text)
+	}
+	if text := blocks[1].(map[string]interface{})["text"]; text != "üü\n...[truncated 1 characters]" {
+		t.Errorf("second block = %q, want the rest of the budget", text)
+	}
+	if messages[0].Content != "héllo wörld" {
+		t.Errorf("input was modified: %v", messages)
+	}
+}
+
+func TestProcessChatCreated(t *testing.T) {
+	service, _ := newTestService(`{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn"}`)
+	before := time.Now()
+	result, err := service.ProcessChat(context.Background(), ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", Messages: []Message{{Role: "user", Content: "Hi"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Created.Before(before) || result.Created.After(time.Now()) {
+		t.Errorf("created = %v, want the time the generation completed", result.Created)
+	}
+}
+
+func TestBedrockLatencyHeader(t *testing.T) {
+	service, _ := newTestService(`{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn"}`)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	completeChat(c, service, ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", Messages: []Message{{Role: "user", Content: "Hi"}}})
+
+	if recorder.Code != http.StatusOK || recorder.Header().Get("x-bedrock-latency-ms") != "0" {
+		t.Errorf("got %d with x-bedrock-latency-ms %q, want the mock's instant invocation", recorder.Code, recorder.Header().Get("x-bedrock-latency-ms"))
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	for _, response := range []string{`not json`, `{"usage":{"input_tokens":10,"output_tokens":0}}`} {
+		service, _ := newTestService(response)
+		_, err := service.ProcessChat(context.Background(), ChatRequest{
+			Model:    "anthropic.claude-3-haiku-20240307-v1:0",
+			Messages: []Message{{Role: "user", Content: "Hello"}},
+		})
+		if !errors.Is(err, errMalformedResponse) || chatErrorStatus(err) != http.StatusBadGateway {
+			t.Errorf("response %s: err = %v, want a malformed response reported as 502", response, err)
+		}
+	}
+}
+
+func TestObjectNames(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.ObjectNames = map[string]string{"chat.completion": "chat_completion", "chat.completion.chunk": "chat_completion_chunk"}
+
+	service, _ := newTestService(`{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn"}`)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{"model": "anthropic.claude-3-haiku-20240307-v1:0", "messages": [{"role": "user", "content": "Hi"}]}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handleChat(service)(c)
+	var response ChatResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.Object != "chat_completion" {
+		t.Errorf("object = %q, want the configured name", response.Object)
+	}
+
+	recorder = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	newChatStreamWriter(c, "anthropic.claude-3-haiku-20240307-v1:0").writeChunk(ChunkDelta{Content: "Hi"}, nil)
+	if !strings.Contains(recorder.Body.String(), `"object":"chat_completion_chunk"`) {
+		t.Errorf("chunk = %s, want the configured chunk name", recorder.Body.String())
+	}
+	if objectName(objectTextCompletion) != "text_completion" {
+		t.Errorf("text completion object = %q, want the standard name", objectName(objectTextCompletion))
+	}
+
+	if err := ValidateObjectNames(map[string]string{"embedding": "vector"}); err == nil {
+		t.Error("expected an error renaming an unsupported object type")
+	}
+}
+
+func TestGreedySampling(t *testing.T) {
+	zero, topP, topK := float32(0), float32(0.9), 40
+	tests := []struct {
+		model    string
+		wantTopK interface{}
+	}{
+		{model: "anthropic.claude-3-haiku-20240307-v1:0", wantTopK: nil},
+		{model: "amazon.nova-pro-v1:0", wantTopK: float64(1)},
+		{model: "meta.llama3-8b-instruct-v1:0", wantTopK: nil},
+	}
+	for _, tt := range tests {
+		payload, err := formatPayloadForModel(context.Background(), ChatRequest{
+			Model:       tt.model,
+			Messages:    []Message{{Role: "user", Content: "Hi"}},
+			Temperature: &zero,
+			TopP:        &topP,
+			TopK:        &topK,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.model, err)
+		}
+		var decoded map[string]interface{}
+		json.Unmarshal(payload, &decoded)
+		if _, ok := decoded["top_p"]; ok || decoded["top_k"] != tt.wantTopK || decoded["temperature"] != float64(0) {
+			t.Errorf("%s: payload = %v, want temperature 0, no top_p and top_k %v", tt.model, decoded, tt.wantTopK)
+		}
+	}
+}
+
+// throttlingTransport answers the first throttled requests with a ThrottlingException and the rest with body
+type throttlingTransport struct {
+	throttled int
+	body      string
+	calls     int
+}
+
+func (t *throttlingTransport) Do(req *http.Request) (*http.Response, error) {
+	t.calls++
+	recorder := httptest.NewRecorder()
+	if t.calls <= t.throttled {
+		recorder.Header().Set("X-Amzn-Errortype", "ThrottlingException")
+		recorder.WriteHeader(http.StatusTooManyRequests)
+		recorder.WriteString(`{"message":"Too many requests"}`)
+	} else {
+		recorder.Header().Set("Content-Type", "application/json")
+		recorder.WriteString(t.body)
+	}
+	return recorder.Result(), nil
+}
+
+func TestGatewayRetriesHeader(t *testing.T) {
+	transport := &throttlingTransport{throttled: 2, body: `{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn"}`}
+	client := bedrockruntime.New(bedrockruntime.Options{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		HTTPClient:  transport,
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+		}),
+	})
+	service := &BedrockService{client: client}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	completeChat(c, service, ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", Messages: []Message{{Role: "user", Content: "Hi"}}})
+
+	if recorder.Code != http.StatusOK || recorder.Header().Get("x-gateway-retries") != "2" {
+		t.Errorf("got %d with x-gateway-retries %q after %d calls, want 200 with 2 retries", recorder.Code, recorder.Header().Get("x-gateway-retries"), transport.calls)
+	}
+}
+
+func TestSDKRetrySettingsEndToEnd(t *testing.T) {
+	restoreConfig(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", t.TempDir()+"/config")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", t.TempDir()+"/credentials")
+	AppConfig.AWSRetryMode = "standard"
+	AppConfig.AWSMaxAttempts = 2
+
+	// A chat request goes through the router to a client built from the configured SDK settings, whose only
+	// change is an HTTP client that throttles the first calls and no backoff between attempts
+	send := func(throttled int) (*httptest.ResponseRecorder, *throttlingTransport) {
+		service, err := NewBedrockService("us-east-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := &throttlingTransport{throttled: throttled, body: `{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`}
+		service.client = bedrockruntime.NewFromConfig(service.awsConfig, func(o *bedrockruntime.Options) {
+			o.HTTPClient = transport
+			o.Retryer = retry.AddWithMaxBackoffDelay(o.Retryer, 0)
+		})
+		router := gin.New()
+		SetupRoutes(router, service)
+
+		recorder := httptest.NewRecorder()
+		body := `{"model": "anthropic.claude-3-haiku-20240307-v1:0", "messages": [{"role": "user", "content": "Hi"}]}`
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body)))
+		return recorder, transport
+	}
+
+	recorder, transport := send(1)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("x-gateway-retries") != "1" || !strings.Contains(recorder.Body.String(), `"content":"Hi"`) {
+		t.Errorf("got %d with x-gateway-retries %q after %d calls: %s, want the completion after one SDK retry",
+			recorder.Code, recorder.Header().Get("x-gateway-retries"), transport.calls, recorder.Body)
+	}
+
+	// AWS_MAX_ATTEMPTS caps the calls, so a model that keeps throttling fails the request
+	recorder, transport = send(2)
+	if recorder.Code == http.StatusOK || transport.calls != 2 {
+		t.Errorf("got %d after %d calls, want a failure after AWS_MAX_ATTEMPTS of 2", recorder.Code, transport.calls)
+	}
+}
+
+// gatedInvoker holds each invocation until released, reporting when one has started and the deadline it runs under
+type gatedInvoker struct {
+	mockInvoker
+	started  chan struct{}
+	release  chan struct{}
+	deadline time.Time
+}
+
+func (g *gatedInvoker) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	g.deadline, _ = ctx.Deadline()
+	g.started <- struct{}{}
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return g.mockInvoker.InvokeModel(ctx, params, optFns...)
+}
+
+func TestProcessChatDeduplicatesRequests(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.DeduplicateRequests = true
+	AppConfig.ChatTimeout = time.Minute
+
+	invoker := &gatedInvoker{started: make(chan struct{}, 1), release: make(chan struct{})}
+	invoker.responses = [][]byte{[]byte(`{"content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}],"stop_reason":"tool_use"}`)}
+	service := &BedrockService{client: invoker}
+	req := ChatRequest{
+		Model:       "anthropic.claude-3-haiku-20240307-v1:0",
+		Messages:    []Message{{Role: "user", Content: "Weather in Paris?"}},
+		Tools:       []Tool{{Type: "function", Function: Function{Name: "get_weather"}}},
+		Temperature: float32Ptr(0),
+	}
+
+	results := make([]*ChatResult, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	call := func(i int) {
+		defer wg.Done()
+		results[i], errs[i] = service.ProcessChat(context.Background(), req)
+	}
+	wg.Add(2)
+	go call(0)
+	<-invoker.started
+	go call(1)
+
+	// A waiter whose own context ends stops waiting without failing the shared call
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := service.ProcessChat(ctx, req); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled waiter: err = %v, want context.Canceled", err)
+	}
+
+	time.Sleep(20 * time.Millisecond) // let the second caller join the invocation
+	close(invoker.release)
+	wg.Wait()
+
+	if len(invoker.inputs) != 1 {
+		t.Fatalf("%d invocations, want one shared by identical concurrent requests", len(invoker.inputs))
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d: %v", i, err)
+		}
+	}
+	if invoker.deadline.IsZero() {
+		t.Error("expected the shared invocation to run under CHAT_TIMEOUT")
+	}
+	results[0].ToolCalls[0].ID = "changed"
+	if results[1].ToolCalls[0].ID != "toolu_1" {
+		t.Error("expected each caller to get its own tool calls")
+	}
+}
+
+func TestModelARN(t *testing.T) {
+	profileArn := "arn:aws:bedrock:us-east-1:123456789012:inference-profile/us.anthropic.claude-3-haiku-20240307-v1:0"
+	profiles := &fakeProfileClient{profileArn: profileArn}
+	service := &BedrockService{profileClient: profiles, awsConfig: aws.Config{Region: "us-east-1"}}
+
+	for model, want := range map[string]string{
+		"anthropic.claude-3-haiku-20240307-v1:0":    "arn:aws:bedrock:us-east-1::foundation-model/anthropic.claude-3-haiku-20240307-v1:0",
+		"us.anthropic.claude-3-haiku-20240307-v1:0": profileArn,
+		profileArn: profileArn,
+	} {
+		if got, err := service.modelARN(context.Background(), model); err != nil || got != want {
+			t.Errorf("modelARN(%s) = %q, %v, want %q", model, got, err, want)
+		}
+	}
+
+	// The profile's ARN is looked up once
+	if _, err := service.modelARN(context.Background(), "us.anthropic.claude-3-haiku-20240307-v1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if profiles.lookups != 1 {
+		t.Errorf("GetInferenceProfile called %d times, want once", profiles.lookups)
+	}
+}
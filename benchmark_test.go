@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// largeConversation builds a Claude request with a system prompt and n alternating user/assistant turns
+func largeConversation(n int) ChatRequest {
+	messages := []Message{{Role: "system", Content: "You are a helpful assistant."}}
+	for i := 0; i < n; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		messages = append(messages, Message{
+			Role:    role,
+			Content: fmt.Sprintf("Message %d: %s", i, strings.Repeat("lorem ipsum dolor sit amet ", 20)),
+		})
+	}
+
+	return ChatRequest{
+		Model:    "anthropic.claude-3-sonnet-20240229-v1:0",
+		Messages: messages,
+	}
+}
+
+// embeddingResponseBody builds a Cohere embeddings response with n vectors of the given dimension
+func embeddingResponseBody(b *testing.B, n, dimension int) []byte {
+	embeddings := make([][]float64, n)
+	for i := range embeddings {
+		embeddings[i] = make([]float64, dimension)
+		for j := range embeddings[i] {
+			embeddings[i][j] = float64(i*dimension+j) / 1e6
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"embeddings": embeddings})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return body
+}
+
+func BenchmarkFormatPayloadForModelLargeConversation(b *testing.B) {
+	req := largeConversation(200)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := formatPayloadForModel(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFormatPayloadForModelToolResultTruncation(b *testing.B) {
+	req := largeConversation(20)
+	req.Messages = append(req.Messages, Message{Role: "tool", Content: strings.Repeat("x", 1<<20)})
+
+	restoreConfig(b)
+	AppConfig.MaxToolResultChars = 4096
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := formatPayloadForModel(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseResponseFromModel(b *testing.B) {
+	body, err := json.Marshal(map[string]interface{}{
+		"content": []map[string]string{
+			{"type": "thinking", "thinking": strings.Repeat("reasoning ", 500)},
+			{"type": "text", "text": strings.Repeat("answer ", 2000)},
+		},
+		"usage": map[string]int{"input_tokens": 1200, "output_tokens": 2500},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseResponseFromModel(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseEmbeddingResponseLargeBatch(b *testing.B) {
+	body := embeddingResponseBody(b, 96, 1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseEmbeddingResponse("cohere.embed-english-v3", body, "float", nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseEmbeddingResponseBase64(b *testing.B) {
+	body := embeddingResponseBody(b, 96, 1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseEmbeddingResponse("cohere.embed-english-v3", body, "base64", nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bulkEmbeddingBatch is how many input lines the bulk embeddings endpoint embeds at a time
+const bulkEmbeddingBatch = cohereMaxTexts
+
+// bulkEmbeddingMaxLine is the longest input line the bulk embeddings endpoint accepts, in bytes
+const bulkEmbeddingMaxLine = 1 << 20
+
+// bulkInputReader reads the inputs of a bulk embeddings request one line at a time: a text per line for
+// text/plain, and a JSON string or {"text": ..., "input_type": ...} object per line for NDJSON. Blank lines
+// are skipped but still counted, so every input is identified by its line number.
+type bulkInputReader struct {
+	scanner *bufio.Scanner
+	ndjson  bool
+	line    int
+}
+
+// newBulkInputReader reads inputs from body, which has the given media type
+func newBulkInputReader(body io.Reader, mediaType string) *bulkInputReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), bulkEmbeddingMaxLine)
+	return &bulkInputReader{scanner: scanner, ndjson: mediaType == embeddingsNDJSON, line: -1}
+}
+
+// next returns up to n inputs along with the line number of each, and io.EOF once the body is exhausted
+func (r *bulkInputReader) next(n int) ([]interface{}, []int, error) {
+	var inputs []interface{}
+	var lines []int
+	for len(inputs) < n && r.scanner.Scan() {
+		r.line++
+		text := r.scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if !r.ndjson {
+			inputs, lines = append(inputs, text), append(lines, r.line)
+			continue
+		}
+
+		var input interface{}
+		if err := json.Unmarshal([]byte(text), &input); err != nil {
+			return nil, nil, fmt.Errorf("line %d: invalid JSON: %v", r.line, err)
+		}
+		// Check each item on its own, so a bad one is reported by its line rather than its place in the batch
+		if err := (EmbeddingsRequest{Input: []interface{}{input}}).Validate(); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", r.line, strings.TrimPrefix(err.Error(), "input[0]: "))
+		}
+		inputs, lines = append(inputs, input), append(lines, r.line)
+	}
+	if err := r.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, nil, fmt.Errorf("line %d: longer than the limit of %d bytes", r.line+1, bulkEmbeddingMaxLine)
+		}
+		return nil, nil, err
+	}
+	if len(inputs) == 0 {
+		return nil, nil, io.EOF
+	}
+	return inputs, lines, nil
+}
+
+// bulkEmbeddingsRequest reads the parameters of a bulk embeddings request from its query string
+func bulkEmbeddingsRequest(c *gin.Context, defaultInputType string) (EmbeddingsRequest, error) {
+	req := EmbeddingsRequest{
+		Model:          c.Query("model"),
+		EncodingFormat: c.Query("encoding_format"),
+		InputType:      c.DefaultQuery("input_type", defaultInputType),
+		Truncate:       c.Query("truncate"),
+	}
+	if req.Model == "" {
+		return req, errors.New("the model query parameter is required")
+	}
+	if value := c.Query("dimensions"); value != "" {
+		dimensions, err := strconv.Atoi(value)
+		if err != nil {
+			return req, fmt.Errorf("invalid dimensions %q", value)
+		}
+		req.Dimensions = dimensions
+	}
+	if value := c.Query("allow_partial"); value != "" {
+		allowPartial, err := strconv.ParseBool(value)
+		if err != nil {
+			return req, fmt.Errorf("invalid allow_partial %q", value)
+		}
+		req.AllowPartial = allowPartial
+	}
+	return req, nil
+}
+
+// handleBulkEmbeddings embeds a newline-delimited body, text/plain or NDJSON, in batches as it is read, and
+// streams the embeddings back as NDJSON, so memory use stays bounded by the batch size rather than the body.
+// Each embedding's index is the line number of its input. The last line holds the model, the total usage and
+// any failed indices; a failure after the response has started is reported as a final {"error": ...} line.
+func handleBulkEmbeddings(bedrockService *BedrockService, defaultInputType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mediaType := c.ContentType()
+		if mediaType != "text/plain" && mediaType != embeddingsNDJSON {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "the bulk embeddings endpoint accepts text/plain or " + embeddingsNDJSON})
+			return
+		}
+		embeddingsReq, err := bulkEmbeddingsRequest(c, defaultInputType)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkModelAllowed(c, embeddingsReq.Model) {
+			return
+		}
+		releaseSlot, ok := admit(c, embeddingsReq.Model)
+		if !ok {
+			return
+		}
+		defer releaseSlot()
+
+		reader := newBulkInputReader(c.Request.Body, mediaType)
+		encoder := json.NewEncoder(c.Writer)
+		summary := EmbeddingsResponse{Object: "list", Data: []Embedding{}, Model: embeddingsReq.Model}
+		started := false
+
+		// fail reports an error as a JSON response while nothing has been written, and as an NDJSON line after
+		fail := func(status int, err error) {
+			if !started {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Bulk embeddings failed after %d lines: %v", reader.line, err)
+			encoder.Encode(gin.H{"error": err.Error()})
+		}
+
+		for {
+			inputs, lines, err := reader.next(bulkEmbeddingBatch)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fail(http.StatusBadRequest, err)
+				return
+			}
+
+			batchReq := embeddingsReq
+			batchReq.Input = inputs
+			if err := batchReq.Validate(); err != nil {
+				fail(http.StatusBadRequest, err)
+				return
+			}
+			ctx, cancel := withOperationTimeout(c.Request.Context(), AppConfig.EmbeddingsTimeout)
+			response, err := bedrockService.ProcessEmbeddings(ctx, batchReq)
+			cancel()
+			if err != nil {
+				fail(timeoutErrorStatus(err, http.StatusInternalServerError), err)
+				return
+			}
+
+			if !started {
+				c.Header("Content-Type", embeddingsNDJSON)
+				c.Status(http.StatusOK)
+				started = true
+			}
+			for i, embedding := range response.Data {
+				embedding.Index = lines[i]
+				if err := encoder.Encode(embedding); err != nil {
+					log.Printf("Error writing embeddings: %v", err)
+					return
+				}
+			}
+			for _, index := range response.FailedIndices {
+				summary.FailedIndices = append(summary.FailedIndices, lines[index])
+			}
+			summary.Usage.PromptTokens += response.Usage.PromptTokens
+			summary.Usage.TotalTokens += response.Usage.TotalTokens
+			c.Writer.Flush()
+		}
+
+		if !started {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "input must contain at least one line"})
+			return
+		}
+		if err := encoder.Encode(summary); err != nil {
+			log.Printf("Error writing embeddings: %v", err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBulkEmbeddings(t *testing.T) {
+	// 97 inputs with a blank line between the first two: a full Cohere batch and then one more
+	var body strings.Builder
+	body.WriteString(`"first"` + "\n\n")
+	for i := 1; i < 97; i++ {
+		fmt.Fprintf(&body, `{"text": "line %d"}`+"\n", i)
+	}
+	vectors := strings.TrimSuffix(strings.Repeat("[0.5],", 96), ",")
+	service, invoker := newTestService(`{"embeddings":[`+vectors+`]}`, `{"embeddings":[[0.25]]}`)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/embeddings/bulk?model=cohere.embed-english-v3", strings.NewReader(body.String()))
+	c.Request.Header.Set("Content-Type", embeddingsNDJSON)
+	handleBulkEmbeddings(service, "search_document")(c)
+
+	if len(invoker.inputs) != 2 {
+		t.Fatalf("got %d invocations, want one per batch", len(invoker.inputs))
+	}
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if len(lines) != 98 {
+		t.Fatalf("got %d lines, want 97 embeddings and a summary", len(lines))
+	}
+	var first, last Embedding
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[96]), &last)
+	if first.Index != 0 || last.Index != 97 || last.Embedding.([]interface{})[0] != 0.25 {
+		t.Errorf("first = %+v, last = %+v, want indices by input line", first, last)
+	}
+	var summary EmbeddingsResponse
+	if err := json.Unmarshal([]byte(lines[97]), &summary); err != nil || summary.Model != "cohere.embed-english-v3" {
+		t.Errorf("summary = %s, want the model and usage", lines[97])
+	}
+
+	recorder = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/embeddings/bulk?model=cohere.embed-english-v3", strings.NewReader("\"ok\"\n{\"text\": 3}\n"))
+	c.Request.Header.Set("Content-Type", embeddingsNDJSON)
+	handleBulkEmbeddings(service, "search_document")(c)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "line 1:") {
+		t.Errorf("got %d %s, want 400 naming line 1", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errRequestCancelled is the cancellation cause of a request stopped through the cancel endpoint
+var errRequestCancelled = errors.New("request cancelled by client")
+
+// requestRegistry tracks the contexts of in-flight generations by their completion ID so they can be cancelled out of band
+type requestRegistry struct {
+	mu      sync.Mutex
+	cancels map[string]registeredRequest
+}
+
+// registeredRequest is an in-flight generation with the principal that started it, the only one that may cancel it
+type registeredRequest struct {
+	principal string
+	cancel    context.CancelCauseFunc
+}
+
+// activeRequests holds the in-flight generations of this process
+var activeRequests = &requestRegistry{cancels: make(map[string]registeredRequest)}
+
+// register derives a cancellable context for the generation with the given ID, started by principal. The returned
+// release function must be called when the generation ends; it removes the entry and releases the context.
+func (r *requestRegistry) register(ctx context.Context, id, principal string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	r.mu.Lock()
+	r.cancels[id] = registeredRequest{principal: principal, cancel: cancel}
+	r.mu.Unlock()
+
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.cancels, id)
+		r.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancel stops the generation with the given ID, reporting whether it was in flight and started by principal;
+// another caller's generation is reported as not found
+func (r *requestRegistry) cancel(id, principal string) bool {
+	r.mu.Lock()
+	request, ok := r.cancels[id]
+	r.mu.Unlock()
+
+	if !ok || request.principal != principal {
+		return false
+	}
+	request.cancel(errRequestCancelled)
+	return true
+}
+
+// handleCancelChatCompletion stops an in-flight generation by the ID of its chunks, if the caller started it
+func handleCancelChatCompletion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if !activeRequests.cancel(id, requestPrincipal(c)) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no in-flight request with this id"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": id, "object": objectName(objectChatCompletion), "cancelled": true})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRequestRegistryCancel(t *testing.T) {
+	registry := &requestRegistry{cancels: make(map[string]registeredRequest)}
+	ctx, release := registry.register(context.Background(), "chatcmpl-1", "key:owner")
+
+	if registry.cancel("chatcmpl-2", "key:owner") {
+		t.Error("expected cancelling an unknown id to report false")
+	}
+	if registry.cancel("chatcmpl-1", "key:other") || ctx.Err() != nil {
+		t.Error("expected another caller not to cancel the request")
+	}
+	if !registry.cancel("chatcmpl-1", "key:owner") {
+		t.Fatal("expected the registered request to be cancelled")
+	}
+	if context.Cause(ctx) != errRequestCancelled {
+		t.Errorf("cause = %v, want errRequestCancelled", context.Cause(ctx))
+	}
+
+	release()
+	if registry.cancel("chatcmpl-1", "key:owner") {
+		t.Error("expected a released request to no longer be cancellable")
+	}
+}
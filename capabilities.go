@@ -0,0 +1,117 @@
+package main
+
+import "strings"
+
+// ModelCapabilities describes the limits and behavior of a model family
+type ModelCapabilities struct {
+	// ContextWindow is the maximum number of input plus output tokens
+	ContextWindow int
+	// MaxOutputTokens is the largest max_tokens value the model accepts
+	MaxOutputTokens int
+	// StreamFormat names the model's family in builtinFormatters, which sets its payload and chunk formats
+	StreamFormat string
+	// Accept is the response MIME type requested from InvokeModel; empty means defaultAccept
+	Accept string
+	// Logprobs reports whether the model can return token log probabilities; no model invoked through
+	// InvokeModel does today, so requests for them are rejected rather than silently answered without
+	Logprobs bool
+	// ScaleTemperature maps OpenAI's 0-2 temperature onto the model's native range; nil means unitTemperature,
+	// so only models with another range set it
+	ScaleTemperature func(float32) float32
+}
+
+// openAIMaxTemperature is the top of OpenAI's temperature range
+const openAIMaxTemperature = 2
+
+// linearTemperature maps OpenAI's 0-2 range linearly onto a native range of 0 to nativeMax, so 1 becomes nativeMax/2
+func linearTemperature(nativeMax float32) func(float32) float32 {
+	return func(temperature float32) float32 {
+		temperature = min(max(temperature, 0), openAIMaxTemperature)
+		return temperature * nativeMax / openAIMaxTemperature
+	}
+}
+
+// defaultAccept is the response MIME type requested from models that don't specify one
+const defaultAccept = "application/json"
+
+// unitTemperature scales onto the 0-1 range that Claude, Llama, Mistral, Titan, Nova and Command R use, and is
+// the scaling of every model whose capabilities don't set one
+var unitTemperature = linearTemperature(1)
+
+// modelCapabilities maps model ID prefixes to their capabilities; the longest matching prefix wins
+var modelCapabilities = map[string]ModelCapabilities{
+	"anthropic.claude-opus-4":     {ContextWindow: 200000, MaxOutputTokens: 32000, StreamFormat: "claude"},
+	"anthropic.claude-sonnet-4":   {ContextWindow: 200000, MaxOutputTokens: 64000, StreamFormat: "claude"},
+	"anthropic.claude-3-7-sonnet": {ContextWindow: 200000, MaxOutputTokens: 64000, StreamFormat: "claude"},
+	"anthropic.claude-3-5-sonnet": {ContextWindow: 200000, MaxOutputTokens: 8192, StreamFormat: "claude"},
+	"anthropic.claude-3-5-haiku":  {ContextWindow: 200000, MaxOutputTokens: 8192, StreamFormat: "claude"},
+	"anthropic.claude-3-opus":     {ContextWindow: 200000, MaxOutputTokens: 4096, StreamFormat: "claude"},
+	"anthropic.claude-3-sonnet":   {ContextWindow: 200000, MaxOutputTokens: 4096, StreamFormat: "claude"},
+	"anthropic.claude-3-haiku":    {ContextWindow: 200000, MaxOutputTokens: 4096, StreamFormat: "claude"},
+	"anthropic.claude-v2":         {ContextWindow: 100000, MaxOutputTokens: 4096, StreamFormat: "claude"},
+	"anthropic.claude-instant":    {ContextWindow: 100000, MaxOutputTokens: 4096, StreamFormat: "claude"},
+	"meta.llama3-1":               {ContextWindow: 128000, MaxOutputTokens: 2048, StreamFormat: "llama"},
+	"meta.llama3-2":               {ContextWindow: 128000, MaxOutputTokens: 2048, StreamFormat: "llama"},
+	"meta.llama3-3":               {ContextWindow: 128000, MaxOutputTokens: 2048, StreamFormat: "llama"},
+	"meta.llama3":                 {ContextWindow: 8000, MaxOutputTokens: 2048, StreamFormat: "llama"},
+	"mistral.mistral-large":       {ContextWindow: 128000, MaxOutputTokens: 8192, StreamFormat: "mistral"},
+	"mistral.mixtral":             {ContextWindow: 32000, MaxOutputTokens: 4096, StreamFormat: "mistral"},
+	"mistral.mistral":             {ContextWindow: 32000, MaxOutputTokens: 8192, StreamFormat: "mistral"},
+	"amazon.titan-text-premier":   {ContextWindow: 32000, MaxOutputTokens: 3072, StreamFormat: "titan"},
+	"amazon.titan-text":           {ContextWindow: 8000, MaxOutputTokens: 3072, StreamFormat: "titan"},
+	"amazon.nova":                 {ContextWindow: 300000, MaxOutputTokens: 5000, StreamFormat: "nova"},
+	"amazon.nova-micro":           {ContextWindow: 128000, MaxOutputTokens: 5000, StreamFormat: "nova"},
+	"cohere.command-r":            {ContextWindow: 128000, MaxOutputTokens: 4000, StreamFormat: "cohere"},
+}
+
+// LookupCapabilities returns the capabilities of a model, ignoring any cross-region profile prefix
+func LookupCapabilities(model string) (ModelCapabilities, bool) {
+	for _, prefix := range crossRegionPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			model = strings.TrimPrefix(model, prefix)
+			break
+		}
+	}
+
+	var best string
+	for prefix := range modelCapabilities {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return ModelCapabilities{}, false
+	}
+
+	return modelCapabilities[best], true
+}
+
+// AcceptType returns the response MIME type to request when invoking a model
+func AcceptType(model string) string {
+	if capabilities, ok := LookupCapabilities(model); ok && capabilities.Accept != "" {
+		return capabilities.Accept
+	}
+	return defaultAccept
+}
+
+// greedyTopK is the top_k sent with temperature 0 to model families that take one for greedy decoding, limiting
+// sampling to the most likely token; other families get no top_k at temperature 0
+var greedyTopK = map[string]int{
+	"nova": 1,
+}
+
+// ScaleTemperature converts an OpenAI temperature to the model's native scale when TEMPERATURE_SCALING is enabled
+func ScaleTemperature(model string, temperature float32) float32 {
+	if !AppConfig.TemperatureScaling {
+		return temperature
+	}
+	capabilities, ok := LookupCapabilities(model)
+	if !ok {
+		// The native range of an unknown model can't be known, so its temperature passes through
+		return temperature
+	}
+	if capabilities.ScaleTemperature != nil {
+		return capabilities.ScaleTemperature(temperature)
+	}
+	return unitTemperature(temperature)
+}
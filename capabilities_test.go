@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestScaleTemperature(t *testing.T) {
+	model := "anthropic.claude-3-haiku-20240307-v1:0"
+	if got := ScaleTemperature(model, 1.4); got != 1.4 {
+		t.Errorf("scaling disabled: got %v, want the temperature unchanged", got)
+	}
+
+	restoreConfig(t)
+	AppConfig.TemperatureScaling = true
+
+	tests := []struct {
+		model       string
+		temperature float32
+		want        float32
+	}{
+		{model: model, temperature: 0, want: 0},
+		{model: model, temperature: 1, want: 0.5},
+		{model: "us." + model, temperature: 2, want: 1},
+		{model: model, temperature: 3, want: 1},
+		{model: "unknown.model-v1", temperature: 1.5, want: 1.5},
+	}
+	for _, tt := range tests {
+		if got := ScaleTemperature(tt.model, tt.temperature); got != tt.want {
+			t.Errorf("ScaleTemperature(%s, %v) = %v, want %v", tt.model, tt.temperature, got, tt.want)
+		}
+	}
+}
+
+func TestModelCapabilitiesLeaveRoomForPrompts(t *testing.T) {
+	for prefix, capabilities := range modelCapabilities {
+		if capabilities.MaxOutputTokens >= capabilities.ContextWindow {
+			t.Errorf("%s: MaxOutputTokens %d fills its %d token context window", prefix, capabilities.MaxOutputTokens, capabilities.ContextWindow)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import "encoding/json"
+
+// claudeMessage is a message in Claude's messages API format
+type claudeMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+// toClaudeMessages converts non-system OpenAI messages into Claude messages.
+// Claude has no participant names, so a user message's name is folded into its content
+// to keep speakers distinguishable in multi-participant conversations.
+// Assistant tool calls become tool_use blocks, and tool messages become tool_result blocks in the
+// following user turn, where consecutive results and any user text after them share one message.
+func toClaudeMessages(messages []Message) []claudeMessage {
+	result := make([]claudeMessage, 0, len(messages))
+	toolResultTurn := -1
+	for _, msg := range messages {
+		content := msg.Content
+		if content == nil {
+			content = ""
+		}
+
+		switch {
+		case msg.Role == "tool":
+			block := map[string]interface{}{
+				"type":        "tool_result",
+				"tool_use_id": msg.ToolCallID,
+				"content":     content,
+			}
+			if toolResultTurn >= 0 && toolResultTurn == len(result)-1 {
+				result[toolResultTurn].Content = append(result[toolResultTurn].Content.([]interface{}), block)
+				continue
+			}
+			result = append(result, claudeMessage{Role: "user", Content: []interface{}{block}})
+			toolResultTurn = len(result) - 1
+			continue
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			content = toolUseContent(content, msg.ToolCalls)
+		case msg.Name != "" && msg.Role == "user":
+			content = prefixContent(content, msg.Name+": ")
+		}
+
+		// Claude expects tool results first in the user turn following the tool calls, then any new user input
+		if msg.Role == "user" && toolResultTurn >= 0 && toolResultTurn == len(result)-1 {
+			result[toolResultTurn].Content = append(result[toolResultTurn].Content.([]interface{}), contentBlocks(content)...)
+			toolResultTurn = -1
+			continue
+		}
+		result = append(result, claudeMessage{Role: msg.Role, Content: content})
+	}
+	return result
+}
+
+// toolUseContent builds an assistant turn's content blocks: any text, followed by a tool_use block per tool call
+func toolUseContent(content interface{}, toolCalls []ToolCall) []interface{} {
+	blocks := contentBlocks(content)
+	for _, toolCall := range toolCalls {
+		var input interface{}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &input); err != nil || input == nil {
+			// Claude requires an object input; arguments that don't decode are sent as an empty one
+			input = map[string]interface{}{}
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    toolCall.ID,
+			"name":  toolCall.Function.Name,
+			"input": input,
+		})
+	}
+	return blocks
+}
+
+// contentBlocks returns content as a list of content blocks, dropping empty text
+func contentBlocks(content interface{}) []interface{} {
+	switch c := content.(type) {
+	case string:
+		if c == "" {
+			return []interface{}{}
+		}
+		return []interface{}{map[string]interface{}{"type": "text", "text": c}}
+	case []interface{}:
+		return append([]interface{}{}, c...)
+	default:
+		return []interface{}{}
+	}
+}
+
+// prefixContent prepends text to string content, or as a leading text block to block content
+func prefixContent(content interface{}, prefix string) interface{} {
+	switch c := content.(type) {
+	case string:
+		return prefix + c
+	case []interface{}:
+		blocks := make([]interface{}, 0, len(c)+1)
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": prefix})
+		return append(blocks, c...)
+	default:
+		return content
+	}
+}
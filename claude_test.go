@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestFormatPayloadForModelToolRoundTrip(t *testing.T) {
+	data, err := formatPayloadForModel(context.Background(), ChatRequest{
+		Model: "anthropic.claude-3-haiku-20240307-v1:0",
+		Messages: []Message{
+			{Role: "user", Content: []interface{}{map[string]interface{}{"type": "text", "text": "Weather in Paris and Rome?"}}},
+			{Role: "assistant", Content: "Checking.", ToolCalls: []ToolCall{
+				{ID: "toolu_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+				{ID: "toolu_2", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Rome"}`}},
+			}},
+			{Role: "tool", ToolCallID: "toolu_1", Content: "18C"},
+			{Role: "tool", ToolCallID: "toolu_2", Content: "24C"},
+			{Role: "user", Content: "Which is warmer?"},
+		},
+		Tools:      []Tool{{Type: "function", Function: Function{Name: "get_weather"}}},
+		ToolChoice: map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_weather"}},
+	})
+	if err != nil {
+		t.Fatalf("formatPayloadForModel returned error: %v", err)
+	}
+
+	var payload struct {
+		Messages []struct {
+			Role    string `json:"role"`
+			Content []struct {
+				Type      string                 `json:"type"`
+				Text      string                 `json:"text"`
+				ID        string                 `json:"id"`
+				Input     map[string]interface{} `json:"input"`
+				ToolUseID string                 `json:"tool_use_id"`
+				Content   string                 `json:"content"`
+			} `json:"content"`
+		} `json:"messages"`
+		ToolChoice map[string]string `json:"tool_choice"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payload.Messages) != 3 {
+		t.Fatalf("messages = %d, want user, assistant and a merged user turn", len(payload.Messages))
+	}
+
+	assistant := payload.Messages[1]
+	if len(assistant.Content) != 3 || assistant.Content[0].Type != "text" || assistant.Content[1].Type != "tool_use" || assistant.Content[2].ID != "toolu_2" {
+		t.Errorf("assistant content = %+v, want text then tool_use blocks in order", assistant.Content)
+	}
+	if assistant.Content[1].Input["city"] != "Paris" {
+		t.Errorf("tool_use input = %v, want decoded arguments", assistant.Content[1].Input)
+	}
+
+	results := payload.Messages[2]
+	if results.Role != "user" || len(results.Content) != 3 {
+		t.Fatalf("tool results turn = %+v, want one user message with two results and the question", results)
+	}
+	if results.Content[0].ToolUseID != "toolu_1" || results.Content[1].ToolUseID != "toolu_2" || results.Content[1].Content != "24C" {
+		t.Errorf("tool results = %+v, want results correlated to their tool_use ids in order", results.Content)
+	}
+	if results.Content[2].Type != "text" || results.Content[2].Text != "Which is warmer?" {
+		t.Errorf("trailing content = %+v, want the user question after the results", results.Content[2])
+	}
+
+	if payload.ToolChoice["type"] != "tool" || payload.ToolChoice["name"] != "get_weather" {
+		t.Errorf("tool_choice = %v, want the named tool", payload.ToolChoice)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CompletionRequest represents a request to OpenAI's legacy text completions API
+type CompletionRequest struct {
+	Model         string         `json:"model" binding:"required"`
+	Prompt        interface{}    `json:"prompt" binding:"required"`
+	Suffix        string         `json:"suffix,omitempty"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Temperature   *float32       `json:"temperature,omitempty"`
+	TopP          *float32       `json:"top_p,omitempty"`
+	Stop          StopSequences  `json:"stop,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	User          string         `json:"user,omitempty"`
+}
+
+// TextCompletionResponse represents a response in OpenAI's text_completion format, or one streamed chunk of it
+type TextCompletionResponse struct {
+	ID                string                 `json:"id"`
+	Object            string                 `json:"object"`
+	Created           int64                  `json:"created"`
+	Model             string                 `json:"model"`
+	SystemFingerprint string                 `json:"system_fingerprint,omitempty"`
+	Choices           []TextCompletionChoice `json:"choices"`
+	Usage             *Usage                 `json:"usage,omitempty"`
+}
+
+// TextCompletionChoice represents a choice in a text completion response or chunk
+type TextCompletionChoice struct {
+	Index        int         `json:"index"`
+	Text         string      `json:"text"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+// Prompts returns the request's prompts: a single string, or an array of strings that each produce a choice
+func (r CompletionRequest) Prompts() ([]string, error) {
+	switch prompt := r.Prompt.(type) {
+	case string:
+		return []string{prompt}, nil
+	case []interface{}:
+		if len(prompt) == 0 {
+			return nil, fmt.Errorf("prompt must contain at least one string")
+		}
+		prompts := make([]string, len(prompt))
+		for i, item := range prompt {
+			text, ok := item.(string)
+			if !ok {
+				// Token IDs can't be decoded without the model's tokenizer, which Bedrock doesn't expose
+				return nil, fmt.Errorf("prompt[%d]: token array prompts are not supported, send text prompts", i)
+			}
+			prompts[i] = text
+		}
+		return prompts, nil
+	default:
+		return nil, fmt.Errorf("prompt must be a string or an array of strings, got %s", jsonTypeName(prompt))
+	}
+}
+
+// ChatRequest converts the completion, with its first prompt, into a single-turn chat request so both APIs
+// share one model path; further prompts are sent with the same request by replacing its messages. The chat
+// request is not yet validated, since that depends on the model it is routed to.
+func (r CompletionRequest) ChatRequest() (ChatRequest, error) {
+	if r.Suffix != "" {
+		return ChatRequest{}, fmt.Errorf("suffix is not supported")
+	}
+	prompts, err := r.Prompts()
+	if err != nil {
+		return ChatRequest{}, err
+	}
+	if r.Stream && len(prompts) > 1 {
+		return ChatRequest{}, fmt.Errorf("stream is not supported with more than one prompt")
+	}
+
+	chatReq := ChatRequest{
+		Model:         r.Model,
+		Messages:      promptMessages(prompts[0]),
+		MaxTokens:     r.MaxTokens,
+		Temperature:   r.Temperature,
+		TopP:          r.TopP,
+		Stop:          r.Stop,
+		Stream:        r.Stream,
+		StreamOptions: r.StreamOptions,
+		User:          r.User,
+	}
+	return chatReq, nil
+}
+
+// promptMessages returns the chat messages that send a completion prompt to the model
+func promptMessages(prompt string) []Message {
+	return []Message{{Role: "user", Content: prompt}}
+}
+
+// GenerateCompletionID generates a unique text completion ID
+func GenerateCompletionID() string {
+	return fmt.Sprintf("cmpl-%s%s", time.Now().Format("20060102150405"), randomSuffix())
+}
+
+// handleCompletions handles the legacy text completions endpoint, streaming when the request sets stream: true
+func handleCompletions(bedrockService *BedrockService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var completionReq CompletionRequest
+		if err := bindJSON(c, &completionReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		chatReq, err := completionReq.ChatRequest()
+		if err == nil {
+			// Route first, so the request is validated for the model that serves it
+			applyModelRoute(c, &chatReq)
+			err = chatReq.Validate()
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkModelAllowed(c, chatReq.Model) {
+			return
+		}
+		logRequest(c, "Received completion request: %s", SanitizeChatRequest(chatReq, AppConfig.Debug))
+
+		if chatReq.Stream {
+			streamModel(c, bedrockService, chatReq, newTextCompletionStreamWriter)
+			return
+		}
+
+		prompts, _ := completionReq.Prompts()
+		if len(prompts) == 1 {
+			served, result, _, ok := runChat(c, bedrockService, chatReq)
+			if !ok {
+				return
+			}
+			c.JSON(http.StatusOK, textCompletionResponse(served, []TextCompletionChoice{textCompletionChoice(0, result)}, result.Usage, result.Created))
+			return
+		}
+
+		// Each prompt is completed concurrently by its own invocation, admitted by the queues like any other
+		// request, and becomes the choice at its index
+		chatReq.ApplyServiceTier()
+		setMaxTokensHeader(c, chatReq)
+		runs := make([]chatRun, len(prompts))
+		var wg sync.WaitGroup
+		for i, prompt := range prompts {
+			promptReq := chatReq
+			promptReq.Messages = promptMessages(prompt)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runs[i] = invokeChat(c.Request, bedrockService, promptReq)
+			}()
+		}
+		wg.Wait()
+
+		choices := make([]TextCompletionChoice, len(prompts))
+		var usage Usage
+		var created time.Time // when the last of the choices completed
+		var waited, latency time.Duration
+		var retries int
+		for i, run := range runs {
+			// The request fails as a whole, with the first prompt that failed
+			if run.err != nil {
+				c.JSON(chatErrorStatus(run.err), gin.H{"error": fmt.Sprintf("prompt[%d]: %v", i, run.err)})
+				return
+			}
+			choices[i] = textCompletionChoice(i, run.result)
+			usage.PromptTokens += run.result.Usage.PromptTokens
+			usage.CompletionTokens += run.result.Usage.CompletionTokens
+			usage.TotalTokens += run.result.Usage.TotalTokens
+			if run.result.Created.After(created) {
+				created = run.result.Created
+			}
+			waited = max(waited, run.waited)
+			latency += run.result.BedrockLatency
+			retries += run.result.Retries
+		}
+
+		// The headers cover every prompt: the longest queue wait, and the summed latency, retries and cost
+		served := runs[0].served
+		for _, run := range runs {
+			if run.served.Model != chatReq.Model {
+				served = run.served
+			}
+		}
+		setFallbackHeader(c, chatReq.Model, served)
+		if waited > 0 {
+			c.Writer.Header().Set("x-queue-wait-ms", strconv.FormatInt(waited.Milliseconds(), 10))
+		}
+		c.Header("x-bedrock-invocation-path", runs[0].usage.InvocationPath)
+		c.Header("x-bedrock-latency-ms", strconv.FormatInt(latency.Milliseconds(), 10))
+		c.Header("x-gateway-retries", strconv.Itoa(retries))
+		if cost := NewUsageRecord(served, usage, false).EstimatedCostUSD; cost != nil {
+			c.Header("x-estimated-cost-usd", fmt.Sprintf("%.6f", *cost))
+		}
+
+		c.JSON(http.StatusOK, textCompletionResponse(served, choices, usage, created))
+	}
+}
+
+// textCompletionChoice returns the choice at index for the result of a prompt
+func textCompletionChoice(index int, result *ChatResult) TextCompletionChoice {
+	// Legacy completions have no refusal field, so a refusal is returned as the text
+	text := result.Content
+	if result.Refusal != "" {
+		text = result.Refusal
+	}
+	finishReason := result.FinishReason
+	return TextCompletionChoice{Index: index, Text: text, FinishReason: &finishReason}
+}
+
+// textCompletionResponse returns the text_completion response with the given choices, served by served
+func textCompletionResponse(served ChatRequest, choices []TextCompletionChoice, usage Usage, created time.Time) TextCompletionResponse {
+	return TextCompletionResponse{
+		ID:                GenerateCompletionID(),
+		Object:            objectName(objectTextCompletion),
+		Created:           created.Unix(),
+		Model:             served.Model,
+		SystemFingerprint: SystemFingerprint(served),
+		Choices:           choices,
+		Usage:             &usage,
+	}
+}
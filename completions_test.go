@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHandleCompletionsPromptArray(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service, invoker := newTestService(
+		`{"content":[{"type":"text","text":"one"}],"stop_reason":"end_turn","usage":{"input_tokens":2,"output_tokens":1}}`,
+		`{"content":[{"type":"text","text":"two"}],"stop_reason":"max_tokens","usage":{"input_tokens":3,"output_tokens":2}}`,
+	)
+	r := gin.New()
+	r.POST("/completions", handleCompletions(service))
+
+	body := `{"model":"anthropic.claude-3-haiku-20240307-v1:0","prompt":["first","second"]}`
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/completions", strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body)
+	}
+
+	var response TextCompletionResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(invoker.inputs) != 2 || len(response.Choices) != 2 {
+		t.Fatalf("got %d invocations and %d choices, want one of each per prompt", len(invoker.inputs), len(response.Choices))
+	}
+	// The prompts run concurrently, so either may have been given either canned response
+	texts := map[string]*TextCompletionChoice{}
+	for i := range response.Choices {
+		choice := &response.Choices[i]
+		if choice.Index != i {
+			t.Errorf("choices[%d] has index %d", i, choice.Index)
+		}
+		texts[choice.Text] = choice
+	}
+	if texts["one"] == nil || texts["two"] == nil {
+		t.Fatalf("choices = %+v, want one per response", response.Choices)
+	}
+	if *texts["two"].FinishReason != "length" || response.Usage.TotalTokens != 8 {
+		t.Errorf("finish reason %s with usage %+v, want per-prompt finish reasons and summed usage", *texts["two"].FinishReason, response.Usage)
+	}
+
+	// A failed prompt fails the request
+	service.client = &mockInvoker{responses: [][]byte{[]byte(`{"content":[{"type":"text","text":"one"}],"stop_reason":"end_turn","usage":{"input_tokens":2,"output_tokens":1}}`)}}
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/completions", strings.NewReader(body)))
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), "prompt[") {
+		t.Errorf("status = %d: %s, want 500 naming the failed prompt", recorder.Code, recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	body = `{"model":"anthropic.claude-3-haiku-20240307-v1:0","prompt":[[1,2,3]]}`
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/completions", strings.NewReader(body)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("token array prompt: status = %d, want 400", recorder.Code)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 // Config holds all configuration for the application
@@ -18,10 +20,179 @@ type Config struct {
 
 	// Debug and AWS configuration
 	Debug                      bool
+	LogSampleRate              float64
+	LogHeaders                 []string
+	LogHeaderMaxBytes          int
 	AWSRegion                  string
+	AWSRetryMode               string
+	AWSMaxAttempts             int
 	DefaultModel               string
 	DefaultEmbeddingModel      string
 	EnableCrossRegionInference bool
+
+	// AllowedModels restricts which models clients may call to these IDs or ID prefixes; empty allows all
+	AllowedModels []string
+
+	// Embeddings configuration
+	EmbeddingChunkSize         int
+	EmbeddingTruncate          string
+	DeduplicateEmbeddingInputs bool
+	EmbeddingAWSRegion         string
+	EmbeddingModelRegions      map[string]string
+	EmbeddingDimensions        map[string]string
+
+	// System prompt templates per model family; loaded from SystemPromptTemplatesFile at startup
+	SystemPromptTemplatesFile string
+	SystemPromptTemplates     map[string]*template.Template
+
+	// SystemMessageStrategy combines several system messages: "join", "first", "last" or "reject"
+	SystemMessageStrategy string
+
+	// Named sampling profiles, merged over the defaults; loaded from SamplingProfilesFile at startup
+	SamplingProfilesFile string
+	SamplingProfiles     map[string]SamplingProfile
+
+	// Cost estimation configuration; Pricing is loaded from PricingFile at startup
+	PricingFile string
+	Pricing     map[string]ModelPricing
+
+	// Cost allocation tags: the metadata keys clients may set, tags applied to every request, and whether they are
+	// forwarded to AWS through tagged application inference profiles
+	CostTagKeys     []string
+	DefaultCostTags map[string]string
+	CostTagProfiles bool
+
+	// Audit logging configuration; disabled unless AuditLogFile is set
+	AuditLogFile       string
+	AuditLogLevel      string
+	AuditLogMaxSizeMB  int
+	AuditLogMaxBackups int
+
+	// Health check configuration
+	StartupHealthcheck bool
+	DeepHealthcheck    bool
+	DeepHealthcheckTTL time.Duration
+
+	// ModelsCacheTTL is how long the models endpoint reuses the model list fetched from Bedrock
+	ModelsCacheTTL time.Duration
+
+	// Batch inference jobs; disabled unless BatchRoleARN names the service role Bedrock runs them with
+	BatchRoleARN     string
+	BatchOutputS3URI string
+
+	// BatchS3Prefixes are the S3 locations batch jobs may read input from and write results to; since Bedrock
+	// reaches S3 with the service role, not the caller's credentials, any other URI is rejected
+	BatchS3Prefixes []string
+
+	// Knowledge bases the RAG endpoint answers from: KnowledgeBaseID by default, and any of KnowledgeBaseIDs when a
+	// request selects it; the endpoint is disabled without either
+	KnowledgeBaseID  string
+	KnowledgeBaseIDs []string
+
+	// KnowledgeBaseAccess maps principals, as identified in the audit log, to the "|"-separated knowledge bases
+	// of KnowledgeBaseIDs they may select; when set, principals it doesn't list may only query KnowledgeBaseID
+	KnowledgeBaseAccess map[string]string
+
+	// HTTP server timeouts; WriteTimeout is disabled by default because it would cut off long streams
+	ServerReadTimeout       time.Duration
+	ServerReadHeaderTimeout time.Duration
+	ServerWriteTimeout      time.Duration
+	ServerIdleTimeout       time.Duration
+
+	// Storage of completed responses requested with store: true
+	EnableResponseStore     bool
+	ResponseStoreTTL        time.Duration
+	ResponseStoreMaxEntries int
+
+	// Stream resumption: buffer streamed output so disconnected clients can reconnect with a token
+	StreamResumption           bool
+	StreamResumptionTTL        time.Duration
+	StreamResumptionMaxStreams int
+	StreamResumptionMaxBytes   int
+
+	// Request shaping configuration
+	TemperatureScaling    bool
+	ServerMaxOutputTokens int
+	MaxToolResultChars    int
+	ExposeReasoning       bool
+	StreamJSONDone        bool
+	StreamMaxDeltaBytes   int
+
+	// MaxStreamDurationSeconds cuts off streams that run longer, ending them with StreamDurationFinishReason
+	MaxStreamDurationSeconds   int
+	StreamDurationFinishReason string
+
+	// StrictModelSupport rejects models without a dedicated request format instead of sending the generic payload
+	StrictModelSupport bool
+
+	// ContextOverflowPolicy handles prompts too large for the model's context window: "none", "error",
+	// "truncate-oldest" or "truncate-middle"; ContextOverflowPolicies overrides it per model family
+	ContextOverflowPolicy   string
+	ContextOverflowPolicies map[string]string
+
+	// MessageAlternation makes Claude conversations alternate between user and assistant: "off", "merge",
+	// "insert" or "reject"
+	MessageAlternation string
+
+	// ToolArgumentValidation checks tool call arguments against their schema: "off", "annotate" or "repair"
+	ToolArgumentValidation string
+
+	// StrictRequestValidation rejects request bodies with fields the endpoint doesn't know, such as misspelled parameters
+	StrictRequestValidation bool
+
+	// StreamToolValidation checks the arguments of streamed tool calls once complete: "off", "error" or "repair"
+	StreamToolValidation string
+
+	// FieldAliases renames request body fields of non-standard clients: alias -> field name, e.g. maxTokens -> max_tokens
+	FieldAliases map[string]string
+
+	// DeduplicateRequests shares one Bedrock invocation between identical concurrent deterministic requests
+	DeduplicateRequests bool
+
+	// PayloadCacheSize is how many formatted conversation prefixes to keep for reuse by later turns; 0 disables it.
+	// PayloadCacheMaxBytes bounds their total encoded size, documents included; 0 removes the bound.
+	PayloadCacheSize     int
+	PayloadCacheMaxBytes int
+
+	// Weighted routing of logical model names across models; loaded from ModelRoutesFile at startup
+	ModelRoutesFile string
+	ModelRoutes     map[string][]WeightedModel
+
+	// Fallback chains: model ID -> "|"-separated models tried in order when it fails or its response is blocked
+	ModelFallbacks map[string]string
+
+	// ObjectNames renames response object types for non-standard clients: standard type -> name to report
+	ObjectNames map[string]string
+
+	// Fault injection for resilience testing; outside debug mode it also needs FaultInjectionAllowRelease
+	FaultInjection             bool
+	FaultInjectionAllowRelease bool
+	FaultInjectionRate         float64
+	FaultInjectionKinds        []string
+	FaultInjectionDelay        time.Duration
+
+	// Service tier routing: model ID -> model ID or provisioned/inference profile ARN used for "flex"
+	FlexTierModels map[string]string
+
+	// MaxDocumentBytes caps the size of each document passed to Claude as a file content part; zero disables the cap
+	MaxDocumentBytes int
+
+	// Per-request limits on image and document content parts: their number, and their total size; zero disables each
+	MaxContentParts int
+	MaxContentBytes int
+
+	// Concurrency limit on Bedrock requests, with a bounded queue for requests over it; zero disables the limit
+	MaxConcurrentRequests int
+	RequestQueueDepth     int
+	RequestQueueTimeout   time.Duration
+
+	// ModelConcurrencyLimits maps model ID prefixes to concurrency limits of their own, queued like the global one
+	ModelConcurrencyLimits map[string]string
+
+	// Per-operation limits on the time spent invoking models, after any wait in the queue; zero disables each
+	ChatTimeout       time.Duration
+	StreamTimeout     time.Duration
+	EmbeddingsTimeout time.Duration
 }
 
 // NewConfig creates a new configuration with values from environment variables
@@ -36,16 +207,133 @@ func NewConfig() *Config {
 		Description: "Use OpenAI-Compatible RESTful APIs for Amazon Bedrock models.",
 
 		Debug:                      getEnv("DEBUG", false),
+		LogSampleRate:              getEnv("LOG_SAMPLE_RATE", 1.0),
+		LogHeaders:                 getEnvList("LOG_HEADERS"),
+		LogHeaderMaxBytes:          getEnv("LOG_HEADER_MAX_BYTES", 256),
 		AWSRegion:                  getEnv("AWS_REGION", "us-east-1"),
+		AWSRetryMode:               getEnv("AWS_RETRY_MODE", ""),
+		AWSMaxAttempts:             getEnv("AWS_MAX_ATTEMPTS", 0),
 		DefaultModel:               getEnv("DEFAULT_MODEL", "anthropic.claude-3-sonnet-20240229-v1:0"),
 		DefaultEmbeddingModel:      getEnv("DEFAULT_EMBEDDING_MODEL", "cohere.embed-multilingual-v3"),
 		EnableCrossRegionInference: getEnv("ENABLE_CROSS_REGION_INFERENCE", false),
+
+		AllowedModels: getEnvList("ALLOWED_MODELS"),
+
+		EmbeddingChunkSize:         getEnv("EMBEDDING_CHUNK_SIZE", 2000),
+		EmbeddingTruncate:          getEnv("EMBEDDING_TRUNCATE", "END"),
+		DeduplicateEmbeddingInputs: getEnv("DEDUPLICATE_EMBEDDING_INPUTS", false),
+		EmbeddingAWSRegion:         getEnv("EMBEDDING_AWS_REGION", ""),
+		EmbeddingModelRegions:      getEnvMap("EMBEDDING_MODEL_REGIONS"),
+		EmbeddingDimensions:        getEnvMap("EMBEDDING_DIMENSIONS"),
+
+		SystemPromptTemplatesFile: getEnv("SYSTEM_PROMPT_TEMPLATES_FILE", ""),
+
+		SystemMessageStrategy: getEnv("SYSTEM_MESSAGE_STRATEGY", SystemMessagesJoin),
+
+		SamplingProfilesFile: getEnv("SAMPLING_PROFILES_FILE", ""),
+
+		PricingFile: getEnv("PRICING_FILE", ""),
+
+		CostTagKeys:     getEnvList("COST_TAG_KEYS"),
+		DefaultCostTags: getEnvMap("COST_TAGS"),
+		CostTagProfiles: getEnv("COST_TAG_PROFILES", false),
+
+		AuditLogFile:       getEnv("AUDIT_LOG_FILE", ""),
+		AuditLogLevel:      getEnv("AUDIT_LOG_LEVEL", AuditLevelMetadata),
+		AuditLogMaxSizeMB:  getEnv("AUDIT_LOG_MAX_SIZE_MB", 100),
+		AuditLogMaxBackups: getEnv("AUDIT_LOG_MAX_BACKUPS", 5),
+
+		StartupHealthcheck: getEnv("STARTUP_HEALTHCHECK", false),
+		DeepHealthcheck:    getEnv("DEEP_HEALTHCHECK", false),
+		DeepHealthcheckTTL: getEnv("DEEP_HEALTHCHECK_TTL", 5*time.Minute),
+
+		ModelsCacheTTL: getEnv("MODELS_CACHE_TTL", 5*time.Minute),
+
+		BatchRoleARN:     getEnv("BATCH_ROLE_ARN", ""),
+		BatchOutputS3URI: getEnv("BATCH_OUTPUT_S3_URI", ""),
+		BatchS3Prefixes:  getEnvList("BATCH_S3_PREFIXES"),
+
+		KnowledgeBaseID:     getEnv("KNOWLEDGE_BASE_ID", ""),
+		KnowledgeBaseIDs:    getEnvList("KNOWLEDGE_BASE_IDS"),
+		KnowledgeBaseAccess: getEnvMap("KNOWLEDGE_BASE_ACCESS"),
+
+		ServerReadTimeout:       getEnv("SERVER_READ_TIMEOUT", 60*time.Second),
+		ServerReadHeaderTimeout: getEnv("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+		ServerWriteTimeout:      getEnv("SERVER_WRITE_TIMEOUT", time.Duration(0)),
+		ServerIdleTimeout:       getEnv("SERVER_IDLE_TIMEOUT", 120*time.Second),
+
+		EnableResponseStore:     getEnv("ENABLE_RESPONSE_STORE", false),
+		ResponseStoreTTL:        getEnv("RESPONSE_STORE_TTL", time.Hour),
+		ResponseStoreMaxEntries: getEnv("RESPONSE_STORE_MAX_ENTRIES", 10000),
+
+		StreamResumption:           getEnv("STREAM_RESUMPTION", false),
+		StreamResumptionTTL:        getEnv("STREAM_RESUMPTION_TTL", 2*time.Minute),
+		StreamResumptionMaxStreams: getEnv("STREAM_RESUMPTION_MAX_STREAMS", 1000),
+		StreamResumptionMaxBytes:   getEnv("STREAM_RESUMPTION_MAX_BYTES", 1<<20),
+
+		TemperatureScaling:    getEnv("TEMPERATURE_SCALING", false),
+		ServerMaxOutputTokens: getEnv("SERVER_MAX_OUTPUT_TOKENS", 0),
+		MaxToolResultChars:    getEnv("MAX_TOOL_RESULT_CHARS", 0),
+		ExposeReasoning:       getEnv("EXPOSE_REASONING", false),
+		StreamJSONDone:        getEnv("STREAM_JSON_DONE", false),
+		StreamMaxDeltaBytes:   getEnv("STREAM_MAX_DELTA_BYTES", 16384),
+
+		MaxStreamDurationSeconds:   getEnv("MAX_STREAM_DURATION_SECONDS", 0),
+		StreamDurationFinishReason: getEnv("STREAM_DURATION_FINISH_REASON", "length"),
+
+		StrictModelSupport: getEnv("STRICT_MODEL_SUPPORT", false),
+
+		MessageAlternation: getEnv("MESSAGE_ALTERNATION", AlternationOff),
+
+		ToolArgumentValidation: getEnv("TOOL_ARGUMENT_VALIDATION", "off"),
+
+		ContextOverflowPolicy:   getEnv("CONTEXT_OVERFLOW_POLICY", OverflowNone),
+		ContextOverflowPolicies: getEnvMap("CONTEXT_OVERFLOW_POLICIES"),
+
+		StreamToolValidation: getEnv("STREAM_TOOL_VALIDATION", StreamToolValidationOff),
+
+		StrictRequestValidation: getEnv("STRICT_REQUEST_VALIDATION", false),
+
+		FieldAliases: getEnvMap("FIELD_ALIASES"),
+
+		DeduplicateRequests: getEnv("DEDUPLICATE_REQUESTS", false),
+
+		PayloadCacheSize:     getEnv("PAYLOAD_CACHE_SIZE", 0),
+		PayloadCacheMaxBytes: getEnv("PAYLOAD_CACHE_MAX_BYTES", 64<<20),
+
+		ModelRoutesFile: getEnv("MODEL_ROUTES_FILE", ""),
+
+		ModelFallbacks: getEnvMap("MODEL_FALLBACKS"),
+
+		ObjectNames: getEnvMap("OBJECT_NAMES"),
+
+		FaultInjection:             getEnv("FAULT_INJECTION", false),
+		FaultInjectionAllowRelease: getEnv("FAULT_INJECTION_ALLOW_RELEASE", false),
+		FaultInjectionRate:         getEnv("FAULT_INJECTION_RATE", 0.1),
+		FaultInjectionKinds:        getEnvList("FAULT_INJECTION_KINDS"),
+		FaultInjectionDelay:        getEnv("FAULT_INJECTION_DELAY", 2*time.Second),
+
+		FlexTierModels: getEnvMap("FLEX_TIER_MODELS"),
+
+		MaxDocumentBytes: getEnv("MAX_DOCUMENT_BYTES", 10<<20),
+		MaxContentParts:  getEnv("MAX_CONTENT_PARTS", 100),
+		MaxContentBytes:  getEnv("MAX_CONTENT_BYTES", 32<<20),
+
+		MaxConcurrentRequests: getEnv("MAX_CONCURRENT_REQUESTS", 0),
+		RequestQueueDepth:     getEnv("REQUEST_QUEUE_DEPTH", 100),
+		RequestQueueTimeout:   getEnv("REQUEST_QUEUE_TIMEOUT", 30*time.Second),
+
+		ModelConcurrencyLimits: getEnvMap("MODEL_CONCURRENCY_LIMITS"),
+
+		ChatTimeout:       getEnv("CHAT_TIMEOUT", time.Duration(0)),
+		StreamTimeout:     getEnv("STREAM_TIMEOUT", time.Duration(0)),
+		EmbeddingsTimeout: getEnv("EMBEDDINGS_TIMEOUT", time.Duration(0)),
 	}
 }
 
 // getEnv is a generic function that gets an environment variable with a default value
-// It supports string, bool, int, float64 types
-func getEnv[T string | bool | int | float64](key string, defaultValue T) T {
+// It supports string, bool, int, float64 and time.Duration types
+func getEnv[T string | bool | int | float64 | time.Duration](key string, defaultValue T) T {
 	value := os.Getenv(key)
 	if value == "" {
 		return defaultValue
@@ -74,6 +362,13 @@ func getEnv[T string | bool | int | float64](key string, defaultValue T) T {
 		} else {
 			result = defaultValue
 		}
+	case time.Duration:
+		// For duration type, parse the value (e.g. "30s", "5m")
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			result = any(durationValue).(T)
+		} else {
+			result = defaultValue
+		}
 	default:
 		// For unsupported types, return the default value
 		result = defaultValue
@@ -81,3 +376,52 @@ func getEnv[T string | bool | int | float64](key string, defaultValue T) T {
 
 	return result
 }
+
+// IsModelAllowed reports whether a model ID matches the allowlist, directly or without its cross-region prefix
+func (c *Config) IsModelAllowed(model string) bool {
+	if len(c.AllowedModels) == 0 {
+		return true
+	}
+
+	candidates := []string{model}
+	for _, prefix := range crossRegionPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			candidates = append(candidates, strings.TrimPrefix(model, prefix))
+			break
+		}
+	}
+	for _, allowed := range c.AllowedModels {
+		for _, candidate := range candidates {
+			if strings.HasPrefix(candidate, allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getEnvList parses a comma-separated environment variable into a list, skipping empty entries
+func getEnvList(key string) []string {
+	var result []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// getEnvMap parses an environment variable of the form "key1=value1,key2=value2" into a map
+// Entries without a key or value are skipped; an empty variable yields an empty map
+func getEnvMap(key string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		k, v, found := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !found || k == "" || v == "" {
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
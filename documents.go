@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// documentMediaTypes are the document types Claude accepts, and the source type each is sent with
+var documentMediaTypes = map[string]string{
+	"application/pdf": "base64",
+	"text/plain":      "text",
+}
+
+// dataURLPattern matches the header of a base64 data URL, capturing its media type
+var dataURLPattern = regexp.MustCompile(`^data:([a-zA-Z0-9.+-]+/[a-zA-Z0-9.+-]+);base64,\s*`)
+
+// errDocumentTooLarge is reported when a document is larger than the size limit it is read with
+var errDocumentTooLarge = errors.New("document is too large")
+
+// errContentTooLarge wraps errors for requests whose documents turn out, once fetched, to exceed the size limits,
+// which are reported to the client as a bad request
+var errContentTooLarge = errors.New("request content is too large")
+
+// mediaPartTypes are the content part types that carry images or documents, counted against the content limits
+var mediaPartTypes = map[string]bool{
+	"image_url": true,
+	"file":      true,
+}
+
+// filePart is OpenAI's file content part: {"type": "file", "file": {"file_data": ..., "filename": ...}}
+type filePart struct {
+	FileData string
+	Filename string
+}
+
+// parseFilePart reads an OpenAI file content part. file_data is a base64 data URL or, as an extension, an
+// http(s) URL to fetch; uploaded file IDs are not supported, since the gateway has no files API.
+func parseFilePart(part map[string]interface{}) (filePart, error) {
+	file, ok := part["file"].(map[string]interface{})
+	if !ok {
+		return filePart{}, errors.New("file content part must have a file object")
+	}
+	if _, ok := file["file_id"]; ok {
+		return filePart{}, errors.New("file_id is not supported; send the document inline as file_data")
+	}
+
+	fileData, _ := file["file_data"].(string)
+	filename, _ := file["filename"].(string)
+	if fileData == "" {
+		return filePart{}, errors.New("file content part must set file_data")
+	}
+	if !dataURLPattern.MatchString(fileData) && !strings.HasPrefix(fileData, "https://") && !strings.HasPrefix(fileData, "http://") {
+		return filePart{}, errors.New("file_data must be a base64 data URL or an http(s) URL")
+	}
+
+	if matches := dataURLPattern.FindStringSubmatch(fileData); matches != nil {
+		if _, ok := documentMediaTypes[matches[1]]; !ok {
+			return filePart{}, fmt.Errorf("unsupported document type %s, must be application/pdf or text/plain", matches[1])
+		}
+		// Reject oversized inline documents from the encoded length, before decoding anything;
+		// DecodedLen counts padding, so it can exceed the real size by up to two bytes
+		encoded := len(fileData) - len(matches[0])
+		if limit := AppConfig.MaxDocumentBytes; limit > 0 && base64.StdEncoding.DecodedLen(encoded) > limit+2 {
+			return filePart{}, fmt.Errorf("document %s exceeds the %d byte limit", filename, limit)
+		}
+	}
+
+	return filePart{FileData: fileData, Filename: filename}, nil
+}
+
+// ParseDocument returns the raw data and media type of a document given as a base64 data URL or an http(s) URL,
+// fetched within ctx, failing with errDocumentTooLarge beyond limit bytes; a limit of zero or less reads
+// documents of any size
+func ParseDocument(ctx context.Context, fileData string, limit int) ([]byte, string, error) {
+	if matches := dataURLPattern.FindStringSubmatch(fileData); matches != nil {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(fileData[len(matches[0]):]))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid base64 document data: %v", err)
+		}
+		if limit > 0 && len(decoded) > limit {
+			return nil, "", errDocumentTooLarge
+		}
+		return decoded, matches[1], nil
+	}
+
+	// Send a request to the document URL
+	resp, err := fetchURL(ctx, fileData)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unable to access the document URL, status: %d", resp.StatusCode)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if _, ok := documentMediaTypes[contentType]; !ok {
+		return nil, "", fmt.Errorf("unsupported document type %q at URL, must be application/pdf or text/plain", contentType)
+	}
+	data, err := readLimited(resp, limit, errDocumentTooLarge)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, contentType, nil
+}
+
+// fetchTimeout bounds fetching an image or document from a URL, whose server the gateway doesn't control
+const fetchTimeout = 30 * time.Second
+
+// fetchClient fetches the images and documents requests link to
+var fetchClient = &http.Client{Timeout: fetchTimeout}
+
+// fetchURL GETs an image or document URL on behalf of the request whose context is ctx
+func fetchURL(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetchClient.Do(req)
+}
+
+// readLimited reads a fetched response body, failing with tooLarge beyond limit bytes; a limit of zero or less
+// reads bodies of any size
+func readLimited(resp *http.Response, limit int, tooLarge error) ([]byte, error) {
+	if limit > 0 && resp.ContentLength > int64(limit) {
+		return nil, tooLarge
+	}
+
+	// Stop reading one byte past the limit, so an oversized body is detected without downloading all of it
+	var body io.Reader = resp.Body
+	if limit > 0 {
+		body = io.LimitReader(resp.Body, int64(limit)+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(data) > limit {
+		return nil, tooLarge
+	}
+	return data, nil
+}
+
+// claudeDocumentBlock converts an OpenAI file content part into a Claude document block, reading at most
+// limit bytes of it within ctx, and returns the block with the document's size
+func claudeDocumentBlock(ctx context.Context, part map[string]interface{}, limit int) (map[string]interface{}, int, error) {
+	file, err := parseFilePart(part)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, mediaType, err := ParseDocument(ctx, file.FileData, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	source := map[string]interface{}{"type": documentMediaTypes[mediaType], "media_type": mediaType}
+	if source["type"] == "text" {
+		source["data"] = string(data)
+	} else {
+		source["data"] = base64.StdEncoding.EncodeToString(data)
+	}
+
+	block := map[string]interface{}{"type": "document", "source": source}
+	if file.Filename != "" {
+		block["title"] = file.Filename
+	}
+	return block, len(data), nil
+}
+
+// withClaudeDocuments returns the messages with every file content part replaced by a Claude document block,
+// leaving the request's own messages unchanged. Documents fetched from URLs count towards MAX_CONTENT_BYTES
+// as they download, so the fetch stops once the request's content would exceed it; ctx bounds the fetches.
+func withClaudeDocuments(ctx context.Context, messages []Message) ([]Message, error) {
+	_, used := mediaPartStats(messages)
+	converted, _, err := convertClaudeDocuments(ctx, messages, used)
+	return converted, err
+}
+
+// convertClaudeDocuments replaces the file content parts of messages as withClaudeDocuments does, given the
+// bytes of the request's content already counted towards MAX_CONTENT_BYTES, and returns the size of the
+// documents it fetched
+func convertClaudeDocuments(ctx context.Context, messages []Message, used int) ([]Message, int, error) {
+	fetchedBytes := 0
+	converted, copied := messages, false
+	for i, msg := range messages {
+		parts, ok := msg.Content.([]interface{})
+		if !ok {
+			continue
+		}
+
+		var blocks []interface{}
+		for j, part := range parts {
+			partMap, ok := part.(map[string]interface{})
+			if !ok || partMap["type"] != "file" {
+				continue
+			}
+			fetched := !dataURLPattern.MatchString(filePartData(partMap))
+			limit, total := AppConfig.MaxDocumentBytes, AppConfig.MaxContentBytes
+			totalBinds := fetched && total > 0 && (limit <= 0 || total-used < limit)
+			if totalBinds {
+				limit = max(total-used, 1)
+			}
+			block, size, err := claudeDocumentBlock(ctx, partMap, limit)
+			if errors.Is(err, errDocumentTooLarge) {
+				if totalBinds {
+					return nil, 0, fmt.Errorf("%w: content parts exceed the limit of %d bytes per request", errContentTooLarge, total)
+				}
+				return nil, 0, fmt.Errorf("%w: document exceeds the limit of %d bytes", errContentTooLarge, limit)
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to read document: %v", err)
+			}
+			if fetched {
+				used += size
+				fetchedBytes += size
+			}
+			if blocks == nil {
+				blocks = append([]interface{}{}, parts...)
+			}
+			blocks[j] = block
+		}
+		if blocks == nil {
+			continue
+		}
+
+		if !copied {
+			converted, copied = append([]Message{}, messages...), true
+		}
+		converted[i].Content = blocks
+	}
+	return converted, fetchedBytes, nil
+}
+
+// errDocumentsUnsupported is reported for file content parts sent to a model whose format has no documents,
+// which would otherwise lose them silently; it is a bad request
+var errDocumentsUnsupported = errors.New("file content parts are only supported by Claude models")
+
+// checkDocumentSupport rejects requests carrying file content parts for models whose built-in formatter would
+// drop them. Registered formatters receive the parts as they are, to handle as they see fit.
+func checkDocumentSupport(req ChatRequest) error {
+	f, ok := formatterFor(req.FormatModel()).(funcFormatter)
+	if !ok || f.documents {
+		return nil
+	}
+	for i, msg := range req.Messages {
+		parts, _ := msg.Content.([]interface{})
+		for _, part := range parts {
+			if partMap, ok := part.(map[string]interface{}); ok && partMap["type"] == "file" {
+				return fmt.Errorf("%w: message %d has one, but model %s takes no documents", errDocumentsUnsupported, i, req.FormatModel())
+			}
+		}
+	}
+	return nil
+}
+
+// filePartData returns the file_data of a file content part, or "" if it has none
+func filePartData(part map[string]interface{}) string {
+	file, _ := part["file"].(map[string]interface{})
+	fileData, _ := file["file_data"].(string)
+	return fileData
+}
+
+// inlineDataSize returns the decoded size of a base64 data URL, or zero for any other URL
+func inlineDataSize(url string) int {
+	matches := dataURLPattern.FindStringSubmatch(url)
+	if matches == nil {
+		return 0
+	}
+	return base64.StdEncoding.DecodedLen(len(strings.TrimSpace(url[len(matches[0]):])))
+}
+
+// mediaPartStats counts the image and document content parts of the messages and sums the size of their inline data
+func mediaPartStats(messages []Message) (int, int) {
+	var count, size int
+	for _, msg := range messages {
+		parts, _ := msg.Content.([]interface{})
+		for _, part := range parts {
+			partMap, ok := part.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			partType, _ := partMap["type"].(string)
+			if !mediaPartTypes[partType] {
+				continue
+			}
+			count++
+			if partType == "file" {
+				size += inlineDataSize(filePartData(partMap))
+			} else if image, ok := partMap["image_url"].(map[string]interface{}); ok {
+				url, _ := image["url"].(string)
+				size += inlineDataSize(url)
+			}
+		}
+	}
+	return count, size
+}
+
+// validateContentLimits checks the number of image and document content parts and the size of their inline data
+// against MAX_CONTENT_PARTS and MAX_CONTENT_BYTES, before any document is fetched
+func validateContentLimits(messages []Message) error {
+	count, size := mediaPartStats(messages)
+	if limit := AppConfig.MaxContentParts; limit > 0 && count > limit {
+		return fmt.Errorf("request has %d image and document content parts, over the limit of %d", count, limit)
+	}
+	if limit := AppConfig.MaxContentBytes; limit > 0 && size > limit {
+		return fmt.Errorf("request has %d bytes of inline image and document data, over the limit of %d", size, limit)
+	}
+	return nil
+}
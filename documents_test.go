@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatPayloadForModelDocuments(t *testing.T) {
+	pdf := "data:application/pdf;base64," + base64.StdEncoding.EncodeToString([]byte("%PDF-1.7"))
+	text := "data:text/plain;base64," + base64.StdEncoding.EncodeToString([]byte("plain notes"))
+	parts := []interface{}{
+		map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_data": pdf, "filename": "report.pdf"}},
+		map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_data": text}},
+		map[string]interface{}{"type": "text", "text": "Summarize these."},
+	}
+	req := ChatRequest{Model: "anthropic.claude-3-5-sonnet-20240620-v1:0", Messages: []Message{{Role: "user", Content: parts}}}
+	if err := req.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := formatPayloadForModel(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Messages []struct {
+			Content []struct {
+				Type   string            `json:"type"`
+				Title  string            `json:"title"`
+				Source map[string]string `json:"source"`
+			} `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	blocks := payload.Messages[0].Content
+	if blocks[0].Type != "document" || blocks[0].Title != "report.pdf" || blocks[0].Source["type"] != "base64" || blocks[0].Source["media_type"] != "application/pdf" {
+		t.Errorf("pdf block = %+v", blocks[0])
+	}
+	if blocks[1].Source["type"] != "text" || blocks[1].Source["data"] != "plain notes" {
+		t.Errorf("text block = %+v", blocks[1])
+	}
+	if blocks[2].Type != "text" {
+		t.Errorf("text part = %+v, want it unchanged", blocks[2])
+	}
+	if parts[0].(map[string]interface{})["type"] != "file" {
+		t.Error("the request's own content parts were modified")
+	}
+
+	restoreConfig(t)
+	AppConfig.MaxDocumentBytes = 4
+	for name, file := range map[string]map[string]interface{}{
+		"oversized":    {"file_data": pdf},
+		"file_id":      {"file_id": "file-abc"},
+		"unsupported":  {"file_data": "data:application/zip;base64,UEs="},
+		"no file_data": {"filename": "report.pdf"},
+	} {
+		req := ChatRequest{Model: req.Model, Messages: []Message{{Role: "user", Content: []interface{}{map[string]interface{}{"type": "file", "file": file}}}}}
+		if err := req.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
+
+func TestContentLimits(t *testing.T) {
+	restoreConfig(t)
+
+	image := map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "data:image/png;base64," + base64.StdEncoding.EncodeToString(make([]byte, 30))}}
+	req := ChatRequest{Model: "anthropic.claude-3-5-sonnet-20240620-v1:0", Messages: []Message{
+		{Role: "user", Content: []interface{}{image, image, map[string]interface{}{"type": "text", "text": "Compare them."}}},
+	}}
+
+	AppConfig.MaxContentParts, AppConfig.MaxContentBytes = 1, 0
+	if err := req.Validate(); err == nil || !strings.Contains(err.Error(), "2 image and document content parts, over the limit of 1") {
+		t.Errorf("err = %v, want the part count and limit", err)
+	}
+	AppConfig.MaxContentParts, AppConfig.MaxContentBytes = 2, 50
+	if err := req.Validate(); err == nil || !strings.Contains(err.Error(), "60 bytes of inline image and document data, over the limit of 50") {
+		t.Errorf("err = %v, want the inline size and limit", err)
+	}
+
+	// A fetched document is cut off once the request's total would exceed the limit
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(make([]byte, 40))
+	}))
+	defer server.Close()
+	req.Messages[0].Content = []interface{}{image, map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_data": server.URL + "/report.pdf"}}}
+	AppConfig.MaxContentBytes = 100
+	if err := req.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := formatPayloadForModel(context.Background(), req); err != nil {
+		t.Errorf("unexpected error within the limit: %v", err)
+	}
+	AppConfig.MaxContentBytes = 60
+	if _, err := formatPayloadForModel(context.Background(), req); err == nil || !strings.Contains(err.Error(), "limit of 60 bytes per request") {
+		t.Errorf("err = %v, want the total limit to stop the fetch", err)
+	}
+}
+
+func TestParseImageLimit(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.MaxContentBytes = 100
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/chunked.png" {
+			// Without a Content-Length, the size is only known by reading the body
+			w.(http.Flusher).Flush()
+		}
+		w.Write(make([]byte, 80))
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/sized.png", "/chunked.png"} {
+		if data, _, err := ParseImage(context.Background(), server.URL+path, 0); err != nil || len(data) != 80 {
+			t.Errorf("%s: got %d bytes and %v, want the image within the limit", path, len(data), err)
+		}
+		if _, _, err := ParseImage(context.Background(), server.URL+path, 30); !errors.Is(err, errContentTooLarge) {
+			t.Errorf("%s: err = %v, want errContentTooLarge once the request's content exceeds the limit", path, err)
+		}
+	}
+}
+
+func TestDocumentFetchFollowsRequestContext(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	// The fetch gives up with the request rather than waiting on the document server
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := ParseDocument(ctx, server.URL+"/report.pdf", 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the request's deadline to end the fetch", err)
+	}
+}
+
+func TestDocumentsRejectedForOtherModels(t *testing.T) {
+	messages := []Message{{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "Summarize this."},
+		map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_data": "data:text/plain;base64,aGVsbG8=", "filename": "notes.txt"}},
+	}}}
+
+	_, err := formatPayloadForModel(context.Background(), ChatRequest{Model: "meta.llama3-8b-instruct-v1:0", Messages: messages})
+	if !errors.Is(err, errDocumentsUnsupported) || chatErrorStatus(err) != http.StatusBadRequest {
+		t.Errorf("err = %v, want documents rejected with 400 rather than dropped", err)
+	}
+	if _, err := formatPayloadForModel(context.Background(), ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", Messages: messages}); err != nil {
+		t.Errorf("unexpected error for Claude: %v", err)
+	}
+}
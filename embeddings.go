@@ -1,11 +1,20 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
@@ -14,9 +23,31 @@ import (
 // EmbeddingsRequest represents a request for embeddings
 type EmbeddingsRequest struct {
 	Model           string      `json:"model" binding:"required"`
-	Input           interface{} `json:"input" binding:"required"`
+	Input           interface{} `json:"input"`
 	EncodingFormat  string      `json:"encoding_format,omitempty"`
 	EmbeddingConfig interface{} `json:"embedding_config,omitempty"`
+
+	// Dimensions is the length of the returned vectors; EMBEDDING_DIMENSIONS sets per-model defaults
+	Dimensions int `json:"dimensions,omitempty"`
+
+	// InputType is Cohere's input_type; when omitted the endpoint's default is used
+	InputType string `json:"input_type,omitempty"`
+
+	// Truncate is Cohere's truncation of over-length inputs: "NONE", "START" or "END"; EMBEDDING_TRUNCATE when omitted
+	Truncate string `json:"truncate,omitempty"`
+
+	// ReturnChunks splits each input into chunks of ChunkSize characters and returns one embedding per chunk
+	ReturnChunks bool `json:"return_chunks,omitempty"`
+	ChunkSize    int  `json:"chunk_size,omitempty"`
+
+	// EmbeddingTypes asks Cohere v3 for several encodings at once: "float", "int8", "uint8", "binary" or "ubinary"
+	EmbeddingTypes []string `json:"embedding_types,omitempty"`
+
+	// UsagePerInput attributes prompt tokens to each embedding for models that report them per input, such as Titan
+	UsagePerInput bool `json:"usage_per_input,omitempty"`
+
+	// AllowPartial returns the embeddings of the Bedrock calls that succeeded when others fail, instead of an error
+	AllowPartial bool `json:"allow_partial,omitempty"`
 }
 
 // EmbeddingsResponse represents a response from the embeddings service
@@ -25,6 +56,9 @@ type EmbeddingsResponse struct {
 	Data   []Embedding     `json:"data"`
 	Model  string          `json:"model"`
 	Usage  EmbeddingsUsage `json:"usage"`
+
+	// FailedIndices lists the data indices whose embedding failed, when allow_partial is set
+	FailedIndices []int `json:"failed_indices,omitempty"`
 }
 
 // Embedding represents a single embedding
@@ -32,6 +66,29 @@ type Embedding struct {
 	Object    string      `json:"object"`
 	Embedding interface{} `json:"embedding"`
 	Index     int         `json:"index"`
+
+	// InputIndex and ChunkIndex locate a chunk embedding within the original input when chunks are returned
+	InputIndex *int `json:"input_index,omitempty"`
+	ChunkIndex *int `json:"chunk_index,omitempty"`
+
+	// Embeddings holds the vector in each requested embedding type when embedding_types is set;
+	// Embedding is then the float vector, or the first requested type without float
+	Embeddings map[string]interface{} `json:"embeddings,omitempty"`
+
+	// PromptTokens is the input's token count, set when usage_per_input is requested and the model reports it
+	PromptTokens *int `json:"prompt_tokens,omitempty"`
+
+	// Error explains why the embedding is null, when allow_partial is set and its Bedrock call failed
+	Error string `json:"error,omitempty"`
+}
+
+// cohereMaxTexts is the most texts Cohere embedding models accept in one invocation
+const cohereMaxTexts = 96
+
+// chunkOrigin records which input, and which chunk of it, an embedded text came from
+type chunkOrigin struct {
+	inputIndex int
+	chunkIndex int
 }
 
 // EmbeddingsUsage represents token usage information for embeddings
@@ -40,10 +97,87 @@ type EmbeddingsUsage struct {
 	TotalTokens  int `json:"total_tokens"`
 }
 
+// embeddingDimensions lists the vector lengths each embedding model can produce; the first is its default
+var embeddingDimensions = map[string][]int{
+	"cohere.embed-multilingual-v3": {1024},
+	"cohere.embed-english-v3":      {1024},
+	"amazon.titan-embed-text-v1":   {1536},
+	"amazon.titan-embed-text-v2:0": {1024, 512, 256},
+}
+
+// checkEmbeddingDimensions reports an error if the model can't produce vectors of the given length
+func checkEmbeddingDimensions(model string, dimensions int) error {
+	supported, ok := embeddingDimensions[model]
+	if !ok {
+		return fmt.Errorf("unsupported embedding model %s", model)
+	}
+	if !slices.Contains(supported, dimensions) {
+		return fmt.Errorf("dimensions %d is not supported for model %s, must be one of %v", dimensions, model, supported)
+	}
+	return nil
+}
+
+// ValidateEmbeddingDimensions checks the per-model defaults configured in EMBEDDING_DIMENSIONS
+func ValidateEmbeddingDimensions(defaults map[string]string) error {
+	for model, value := range defaults {
+		dimensions, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("dimensions for %s must be a number, got %q", model, value)
+		}
+		if err := checkEmbeddingDimensions(model, dimensions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestedDimensions returns the vector length for a request: its own dimensions, else the configured default for
+// the model, else 0 for the model's native length
+func (r EmbeddingsRequest) requestedDimensions() int {
+	if r.Dimensions > 0 {
+		return r.Dimensions
+	}
+	dimensions, _ := strconv.Atoi(AppConfig.EmbeddingDimensions[r.Model])
+	return dimensions
+}
+
+// cohereInputTypes are the input_type values accepted by Cohere embedding models
+var cohereInputTypes = map[string]bool{
+	"search_document": true,
+	"search_query":    true,
+	"classification":  true,
+	"clustering":      true,
+}
+
+// cohereTruncateModes are the truncate values accepted by Cohere embedding models; NONE rejects over-length inputs
+var cohereTruncateModes = map[string]bool{
+	"NONE":  true,
+	"START": true,
+	"END":   true,
+}
+
+// cohereEmbeddingTypes are the embedding_types values accepted by Cohere v3 embedding models
+var cohereEmbeddingTypes = map[string]bool{
+	"float":   true,
+	"int8":    true,
+	"uint8":   true,
+	"binary":  true,
+	"ubinary": true,
+}
+
+// Embeddings response media types that clients can negotiate with the Accept header
+const (
+	embeddingsJSON    = "application/json"
+	embeddingsNDJSON  = "application/x-ndjson"
+	embeddingsFloat32 = "application/x-float32"
+)
+
 // SupportedEmbeddingModels is a map of supported embedding models
 var SupportedEmbeddingModels = map[string]string{
 	"cohere.embed-multilingual-v3": "Cohere Embed Multilingual",
 	"cohere.embed-english-v3":      "Cohere Embed English",
+	"amazon.titan-embed-text-v1":   "Titan Embeddings G1 - Text",
+	"amazon.titan-embed-text-v2:0": "Titan Text Embeddings V2",
 }
 
 // ProcessEmbeddings processes an embeddings request
@@ -54,25 +188,216 @@ func (s *BedrockService) ProcessEmbeddings(ctx context.Context, req EmbeddingsRe
 		return nil, errors.New("unsupported embedding model")
 	}
 
-	// Format the request based on the model
-	var payload []byte
-	var err error
+	if !cohereInputTypes[req.InputType] {
+		return nil, fmt.Errorf("unsupported input_type %q", req.InputType)
+	}
+
+	truncate := strings.ToUpper(req.Truncate)
+	if truncate == "" {
+		truncate = strings.ToUpper(AppConfig.EmbeddingTruncate)
+	}
+	if !cohereTruncateModes[truncate] {
+		return nil, fmt.Errorf("unsupported truncate %q, must be one of NONE, START, END", truncate)
+	}
+
+	texts, inputTypes, err := parseEmbeddingInput(req.Input)
+	if err != nil {
+		return nil, err
+	}
+	for i, inputType := range inputTypes {
+		if inputType == "" {
+			inputTypes[i] = req.InputType
+		} else if !cohereInputTypes[inputType] {
+			return nil, fmt.Errorf("input[%d]: unsupported input_type %q", i, inputType)
+		}
+	}
+
+	// Apply the configured dimensions when the request doesn't choose any
+	req.Dimensions = req.requestedDimensions()
+	if req.Dimensions > 0 {
+		if err := checkEmbeddingDimensions(req.Model, req.Dimensions); err != nil {
+			return nil, err
+		}
+	}
+
+	// Optionally split long inputs into chunks that are embedded individually
+	var origins []chunkOrigin
+	if req.ReturnChunks {
+		chunkSize := req.ChunkSize
+		if chunkSize <= 0 {
+			chunkSize = AppConfig.EmbeddingChunkSize
+		}
+		texts, origins = chunkTexts(texts, chunkSize)
+		chunkTypes := make([]string, len(origins))
+		for i, origin := range origins {
+			chunkTypes[i] = inputTypes[origin.inputIndex]
+		}
+		inputTypes = chunkTypes
+	}
+
+	// Optionally embed each distinct text once and fan the results back out afterwards;
+	// the same text with different input types is embedded once per type
+	var positions []int
+	if AppConfig.DeduplicateEmbeddingInputs {
+		items := make([]embeddingItem, len(texts))
+		for i := range texts {
+			items[i] = embeddingItem{text: texts[i], inputType: inputTypes[i]}
+		}
+		items, positions = deduplicate(items)
+		texts, inputTypes = make([]string, len(items)), make([]string, len(items))
+		for i, item := range items {
+			texts[i], inputTypes[i] = item.text, item.inputType
+		}
+	}
 
+	var embeddingResponse *EmbeddingsResponse
 	switch modelName {
 	case "Cohere Embed Multilingual", "Cohere Embed English":
-		payload, err = formatCohereEmbeddingPayload(req)
+		embeddingResponse, err = s.invokeCohereByInputType(ctx, req, texts, inputTypes, truncate)
+	case "Titan Embeddings G1 - Text", "Titan Text Embeddings V2":
+		if len(req.EmbeddingTypes) > 0 {
+			return nil, fmt.Errorf("embedding_types is not supported for model %s", req.Model)
+		}
+		embeddingResponse, err = s.invokeTitanEmbeddings(ctx, req, texts)
 	default:
 		return nil, errors.New("unsupported embedding model")
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	if positions != nil {
+		embeddingResponse.Data = expandEmbeddings(embeddingResponse.Data, positions)
+	}
+
+	// Point each chunk embedding back at the input it came from, and list the failures to retry
+	for i := range embeddingResponse.Data {
+		if i < len(origins) {
+			inputIndex, chunkIndex := origins[i].inputIndex, origins[i].chunkIndex
+			embeddingResponse.Data[i].InputIndex = &inputIndex
+			embeddingResponse.Data[i].ChunkIndex = &chunkIndex
+		}
+		if embeddingResponse.Data[i].Error != "" {
+			embeddingResponse.FailedIndices = append(embeddingResponse.FailedIndices, i)
+		}
+	}
 
+	return embeddingResponse, nil
+}
+
+// invokeCohereByInputType embeds texts of mixed input types with separate Cohere invocations per input type,
+// merging the embeddings back into the order of the texts
+func (s *BedrockService) invokeCohereByInputType(ctx context.Context, req EmbeddingsRequest, texts, inputTypes []string, truncate string) (*EmbeddingsResponse, error) {
+	var order []string
+	groups := make(map[string][]int)
+	for i, inputType := range inputTypes {
+		if _, ok := groups[inputType]; !ok {
+			order = append(order, inputType)
+		}
+		groups[inputType] = append(groups[inputType], i)
+	}
+	if len(order) == 1 {
+		req.InputType = order[0]
+	}
+	if len(order) <= 1 {
+		return s.invokeCohereEmbeddings(ctx, req, texts, truncate)
+	}
+
+	embeddingResponse := &EmbeddingsResponse{
+		Object: "list",
+		Model:  req.Model,
+		Data:   make([]Embedding, len(texts)),
+	}
+	var failedGroups int
+	var firstErr error
+	for _, inputType := range order {
+		indices := groups[inputType]
+		groupTexts := make([]string, len(indices))
+		for j, i := range indices {
+			groupTexts[j] = texts[i]
+		}
+
+		groupReq := req
+		groupReq.InputType = inputType
+		groupResponse, err := s.invokeCohereEmbeddings(ctx, groupReq, groupTexts, truncate)
+		if err != nil {
+			if !req.AllowPartial || ctx.Err() != nil {
+				return nil, err
+			}
+			failedGroups++
+			firstErr = cmp.Or(firstErr, err)
+			for _, i := range indices {
+				embeddingResponse.Data[i] = failedEmbedding(i, err)
+			}
+			continue
+		}
+
+		for j, embedding := range groupResponse.Data {
+			embedding.Index = indices[j]
+			embeddingResponse.Data[indices[j]] = embedding
+		}
+		embeddingResponse.Usage.PromptTokens += groupResponse.Usage.PromptTokens
+		embeddingResponse.Usage.TotalTokens += groupResponse.Usage.TotalTokens
+	}
+	if failedGroups == len(order) {
+		return nil, firstErr
+	}
+
+	return embeddingResponse, nil
+}
+
+// invokeCohereEmbeddings embeds the texts with one Cohere invocation per batch of up to cohereMaxTexts
+func (s *BedrockService) invokeCohereEmbeddings(ctx context.Context, req EmbeddingsRequest, texts []string, truncate string) (*EmbeddingsResponse, error) {
+	embeddingResponse := &EmbeddingsResponse{
+		Object: "list",
+		Model:  req.Model,
+		Data:   make([]Embedding, 0, len(texts)),
+	}
+
+	var failed int
+	var firstErr error
+	for start := 0; start < len(texts); start += cohereMaxTexts {
+		batch := texts[start:min(start+cohereMaxTexts, len(texts))]
+		batchResponse, err := s.invokeCohereBatch(ctx, req, batch, truncate)
+		if err != nil {
+			if !req.AllowPartial || ctx.Err() != nil {
+				return nil, err
+			}
+			failed += len(batch)
+			firstErr = cmp.Or(firstErr, err)
+			for i := range batch {
+				embeddingResponse.Data = append(embeddingResponse.Data, failedEmbedding(start+i, err))
+			}
+			continue
+		}
+
+		for _, embedding := range batchResponse.Data {
+			embedding.Index += start
+			embeddingResponse.Data = append(embeddingResponse.Data, embedding)
+		}
+		embeddingResponse.Usage.PromptTokens += batchResponse.Usage.PromptTokens
+		embeddingResponse.Usage.TotalTokens += batchResponse.Usage.TotalTokens
+	}
+	if failed > 0 && failed == len(embeddingResponse.Data) {
+		// Nothing succeeded, so there is no partial result worth returning
+		return nil, firstErr
+	}
+
+	return embeddingResponse, nil
+}
+
+// invokeCohereBatch embeds a batch of texts with a single Cohere invocation
+func (s *BedrockService) invokeCohereBatch(ctx context.Context, req EmbeddingsRequest, texts []string, truncate string) (*EmbeddingsResponse, error) {
+	payload, err := formatCohereEmbeddingPayload(texts, req.InputType, truncate, req.EmbeddingTypes)
 	if err != nil {
 		return nil, err
 	}
 
-	// Call Bedrock InvokeModel API
-	resp, err := s.client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
+	// Call Bedrock InvokeModel API in the region where the embedding model is available
+	resp, err := s.runtimeClient(embeddingRegion(req.Model)).InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
 		ModelId:     aws.String(req.Model),
 		ContentType: aws.String("application/json"),
+		Accept:      aws.String(AcceptType(req.Model)),
 		Body:        payload,
 	})
 	if err != nil {
@@ -80,39 +405,315 @@ func (s *BedrockService) ProcessEmbeddings(ctx context.Context, req EmbeddingsRe
 	}
 
 	// Parse the response
-	return parseEmbeddingResponse(req.Model, resp.Body, req.EncodingFormat)
+	return parseEmbeddingResponse(req.Model, resp.Body, req.EncodingFormat, req.EmbeddingTypes)
 }
 
-// formatCohereEmbeddingPayload formats the request for Cohere embedding models
-func formatCohereEmbeddingPayload(req EmbeddingsRequest) ([]byte, error) {
-	var texts []string
+// failedEmbedding is the null embedding reported at index in place of one whose Bedrock call failed
+func failedEmbedding(index int, err error) Embedding {
+	return Embedding{Object: "embedding", Index: index, Error: err.Error()}
+}
 
-	switch v := req.Input.(type) {
+// titanEmbeddingConcurrency is how many inputs of an embeddings request are embedded with Titan at once
+const titanEmbeddingConcurrency = 8
+
+// invokeTitanEmbeddings embeds each text with its own Titan invocation, since Titan accepts one input per call,
+// running up to titanEmbeddingConcurrency at a time, and sums the token counts that each call reports
+func (s *BedrockService) invokeTitanEmbeddings(ctx context.Context, req EmbeddingsRequest, texts []string) (*EmbeddingsResponse, error) {
+	client := s.runtimeClient(embeddingRegion(req.Model))
+	embeddingResponse := &EmbeddingsResponse{
+		Object: "list",
+		Model:  req.Model,
+		Data:   make([]Embedding, len(texts)),
+	}
+
+	// Without allow_partial the first failure fails the request, so it stops the calls still to come
+	invokeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failure error
+	var failOnce sync.Once
+
+	responses := make([]*titanEmbeddingResponse, len(texts))
+	errs := make([]error, len(texts))
+	slots := make(chan struct{}, titanEmbeddingConcurrency)
+	var wg sync.WaitGroup
+	for i, text := range texts {
+		slots <- struct{}{}
+		if err := invokeCtx.Err(); err != nil {
+			<-slots
+			errs[i] = err
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			responses[i], errs[i] = invokeTitanEmbedding(invokeCtx, client, req, text)
+			if errs[i] != nil && !req.AllowPartial {
+				failOnce.Do(func() {
+					failure = errs[i]
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if failure != nil {
+		return nil, failure
+	}
+
+	var failed int
+	var firstErr error
+	for i, response := range responses {
+		if err := errs[i]; err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			failed++
+			firstErr = cmp.Or(firstErr, err)
+			embeddingResponse.Data[i] = failedEmbedding(i, err)
+			continue
+		}
+
+		embeddingResponse.Data[i] = Embedding{
+			Object:    "embedding",
+			Index:     i,
+			Embedding: encodeEmbedding(response.Embedding, req.EncodingFormat),
+		}
+		if req.UsagePerInput {
+			tokens := response.InputTextTokenCount
+			embeddingResponse.Data[i].PromptTokens = &tokens
+		}
+		embeddingResponse.Usage.PromptTokens += response.InputTextTokenCount
+	}
+	embeddingResponse.Usage.TotalTokens = embeddingResponse.Usage.PromptTokens
+	if failed > 0 && failed == len(texts) {
+		// Nothing succeeded, so there is no partial result worth returning
+		return nil, firstErr
+	}
+
+	return embeddingResponse, nil
+}
+
+// titanEmbeddingResponse is the body of a Titan embeddings invocation
+type titanEmbeddingResponse struct {
+	Embedding           []interface{} `json:"embedding"`
+	InputTextTokenCount int           `json:"inputTextTokenCount"`
+}
+
+// invokeTitanEmbedding embeds a single text with Titan
+func invokeTitanEmbedding(ctx context.Context, client BedrockInvoker, req EmbeddingsRequest, text string) (*titanEmbeddingResponse, error) {
+	body := map[string]interface{}{"inputText": text}
+	if req.Dimensions > 0 && req.Model != "amazon.titan-embed-text-v1" {
+		// Only Titan V2 takes a dimensions parameter; V1 always produces its single supported length
+		body["dimensions"] = req.Dimensions
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String(req.Model),
+		ContentType: aws.String("application/json"),
+		Accept:      aws.String(AcceptType(req.Model)),
+		Body:        payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var response titanEmbeddingResponse
+	if err := json.Unmarshal(resp.Body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse embedding response: %v", err)
+	}
+	return &response, nil
+}
+
+// embeddingRegion returns the region to invoke an embedding model in: a per-model override,
+// then the embeddings-wide override, and otherwise the default AWS region
+func embeddingRegion(model string) string {
+	if region, ok := AppConfig.EmbeddingModelRegions[model]; ok {
+		return region
+	}
+	return AppConfig.EmbeddingAWSRegion
+}
+
+// parseEmbeddingInput normalizes the embeddings input into a list of texts and, when any item is an object
+// {"text": ..., "input_type": ...}, the input type of each text; items without their own type get ""
+func parseEmbeddingInput(input interface{}) ([]string, []string, error) {
+	var texts, inputTypes []string
+
+	switch v := input.(type) {
 	case string:
 		texts = []string{v}
 	case []string:
 		texts = v
 	case []interface{}:
-		for _, item := range v {
-			if text, ok := item.(string); ok {
+		inputTypes = make([]string, 0, len(v))
+		for i, item := range v {
+			switch item := item.(type) {
+			case string:
+				texts = append(texts, item)
+				inputTypes = append(inputTypes, "")
+			case map[string]interface{}:
+				text, ok := item["text"].(string)
+				if !ok {
+					return nil, nil, fmt.Errorf("input[%d]: text must be a string, got %s", i, jsonTypeName(item["text"]))
+				}
+				inputType, ok := item["input_type"].(string)
+				if _, present := item["input_type"]; present && !ok {
+					return nil, nil, fmt.Errorf("input[%d]: input_type must be a string, got %s", i, jsonTypeName(item["input_type"]))
+				}
 				texts = append(texts, text)
+				inputTypes = append(inputTypes, inputType)
+			default:
+				return nil, nil, fmt.Errorf("input[%d]: expected a string or an object, got %s", i, jsonTypeName(item))
 			}
 		}
 	default:
-		return nil, errors.New("unsupported input format for embeddings")
+		return nil, nil, errors.New("unsupported input format for embeddings")
 	}
 
+	if inputTypes == nil {
+		inputTypes = make([]string, len(texts))
+	}
+	return texts, inputTypes, nil
+}
+
+// Validate checks the request for problems that should be reported to the client as a bad request
+func (r EmbeddingsRequest) Validate() error {
+	if r.Input == nil {
+		return errors.New("input is required")
+	}
+	texts, inputTypes, err := parseEmbeddingInput(r.Input)
+	if err != nil {
+		return err
+	}
+	for i, inputType := range inputTypes {
+		if inputType != "" && !cohereInputTypes[inputType] {
+			return fmt.Errorf("input[%d]: unsupported input_type %q", i, inputType)
+		}
+	}
+	if len(texts) == 0 {
+		return errors.New("input must contain at least one string")
+	}
+	if r.Dimensions < 0 {
+		return fmt.Errorf("dimensions must be positive, got %d", r.Dimensions)
+	}
+	if r.Dimensions > 0 {
+		if _, ok := embeddingDimensions[r.Model]; ok {
+			if err := checkEmbeddingDimensions(r.Model, r.Dimensions); err != nil {
+				return err
+			}
+		}
+	}
+	for _, embeddingType := range r.EmbeddingTypes {
+		if !cohereEmbeddingTypes[embeddingType] {
+			return fmt.Errorf("unsupported embedding_types value %q, must be one of float, int8, uint8, binary, ubinary", embeddingType)
+		}
+	}
+
+	// Empty texts make embedding models fail or return meaningless vectors
+	_, single := r.Input.(string)
+	for i, text := range texts {
+		if strings.TrimSpace(text) != "" {
+			continue
+		}
+		if single {
+			return errors.New("input must not be empty")
+		}
+		return fmt.Errorf("input[%d]: must not be empty", i)
+	}
+
+	return nil
+}
+
+// chunkTexts splits each text into chunks of at most size runes, preferring to break on whitespace,
+// and returns the chunks along with the origin of each one
+func chunkTexts(texts []string, size int) ([]string, []chunkOrigin) {
+	var chunks []string
+	var origins []chunkOrigin
+
+	for inputIndex, text := range texts {
+		runes := []rune(text)
+		chunkIndex := 0
+		for start := 0; start < len(runes) || chunkIndex == 0; chunkIndex++ {
+			end := len(runes)
+			if size > 0 && end-start > size {
+				end = start + size
+				// Back off to the last whitespace in the final fifth of the window
+				for i := end; i > start+size*4/5; i-- {
+					if unicode.IsSpace(runes[i-1]) {
+						end = i
+						break
+					}
+				}
+			}
+			chunks = append(chunks, string(runes[start:end]))
+			origins = append(origins, chunkOrigin{inputIndex: inputIndex, chunkIndex: chunkIndex})
+			start = end
+		}
+	}
+
+	return chunks, origins
+}
+
+// embeddingItem is a text to embed with the input type it is embedded as
+type embeddingItem struct {
+	text      string
+	inputType string
+}
+
+// deduplicate returns the distinct items in first-seen order, and for each original item
+// the position of its distinct copy
+func deduplicate[T comparable](items []T) ([]T, []int) {
+	seen := make(map[T]int, len(items))
+	unique := make([]T, 0, len(items))
+	positions := make([]int, len(items))
+
+	for i, item := range items {
+		position, ok := seen[item]
+		if !ok {
+			position = len(unique)
+			seen[item] = position
+			unique = append(unique, item)
+		}
+		positions[i] = position
+	}
+
+	return unique, positions
+}
+
+// expandEmbeddings maps embeddings of distinct texts back onto every original position
+func expandEmbeddings(unique []Embedding, positions []int) []Embedding {
+	expanded := make([]Embedding, 0, len(positions))
+	for i, position := range positions {
+		if position >= len(unique) {
+			break
+		}
+		embedding := unique[position]
+		embedding.Index = i
+		expanded = append(expanded, embedding)
+	}
+	return expanded
+}
+
+// formatCohereEmbeddingPayload formats the request for Cohere embedding models
+func formatCohereEmbeddingPayload(texts []string, inputType, truncate string, embeddingTypes []string) ([]byte, error) {
 	payload := map[string]interface{}{
 		"texts":      texts,
-		"input_type": "search_document",
-		"truncate":   "END",
+		"input_type": inputType,
+		"truncate":   truncate,
+	}
+	if len(embeddingTypes) > 0 {
+		payload["embedding_types"] = embeddingTypes
 	}
 
 	return json.Marshal(payload)
 }
 
 // parseEmbeddingResponse parses the embedding response
-func parseEmbeddingResponse(model string, responseBody []byte, encodingFormat string) (*EmbeddingsResponse, error) {
+func parseEmbeddingResponse(model string, responseBody []byte, encodingFormat string, embeddingTypes []string) (*EmbeddingsResponse, error) {
 	var response map[string]interface{}
 	if err := json.Unmarshal(responseBody, &response); err != nil {
 		return nil, err
@@ -120,11 +721,17 @@ func parseEmbeddingResponse(model string, responseBody []byte, encodingFormat st
 
 	// Extract embeddings based on model
 	var embeddings []interface{}
+	var embeddingsByType map[string]interface{}
 	var promptTokens int
 
 	if strings.HasPrefix(model, "cohere.embed") {
-		if embeds, ok := response["embeddings"].([]interface{}); ok {
+		switch embeds := response["embeddings"].(type) {
+		case []interface{}:
 			embeddings = embeds
+		case map[string]interface{}:
+			// With embedding_types, Cohere returns one list of vectors per type
+			embeddingsByType = embeds
+			embeddings = primaryEmbeddings(embeds, embeddingTypes)
 		}
 	}
 
@@ -142,18 +749,76 @@ func parseEmbeddingResponse(model string, responseBody []byte, encodingFormat st
 	// Format embeddings based on encoding format
 	for i, embed := range embeddings {
 		embeddingResponse.Data[i] = Embedding{
-			Object: "embedding",
-			Index:  i,
+			Object:    "embedding",
+			Index:     i,
+			Embedding: encodeEmbedding(embed, encodingFormat),
 		}
-
-		if encodingFormat == "base64" {
-			// Convert to base64
-			jsonData, _ := json.Marshal(embed)
-			embeddingResponse.Data[i].Embedding = base64.StdEncoding.EncodeToString(jsonData)
-		} else {
-			embeddingResponse.Data[i].Embedding = embed
+		if embeddingsByType != nil {
+			embeddingResponse.Data[i].Embeddings = make(map[string]interface{}, len(embeddingsByType))
+			for embeddingType, vectors := range embeddingsByType {
+				if vectors, ok := vectors.([]interface{}); ok && i < len(vectors) {
+					embeddingResponse.Data[i].Embeddings[embeddingType] = encodeEmbedding(vectors[i], encodingFormat)
+				}
+			}
 		}
 	}
 
 	return embeddingResponse, nil
 }
+
+// primaryEmbeddings picks the vectors reported as embedding from a by-type response: float if present,
+// otherwise the first requested type
+func primaryEmbeddings(byType map[string]interface{}, embeddingTypes []string) []interface{} {
+	for _, embeddingType := range append([]string{"float"}, embeddingTypes...) {
+		if vectors, ok := byType[embeddingType].([]interface{}); ok {
+			return vectors
+		}
+	}
+	return nil
+}
+
+// encodeEmbedding returns an embedding vector in the requested encoding format
+func encodeEmbedding(embed interface{}, encodingFormat string) interface{} {
+	if encodingFormat == "base64" {
+		// Convert to base64
+		jsonData, _ := json.Marshal(embed)
+		return base64.StdEncoding.EncodeToString(jsonData)
+	}
+	return embed
+}
+
+// writeEmbeddingsNDJSON writes one embedding object per line, followed by a line with the model, usage and any failures
+func writeEmbeddingsNDJSON(w io.Writer, response *EmbeddingsResponse) error {
+	encoder := json.NewEncoder(w)
+	for _, embedding := range response.Data {
+		if err := encoder.Encode(embedding); err != nil {
+			return err
+		}
+	}
+	return encoder.Encode(EmbeddingsResponse{Object: "list", Data: []Embedding{}, Model: response.Model, Usage: response.Usage, FailedIndices: response.FailedIndices})
+}
+
+// encodeEmbeddingsFloat32 packs the embeddings as consecutive little-endian float32 vectors and returns their dimension
+func encodeEmbeddingsFloat32(response *EmbeddingsResponse) ([]byte, int, error) {
+	var data []byte
+	dimensions := -1
+	for _, embedding := range response.Data {
+		values, ok := embedding.Embedding.([]interface{})
+		if !ok {
+			return nil, 0, fmt.Errorf("embedding %d is not a float vector", embedding.Index)
+		}
+		if dimensions >= 0 && len(values) != dimensions {
+			return nil, 0, errors.New("embeddings have differing dimensions")
+		}
+		dimensions = len(values)
+
+		for _, value := range values {
+			number, ok := value.(float64)
+			if !ok {
+				return nil, 0, fmt.Errorf("embedding %d contains a non-numeric value", embedding.Index)
+			}
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(number)))
+		}
+	}
+	return data, max(dimensions, 0), nil
+}
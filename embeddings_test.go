@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+func TestEmbeddingsRequestValidate(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{input: `"hello"`},
+		{input: `["a","b"]`},
+		{input: `""`, wantErr: "input must not be empty"},
+		{input: `[]`, wantErr: "at least one string"},
+		{input: `["a"," "]`, wantErr: "input[1]"},
+		{input: `["a",3]`, wantErr: "input[1]: expected a string"},
+	}
+
+	for _, tt := range tests {
+		var req EmbeddingsRequest
+		if err := json.Unmarshal([]byte(`{"model":"cohere.embed-english-v3","input":`+tt.input+`}`), &req); err != nil {
+			t.Fatal(err)
+		}
+		err := req.Validate()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.input, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error = %v, want it to mention %q", tt.input, err, tt.wantErr)
+		}
+	}
+}
+
+// titanInvoker answers each Titan embeddings call with the length of its input as the token count, recording the
+// most calls it had in flight at once
+type titanInvoker struct {
+	mockInvoker
+	mu           sync.Mutex
+	active, peak int
+}
+
+func (t *titanInvoker) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	t.mu.Lock()
+	t.active++
+	t.peak = max(t.peak, t.active)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.active--
+		t.mu.Unlock()
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	var body struct {
+		InputText string `json:"inputText"`
+	}
+	if err := json.Unmarshal(params.Body, &body); err != nil {
+		return nil, err
+	}
+	response := fmt.Sprintf(`{"embedding":[0.1,0.2],"inputTextTokenCount":%d}`, len(body.InputText))
+	return &bedrockruntime.InvokeModelOutput{Body: []byte(response), ContentType: aws.String("application/json")}, nil
+}
+
+func TestProcessEmbeddingsTitanUsagePerInput(t *testing.T) {
+	invoker := &titanInvoker{}
+	service := &BedrockService{client: invoker}
+	response, err := service.ProcessEmbeddings(context.Background(), EmbeddingsRequest{
+		Model:         "amazon.titan-embed-text-v2:0",
+		Input:         []interface{}{"short", "a longer input"},
+		InputType:     "search_document",
+		UsagePerInput: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Usage.PromptTokens != 19 || response.Usage.TotalTokens != 19 {
+		t.Errorf("usage = %+v, want the per-call counts summed", response.Usage)
+	}
+	for i, want := range []int{5, 14} {
+		if got := response.Data[i].PromptTokens; got == nil || *got != want {
+			t.Errorf("data[%d].prompt_tokens = %v, want %d", i, got, want)
+		}
+	}
+}
+
+func TestProcessEmbeddingsTitanConcurrency(t *testing.T) {
+	texts := make([]interface{}, 3*titanEmbeddingConcurrency)
+	for i := range texts {
+		texts[i] = strings.Repeat("x", i+1)
+	}
+	invoker := &titanInvoker{}
+	service := &BedrockService{client: invoker}
+	response, err := service.ProcessEmbeddings(context.Background(), EmbeddingsRequest{Model: "amazon.titan-embed-text-v2:0", Input: texts, InputType: "search_document", UsagePerInput: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if invoker.peak < 2 || invoker.peak > titanEmbeddingConcurrency {
+		t.Errorf("%d calls in flight at once, want between 2 and %d", invoker.peak, titanEmbeddingConcurrency)
+	}
+	for i, embedding := range response.Data {
+		if embedding.Index != i || *embedding.PromptTokens != i+1 {
+			t.Errorf("data[%d] = index %d with %d tokens, want each input's embedding at its own index", i, embedding.Index, *embedding.PromptTokens)
+		}
+	}
+}
+
+func TestProcessEmbeddingsAllowPartial(t *testing.T) {
+	texts := make([]interface{}, cohereMaxTexts+2)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("text %d", i)
+	}
+	req := EmbeddingsRequest{Model: "cohere.embed-english-v3", Input: texts, InputType: "search_document"}
+	throttled := &types.ThrottlingException{Message: aws.String("slow down")}
+
+	// Without allow_partial one failed batch fails the request
+	service, invoker := newTestService(`{"embeddings":[[0.1],[0.2]]}`)
+	invoker.failures = []error{throttled}
+	if _, err := service.ProcessEmbeddings(context.Background(), req); err == nil {
+		t.Error("expected the batch failure to fail the request")
+	}
+
+	req.AllowPartial = true
+	service, invoker = newTestService(`{"embeddings":[[0.1],[0.2]]}`)
+	invoker.failures = []error{throttled}
+	response, err := service.ProcessEmbeddings(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(invoker.inputs) != 2 || len(response.Data) != len(texts) {
+		t.Fatalf("got %d embeddings from %d invocations, want %d from 2", len(response.Data), len(invoker.inputs), len(texts))
+	}
+	if len(response.FailedIndices) != cohereMaxTexts || response.FailedIndices[cohereMaxTexts-1] != cohereMaxTexts-1 {
+		t.Errorf("failed_indices = %v, want the first batch", response.FailedIndices)
+	}
+	if failed := response.Data[0]; failed.Embedding != nil || !strings.Contains(failed.Error, "slow down") {
+		t.Errorf("data[0] = %+v, want a null embedding with the error", failed)
+	}
+	if last := response.Data[len(texts)-1]; last.Index != len(texts)-1 || last.Embedding == nil || last.Error != "" {
+		t.Errorf("last embedding = %+v, want the second batch's result at its own index", last)
+	}
+
+	// When every call fails there is nothing partial to return
+	service, invoker = newTestService()
+	invoker.failures = []error{throttled, throttled}
+	if _, err := service.ProcessEmbeddings(context.Background(), req); err == nil {
+		t.Error("expected an error when every batch fails")
+	}
+}
+
+func TestParseEmbeddingResponseByType(t *testing.T) {
+	body := []byte(`{"response_type":"embeddings_by_type","embeddings":{"float":[[0.5,-0.5],[1,0]],"int8":[[64,-64],[127,0]]}}`)
+	response, err := parseEmbeddingResponse("cohere.embed-english-v3", body, "float", []string{"int8", "float"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Data) != 2 {
+		t.Fatalf("got %d embeddings, want 2", len(response.Data))
+	}
+	second := response.Data[1]
+	if vector, ok := second.Embedding.([]interface{}); !ok || vector[0] != 1.0 {
+		t.Errorf("embedding = %v, want the float vector", second.Embedding)
+	}
+	if vector, ok := second.Embeddings["int8"].([]interface{}); !ok || vector[0] != 127.0 {
+		t.Errorf("embeddings.int8 = %v, want the int8 vector", second.Embeddings["int8"])
+	}
+}
+
+func TestEmbeddingDimensionsDefault(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.EmbeddingDimensions = map[string]string{"amazon.titan-embed-text-v2:0": "512"}
+
+	service, invoker := newTestService(`{"embedding":[0.1],"inputTextTokenCount":1}`)
+	req := EmbeddingsRequest{Model: "amazon.titan-embed-text-v2:0", Input: "hello", InputType: "search_document"}
+	if _, err := service.ProcessEmbeddings(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(invoker.inputs[0].Body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["dimensions"] != 512.0 {
+		t.Errorf("dimensions = %v, want the configured default of 512", payload["dimensions"])
+	}
+
+	if err := ValidateEmbeddingDimensions(map[string]string{"amazon.titan-embed-text-v2:0": "768"}); err == nil {
+		t.Error("expected a dimension the model doesn't support to be rejected")
+	}
+	req.Dimensions = 300
+	if err := req.Validate(); err == nil {
+		t.Error("expected an unsupported request dimension to be rejected")
+	}
+}
+
+func TestProcessEmbeddingsPerItemInputType(t *testing.T) {
+	service, invoker := newTestService(`{"embeddings":[[0.1],[0.3]]}`, `{"embeddings":[[0.2]]}`)
+	response, err := service.ProcessEmbeddings(context.Background(), EmbeddingsRequest{
+		Model: "cohere.embed-english-v3",
+		Input: []interface{}{
+			"a document",
+			map[string]interface{}{"text": "a query?", "input_type": "search_query"},
+			map[string]interface{}{"text": "another document"},
+		},
+		InputType: "search_document",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(invoker.inputs) != 2 {
+		t.Fatalf("got %d invocations, want one per input type", len(invoker.inputs))
+	}
+	if first := invoker.payload(t, 0); first["input_type"] != "search_document" || len(first["texts"].([]interface{})) != 2 {
+		t.Errorf("first call = %v, want both documents", first)
+	}
+	if second := invoker.payload(t, 1); second["input_type"] != "search_query" {
+		t.Errorf("second call = %v, want the query", second)
+	}
+	for i, want := range []float64{0.1, 0.2, 0.3} {
+		if got := response.Data[i].Embedding.([]interface{})[0]; got != want || response.Data[i].Index != i {
+			t.Errorf("data[%d] = %v at index %d, want %v in input order", i, got, response.Data[i].Index, want)
+		}
+	}
+
+	if err := (EmbeddingsRequest{Model: "cohere.embed-english-v3", Input: []interface{}{map[string]interface{}{"text": "x", "input_type": "search"}}}).Validate(); err == nil {
+		t.Error("expected an error for an unknown per-item input_type")
+	}
+}
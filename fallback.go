@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/smithy-go"
+)
+
+// fallbackErrorCodes are the Bedrock errors that say nothing about the request itself, so another model may succeed.
+// Anything else, such as a ValidationException or AccessDeniedException, is returned to the client immediately.
+var fallbackErrorCodes = map[string]bool{
+	"ThrottlingException":           true,
+	"ServiceQuotaExceededException": true,
+	"ServiceUnavailableException":   true,
+	"InternalServerException":       true,
+	"ModelNotReadyException":        true,
+	"ModelTimeoutException":         true,
+	"ModelErrorException":           true,
+	"ResourceNotFoundException":     true,
+}
+
+// isFallbackError reports whether a failed invocation should move on to the next model in the chain
+func isFallbackError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return fallbackErrorCodes[apiErr.ErrorCode()]
+	}
+	return false
+}
+
+// FallbackModels returns the configured fallback chain for a model, in the order they are tried
+func FallbackModels(model string) []string {
+	var models []string
+	for _, fallback := range strings.Split(AppConfig.ModelFallbacks[model], "|") {
+		if fallback = strings.TrimSpace(fallback); fallback != "" {
+			models = append(models, fallback)
+		}
+	}
+	return models
+}
+
+// fallbackRequest returns a copy of the request addressed to another model, dropping routing resolved for the original
+func fallbackRequest(req ChatRequest, model string) ChatRequest {
+	req.Model = model
+	req.targetModel = ""
+	req.baseModel = ""
+	return req
+}
+
+// ProcessChatWithFallback processes a chat request, moving down the model's fallback chain while the invocation
+// fails with a fallback error or is blocked by a content filter. Each attempt moves the request's admission, if
+// ctx carries one, to the queues of the model it invokes. It returns the request as served by the model that
+// produced the result, or the last error.
+func (s *BedrockService) ProcessChatWithFallback(ctx context.Context, req ChatRequest) (ChatRequest, *ChatResult, error) {
+	fallbacks := FallbackModels(req.Model)
+	for i := 0; ; i++ {
+		served, err := s.resolveApplicationProfile(ctx, req)
+		if err == nil {
+			served, err = s.applyCostTagProfile(ctx, served)
+		}
+		if err != nil {
+			return req, nil, err
+		}
+
+		if err := admitAttempt(ctx, served.FormatModel()); err != nil {
+			return served, nil, err
+		}
+
+		result, err := s.ProcessChat(ctx, served)
+		if i == len(fallbacks) {
+			return served, result, err
+		}
+
+		switch {
+		case err == nil && result.FinishReason != "content_filter":
+			return served, result, nil
+		case err == nil:
+			log.Printf("Model %s blocked the response, falling back to %s", req.Model, fallbacks[i])
+		case isFallbackError(err):
+			log.Printf("Model %s failed (%v), falling back to %s", req.Model, err, fallbacks[i])
+		default:
+			return served, nil, err
+		}
+		req = fallbackRequest(req, fallbacks[i])
+	}
+}
+
+// ProcessChatStreamWithFallback starts a streamed chat request, moving down the model's fallback chain while
+// the invocation fails with a fallback error. Only the initial invocation can fall back; once the stream has
+// started its failures are reported to the client. Attempts are admitted as by ProcessChatWithFallback. It
+// returns the request as served alongside the stream.
+func (s *BedrockService) ProcessChatStreamWithFallback(ctx context.Context, req ChatRequest) (ChatRequest, *bedrockruntime.InvokeModelWithResponseStreamOutput, error) {
+	fallbacks := FallbackModels(req.Model)
+	for i := 0; ; i++ {
+		served, err := s.resolveApplicationProfile(ctx, req)
+		if err == nil {
+			served, err = s.applyCostTagProfile(ctx, served)
+		}
+		if err != nil {
+			return req, nil, err
+		}
+
+		if err := admitAttempt(ctx, served.FormatModel()); err != nil {
+			return served, nil, err
+		}
+
+		stream, err := s.ProcessChatStream(ctx, served)
+		if err == nil || i == len(fallbacks) || !isFallbackError(err) {
+			return served, stream, err
+		}
+
+		log.Printf("Model %s failed (%v), falling back to %s", req.Model, err, fallbacks[i])
+		req = fallbackRequest(req, fallbacks[i])
+	}
+}
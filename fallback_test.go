@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock"
+	bedrocktypes "github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// fakeProfileClient is an InferenceProfileClient that resolves every profile to one foundation model and counts
+// lookups; profiles are given the ARN of profileArn when it is set
+type fakeProfileClient struct {
+	modelArn   string
+	profileArn string
+	lookups    int
+}
+
+func (f *fakeProfileClient) GetInferenceProfile(ctx context.Context, params *bedrock.GetInferenceProfileInput, optFns ...func(*bedrock.Options)) (*bedrock.GetInferenceProfileOutput, error) {
+	f.lookups++
+	output := &bedrock.GetInferenceProfileOutput{Models: []bedrocktypes.InferenceProfileModel{{ModelArn: aws.String(f.modelArn)}}}
+	if f.profileArn != "" {
+		output.InferenceProfileArn = aws.String(f.profileArn)
+	}
+	return output, nil
+}
+
+func TestProcessChatWithFallback(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.ModelFallbacks = map[string]string{"anthropic.claude-3-5-sonnet-20240620-v1:0": "anthropic.claude-3-haiku-20240307-v1:0"}
+
+	service, invoker := newTestService(`{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	invoker.failures = []error{&types.ThrottlingException{Message: aws.String("slow down")}}
+
+	req := ChatRequest{Model: "anthropic.claude-3-5-sonnet-20240620-v1:0", Messages: []Message{{Role: "user", Content: "Hi"}}}
+	served, result, err := service.ProcessChatWithFallback(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served.Model != "anthropic.claude-3-haiku-20240307-v1:0" || result.Content != "Hi" {
+		t.Errorf("served by %s with %q, want the fallback model", served.Model, result.Content)
+	}
+
+	// Errors about the request itself are returned without trying the chain
+	service, invoker = newTestService()
+	invoker.failures = []error{&types.ValidationException{Message: aws.String("bad request")}}
+	if _, _, err := service.ProcessChatWithFallback(context.Background(), req); err == nil || len(invoker.inputs) != 1 {
+		t.Errorf("err = %v after %d invocations, want the validation error without fallback", err, len(invoker.inputs))
+	}
+}
+
+func TestProcessChatResolvesApplicationProfile(t *testing.T) {
+	service, invoker := newTestService(
+		`{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`,
+		`{"content":[{"type":"text","text":"Again"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	profiles := &fakeProfileClient{modelArn: "arn:aws:bedrock:us-east-1::foundation-model/anthropic.claude-3-haiku-20240307-v1:0"}
+	service.profileClient = profiles
+
+	profile := "arn:aws:bedrock:us-east-1:123456789012:application-inference-profile/abc123"
+	req := ChatRequest{Model: profile, Messages: []Message{{Role: "user", Content: "Hi"}}}
+	served, result, err := service.ProcessChatWithFallback(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served.FormatModel() != "anthropic.claude-3-haiku-20240307-v1:0" || result.Content != "Hi" {
+		t.Errorf("served as %s with %q, want the profile's foundation model", served.FormatModel(), result.Content)
+	}
+	if payload := invoker.payload(t, 0); payload["anthropic_version"] == nil || aws.ToString(invoker.inputs[0].ModelId) != profile {
+		t.Errorf("invoked %s with %v, want a Claude payload sent to the profile", aws.ToString(invoker.inputs[0].ModelId), payload)
+	}
+
+	// Later requests for the profile reuse the resolved model
+	if _, _, err := service.ProcessChatWithFallback(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if profiles.lookups != 1 {
+		t.Errorf("GetInferenceProfile called %d times, want once", profiles.lookups)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// Kinds of faults the fault injector can produce
+const (
+	FaultDelay     = "delay"     // wait before invoking the model
+	FaultThrottle  = "throttle"  // fail with a ThrottlingException without invoking the model
+	FaultMalformed = "malformed" // invoke the model but return a truncated response body
+)
+
+// faultInjector is a BedrockInvoker that randomly injects faults into a fraction of invocations,
+// so client retries and the gateway's fallback behavior can be exercised against the real HTTP surface
+type faultInjector struct {
+	next  BedrockInvoker
+	rate  float64
+	kinds []string
+	delay time.Duration
+}
+
+// newFaultInjector wraps an invoker, injecting one of kinds into a rate fraction of invocations
+func newFaultInjector(next BedrockInvoker, rate float64, kinds []string, delay time.Duration) (*faultInjector, error) {
+	if len(kinds) == 0 {
+		return nil, fmt.Errorf("no fault kinds configured")
+	}
+	for _, kind := range kinds {
+		switch kind {
+		case FaultDelay, FaultThrottle, FaultMalformed:
+		default:
+			return nil, fmt.Errorf("unknown fault kind %q, must be one of delay, throttle, malformed", kind)
+		}
+	}
+	return &faultInjector{next: next, rate: rate, kinds: kinds, delay: delay}, nil
+}
+
+// pick returns the fault to inject into this invocation, or "" for none
+func (f *faultInjector) pick() string {
+	if rand.Float64() >= f.rate {
+		return ""
+	}
+	return f.kinds[rand.Intn(len(f.kinds))]
+}
+
+// wait sleeps for the configured delay unless the context ends first
+func (f *faultInjector) wait(ctx context.Context) error {
+	select {
+	case <-time.After(f.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttled returns the error Bedrock reports when a request is throttled
+func throttled() error {
+	return &types.ThrottlingException{Message: aws.String("Too many requests, please wait before trying again. (injected fault)")}
+}
+
+// InvokeModel invokes the model, possibly delayed, throttled or with its response body truncated
+func (f *faultInjector) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	fault := f.pick()
+	if fault != "" {
+		log.Printf("Injecting %s fault into invocation of %s", fault, aws.ToString(params.ModelId))
+	}
+
+	switch fault {
+	case FaultDelay:
+		if err := f.wait(ctx); err != nil {
+			return nil, err
+		}
+	case FaultThrottle:
+		return nil, throttled()
+	}
+
+	output, err := f.next.InvokeModel(ctx, params, optFns...)
+	if err == nil && fault == FaultMalformed {
+		truncated := *output
+		truncated.Body = output.Body[:len(output.Body)/2]
+		return &truncated, nil
+	}
+	return output, err
+}
+
+// InvokeModelWithResponseStream starts a stream, possibly delayed or throttled; streams are never malformed
+// because their events are decoded by the SDK
+func (f *faultInjector) InvokeModelWithResponseStream(ctx context.Context, params *bedrockruntime.InvokeModelWithResponseStreamInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelWithResponseStreamOutput, error) {
+	fault := f.pick()
+	switch fault {
+	case FaultDelay:
+		log.Printf("Injecting %s fault into stream of %s", fault, aws.ToString(params.ModelId))
+		if err := f.wait(ctx); err != nil {
+			return nil, err
+		}
+	case FaultThrottle:
+		log.Printf("Injecting %s fault into stream of %s", fault, aws.ToString(params.ModelId))
+		return nil, throttled()
+	}
+
+	return f.next.InvokeModelWithResponseStream(ctx, params, optFns...)
+}
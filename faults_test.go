@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+func TestFaultInjector(t *testing.T) {
+	response := `{"content":[{"type":"text","text":"Hello"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`
+	input := &bedrockruntime.InvokeModelInput{ModelId: aws.String("anthropic.claude-3-haiku-20240307-v1:0")}
+
+	_, invoker := newTestService(response)
+	injector, err := newFaultInjector(invoker, 1, []string{FaultThrottle}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var throttle *types.ThrottlingException
+	if _, err := injector.InvokeModel(context.Background(), input); !errors.As(err, &throttle) || !isFallbackError(err) {
+		t.Errorf("err = %v, want an injected ThrottlingException", err)
+	}
+	if len(invoker.inputs) != 0 {
+		t.Error("expected a throttled invocation not to reach the model")
+	}
+
+	injector, _ = newFaultInjector(invoker, 1, []string{FaultMalformed}, 0)
+	output, err := injector.InvokeModel(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseResponseFromModel(output.Body); err == nil {
+		t.Error("expected the malformed response body to fail parsing")
+	}
+
+	if _, err := newFaultInjector(invoker, 1, []string{"explode"}, 0); err == nil {
+		t.Error("expected an unknown fault kind to be rejected")
+	}
+}
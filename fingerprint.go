@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// SystemFingerprint identifies the backend configuration that serves a request: the gateway version,
+// the model invoked and the settings that change what it is sent, including the request's sampling profile
+// and context overflow policy as configured. Identical requests with the same
+// fingerprint are processed identically, so clients relying on seeded or greedy sampling can detect
+// that a backend change may have invalidated earlier results when the fingerprint changes.
+func SystemFingerprint(req ChatRequest) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "version=%s\n", AppConfig.Version)
+	fmt.Fprintf(hash, "invoked_model=%s\nformat_model=%s\n", req.InvocationModel(), req.FormatModel())
+	fmt.Fprintf(hash, "server_max_output_tokens=%d\n", AppConfig.ServerMaxOutputTokens)
+	fmt.Fprintf(hash, "temperature_scaling=%t\n", AppConfig.TemperatureScaling)
+	fmt.Fprintf(hash, "max_tool_result_chars=%d\n", AppConfig.MaxToolResultChars)
+	fmt.Fprintf(hash, "tool_argument_validation=%s\n", AppConfig.ToolArgumentValidation)
+	fmt.Fprintf(hash, "stream_tool_validation=%s\n", AppConfig.StreamToolValidation)
+	fmt.Fprintf(hash, "system_message_strategy=%s\n", AppConfig.SystemMessageStrategy)
+	fmt.Fprintf(hash, "message_alternation=%s\n", AppConfig.MessageAlternation)
+	fmt.Fprintf(hash, "strict_request_validation=%t\n", AppConfig.StrictRequestValidation)
+	fmt.Fprintf(hash, "prompt_template_revision=%d\n", promptTemplateRevision)
+	capabilities, _ := LookupCapabilities(req.FormatModel())
+	fmt.Fprintf(hash, "context_overflow=%s\n", overflowPolicy(req, capabilities))
+
+	// Maps and pointers are hashed as JSON, which sorts keys and writes values rather than addresses
+	aliases, _ := json.Marshal(AppConfig.FieldAliases)
+	fmt.Fprintf(hash, "field_aliases=%s\n", aliases)
+	if profile, ok := LookupSamplingProfile(req.SamplingProfile); ok {
+		sampling, _ := json.Marshal(profile)
+		fmt.Fprintf(hash, "sampling_profile=%s\n", sampling)
+	}
+	if tmpl, ok := AppConfig.SystemPromptTemplates[ModelFamily(req.FormatModel())]; ok && tmpl.Tree != nil {
+		fmt.Fprintf(hash, "system_prompt_template=%s\n", tmpl.Tree.Root.String())
+	}
+
+	return "fp_" + hex.EncodeToString(hash.Sum(nil)[:5])
+}
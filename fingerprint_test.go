@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSystemFingerprint(t *testing.T) {
+	req := ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", MaxTokens: 100, Seed: 42}
+	fingerprint := SystemFingerprint(req)
+	if !strings.HasPrefix(fingerprint, "fp_") {
+		t.Errorf("SystemFingerprint = %q, want an fp_ prefix", fingerprint)
+	}
+
+	other := req
+	other.MaxTokens = 200
+	other.Seed = 7
+	if got := SystemFingerprint(other); got != fingerprint {
+		t.Errorf("fingerprint changed with request parameters: %q != %q", got, fingerprint)
+	}
+
+	other = req
+	other.Model = "anthropic.claude-3-5-sonnet-20240620-v1:0"
+	if got := SystemFingerprint(other); got == fingerprint {
+		t.Error("expected a different model to change the fingerprint")
+	}
+
+	restoreConfig(t)
+	for name, change := range map[string]func(){
+		"SERVER_MAX_OUTPUT_TOKENS":  func() { AppConfig.ServerMaxOutputTokens = 1000 },
+		"SYSTEM_MESSAGE_STRATEGY":   func() { AppConfig.SystemMessageStrategy = SystemMessagesFirst },
+		"MESSAGE_ALTERNATION":       func() { AppConfig.MessageAlternation = "merge" },
+		"CONTEXT_OVERFLOW_POLICY":   func() { AppConfig.ContextOverflowPolicy = OverflowTruncateOldest },
+		"FIELD_ALIASES":             func() { AppConfig.FieldAliases = map[string]string{"maxTokens": "max_tokens"} },
+		"STRICT_REQUEST_VALIDATION": func() { AppConfig.StrictRequestValidation = !AppConfig.StrictRequestValidation },
+		"STREAM_TOOL_VALIDATION":    func() { AppConfig.StreamToolValidation = StreamToolValidationRepair },
+	} {
+		saved := *AppConfig
+		change()
+		if got := SystemFingerprint(req); got == fingerprint {
+			t.Errorf("expected a change to %s to change the fingerprint", name)
+		}
+		*AppConfig = saved
+	}
+
+	// A sampling profile changes the fingerprint when its parameters do
+	req.SamplingProfile = "precise"
+	fingerprint = SystemFingerprint(req)
+	AppConfig.SamplingProfiles = map[string]SamplingProfile{"precise": {Temperature: float32Ptr(0.1)}}
+	if got := SystemFingerprint(req); got == fingerprint {
+		t.Error("expected a redefined sampling profile to change the fingerprint")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// errModelUnsupported is reported under STRICT_MODEL_SUPPORT for models the gateway has no dedicated format for
+var errModelUnsupported = errors.New("not supported by this gateway")
+
+// ModelFormatter translates between the gateway's OpenAI-shaped requests and one model family's
+// InvokeModel request and response bodies. Implementations must be safe for concurrent use.
+type ModelFormatter interface {
+	// FormatPayload builds the InvokeModel request body for a chat request
+	FormatPayload(req ChatRequest) ([]byte, error)
+
+	// ParseResponse decodes an InvokeModel response body
+	ParseResponse(body []byte) (*ChatResult, error)
+
+	// ParseStreamChunk decodes one InvokeModelWithResponseStream chunk
+	ParseStreamChunk(data []byte) (streamDelta, error)
+}
+
+// funcFormatter assembles a ModelFormatter from the functions of a built-in model family
+type funcFormatter struct {
+	format      func(req ChatRequest) ([]byte, error)
+	parse       func(body []byte) (*ChatResult, error)
+	parseStream streamParser
+
+	// generic marks formatters that send the passthrough payload rather than one built for the model
+	generic bool
+
+	// documents marks formatters that send file content parts to the model as documents
+	documents bool
+}
+
+func (f funcFormatter) FormatPayload(req ChatRequest) ([]byte, error) { return f.format(req) }
+
+func (f funcFormatter) ParseResponse(body []byte) (*ChatResult, error) { return f.parse(body) }
+
+func (f funcFormatter) ParseStreamChunk(data []byte) (streamDelta, error) { return f.parseStream(data) }
+
+// claudeFormatter speaks Claude's Messages API, and is used for unrecognised Anthropic models
+var claudeFormatter ModelFormatter = funcFormatter{
+	format:      formatClaudePayload,
+	parse:       parseResponseFromModel,
+	parseStream: parseClaudeStreamChunk,
+	documents:   true,
+}
+
+// defaultFormatter passes the messages through and expects Claude-shaped responses, for models with no known format
+var defaultFormatter ModelFormatter = funcFormatter{
+	format:      formatGenericPayload,
+	parse:       parseResponseFromModel,
+	parseStream: parseClaudeStreamChunk,
+	generic:     true,
+}
+
+// builtinFormatters maps the StreamFormat of the capability registry to the formatter for that family
+var builtinFormatters = map[string]ModelFormatter{
+	"claude":  claudeFormatter,
+	"titan":   funcFormatter{format: formatGenericPayload, parse: parseResponseFromModel, parseStream: parseTitanStreamChunk, generic: true},
+	"llama":   funcFormatter{format: formatLlamaPayload, parse: parseLlamaResponse, parseStream: parseLlamaStreamChunk},
+	"mistral": funcFormatter{format: formatMistralPayload, parse: parseMistralResponse, parseStream: parseMistralStreamChunk},
+	"nova":    funcFormatter{format: formatGenericPayload, parse: parseResponseFromModel, parseStream: parseNovaStreamChunk, generic: true},
+	"cohere":  funcFormatter{format: formatGenericPayload, parse: parseResponseFromModel, parseStream: parseCohereStreamChunk, generic: true},
+}
+
+// customFormatters holds formatters registered with RegisterModelFormatter, by model ID prefix
+var customFormatters = struct {
+	sync.RWMutex
+	byPrefix map[string]ModelFormatter
+}{byPrefix: make(map[string]ModelFormatter)}
+
+// RegisterModelFormatter makes f the formatter for every model whose ID starts with prefix, ignoring any
+// cross-region profile prefix. Registered formatters take precedence over the built-in ones, and the
+// longest matching prefix wins; registering a prefix again replaces its formatter.
+func RegisterModelFormatter(prefix string, f ModelFormatter) {
+	customFormatters.Lock()
+	defer customFormatters.Unlock()
+
+	if f == nil {
+		delete(customFormatters.byPrefix, prefix)
+		return
+	}
+	customFormatters.byPrefix[prefix] = f
+}
+
+// formatterFor returns the formatter for a model: a registered one if its prefix matches, otherwise the
+// built-in formatter for the model's family
+func formatterFor(model string) ModelFormatter {
+	if f, ok := registeredFormatter(model); ok {
+		return f
+	}
+	if capabilities, ok := LookupCapabilities(model); ok {
+		if f, ok := builtinFormatters[capabilities.StreamFormat]; ok {
+			return f
+		}
+	}
+	if strings.Contains(model, "anthropic.claude") || strings.Contains(model, ".anthropic.") {
+		return claudeFormatter
+	}
+	return defaultFormatter
+}
+
+// checkModelSupport rejects, when STRICT_MODEL_SUPPORT is enabled, models whose formatter would send the
+// generic passthrough payload, which few models accept
+func checkModelSupport(model string) error {
+	if !AppConfig.StrictModelSupport {
+		return nil
+	}
+	if f, ok := formatterFor(model).(funcFormatter); ok && f.generic {
+		return fmt.Errorf("model %s %w", model, errModelUnsupported)
+	}
+	return nil
+}
+
+// registeredFormatter returns the registered formatter with the longest prefix matching the model
+func registeredFormatter(model string) (ModelFormatter, bool) {
+	for _, prefix := range crossRegionPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			model = strings.TrimPrefix(model, prefix)
+			break
+		}
+	}
+
+	customFormatters.RLock()
+	defer customFormatters.RUnlock()
+
+	var best string
+	for prefix := range customFormatters.byPrefix {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return nil, false
+	}
+	return customFormatters.byPrefix[best], true
+}
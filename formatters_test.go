@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// acmeFormatter is a third-party formatter with its own request and response shapes
+type acmeFormatter struct{}
+
+func (acmeFormatter) FormatPayload(req ChatRequest) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"prompt": req.Messages[len(req.Messages)-1].Content})
+}
+
+func (acmeFormatter) ParseResponse(body []byte) (*ChatResult, error) {
+	var resp struct {
+		Output string `json:"output"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return &ChatResult{Content: resp.Output, FinishReason: "stop"}, nil
+}
+
+func (acmeFormatter) ParseStreamChunk(data []byte) (streamDelta, error) {
+	return streamDelta{Text: string(data)}, nil
+}
+
+func TestRegisterModelFormatter(t *testing.T) {
+	RegisterModelFormatter("acme.", acmeFormatter{})
+	defer RegisterModelFormatter("acme.", nil)
+
+	service, invoker := newTestService(`{"output":"Hello"}`)
+	result, err := service.ProcessChat(context.Background(), ChatRequest{Model: "us.acme.large-v1", Messages: []Message{{Role: "user", Content: "Hi"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != "Hello" {
+		t.Errorf("content = %q, want the custom parser's output", result.Content)
+	}
+	if got := invoker.payload(t, 0); got["prompt"] != "Hi" {
+		t.Errorf("payload = %v, want the custom format", got)
+	}
+	if delta, _ := streamParserFor("acme.large-v1")([]byte("chunk")); delta.Text != "chunk" {
+		t.Errorf("stream delta = %q, want the custom chunk parser", delta.Text)
+	}
+
+	// Built-in families are unaffected
+	if _, ok := formatterFor("anthropic.claude-3-haiku-20240307-v1:0").(acmeFormatter); ok {
+		t.Error("Claude model resolved to the custom formatter")
+	}
+}
+
+func TestStrictModelSupport(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.StrictModelSupport = true
+
+	messages := []Message{{Role: "user", Content: "Hi"}}
+	if _, err := formatPayloadForModel(context.Background(), ChatRequest{Model: "amazon.nova-pro-v1:0", Messages: messages}); err == nil || err.Error() != "model amazon.nova-pro-v1:0 not supported by this gateway" {
+		t.Errorf("err = %v, want the model rejected", err)
+	} else if chatErrorStatus(err) != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", chatErrorStatus(err))
+	}
+	if _, err := formatPayloadForModel(context.Background(), ChatRequest{Model: "us.anthropic.claude-3-5-haiku-20241022-v1:0", Messages: messages}); err != nil {
+		t.Errorf("Claude rejected: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrock"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// DeepHealthResult records the outcome of a test invocation of the default model
+type DeepHealthResult struct {
+	Model     string    `json:"model"`
+	Success   bool      `json:"success"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// deepHealthTimeout bounds the test invocation of a deep health check
+const deepHealthTimeout = 30 * time.Second
+
+// deepHealthChecker invokes the default model and caches a successful result so probes don't trigger an
+// invocation each time. Concurrent probes share one invocation, which runs on its own context so a probe that
+// times out or disconnects doesn't cancel it.
+type deepHealthChecker struct {
+	mu      sync.Mutex
+	result  *DeepHealthResult
+	refresh singleflight.Group
+}
+
+// check returns the cached result if it is younger than ttl, otherwise performs a fresh 1-token generation. Failures
+// aren't cached, so the next probe retries rather than reporting a passing problem for the whole ttl; a probe whose
+// ctx ends before the check completes is reported as failed without waiting.
+func (h *deepHealthChecker) check(ctx context.Context, bedrockService *BedrockService, ttl time.Duration) DeepHealthResult {
+	h.mu.Lock()
+	cached := h.result
+	h.mu.Unlock()
+	if cached != nil && time.Since(cached.CheckedAt) < ttl {
+		return *cached
+	}
+
+	checked := h.refresh.DoChan("check", func() (interface{}, error) {
+		result := invokeDeepHealthCheck(bedrockService)
+		if result.Success {
+			h.mu.Lock()
+			h.result = &result
+			h.mu.Unlock()
+		}
+		return result, nil
+	})
+
+	select {
+	case outcome := <-checked:
+		return outcome.Val.(DeepHealthResult)
+	case <-ctx.Done():
+		return DeepHealthResult{
+			Model:     AppConfig.DefaultModel,
+			Error:     fmt.Sprintf("the probe ended before the check completed: %v", context.Cause(ctx)),
+			CheckedAt: time.Now(),
+		}
+	}
+}
+
+// invokeDeepHealthCheck invokes the default model for a single token, within deepHealthTimeout
+func invokeDeepHealthCheck(bedrockService *BedrockService) DeepHealthResult {
+	ctx, cancel := context.WithTimeout(context.Background(), deepHealthTimeout)
+	defer cancel()
+
+	start := time.Now()
+	req, err := bedrockService.resolveApplicationProfile(ctx, ChatRequest{
+		Model:     AppConfig.DefaultModel,
+		Messages:  []Message{{Role: "user", Content: "ping"}},
+		MaxTokens: 1,
+	})
+	if err == nil {
+		_, err = bedrockService.ProcessChat(ctx, req)
+	}
+
+	result := DeepHealthResult{
+		Model:     AppConfig.DefaultModel,
+		Success:   err == nil,
+		LatencyMs: time.Since(start).Milliseconds(),
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// StartupCheck verifies that the AWS credentials resolve and can call Bedrock in the configured region,
+// using ListFoundationModels as a lightweight call that needs no model access
+func (s *BedrockService) StartupCheck(ctx context.Context) error {
+	if s.awsConfig.Credentials == nil {
+		return errors.New("no AWS credentials configured")
+	}
+	if _, err := s.awsConfig.Credentials.Retrieve(ctx); err != nil {
+		return fmt.Errorf("AWS credentials could not be resolved: %v", err)
+	}
+	if _, err := s.controlClient.ListFoundationModels(ctx, &bedrock.ListFoundationModelsInput{}); err != nil {
+		return fmt.Errorf("Bedrock is not reachable with these credentials in region %s: %v", s.awsConfig.Region, err)
+	}
+	return nil
+}
+
+// SetupHealthRoutes configures the liveness, readiness and queue metrics endpoints
+func SetupHealthRoutes(r gin.IRouter, bedrockService *BedrockService) {
+	checker := &deepHealthChecker{}
+
+	// Liveness: the process is up and serving requests
+	r.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// Saturation of the Bedrock request queues: slots in use, queue depth, rejections and wait times,
+	// overall and for each model with a limit of its own
+	r.GET("/health/queue", func(c *gin.Context) {
+		response := gin.H{"enabled": bedrockQueue != nil}
+		if bedrockQueue != nil {
+			response["queue"] = bedrockQueue.stats()
+		}
+		if len(modelQueues) > 0 {
+			response["models"] = modelQueueStats()
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Readiness: AWS credentials resolve and, with DEEP_HEALTHCHECK, the default model is invokable
+	r.GET("/health/ready", func(c *gin.Context) {
+		credentials := bedrockService.awsConfig.Credentials
+		if credentials == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "no AWS credentials configured"})
+			return
+		}
+		if _, err := credentials.Retrieve(c.Request.Context()); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+			return
+		}
+
+		if !AppConfig.DeepHealthcheck {
+			c.JSON(http.StatusOK, gin.H{"status": "ok"})
+			return
+		}
+
+		result := checker.check(c.Request.Context(), bedrockService, AppConfig.DeepHealthcheckTTL)
+		if !result.Success {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "model_check": result})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "model_check": result})
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeepHealthCheck(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.DefaultModel = "anthropic.claude-3-haiku-20240307-v1:0"
+	ok := `{"content":[{"type":"text","text":"p"}],"stop_reason":"max_tokens","usage":{"input_tokens":1,"output_tokens":1}}`
+
+	// A success is cached for the ttl
+	checker := &deepHealthChecker{}
+	service, invoker := newTestService(ok, ok)
+	for i := 0; i < 2; i++ {
+		if result := checker.check(context.Background(), service, time.Minute); !result.Success {
+			t.Fatalf("check %d failed: %s", i, result.Error)
+		}
+	}
+	if len(invoker.inputs) != 1 {
+		t.Errorf("%d invocations, want the second check served from the cache", len(invoker.inputs))
+	}
+
+	// A failure isn't, so the next probe checks again
+	checker = &deepHealthChecker{}
+	service, invoker = newTestService()
+	invoker.err = errors.New("access denied")
+	for i := 0; i < 2; i++ {
+		if result := checker.check(context.Background(), service, time.Minute); result.Success || result.Error == "" {
+			t.Errorf("check %d = %+v, want the failure", i, result)
+		}
+	}
+	if len(invoker.inputs) != 2 {
+		t.Errorf("%d invocations, want each check after a failure to invoke the model", len(invoker.inputs))
+	}
+}
+
+func TestDeepHealthCheckOutlivesProbe(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.DefaultModel = "anthropic.claude-3-haiku-20240307-v1:0"
+	invoker := &gatedInvoker{started: make(chan struct{}, 1), release: make(chan struct{})}
+	invoker.responses = [][]byte{[]byte(`{"content":[{"type":"text","text":"p"}],"stop_reason":"max_tokens"}`)}
+	service := &BedrockService{client: invoker}
+	checker := &deepHealthChecker{}
+
+	// A probe that gives up is reported as failed, without cancelling the invocation
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-invoker.started
+		cancel()
+	}()
+	if result := checker.check(ctx, service, time.Minute); result.Success {
+		t.Fatal("expected the abandoned probe to fail")
+	}
+
+	// The invocation completes for the next probe, which doesn't start another
+	close(invoker.release)
+	if result := checker.check(context.Background(), service, time.Minute); !result.Success {
+		t.Errorf("next probe = %+v, want the completed check", result)
+	}
+	if len(invoker.inputs) != 1 {
+		t.Errorf("%d invocations, want the next probe to share the first", len(invoker.inputs))
+	}
+}
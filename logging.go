@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys used by RequestLogger to coordinate sampled logging with handlers
+const (
+	logSampledKey  = "log_sampled"
+	logDeferredKey = "log_deferred"
+)
+
+// RequestLogger logs each request's method, path, status and latency for a sampleRate fraction of requests.
+// Failed requests (status 400 and above) are always logged, together with any request details that
+// handlers deferred with logRequest because the request was not sampled.
+func RequestLogger(sampleRate float64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		sampled := sampleRate >= 1 || rand.Float64() < sampleRate
+		c.Set(logSampledKey, sampled)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		if !sampled && status < 400 {
+			return
+		}
+		if deferred, ok := c.Get(logDeferredKey); ok && !sampled {
+			for _, line := range deferred.([]string) {
+				log.Print(line)
+			}
+		}
+		line := fmt.Sprintf("%s %s %d %s", c.Request.Method, c.Request.URL.Path, status, time.Since(start).Round(time.Millisecond))
+		if headers := capturedHeaders(c.Request.Header); len(headers) > 0 {
+			data, _ := json.Marshal(headers)
+			line += " headers=" + string(data)
+		}
+		log.Print(line)
+	}
+}
+
+// sensitiveHeaders are never logged verbatim, even when configured in LOG_HEADERS; a short hash is logged instead
+var sensitiveHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"Set-Cookie":           true,
+	"X-Api-Key":            true,
+	"X-Amz-Security-Token": true,
+}
+
+// capturedHeaders returns the request headers named in LOG_HEADERS that are present, with sensitive
+// headers redacted and values truncated to LOG_HEADER_MAX_BYTES
+func capturedHeaders(header http.Header) map[string]string {
+	if len(AppConfig.LogHeaders) == 0 {
+		return nil
+	}
+
+	captured := make(map[string]string)
+	for _, name := range AppConfig.LogHeaders {
+		name = http.CanonicalHeaderKey(name)
+		value := strings.Join(header.Values(name), ", ")
+		if value == "" {
+			continue
+		}
+		if sensitiveHeaders[name] {
+			value = "redacted " + redactContent(value)
+		} else if limit := AppConfig.LogHeaderMaxBytes; limit > 0 && len(value) > limit {
+			value = truncateBytes(value, limit)
+		}
+		captured[strings.ToLower(name)] = value
+	}
+	return captured
+}
+
+// logRequest logs request details immediately if the request is sampled, and otherwise keeps them
+// so RequestLogger can log them should the request fail. Without RequestLogger everything is logged.
+func logRequest(c *gin.Context, format string, args ...interface{}) {
+	sampled, ok := c.Get(logSampledKey)
+	if !ok || sampled.(bool) {
+		log.Printf(format, args...)
+		return
+	}
+
+	var deferred []string
+	if existing, ok := c.Get(logDeferredKey); ok {
+		deferred = existing.([]string)
+	}
+	c.Set(logDeferredKey, append(deferred, fmt.Sprintf(format, args...)))
+}
+
+// UsageRecord describes the token usage and estimated cost of a single completed request
+type UsageRecord struct {
+	Model            string   `json:"model"`
+	InvokedModel     string   `json:"invoked_model"`
+	InvocationPath   string   `json:"invocation_path"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	TotalTokens      int      `json:"total_tokens"`
+	EstimatedCostUSD *float64 `json:"estimated_cost_usd,omitempty"`
+	Stream           bool     `json:"stream"`
+
+	// Tags are the request's cost allocation tags, for chargeback by team or feature
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Headers are the request headers captured by LOG_HEADERS, for correlation with upstream systems
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// NewUsageRecord builds a usage record for a request, estimating cost when pricing is known
+func NewUsageRecord(req ChatRequest, usage Usage, stream bool) UsageRecord {
+	invokedModel := req.InvocationModel()
+	record := UsageRecord{
+		Model:            req.Model,
+		InvokedModel:     invokedModel,
+		InvocationPath:   InvocationPath(invokedModel),
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		Stream:           stream,
+		Tags:             req.CostTags(),
+	}
+	if cost, ok := EstimateCost(invokedModel, usage); ok {
+		record.EstimatedCostUSD = &cost
+	} else if cost, ok := EstimateCost(req.FormatModel(), usage); ok {
+		// Application inference profiles are priced as their underlying foundation model
+		record.EstimatedCostUSD = &cost
+	}
+	return record
+}
+
+// LogUsage writes a usage record to the application log as a single JSON line
+func LogUsage(record UsageRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error marshaling usage record: %v", err)
+		return
+	}
+	log.Printf("Usage: %s", data)
+}
+
+// SanitizeChatRequest returns a log-safe description of a chat request.
+// In debug mode the full request is included as JSON, so optional parameters show their values rather than
+// pointer addresses; otherwise message content is replaced with its length and a short hash so requests can be
+// correlated without exposing user data.
+func SanitizeChatRequest(req ChatRequest, debug bool) string {
+	if debug {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Sprintf("unable to encode request: %v", err)
+		}
+		return string(data)
+	}
+
+	messages := make([]string, len(req.Messages))
+	for i, msg := range req.Messages {
+		messages[i] = fmt.Sprintf("%s(%s)", msg.Role, redactContent(msg.Content))
+	}
+
+	return fmt.Sprintf(
+		"model=%s messages=%d [%s] temperature=%v top_p=%v max_tokens=%d stream=%t tools=%d functions=%d",
+		req.Model, len(req.Messages), strings.Join(messages, " "),
+		formatOptional(req.Temperature), formatOptional(req.TopP), req.MaxTokens, req.Stream, len(req.Tools), len(req.Functions),
+	)
+}
+
+// formatOptional renders an optional parameter for logging, showing "unset" when it was omitted
+func formatOptional[T any](value *T) string {
+	if value == nil {
+		return "unset"
+	}
+	return fmt.Sprint(*value)
+}
+
+// redactContent summarizes message content as its serialized length and a truncated SHA-256 hash
+func redactContent(content interface{}) string {
+	if content == nil {
+		return "empty"
+	}
+
+	var data []byte
+	if text, ok := content.(string); ok {
+		data = []byte(text)
+	} else {
+		data, _ = json.Marshal(content)
+	}
+
+	sum := sha256.Sum256(data)
+	return contentSummary(len(data), sum[:])
+}
+
+// contentSummary formats the length and SHA-256 hash of content as redactContent reports them
+func contentSummary(size int, sum []byte) string {
+	return fmt.Sprintf("len=%d sha256=%s", size, hex.EncodeToString(sum[:6]))
+}
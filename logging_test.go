@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCapturedHeaders(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.LogHeaders = []string{"x-tenant-id", "Authorization", "traceparent", "x-missing"}
+	AppConfig.LogHeaderMaxBytes = 8
+
+	header := http.Header{}
+	header.Set("X-Tenant-Id", "acme")
+	header.Set("Authorization", "Bearer secret")
+	header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-01")
+	header.Set("X-Other", "ignored")
+
+	captured := capturedHeaders(header)
+	if captured["x-tenant-id"] != "acme" {
+		t.Errorf("x-tenant-id = %q, want it captured verbatim", captured["x-tenant-id"])
+	}
+	if strings.Contains(captured["authorization"], "secret") || !strings.HasPrefix(captured["authorization"], "redacted") {
+		t.Errorf("authorization = %q, want it redacted", captured["authorization"])
+	}
+	if !strings.HasPrefix(captured["traceparent"], "00-0af76") || !strings.Contains(captured["traceparent"], "truncated") {
+		t.Errorf("traceparent = %q, want it truncated", captured["traceparent"])
+	}
+	if _, ok := captured["x-missing"]; ok || len(captured) != 3 {
+		t.Errorf("captured = %v, want only configured headers that are present", captured)
+	}
+}
+
+func TestSanitizeChatRequest(t *testing.T) {
+	temperature := float32(0.5)
+	req := ChatRequest{
+		Model:       "anthropic.claude-3-haiku-20240307-v1:0",
+		Temperature: &temperature,
+		Messages:    []Message{{Role: "user", Content: "my password is hunter2"}},
+	}
+
+	sanitized := SanitizeChatRequest(req, false)
+	if strings.Contains(sanitized, "hunter2") {
+		t.Errorf("sanitized request %q exposes message content", sanitized)
+	}
+	if !strings.Contains(sanitized, "user("+redactContent("my password is hunter2")+")") || !strings.Contains(sanitized, "temperature=0.5") {
+		t.Errorf("sanitized request %q, want the content's hash and the temperature's value", sanitized)
+	}
+
+	debug := SanitizeChatRequest(req, true)
+	if !strings.Contains(debug, `"temperature":0.5`) || strings.Contains(debug, "0xc") {
+		t.Errorf("debug request %q, want optional parameters by value rather than address", debug)
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
@@ -33,8 +38,112 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	// Create a new Gin router
-	r := gin.Default()
+	// Load the pricing table used for cost estimates
+	pricing, err := LoadPricingTable(AppConfig.PricingFile)
+	if err != nil {
+		log.Fatalf("Failed to load pricing table: %v", err)
+	}
+	AppConfig.Pricing = pricing
+
+	// Load the per-model-family system prompt templates
+	templates, err := LoadSystemPromptTemplates(AppConfig.SystemPromptTemplatesFile)
+	if err != nil {
+		log.Fatalf("Failed to load system prompt templates: %v", err)
+	}
+	AppConfig.SystemPromptTemplates = templates
+
+	if err := ValidateEmbeddingDimensions(AppConfig.EmbeddingDimensions); err != nil {
+		log.Fatalf("Invalid EMBEDDING_DIMENSIONS: %v", err)
+	}
+	if !cohereTruncateModes[strings.ToUpper(AppConfig.EmbeddingTruncate)] {
+		log.Fatalf("Invalid EMBEDDING_TRUNCATE %q, must be one of NONE, START, END", AppConfig.EmbeddingTruncate)
+	}
+
+	if AppConfig.AWSRetryMode != "" {
+		if _, err := aws.ParseRetryMode(AppConfig.AWSRetryMode); err != nil {
+			log.Fatalf("Invalid AWS_RETRY_MODE %q, must be standard or adaptive", AppConfig.AWSRetryMode)
+		}
+	}
+	if AppConfig.AWSMaxAttempts < 0 {
+		log.Fatalf("Invalid AWS_MAX_ATTEMPTS %d, must be at least 1, or 0 for the SDK default", AppConfig.AWSMaxAttempts)
+	}
+
+	switch AppConfig.SystemMessageStrategy {
+	case SystemMessagesJoin, SystemMessagesFirst, SystemMessagesLast, SystemMessagesReject:
+	default:
+		log.Fatalf("Invalid SYSTEM_MESSAGE_STRATEGY %q, must be one of join, first, last, reject", AppConfig.SystemMessageStrategy)
+	}
+	if !overflowPolicies[AppConfig.ContextOverflowPolicy] {
+		log.Fatalf("Invalid CONTEXT_OVERFLOW_POLICY %q, must be one of none, error, truncate-oldest, truncate-middle", AppConfig.ContextOverflowPolicy)
+	}
+	if err := ValidateOverflowPolicies(AppConfig.ContextOverflowPolicies); err != nil {
+		log.Fatalf("Invalid CONTEXT_OVERFLOW_POLICIES: %v", err)
+	}
+	if !alternationPolicies[AppConfig.MessageAlternation] {
+		log.Fatalf("Invalid MESSAGE_ALTERNATION %q, must be one of off, merge, insert, reject", AppConfig.MessageAlternation)
+	}
+	if !streamToolValidationModes[AppConfig.StreamToolValidation] {
+		log.Fatalf("Invalid STREAM_TOOL_VALIDATION %q, must be one of off, error, repair", AppConfig.StreamToolValidation)
+	}
+	if err := ValidateFieldAliases(AppConfig.FieldAliases); err != nil {
+		log.Fatalf("Invalid FIELD_ALIASES: %v", err)
+	}
+	if err := ValidateObjectNames(AppConfig.ObjectNames); err != nil {
+		log.Fatalf("Invalid OBJECT_NAMES: %v", err)
+	}
+	if err := ValidateKnowledgeBaseAccess(AppConfig.KnowledgeBaseAccess); err != nil {
+		log.Fatalf("Invalid KNOWLEDGE_BASE_ACCESS: %v", err)
+	}
+	if AppConfig.BatchRoleARN != "" {
+		if err := ValidateBatchS3Prefixes(AppConfig.BatchS3Prefixes, AppConfig.BatchOutputS3URI); err != nil {
+			log.Fatalf("Invalid BATCH_S3_PREFIXES: %v", err)
+		}
+	}
+
+	// Load the named sampling profiles requests can select
+	samplingProfiles, err := LoadSamplingProfiles(AppConfig.SamplingProfilesFile)
+	if err != nil {
+		log.Fatalf("Failed to load sampling profiles: %v", err)
+	}
+	AppConfig.SamplingProfiles = samplingProfiles
+
+	// Load the weighted routes for logical model names
+	modelRoutes, err := LoadModelRoutes(AppConfig.ModelRoutesFile)
+	if err != nil {
+		log.Fatalf("Failed to load model routes: %v", err)
+	}
+	AppConfig.ModelRoutes = modelRoutes
+
+	// Limit concurrent Bedrock requests, overall and per model, queueing bursts over the limits
+	if AppConfig.MaxConcurrentRequests > 0 || len(AppConfig.ModelConcurrencyLimits) > 0 {
+		if AppConfig.RequestQueueDepth < 0 || AppConfig.RequestQueueTimeout <= 0 {
+			log.Fatalf("Invalid request queue: REQUEST_QUEUE_DEPTH must not be negative and REQUEST_QUEUE_TIMEOUT must be positive")
+		}
+	}
+	if AppConfig.ChatTimeout < 0 || AppConfig.StreamTimeout < 0 || AppConfig.EmbeddingsTimeout < 0 {
+		log.Fatalf("Invalid timeouts: CHAT_TIMEOUT, STREAM_TIMEOUT and EMBEDDINGS_TIMEOUT must not be negative")
+	}
+	if AppConfig.MaxConcurrentRequests > 0 {
+		bedrockQueue = newRequestQueue(AppConfig.MaxConcurrentRequests, AppConfig.RequestQueueDepth, AppConfig.RequestQueueTimeout)
+	}
+	modelQueues, err = newModelQueues(AppConfig.ModelConcurrencyLimits, AppConfig.RequestQueueDepth, AppConfig.RequestQueueTimeout)
+	if err != nil {
+		log.Fatalf("Invalid MODEL_CONCURRENCY_LIMITS: %v", err)
+	}
+
+	// Keep completed responses requested with store: true for retrieval by ID
+	if AppConfig.EnableResponseStore {
+		responseStore = NewMemoryResponseStore(AppConfig.ResponseStoreTTL, AppConfig.ResponseStoreMaxEntries)
+	}
+
+	// Reuse the formatted history of growing conversations across turns
+	if AppConfig.PayloadCacheSize > 0 {
+		payloadCache = NewPrefixCache(AppConfig.PayloadCacheSize, AppConfig.PayloadCacheMaxBytes)
+	}
+
+	// Create a new Gin router that logs a sample of requests and every failure
+	r := gin.New()
+	r.Use(RequestLogger(AppConfig.LogSampleRate), gin.Recovery())
 
 	// Create Bedrock service with region from config
 	bedrockService, err := NewBedrockService(AppConfig.AWSRegion)
@@ -42,8 +151,54 @@ func main() {
 		log.Fatalf("Failed to create Bedrock service: %v", err)
 	}
 
+	// Inject faults into model invocations for resilience testing; never silently in release mode
+	if AppConfig.FaultInjection {
+		if !AppConfig.Debug && !AppConfig.FaultInjectionAllowRelease {
+			log.Fatalf("FAULT_INJECTION requires DEBUG, or FAULT_INJECTION_ALLOW_RELEASE to enable it in release mode")
+		}
+		kinds := AppConfig.FaultInjectionKinds
+		if len(kinds) == 0 {
+			kinds = []string{FaultDelay, FaultThrottle, FaultMalformed}
+		}
+		injector, err := newFaultInjector(bedrockService.client, AppConfig.FaultInjectionRate, kinds, AppConfig.FaultInjectionDelay)
+		if err != nil {
+			log.Fatalf("Invalid fault injection configuration: %v", err)
+		}
+		bedrockService.client = injector
+		log.Printf("WARNING: fault injection enabled for %.0f%% of model invocations (%v)", AppConfig.FaultInjectionRate*100, kinds)
+	}
+
+	// Fail fast on unusable credentials or region rather than on the first client request
+	if AppConfig.StartupHealthcheck {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := bedrockService.StartupCheck(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Startup health check failed: %v", err)
+		}
+		log.Printf("Startup health check passed for region %s", AppConfig.AWSRegion)
+	}
+
+	// Health endpoints live outside the API prefix so probes don't depend on it
+	SetupHealthRoutes(r, bedrockService)
+
 	// Setup routes with API prefix from config
 	apiGroup := r.Group(AppConfig.APIRoutePrefix)
+
+	// Record API requests and responses to the audit log for compliance, separately from the app log
+	if AppConfig.AuditLogFile != "" {
+		switch AppConfig.AuditLogLevel {
+		case AuditLevelNone, AuditLevelMetadata, AuditLevelFull:
+		default:
+			log.Fatalf("Invalid AUDIT_LOG_LEVEL %q, must be one of none, metadata, full", AppConfig.AuditLogLevel)
+		}
+		auditLogger, err := NewFileAuditLogger(AppConfig.AuditLogFile, int64(AppConfig.AuditLogMaxSizeMB)<<20, AppConfig.AuditLogMaxBackups)
+		if err != nil {
+			log.Fatalf("Failed to create audit logger: %v", err)
+		}
+		defer auditLogger.Close()
+		apiGroup.Use(AuditMiddleware(auditLogger, AppConfig.AuditLogLevel))
+	}
 	SetupRoutes(apiGroup, bedrockService)
 
 	// Get port from environment variable or use default
@@ -58,8 +213,16 @@ func main() {
 	log.Printf("Using AWS Region: %s", AppConfig.AWSRegion)
 	log.Printf("Default model: %s", AppConfig.DefaultModel)
 
-	// Start the server
-	if err := r.Run(":" + port); err != nil {
+	// Start the server with explicit timeouts to protect against slow or hung connections
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           r,
+		ReadTimeout:       AppConfig.ServerReadTimeout,
+		ReadHeaderTimeout: AppConfig.ServerReadHeaderTimeout,
+		WriteTimeout:      AppConfig.ServerWriteTimeout,
+		IdleTimeout:       AppConfig.ServerIdleTimeout,
+	}
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
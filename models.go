@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// maxModelsPageSize is the largest page of models a list request can ask for
+const maxModelsPageSize = 100
+
+// modelsRefreshTimeout bounds a fetch of the model list, which callers share and so don't bound themselves
+const modelsRefreshTimeout = 30 * time.Second
+
+// modelListCache keeps the model list from ListBedrockModels, sorted by ID so pages are stable across requests
+type modelListCache struct {
+	mu      sync.Mutex
+	ids     []string
+	fetched time.Time
+
+	// refresh coalesces concurrent fetches of an expired list into one ListBedrockModels call
+	refresh singleflight.Group
+}
+
+// cachedModels returns the model list, fetching it from Bedrock when the cached copy is older than MODELS_CACHE_TTL.
+// Requests that find the list expired while a fetch is running wait for its result rather than fetching again,
+// each only as long as its own context allows; the fetch itself is bounded by modelsRefreshTimeout.
+func (s *BedrockService) cachedModels(ctx context.Context) ([]string, error) {
+	s.models.mu.Lock()
+	ids, fetched := s.models.ids, s.models.fetched
+	s.models.mu.Unlock()
+	if ids != nil && time.Since(fetched) < AppConfig.ModelsCacheTTL {
+		return ids, nil
+	}
+
+	// Detach from the caller's cancellation so one client disconnecting doesn't fail the others waiting
+	refreshed := s.models.refresh.DoChan("models", func() (interface{}, error) {
+		sharedCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), modelsRefreshTimeout)
+		defer cancel()
+		ids, err := s.ListBedrockModels(sharedCtx)
+		if err != nil {
+			return nil, err
+		}
+		ids = slices.Compact(slices.Sorted(slices.Values(ids)))
+
+		s.models.mu.Lock()
+		s.models.ids, s.models.fetched = ids, time.Now()
+		s.models.mu.Unlock()
+		return ids, nil
+	})
+
+	select {
+	case result := <-refreshed:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.([]string), nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// modelsPage returns up to limit model IDs following the after cursor in the sorted list, and whether more follow.
+// The cursor is compared rather than looked up, so paging continues even if that model has since disappeared.
+// A limit of zero returns every model after the cursor.
+func modelsPage(ids []string, after string, limit int) ([]string, bool) {
+	start, _ := slices.BinarySearch(ids, after)
+	if start < len(ids) && ids[start] == after {
+		start++
+	}
+	ids = ids[start:]
+	if limit <= 0 || len(ids) <= limit {
+		return ids, false
+	}
+	return ids[:limit], true
+}
+
+// handleListModels handles the list models endpoint. Without a limit it lists every model, as it always has;
+// with limit, and optionally the after cursor, it returns one page along with has_more and the page's first_id
+// and last_id, which is the cursor of the next page, as in OpenAI's list endpoints.
+func handleListModels(bedrockService *BedrockService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := 0
+		if value := c.Query("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxModelsPageSize {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxModelsPageSize)})
+				return
+			}
+		}
+
+		models, err := bedrockService.cachedModels(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// List only models clients are allowed to call, so pages are never short of allowed models
+		allowed := make([]string, 0, len(models))
+		for _, model := range models {
+			if AppConfig.IsModelAllowed(model) {
+				allowed = append(allowed, model)
+			}
+		}
+		page, hasMore := modelsPage(allowed, c.Query("after"), limit)
+
+		// Format response in OpenAI-compatible format
+		modelList := make([]gin.H, 0, len(page))
+		for _, model := range page {
+			modelList = append(modelList, gin.H{
+				"id":       model,
+				"object":   "model",
+				"created":  1706745600,                   // You might want to adjust this timestamp
+				"owned_by": strings.Split(model, ".")[0], // Extract owner from model ID
+			})
+		}
+
+		response := gin.H{"object": "list", "data": modelList, "has_more": hasMore}
+		if len(page) > 0 {
+			response["first_id"], response["last_id"] = page[0], page[len(page)-1]
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock"
+	bedrocktypes "github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+	"github.com/gin-gonic/gin"
+)
+
+func TestListModelsPagination(t *testing.T) {
+	service := &BedrockService{}
+	service.models.ids = []string{"amazon.nova-pro-v1:0", "anthropic.claude-3-haiku-20240307-v1:0", "meta.llama3-8b-instruct-v1:0"}
+	service.models.fetched = time.Now()
+
+	list := func(query string) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/models"+query, nil)
+		handleListModels(service)(c)
+		var response map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+
+	_, all := list("")
+	if len(all["data"].([]interface{})) != 3 || all["has_more"] != false {
+		t.Errorf("unpaged list = %v, want every model", all)
+	}
+	_, first := list("?limit=2")
+	if len(first["data"].([]interface{})) != 2 || first["has_more"] != true || first["last_id"] != "anthropic.claude-3-haiku-20240307-v1:0" {
+		t.Errorf("first page = %v, want two models and more to come", first)
+	}
+	_, second := list("?limit=2&after=anthropic.claude-3-haiku-20240307-v1:0")
+	if data := second["data"].([]interface{}); len(data) != 1 || second["has_more"] != false || second["first_id"] != "meta.llama3-8b-instruct-v1:0" {
+		t.Errorf("second page = %v, want the last model", second)
+	}
+	if status, _ := list("?limit=0"); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400 for limit 0", status)
+	}
+}
+
+// fakeCatalogClient is a ModelCatalogClient listing the given foundation models, once release is closed, and no
+// inference profiles; it counts the foundation model listings
+type fakeCatalogClient struct {
+	models  []string
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (f *fakeCatalogClient) ListFoundationModels(ctx context.Context, params *bedrock.ListFoundationModelsInput, optFns ...func(*bedrock.Options)) (*bedrock.ListFoundationModelsOutput, error) {
+	f.calls.Add(1)
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	output := &bedrock.ListFoundationModelsOutput{}
+	for _, id := range f.models {
+		output.ModelSummaries = append(output.ModelSummaries, bedrocktypes.FoundationModelSummary{
+			ModelId:                    aws.String(id),
+			ModelLifecycle:             &bedrocktypes.FoundationModelLifecycle{Status: bedrocktypes.FoundationModelLifecycleStatusActive},
+			ResponseStreamingSupported: aws.Bool(true),
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeCatalogClient) ListInferenceProfiles(ctx context.Context, params *bedrock.ListInferenceProfilesInput, optFns ...func(*bedrock.Options)) (*bedrock.ListInferenceProfilesOutput, error) {
+	return &bedrock.ListInferenceProfilesOutput{}, nil
+}
+
+func TestCachedModelsCoalescesRefresh(t *testing.T) {
+	catalog := &fakeCatalogClient{models: []string{"meta.llama3-8b-instruct-v1:0", "amazon.nova-pro-v1:0"}, release: make(chan struct{})}
+	service := &BedrockService{catalogClient: catalog}
+
+	// A caller that gives up stops waiting without cancelling the fetch the others share
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := service.cachedModels(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the caller's deadline", err)
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]string, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = service.cachedModels(context.Background())
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(catalog.release)
+	wg.Wait()
+
+	if got := catalog.calls.Load(); got != 1 {
+		t.Errorf("model list fetched %d times, want once for concurrent requests", got)
+	}
+	for _, ids := range results {
+		if len(ids) != 2 || ids[0] != "amazon.nova-pro-v1:0" {
+			t.Errorf("models = %v, want the sorted list", ids)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Context overflow policies, applied when a prompt's estimated size leaves no room for max_tokens in the
+// model's context window
+const (
+	OverflowNone           = "none"            // send the request as it is and let the model reject it
+	OverflowError          = "error"           // reject the request before invoking the model
+	OverflowTruncateOldest = "truncate-oldest" // drop the oldest turns of the conversation
+	OverflowTruncateMiddle = "truncate-middle" // drop the turns after the first, keeping how the conversation began
+)
+
+// overflowPolicies are the valid context overflow policies
+var overflowPolicies = map[string]bool{
+	OverflowNone:           true,
+	OverflowError:          true,
+	OverflowTruncateOldest: true,
+	OverflowTruncateMiddle: true,
+}
+
+// errContextOverflow is reported for prompts that don't fit the model's context window, which is a bad request
+var errContextOverflow = errors.New("prompt exceeds the model's context window")
+
+// ValidateOverflowPolicies checks the per-family context overflow policies
+func ValidateOverflowPolicies(byFamily map[string]string) error {
+	for family, policy := range byFamily {
+		if !overflowPolicies[policy] {
+			return fmt.Errorf("policy %q for %s must be one of none, error, truncate-oldest, truncate-middle", policy, family)
+		}
+	}
+	return nil
+}
+
+// overflowPolicy returns the policy for a request: its own context_overflow, or else the one configured for
+// the model's family, or else the global one
+func overflowPolicy(req ChatRequest, capabilities ModelCapabilities) string {
+	if req.ContextOverflow != "" {
+		return req.ContextOverflow
+	}
+	if policy, ok := AppConfig.ContextOverflowPolicies[capabilities.StreamFormat]; ok {
+		return policy
+	}
+	return AppConfig.ContextOverflowPolicy
+}
+
+// applyOverflowPolicy checks the request's estimated prompt against the context window of its model and,
+// depending on the overflow policy, rejects it or drops whole turns of the conversation until it fits.
+// A turn is a user message with the replies and tool results that follow it, so tool calls stay paired with
+// their results; system messages and the last turn are always kept. Models of unknown size are not checked.
+func applyOverflowPolicy(req ChatRequest) (ChatRequest, error) {
+	capabilities, ok := LookupCapabilities(req.FormatModel())
+	policy := overflowPolicy(req, capabilities)
+	if !ok || policy == OverflowNone {
+		return req, nil
+	}
+
+	budget := capabilities.ContextWindow - EffectiveMaxTokens(req)
+	if budget <= 0 {
+		// No prompt could fit, so there is nothing to truncate towards; Bedrock rejects the request itself
+		log.Printf("Not applying %s to %s: max_tokens %d leaves no room for a prompt in its %d token context window",
+			policy, req.Model, EffectiveMaxTokens(req), capabilities.ContextWindow)
+		return req, nil
+	}
+	prompt := EstimateMessageTokens(req.Messages)
+	if prompt <= budget {
+		return req, nil
+	}
+	if policy == OverflowError {
+		return req, fmt.Errorf("%w: an estimated %d prompt tokens plus max_tokens %d exceed the %d token context window of %s",
+			errContextOverflow, prompt, EffectiveMaxTokens(req), capabilities.ContextWindow, req.Model)
+	}
+
+	// Number the turns, each starting at a user message; system messages belong to none
+	turnOf := make([]int, len(req.Messages))
+	turnTokens := []int{}
+	for i, msg := range req.Messages {
+		switch {
+		case msg.Role == "system":
+			turnOf[i] = -1
+			continue
+		case msg.Role == "user" || len(turnTokens) == 0:
+			turnTokens = append(turnTokens, 0)
+		}
+		turnOf[i] = len(turnTokens) - 1
+		turnTokens[turnOf[i]] += EstimateMessageTokens(req.Messages[i : i+1])
+	}
+
+	// Drop the oldest turns, or for truncate-middle the oldest after the first, but never the last one
+	first := 0
+	if policy == OverflowTruncateMiddle {
+		first = 1
+	}
+	keepFrom := first
+	for prompt > budget && keepFrom < len(turnTokens)-1 {
+		prompt -= turnTokens[keepFrom]
+		keepFrom++
+	}
+	if prompt > budget {
+		return req, fmt.Errorf("%w: an estimated %d prompt tokens remain after truncation, over the %d left for the prompt by max_tokens %d in %s",
+			errContextOverflow, prompt, budget, EffectiveMaxTokens(req), req.Model)
+	}
+
+	messages := make([]Message, 0, len(req.Messages))
+	for i, msg := range req.Messages {
+		if turnOf[i] < first || turnOf[i] >= keepFrom {
+			messages = append(messages, msg)
+		}
+	}
+	dropped := len(req.Messages) - len(messages)
+	log.Printf("Dropped %d messages with %s to fit the %d token context window of %s", dropped, policy, capabilities.ContextWindow, req.Model)
+	req.Messages = messages
+	return req, nil
+}
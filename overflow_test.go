@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestApplyOverflowPolicy(t *testing.T) {
+	long := strings.Repeat("word ", 2000) // about 2500 tokens
+	req := ChatRequest{Model: "meta.llama3-8b-instruct-v1:0", MaxTokens: 1000, Messages: []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "first " + long},
+		{Role: "assistant", Content: long},
+		{Role: "user", Content: "second " + long},
+		{Role: "assistant", Content: long},
+		{Role: "user", Content: "last"},
+	}}
+	contents := func(messages []Message) []string {
+		var words []string
+		for _, msg := range messages {
+			words = append(words, strings.Fields(msg.Content.(string) + " -")[0])
+		}
+		return words
+	}
+
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{OverflowNone, []string{"Be", "first", "word", "second", "word", "last"}},
+		{OverflowTruncateOldest, []string{"Be", "second", "word", "last"}},
+		{OverflowTruncateMiddle, []string{"Be", "first", "word", "last"}},
+	}
+	for _, tt := range tests {
+		req.ContextOverflow = tt.policy
+		fitted, err := applyOverflowPolicy(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.policy, err)
+		}
+		if got := contents(fitted.Messages); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: messages = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+
+	req.ContextOverflow = OverflowError
+	if _, err := applyOverflowPolicy(req); !errors.Is(err, errContextOverflow) || chatErrorStatus(err) != http.StatusBadRequest {
+		t.Errorf("err = %v, want a 400 context overflow", err)
+	}
+
+	// A max_tokens that fills the whole window leaves no budget to enforce
+	for _, policy := range []string{OverflowError, OverflowTruncateOldest} {
+		full := req
+		full.ContextOverflow, full.MaxTokens = policy, 8000
+		if fitted, err := applyOverflowPolicy(full); err != nil || len(fitted.Messages) != len(req.Messages) {
+			t.Errorf("%s with no budget: got %d messages and %v, want the request unchanged", policy, len(fitted.Messages), err)
+		}
+	}
+
+	req.ContextOverflow = "truncate"
+	if err := req.Validate(); err == nil {
+		t.Error("expected an error for an unknown context_overflow")
+	}
+}
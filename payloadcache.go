@@ -0,0 +1,164 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// payloadCache holds the Claude messages formatted for conversation prefixes when PAYLOAD_CACHE_SIZE is set;
+// nil disables the cache
+var payloadCache *PrefixCache
+
+// formattedPrefix is the formatted form of a conversation prefix
+type formattedPrefix struct {
+	messages []claudeMessage
+
+	// fetched is the size of the documents fetched from URLs for the prefix, which count towards MAX_CONTENT_BYTES
+	fetched int
+}
+
+// prefixEntry is a formatted prefix held by PrefixCache under the hash of its messages, with its encoded size
+type prefixEntry struct {
+	key    string
+	prefix formattedPrefix
+	size   int
+}
+
+// PrefixCache is an LRU cache of formatted conversation prefixes, safe for concurrent use, that holds at most
+// maxEntries prefixes totalling at most maxBytes, evicting the least recently used first. Prefixes carrying
+// documents can be large, so a maxBytes of zero or less, which removes the byte limit, is best avoided.
+type PrefixCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	entries    map[string]*list.Element
+	order      list.List // of *prefixEntry, most recently used first
+}
+
+// NewPrefixCache creates a prefix cache holding at most maxEntries prefixes and maxBytes of formatted messages
+func NewPrefixCache(maxEntries, maxBytes int) *PrefixCache {
+	return &PrefixCache{maxEntries: maxEntries, maxBytes: maxBytes, entries: make(map[string]*list.Element)}
+}
+
+// get returns the prefix cached under key, marking it as recently used
+func (c *PrefixCache) get(key string) (formattedPrefix, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return formattedPrefix{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*prefixEntry).prefix, true
+}
+
+// put caches a prefix under key, evicting the least recently used prefixes beyond the limits. A prefix larger
+// than the whole byte limit is not cached.
+func (c *PrefixCache) put(key string, prefix formattedPrefix) {
+	encoded, err := json.Marshal(prefix.messages)
+	if err != nil || (c.maxBytes > 0 && len(encoded) > c.maxBytes) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*prefixEntry)
+		c.bytes += len(encoded) - entry.size
+		entry.prefix, entry.size = prefix, len(encoded)
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[key] = c.order.PushFront(&prefixEntry{key: key, prefix: prefix, size: len(encoded)})
+		c.bytes += len(encoded)
+	}
+	for c.order.Len() > c.maxEntries || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		entry := oldest.Value.(*prefixEntry)
+		delete(c.entries, entry.key)
+		c.bytes -= entry.size
+	}
+}
+
+// prefixBoundary is a point in a conversation where its formatted prefix can be cached, with the prefix's hash
+type prefixBoundary struct {
+	end int // the prefix is messages[:end]
+	key string
+}
+
+// prefixBoundaries returns the boundaries of a conversation's cacheable prefixes, in order. A prefix can be
+// cached when it ends with an assistant message, since the messages after it never merge into its Claude turns.
+func prefixBoundaries(messages []Message) ([]prefixBoundary, bool) {
+	var boundaries []prefixBoundary
+	hash := sha256.New()
+	for i, msg := range messages {
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			return nil, false
+		}
+		hash.Write(encoded)
+		hash.Write([]byte{'\n'})
+		if msg.Role == "assistant" {
+			boundaries = append(boundaries, prefixBoundary{end: i + 1, key: hex.EncodeToString(hash.Sum(nil))})
+		}
+	}
+	return boundaries, true
+}
+
+// formatClaudeMessages converts non-system messages, documents included, into Claude messages, fetching linked
+// documents within ctx. With the
+// payload cache enabled, the longest cached prefix of the conversation is reused so that a growing conversation
+// only formats its new messages, and the formatted prefix up to the last assistant message is cached for the
+// next turn.
+func formatClaudeMessages(ctx context.Context, messages []Message) ([]claudeMessage, error) {
+	var boundaries []prefixBoundary
+	ok := false
+	if payloadCache != nil {
+		boundaries, ok = prefixBoundaries(messages)
+	}
+	if !ok || len(boundaries) == 0 {
+		converted, err := withClaudeDocuments(ctx, messages)
+		if err != nil {
+			return nil, err
+		}
+		return toClaudeMessages(converted), nil
+	}
+
+	var prefix formattedPrefix
+	start := 0
+	for i := len(boundaries) - 1; i >= 0; i-- {
+		if cached, ok := payloadCache.get(boundaries[i].key); ok {
+			prefix, start = cached, boundaries[i].end
+			break
+		}
+	}
+
+	// Documents of the cached prefix still count towards the request's content limit
+	_, used := mediaPartStats(messages)
+	used += prefix.fetched
+
+	if last := boundaries[len(boundaries)-1]; last.end > start {
+		converted, fetched, err := convertClaudeDocuments(ctx, messages[start:last.end], used)
+		if err != nil {
+			return nil, err
+		}
+		formatted := append(append([]claudeMessage{}, prefix.messages...), toClaudeMessages(converted)...)
+		prefix = formattedPrefix{messages: formatted, fetched: prefix.fetched + fetched}
+		payloadCache.put(last.key, prefix)
+		used += fetched
+		start = last.end
+	}
+
+	converted, _, err := convertClaudeDocuments(ctx, messages[start:], used)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]claudeMessage{}, prefix.messages...), toClaudeMessages(converted)...), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPayloadCacheGrowingConversation(t *testing.T) {
+	conversation := []Message{
+		{Role: "system", Content: "You are terse."},
+		{Role: "user", Content: "What's the weather in Paris?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "weather", Arguments: `{"city": "Paris"}`}}}},
+		{Role: "tool", ToolCallID: "call_1", Content: "18C and sunny"},
+		{Role: "user", Content: "And tomorrow?"},
+		{Role: "assistant", Content: "Rain."},
+		{Role: "user", Content: "Thanks"},
+	}
+
+	shared := NewPrefixCache(10, 0)
+	defer func() { payloadCache = nil }()
+	for turn := 3; turn <= len(conversation); turn++ {
+		req := ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", Messages: conversation[:turn]}
+
+		payloadCache = nil
+		uncached, err := formatPayloadForModel(context.Background(), req)
+		if err != nil {
+			t.Fatalf("uncached payload at turn %d: %v", turn, err)
+		}
+		payloadCache = shared
+		cached, err := formatPayloadForModel(context.Background(), req)
+		if err != nil {
+			t.Fatalf("cached payload at turn %d: %v", turn, err)
+		}
+		if string(cached) != string(uncached) {
+			t.Errorf("turn %d: cached payload = %s, want %s", turn, cached, uncached)
+		}
+	}
+	if len(shared.entries) != 2 {
+		t.Errorf("cache holds %d prefixes, want one per assistant turn", len(shared.entries))
+	}
+
+	// A bounded cache evicts the least recently used prefix
+	small := NewPrefixCache(1, 0)
+	small.put("a", formattedPrefix{})
+	small.put("b", formattedPrefix{})
+	if _, ok := small.get("a"); ok {
+		t.Error("prefix a was not evicted")
+	}
+
+	// So does one over the byte limit, and a prefix larger than the whole limit is not cached at all
+	prefix := func(text string) formattedPrefix {
+		return formattedPrefix{messages: []claudeMessage{{Role: "user", Content: text}}}
+	}
+	bounded := NewPrefixCache(10, 100)
+	bounded.put("a", prefix(strings.Repeat("a", 40)))
+	bounded.put("b", prefix(strings.Repeat("b", 40)))
+	if _, ok := bounded.get("a"); ok {
+		t.Error("prefix a was not evicted beyond the byte limit")
+	}
+	if _, ok := bounded.get("b"); !ok {
+		t.Error("prefix b was evicted")
+	}
+	bounded.put("c", prefix(strings.Repeat("c", 200)))
+	if _, ok := bounded.get("c"); ok || bounded.bytes > 100 {
+		t.Errorf("oversized prefix cached, holding %d bytes", bounded.bytes)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ModelPricing holds the on-demand token rates for a model in USD
+type ModelPricing struct {
+	InputPer1K  float64 `json:"input_per_1k"`
+	OutputPer1K float64 `json:"output_per_1k"`
+}
+
+// LoadPricingTable reads a JSON object mapping model IDs to their pricing.
+// An empty path yields an empty table, which disables cost estimation.
+func LoadPricingTable(path string) (map[string]ModelPricing, error) {
+	table := make(map[string]ModelPricing)
+	if path == "" {
+		return table, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pricing file: %v", err)
+	}
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("unable to parse pricing file: %v", err)
+	}
+
+	return table, nil
+}
+
+// EstimateCost returns the estimated cost in USD of the given usage for a model.
+// Cross-region inference profile IDs (e.g. "us.anthropic...") fall back to the base model's pricing.
+func EstimateCost(model string, usage Usage) (float64, bool) {
+	pricing, ok := AppConfig.Pricing[model]
+	if !ok {
+		if _, baseModel, found := strings.Cut(model, "."); found {
+			pricing, ok = AppConfig.Pricing[baseModel]
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+
+	cost := float64(usage.PromptTokens)/1000*pricing.InputPer1K +
+		float64(usage.CompletionTokens)/1000*pricing.OutputPer1K
+	return cost, true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// SystemPromptData is the data available to system prompt templates
+type SystemPromptData struct {
+	// System is the client's system content
+	System string
+	// Model is the requested model ID
+	Model string
+}
+
+// LoadSystemPromptTemplates reads a JSON object mapping model families (e.g. "anthropic", "meta")
+// to Go text/template sources that wrap the client's system content.
+// An empty path yields no templates, so system content is passed through unchanged.
+func LoadSystemPromptTemplates(path string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	if path == "" {
+		return templates, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read system prompt templates: %v", err)
+	}
+
+	var sources map[string]string
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("unable to parse system prompt templates: %v", err)
+	}
+
+	for family, source := range sources {
+		tmpl, err := template.New(family).Option("missingkey=error").Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid system prompt template for %s: %v", family, err)
+		}
+		templates[family] = tmpl
+	}
+
+	return templates, nil
+}
+
+// ModelFamily returns the provider family of a model ID, ignoring any cross-region profile prefix
+// (e.g. "us.anthropic.claude-3-haiku-20240307-v1:0" -> "anthropic")
+func ModelFamily(model string) string {
+	for _, prefix := range crossRegionPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			model = strings.TrimPrefix(model, prefix)
+			break
+		}
+	}
+
+	family, _, _ := strings.Cut(model, ".")
+	return family
+}
+
+// RenderSystemPrompt wraps system content with the template configured for the model's family, if any
+func RenderSystemPrompt(model, system string) (string, error) {
+	tmpl, ok := AppConfig.SystemPromptTemplates[ModelFamily(model)]
+	if !ok {
+		return system, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, SystemPromptData{System: system, Model: model}); err != nil {
+		return "", fmt.Errorf("failed to render system prompt template: %v", err)
+	}
+
+	return buf.String(), nil
+}
+
+// Strategies for combining several system messages into the single system prompt models accept
+const (
+	SystemMessagesJoin   = "join"   // join them in order, separated by blank lines
+	SystemMessagesFirst  = "first"  // keep only the first
+	SystemMessagesLast   = "last"   // keep only the last
+	SystemMessagesReject = "reject" // reject requests with more than one
+)
+
+// errSystemMessages is reported for requests with several system messages under the reject strategy, which is a
+// bad request
+var errSystemMessages = errors.New("this gateway accepts at most one system message")
+
+// checkSystemMessages rejects a request with count system messages if the strategy allows only one
+func checkSystemMessages(count int, strategy string) error {
+	if strategy == SystemMessagesReject && count > 1 {
+		return fmt.Errorf("%w, but %d were sent", errSystemMessages, count)
+	}
+	return nil
+}
+
+// joinSystemMessages combines the text of a request's system messages according to the strategy
+func joinSystemMessages(messages []string, strategy string) (string, error) {
+	if len(messages) == 0 {
+		return "", nil
+	}
+
+	switch strategy {
+	case SystemMessagesFirst:
+		return messages[0], nil
+	case SystemMessagesLast:
+		return messages[len(messages)-1], nil
+	case SystemMessagesReject:
+		if err := checkSystemMessages(len(messages), strategy); err != nil {
+			return "", err
+		}
+		return messages[0], nil
+	default:
+		return strings.Join(messages, "\n\n"), nil
+	}
+}
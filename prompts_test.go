@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestJoinSystemMessages(t *testing.T) {
+	messages := []string{"Be brief.", "Answer in French."}
+	tests := []struct {
+		strategy string
+		want     string
+		wantErr  bool
+	}{
+		{strategy: SystemMessagesJoin, want: "Be brief.\n\nAnswer in French."},
+		{strategy: SystemMessagesFirst, want: "Be brief."},
+		{strategy: SystemMessagesLast, want: "Answer in French."},
+		{strategy: SystemMessagesReject, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := joinSystemMessages(messages, tt.strategy)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: got %q, %v; want %q, error %v", tt.strategy, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// Validation and formatting reject with the same error
+	restoreConfig(t)
+	AppConfig.SystemMessageStrategy = SystemMessagesReject
+	req := ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", Messages: []Message{
+		{Role: "system", Content: messages[0]}, {Role: "system", Content: messages[1]}, {Role: "user", Content: "Hi"},
+	}}
+	_, joinErr := joinSystemMessages(messages, SystemMessagesReject)
+	if err := req.Validate(); !errors.Is(err, errSystemMessages) || err.Error() != joinErr.Error() || chatErrorStatus(err) != http.StatusBadRequest {
+		t.Errorf("Validate() = %v, want %v with status 400", err, joinErr)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// promptTemplateRevision identifies the Llama and Mistral prompt formats for the system fingerprint; bump it
+// whenever either changes how a conversation is rendered
+const promptTemplateRevision = 2
+
+// promptTurn is a conversation turn rendered into a prompt template
+type promptTurn struct {
+	role string // "user" or "assistant"
+	text string
+}
+
+// messageText returns the text of a message's content: the string itself, or its text blocks concatenated
+func messageText(content interface{}) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []interface{}:
+		var text string
+		for _, block := range c {
+			if contentMap, ok := block.(map[string]interface{}); ok && contentMap["type"] == "text" {
+				if blockText, ok := contentMap["text"].(string); ok {
+					text += blockText
+				}
+			}
+		}
+		return text
+	}
+	return ""
+}
+
+// systemPrompt separates a request's system messages from the rest of its conversation, combining them with
+// SYSTEM_MESSAGE_STRATEGY and wrapping the result with the model family's system prompt template
+func systemPrompt(req ChatRequest) (string, []Message, error) {
+	var systemMessages []string
+	var conversation []Message
+	for _, msg := range req.Messages {
+		if msg.Role != "system" {
+			conversation = append(conversation, msg)
+			continue
+		}
+		if text := messageText(msg.Content); text != "" {
+			systemMessages = append(systemMessages, text)
+		}
+	}
+
+	system, err := joinSystemMessages(systemMessages, AppConfig.SystemMessageStrategy)
+	if err != nil || system == "" {
+		return "", conversation, err
+	}
+	system, err = RenderSystemPrompt(req.FormatModel(), system)
+	return system, conversation, err
+}
+
+// promptTurns converts a conversation into text turns for a prompt template. Tool results become user turns,
+// since the templates have no tool role, and turns without text, such as tool calls, are left out.
+func promptTurns(messages []Message) []promptTurn {
+	turns := make([]promptTurn, 0, len(messages))
+	for _, msg := range messages {
+		text := messageText(msg.Content)
+		if text == "" {
+			continue
+		}
+		role := "user"
+		if msg.Role == "assistant" {
+			role = "assistant"
+		}
+		turns = append(turns, promptTurn{role: role, text: text})
+	}
+	return turns
+}
+
+// llamaPrompt renders a conversation in Llama 3's chat template: the system prompt in its own system header
+// ahead of the turns, and an open assistant header for the model to complete
+func llamaPrompt(system string, turns []promptTurn) string {
+	var b strings.Builder
+	header := func(role string) {
+		b.WriteString("<|start_header_id|>" + role + "<|end_header_id|>\n\n")
+	}
+
+	b.WriteString("<|begin_of_text|>")
+	if system != "" {
+		header("system")
+		b.WriteString(system + "<|eot_id|>")
+	}
+	for _, turn := range turns {
+		header(turn.role)
+		b.WriteString(turn.text + "<|eot_id|>")
+	}
+	header("assistant")
+	return b.String()
+}
+
+// textMessages reduces messages to the text a prompt template sends, as user and assistant messages with
+// string content; system messages are kept for systemPrompt. Messages without text are kept, empty, so that
+// alternation errors still name the client's messages, and are left out by promptTurns.
+func textMessages(messages []Message) []Message {
+	result := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			result = append(result, msg)
+			continue
+		}
+		result = append(result, Message{Role: turnRole(msg), Content: messageText(msg.Content)})
+	}
+	return result
+}
+
+// templateAlternation returns the MESSAGE_ALTERNATION policy for a prompt template that can't express
+// consecutive turns of the same role, which merges them when the policy is off
+func templateAlternation(policy string) string {
+	if policy == AlternationOff || policy == "" {
+		return AlternationMerge
+	}
+	return policy
+}
+
+// mistralPrompt renders an alternating conversation in Mistral's instruction template, where user turns are
+// [INST] blocks and assistant turns end with </s>. The template has no system marker, so the system prompt
+// leads the first instruction.
+func mistralPrompt(system string, turns []promptTurn) string {
+	if system != "" && (len(turns) == 0 || turns[0].role != "user") {
+		turns = append([]promptTurn{{role: "user"}}, turns...)
+	}
+
+	var b strings.Builder
+	b.WriteString("<s>")
+	for i, turn := range turns {
+		if turn.role == "assistant" {
+			b.WriteString(" " + turn.text + "</s>")
+			continue
+		}
+		text := turn.text
+		if i == 0 && system != "" {
+			text = strings.TrimSpace(system + "\n\n" + text)
+		}
+		b.WriteString("[INST] " + text + " [/INST]")
+	}
+	return b.String()
+}
+
+// formatLlamaPayload formats the request for Meta Llama's text generation API, as a Llama 3 chat prompt
+func formatLlamaPayload(req ChatRequest) ([]byte, error) {
+	system, conversation, err := systemPrompt(req)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"prompt":      llamaPrompt(system, promptTurns(conversation)),
+		"max_gen_len": EffectiveMaxTokens(req),
+	}
+	setSamplingParameters(payload, req)
+	delete(payload, "top_k") // Llama's API has no top_k
+
+	return json.Marshal(mergeAdditionalModelFields(payload, req.AdditionalModelFields))
+}
+
+// formatMistralPayload formats the request for Mistral's text generation API, as an instruction prompt
+func formatMistralPayload(req ChatRequest) ([]byte, error) {
+	messages, err := enforceAlternation(textMessages(req.Messages), templateAlternation(AppConfig.MessageAlternation))
+	if err != nil {
+		return nil, err
+	}
+	req.Messages = messages
+
+	system, conversation, err := systemPrompt(req)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"prompt":     mistralPrompt(system, promptTurns(conversation)),
+		"max_tokens": EffectiveMaxTokens(req),
+	}
+	setSamplingParameters(payload, req)
+	if len(req.Stop) > 0 {
+		payload["stop"] = req.Stop
+	}
+
+	return json.Marshal(mergeAdditionalModelFields(payload, req.AdditionalModelFields))
+}
+
+// parseLlamaResponse parses a Meta Llama response, which carries the generation and its token counts
+func parseLlamaResponse(body []byte) (*ChatResult, error) {
+	var response struct {
+		Generation           *string `json:"generation"`
+		PromptTokenCount     int     `json:"prompt_token_count"`
+		GenerationTokenCount int     `json:"generation_token_count"`
+		StopReason           string  `json:"stop_reason"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse response: %v", errMalformedResponse, err)
+	}
+	if response.Generation == nil && response.StopReason == "" {
+		return nil, fmt.Errorf("%w: no generation in response", errMalformedResponse)
+	}
+
+	result := &ChatResult{
+		FinishReason: ConvertFinishReason(response.StopReason),
+		Usage: Usage{
+			PromptTokens:     response.PromptTokenCount,
+			CompletionTokens: response.GenerationTokenCount,
+			TotalTokens:      response.PromptTokenCount + response.GenerationTokenCount,
+		},
+	}
+	if response.Generation != nil {
+		result.Content = *response.Generation
+	}
+	return result, nil
+}
+
+// parseMistralResponse parses a Mistral response, which carries its text in an outputs array without token counts
+func parseMistralResponse(body []byte) (*ChatResult, error) {
+	var response struct {
+		Outputs []struct {
+			Text       string `json:"text"`
+			StopReason string `json:"stop_reason"`
+		} `json:"outputs"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse response: %v", errMalformedResponse, err)
+	}
+	if len(response.Outputs) == 0 {
+		return nil, fmt.Errorf("%w: no outputs in response", errMalformedResponse)
+	}
+
+	return &ChatResult{
+		Content:      response.Outputs[0].Text,
+		FinishReason: ConvertFinishReason(response.Outputs[0].StopReason),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestPromptTemplates(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+		{Role: "system", Content: "Answer in French."},
+		{Role: "assistant", Content: "Bonjour"},
+		{Role: "user", Content: "How are you?"},
+		{Role: "user", Content: []interface{}{map[string]interface{}{"type": "text", "text": "Briefly."}}},
+	}
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{
+			model: "meta.llama3-8b-instruct-v1:0",
+			want: "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nBe brief.\n\nAnswer in French.<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\nBonjour<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nHow are you?<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nBriefly.<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\n",
+		},
+		{
+			model: "mistral.mistral-7b-instruct-v0:2",
+			want:  "<s>[INST] Be brief.\n\nAnswer in French.\n\nHi [/INST] Bonjour</s>[INST] How are you?\n\nBriefly. [/INST]",
+		},
+	}
+	for _, tt := range tests {
+		payload, err := formatPayloadForModel(context.Background(), ChatRequest{Model: tt.model, Messages: messages})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.model, err)
+		}
+		var decoded map[string]interface{}
+		json.Unmarshal(payload, &decoded)
+		if decoded["prompt"] != tt.want {
+			t.Errorf("%s: prompt = %q, want %q", tt.model, decoded["prompt"], tt.want)
+		}
+		if _, ok := decoded["messages"]; ok {
+			t.Errorf("%s: payload carries messages alongside the prompt", tt.model)
+		}
+	}
+
+	result, err := parseLlamaResponse([]byte(`{"generation":"Bien.","prompt_token_count":30,"generation_token_count":3,"stop_reason":"stop"}`))
+	if err != nil || result.Content != "Bien." || result.FinishReason != "stop" || result.Usage.TotalTokens != 33 {
+		t.Errorf("Llama response parsed as %+v (%v)", result, err)
+	}
+	result, err = parseMistralResponse([]byte(`{"outputs":[{"text":"Bien.","stop_reason":"length"}]}`))
+	if err != nil || result.Content != "Bien." || result.FinishReason != "length" {
+		t.Errorf("Mistral response parsed as %+v (%v)", result, err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errQueueFull is reported when a request arrives while the queue already holds its maximum depth
+var errQueueFull = errors.New("too many requests are waiting for Bedrock capacity; retry later")
+
+// errQueueTimeout is reported when a request waits longer than the queue's maximum wait without being admitted
+var errQueueTimeout = errors.New("timed out waiting for Bedrock capacity; retry later")
+
+// requestQueue limits how many requests call Bedrock at once. Requests over the limit wait in a bounded
+// FIFO queue for a slot, up to a maximum wait; once the queue is full, further requests are rejected.
+type requestQueue struct {
+	mu       sync.Mutex
+	limit    int
+	maxDepth int
+	maxWait  time.Duration
+	active   int
+	waiters  list.List // of chan struct{}, closed when the waiter is handed a slot
+
+	// Counters reported by stats
+	admitted  uint64
+	rejected  uint64
+	timedOut  uint64
+	waited    uint64
+	totalWait time.Duration
+	longest   time.Duration
+}
+
+// QueueStats is a snapshot of the request queue's saturation
+type QueueStats struct {
+	Active        int    `json:"active"`
+	Limit         int    `json:"limit"`
+	Depth         int    `json:"depth"`
+	MaxDepth      int    `json:"max_depth"`
+	Admitted      uint64 `json:"admitted"`
+	Rejected      uint64 `json:"rejected"`
+	TimedOut      uint64 `json:"timed_out"`
+	Queued        uint64 `json:"queued"`
+	AverageWaitMs int64  `json:"average_wait_ms"`
+	MaxWaitMs     int64  `json:"max_wait_ms"`
+}
+
+// bedrockQueue admits requests to Bedrock when MAX_CONCURRENT_REQUESTS is set; nil admits everything
+var bedrockQueue *requestQueue
+
+// newRequestQueue creates a queue admitting limit concurrent requests, with up to maxDepth waiting at most maxWait
+func newRequestQueue(limit, maxDepth int, maxWait time.Duration) *requestQueue {
+	return &requestQueue{limit: limit, maxDepth: maxDepth, maxWait: maxWait}
+}
+
+// acquire waits for a slot and returns the function that gives it back, along with how long the request waited
+func (q *requestQueue) acquire(ctx context.Context) (func(), time.Duration, error) {
+	q.mu.Lock()
+	if q.active < q.limit && q.waiters.Len() == 0 {
+		q.active++
+		q.admitted++
+		q.mu.Unlock()
+		return q.release, 0, nil
+	}
+	if q.waiters.Len() >= q.maxDepth {
+		q.rejected++
+		q.mu.Unlock()
+		return nil, 0, errQueueFull
+	}
+	ready := make(chan struct{})
+	element := q.waiters.PushBack(ready)
+	q.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(q.maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	}
+	wait := time.Since(start)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err != nil {
+		select {
+		case <-ready:
+			// The slot was handed over as the wait ended; pass it on rather than leak it
+			q.releaseLocked()
+		default:
+			q.waiters.Remove(element)
+		}
+		if err == errQueueTimeout {
+			q.timedOut++
+		}
+		return nil, wait, err
+	}
+
+	q.admitted++
+	q.waited++
+	q.totalWait += wait
+	q.longest = max(q.longest, wait)
+	return q.release, wait, nil
+}
+
+// release gives a slot back, handing it straight to the longest-waiting request if there is one
+func (q *requestQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *requestQueue) releaseLocked() {
+	if front := q.waiters.Front(); front != nil {
+		q.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	q.active--
+}
+
+// stats returns a snapshot of the queue's current depth and its admission and wait-time counters
+func (q *requestQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := QueueStats{
+		Active:    q.active,
+		Limit:     q.limit,
+		Depth:     q.waiters.Len(),
+		MaxDepth:  q.maxDepth,
+		Admitted:  q.admitted,
+		Rejected:  q.rejected,
+		TimedOut:  q.timedOut,
+		Queued:    q.waited,
+		MaxWaitMs: q.longest.Milliseconds(),
+	}
+	if q.waited > 0 {
+		stats.AverageWaitMs = (q.totalWait / time.Duration(q.waited)).Milliseconds()
+	}
+	return stats
+}
+
+// admission holds the queue slots of one request. Slots are taken for the model each attempt invokes: its queue,
+// when MODEL_CONCURRENCY_LIMITS sets one, and then the global Bedrock queue. The model's queue comes first, so
+// requests waiting on a saturated model don't hold global slots other models could use.
+type admission struct {
+	ctx      context.Context // the request's context, which bounds the waits without any operation timeout
+	model    string          // the model whose slots are held, when held is set
+	held     bool
+	releases []func()
+	waited   time.Duration
+}
+
+// admissionKey is the context key under which a request's admission travels to the fallback loops
+type admissionKey struct{}
+
+// admitModel waits for the slots to invoke model, giving back those held for another model first.
+// Holding the slots of model already, it returns at once.
+func (a *admission) admitModel(model string) error {
+	if a.held && a.model == model {
+		return nil
+	}
+	a.release()
+
+	for _, queue := range []*requestQueue{modelQueueFor(model), bedrockQueue} {
+		if queue == nil {
+			continue
+		}
+		releaseSlot, wait, err := queue.acquire(a.ctx)
+		a.waited += wait
+		if err != nil {
+			a.release()
+			return err
+		}
+		a.releases = append(a.releases, releaseSlot)
+	}
+	a.model, a.held = model, true
+	return nil
+}
+
+// release gives back the slots held, if any
+func (a *admission) release() {
+	for i := len(a.releases) - 1; i >= 0; i-- {
+		a.releases[i]()
+	}
+	a.releases, a.held = nil, false
+}
+
+// setWaitHeader reports in x-queue-wait-ms how long the request waited for its slots, if it did
+func (a *admission) setWaitHeader(c *gin.Context) {
+	if a.waited > 0 {
+		c.Writer.Header().Set("x-queue-wait-ms", strconv.FormatInt(a.waited.Milliseconds(), 10))
+	}
+}
+
+// admitAttempt moves the admission carried by ctx to the model an attempt is about to invoke. Requests without
+// one, such as health checks, are not queued.
+func admitAttempt(ctx context.Context, model string) error {
+	if a, ok := ctx.Value(admissionKey{}).(*admission); ok {
+		return a.admitModel(model)
+	}
+	return nil
+}
+
+// admitChat admits a chat request on the queues of the model it invokes first, resolving an application
+// inference profile to find its foundation model. The admission travels in the returned context, so the
+// fallback loops move it to the queues of any fallback they try. It fails with errQueueFull or errQueueTimeout
+// when a queue can't take the request, or the error of the failed resolution; it doesn't touch the response,
+// so the prompts of a completions request can be admitted concurrently.
+func admitChat(ctx context.Context, bedrockService *BedrockService, chatReq ChatRequest) (context.Context, *admission, error) {
+	a := &admission{ctx: ctx}
+	served, err := bedrockService.resolveApplicationProfile(a.ctx, chatReq)
+	if err == nil {
+		err = a.admitModel(served.FormatModel())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return context.WithValue(a.ctx, admissionKey{}, a), a, nil
+}
+
+// admit holds a request that invokes a single model until the model's queues admit it, rejecting it with 429
+// when either is full or the wait runs out. It returns the function that gives the slots back; the time spent
+// waiting is reported in x-queue-wait-ms.
+func admit(c *gin.Context, model string) (func(), bool) {
+	a := &admission{ctx: c.Request.Context()}
+	if err := a.admitModel(model); err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	a.setWaitHeader(c)
+	return a.release, true
+}
+
+// modelQueues limit concurrent requests per model ID prefix, as configured by MODEL_CONCURRENCY_LIMITS
+var modelQueues map[string]*requestQueue
+
+// newModelQueues creates a queue for each model ID prefix in limits, with the queue depth and wait of the global one
+func newModelQueues(limits map[string]string, maxDepth int, maxWait time.Duration) (map[string]*requestQueue, error) {
+	queues := make(map[string]*requestQueue, len(limits))
+	for prefix, value := range limits {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid concurrency limit %q for %s, must be a positive integer", value, prefix)
+		}
+		queues[prefix] = newRequestQueue(limit, maxDepth, maxWait)
+	}
+	return queues, nil
+}
+
+// modelQueueFor returns the queue with the longest prefix matching the model, ignoring any cross-region
+// profile prefix, or nil if the model has no limit of its own
+func modelQueueFor(model string) *requestQueue {
+	for _, prefix := range crossRegionPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			model = strings.TrimPrefix(model, prefix)
+			break
+		}
+	}
+
+	var best string
+	for prefix := range modelQueues {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return modelQueues[best]
+}
+
+// modelQueueStats returns a snapshot of each model queue, by its model ID prefix
+func modelQueueStats() map[string]QueueStats {
+	stats := make(map[string]QueueStats, len(modelQueues))
+	for prefix, queue := range modelQueues {
+		stats[prefix] = queue.stats()
+	}
+	return stats
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestQueue(t *testing.T) {
+	q := newRequestQueue(1, 1, 50*time.Millisecond)
+
+	release, _, err := q.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next request waits for the slot, and one more finds the queue full
+	admitted := make(chan error)
+	go func() {
+		release, _, err := q.acquire(context.Background())
+		if err == nil {
+			defer release()
+		}
+		admitted <- err
+	}()
+	for q.stats().Depth != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, err := q.acquire(context.Background()); err != errQueueFull {
+		t.Errorf("err = %v, want errQueueFull", err)
+	}
+
+	release()
+	if err := <-admitted; err != nil {
+		t.Errorf("queued request: %v", err)
+	}
+
+	// A request that waits longer than the maximum wait gives up
+	release, _, _ = q.acquire(context.Background())
+	if _, wait, err := q.acquire(context.Background()); err != errQueueTimeout || wait < 50*time.Millisecond {
+		t.Errorf("err = %v after %v, want errQueueTimeout after the maximum wait", err, wait)
+	}
+	release()
+
+	stats := q.stats()
+	if stats.Active != 0 || stats.Depth != 0 || stats.Admitted != 3 || stats.Rejected != 1 || stats.TimedOut != 1 || stats.Queued != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestAdmitModelQueues(t *testing.T) {
+	queues, err := newModelQueues(map[string]string{"anthropic.": "2", "anthropic.claude-3-5-sonnet": "1"}, 0, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modelQueues, bedrockQueue = queues, newRequestQueue(2, 0, 50*time.Millisecond)
+	defer func() { modelQueues, bedrockQueue = nil, nil }()
+
+	admitTo := func(model string) (func(), int) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+		release, _ := admit(c, model)
+		return release, recorder.Code
+	}
+
+	// The saturated Sonnet queue turns the next Sonnet request away without it taking a global slot
+	release, _ := admitTo("us.anthropic.claude-3-5-sonnet-20240620-v1:0")
+	defer release()
+	if _, status := admitTo("anthropic.claude-3-5-sonnet-20240620-v1:0"); status != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429 from the model queue", status)
+	}
+	release, status := admitTo("anthropic.claude-3-haiku-20240307-v1:0")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want Haiku admitted", status)
+	}
+	defer release()
+
+	if stats := modelQueueStats(); stats["anthropic.claude-3-5-sonnet"].Active != 1 || stats["anthropic."].Active != 1 || stats["anthropic.claude-3-5-sonnet"].Rejected != 1 {
+		t.Errorf("stats = %+v, want one in flight per model", stats)
+	}
+	if _, err := newModelQueues(map[string]string{"meta.": "many"}, 0, time.Second); err == nil {
+		t.Error("expected an error for a non-numeric limit")
+	}
+}
+
+// queueObservingInvoker is a mockInvoker that records which model queues hold slots at each invocation
+type queueObservingInvoker struct {
+	*mockInvoker
+	active []map[string]int
+}
+
+func (q *queueObservingInvoker) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	active := map[string]int{}
+	for prefix, stats := range modelQueueStats() {
+		active[prefix] = stats.Active
+	}
+	q.active = append(q.active, active)
+	return q.mockInvoker.InvokeModel(ctx, params, optFns...)
+}
+
+func TestAdmitChatFollowsFallbacks(t *testing.T) {
+	restoreConfig(t)
+	sonnet, haiku := "anthropic.claude-3-5-sonnet-20240620-v1:0", "anthropic.claude-3-haiku-20240307-v1:0"
+	AppConfig.ModelFallbacks = map[string]string{sonnet: haiku}
+	queues, err := newModelQueues(map[string]string{"anthropic.claude-3-5-sonnet": "1", "anthropic.claude-3-haiku": "1"}, 0, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modelQueues = queues
+	defer func() { modelQueues = nil }()
+
+	service, mock := newTestService(`{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	mock.failures = []error{&types.ThrottlingException{Message: aws.String("slow down")}}
+	invoker := &queueObservingInvoker{mockInvoker: mock}
+	service.client = invoker
+
+	ctx, queued, err := admitChat(context.Background(), service, ChatRequest{Model: sonnet, Messages: []Message{{Role: "user", Content: "Hi"}}})
+	if err != nil {
+		t.Fatalf("expected the request to be admitted: %v", err)
+	}
+	if _, _, err := service.ProcessChatWithFallback(ctx, ChatRequest{Model: sonnet, Messages: []Message{{Role: "user", Content: "Hi"}}}); err != nil {
+		t.Fatal(err)
+	}
+	queued.release()
+
+	// Each attempt holds the slot of the model it invokes, and only that one
+	want := []map[string]int{
+		{"anthropic.claude-3-5-sonnet": 1, "anthropic.claude-3-haiku": 0},
+		{"anthropic.claude-3-5-sonnet": 0, "anthropic.claude-3-haiku": 1},
+	}
+	if len(invoker.active) != len(want) {
+		t.Fatalf("%d invocations, want %d", len(invoker.active), len(want))
+	}
+	for i, active := range invoker.active {
+		for prefix, n := range want[i] {
+			if active[prefix] != n {
+				t.Errorf("attempt %d: %s queue active = %d, want %d", i, prefix, active[prefix], n)
+			}
+		}
+	}
+	for prefix, stats := range modelQueueStats() {
+		if stats.Active != 0 {
+			t.Errorf("%s queue active = %d after release, want 0", prefix, stats.Active)
+		}
+	}
+}
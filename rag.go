@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	"github.com/gin-gonic/gin"
+)
+
+// RAGClient is the subset of the Bedrock agent runtime client used to answer from knowledge bases.
+// It is satisfied by *bedrockagentruntime.Client and lets tests substitute canned responses.
+type RAGClient interface {
+	RetrieveAndGenerate(ctx context.Context, params *bedrockagentruntime.RetrieveAndGenerateInput, optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveAndGenerateOutput, error)
+}
+
+// RAGRequest asks a question to be answered from a knowledge base
+type RAGRequest struct {
+	Model string `json:"model" binding:"required"`
+	Query string `json:"query" binding:"required"`
+
+	// KnowledgeBaseID selects one of the knowledge bases in KNOWLEDGE_BASE_IDS; KNOWLEDGE_BASE_ID when omitted
+	KnowledgeBaseID string `json:"knowledge_base_id,omitempty"`
+
+	// SessionID continues the conversation of an earlier response, so follow-up questions keep their context
+	SessionID string `json:"session_id,omitempty"`
+
+	// NumberOfResults is how many passages to retrieve for the answer; the knowledge base's default when omitted
+	NumberOfResults int `json:"number_of_results,omitempty"`
+}
+
+// RAGResponse is an answer grounded in a knowledge base, with the passages it cites
+type RAGResponse struct {
+	ID           string        `json:"id"`
+	Object       string        `json:"object"`
+	Created      int64         `json:"created"`
+	Model        string        `json:"model"`
+	Answer       string        `json:"answer"`
+	FinishReason string        `json:"finish_reason"`
+	Citations    []RAGCitation `json:"citations"`
+	SessionID    string        `json:"session_id,omitempty"`
+}
+
+// RAGCitation ties a part of the answer, by its offsets in the answer, to the retrieved passages that support it
+type RAGCitation struct {
+	Text    string      `json:"text"`
+	Start   int         `json:"start"`
+	End     int         `json:"end"`
+	Sources []RAGSource `json:"sources"`
+}
+
+// RAGSource is a retrieved passage and where it came from
+type RAGSource struct {
+	Type     string                 `json:"type,omitempty"`
+	Location string                 `json:"location,omitempty"`
+	Content  string                 `json:"content,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// Validate checks the request for problems that should be reported to the client as a bad request
+func (r RAGRequest) Validate() error {
+	if strings.TrimSpace(r.Query) == "" {
+		return errors.New("query must not be empty")
+	}
+	if r.NumberOfResults < 0 || r.NumberOfResults > 100 {
+		return fmt.Errorf("number_of_results must be between 1 and 100; got %d", r.NumberOfResults)
+	}
+	return nil
+}
+
+// knowledgeBase returns the knowledge base a request queries and whether its caller may query it: the one it
+// names if KNOWLEDGE_BASE_IDS allows it, and KNOWLEDGE_BASE_ACCESS for the caller when that is set, or else the
+// default KNOWLEDGE_BASE_ID
+func knowledgeBase(req RAGRequest, principal string) (string, bool) {
+	if req.KnowledgeBaseID == "" {
+		return AppConfig.KnowledgeBaseID, true
+	}
+	if req.KnowledgeBaseID == AppConfig.KnowledgeBaseID {
+		return req.KnowledgeBaseID, true
+	}
+	if len(AppConfig.KnowledgeBaseAccess) > 0 && !slices.Contains(knowledgeBaseGrants(AppConfig.KnowledgeBaseAccess[principal]), req.KnowledgeBaseID) {
+		return req.KnowledgeBaseID, false
+	}
+	return req.KnowledgeBaseID, slices.Contains(AppConfig.KnowledgeBaseIDs, req.KnowledgeBaseID)
+}
+
+// knowledgeBaseGrants splits the "|"-separated knowledge bases KNOWLEDGE_BASE_ACCESS grants a principal
+func knowledgeBaseGrants(granted string) []string {
+	var grants []string
+	for _, id := range strings.Split(granted, "|") {
+		if id = strings.TrimSpace(id); id != "" {
+			grants = append(grants, id)
+		}
+	}
+	return grants
+}
+
+// ValidateKnowledgeBaseAccess checks that KNOWLEDGE_BASE_ACCESS names principals by full key fingerprints and only
+// grants knowledge bases of KNOWLEDGE_BASE_IDS, which a typo would otherwise silently fail to grant
+func ValidateKnowledgeBaseAccess(access map[string]string) error {
+	for principal, granted := range access {
+		fingerprint, ok := strings.CutPrefix(principal, "key:")
+		if _, err := hex.DecodeString(fingerprint); !ok || err != nil || len(fingerprint) != 2*sha256.Size {
+			return fmt.Errorf("principal %q must be the full fingerprint of an API key, key:<the 64 hex digits of its SHA-256>", principal)
+		}
+		for _, id := range knowledgeBaseGrants(granted) {
+			if !slices.Contains(AppConfig.KnowledgeBaseIDs, id) {
+				return fmt.Errorf("knowledge base %q granted to %s is not in KNOWLEDGE_BASE_IDS", id, principal)
+			}
+		}
+	}
+	return nil
+}
+
+// ragSessionTTL is how long a knowledge base session stays bound to the caller that started it, longer than
+// Bedrock keeps sessions
+const ragSessionTTL = 24 * time.Hour
+
+// ragSessions records the principal that started each knowledge base session, so only that caller can continue it
+var ragSessions = newSessionOwners(ragSessionTTL)
+
+// sessionOwners maps session IDs, or the IDs of batch jobs, to the principals that started them, forgetting them
+// once they expire
+type sessionOwners struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	owners map[string]sessionOwner
+	order  []string // from oldest to newest
+}
+
+// sessionOwner is the principal that started a session, with the session's expiry
+type sessionOwner struct {
+	principal string
+	expires   time.Time
+}
+
+// newSessionOwners creates session ownership records that expire after ttl
+func newSessionOwners(ttl time.Duration) *sessionOwners {
+	return &sessionOwners{ttl: ttl, owners: make(map[string]sessionOwner)}
+}
+
+// set records principal as the owner of a new session, dropping expired sessions
+func (o *sessionOwners) set(id, principal string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	for len(o.order) > 0 && !now.Before(o.owners[o.order[0]].expires) {
+		delete(o.owners, o.order[0])
+		o.order = o.order[1:]
+	}
+	if _, ok := o.owners[id]; !ok {
+		o.order = append(o.order, id)
+	}
+	o.owners[id] = sessionOwner{principal: principal, expires: now.Add(o.ttl)}
+}
+
+// owns reports whether principal started the session with the given ID and it has not expired
+func (o *sessionOwners) owns(id, principal string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	owner, ok := o.owners[id]
+	return ok && owner.principal == principal && time.Now().Before(owner.expires)
+}
+
+// ProcessRAG answers the request's query from the knowledge base with the given ID
+func (s *BedrockService) ProcessRAG(ctx context.Context, req RAGRequest, knowledgeBaseID string) (*RAGResponse, error) {
+	modelARN, err := s.modelARN(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	config := &types.KnowledgeBaseRetrieveAndGenerateConfiguration{
+		KnowledgeBaseId: aws.String(knowledgeBaseID),
+		ModelArn:        aws.String(modelARN),
+	}
+	if req.NumberOfResults > 0 {
+		config.RetrievalConfiguration = &types.KnowledgeBaseRetrievalConfiguration{
+			VectorSearchConfiguration: &types.KnowledgeBaseVectorSearchConfiguration{NumberOfResults: aws.Int32(int32(req.NumberOfResults))},
+		}
+	}
+	input := &bedrockagentruntime.RetrieveAndGenerateInput{
+		Input: &types.RetrieveAndGenerateInput{Text: aws.String(req.Query)},
+		RetrieveAndGenerateConfiguration: &types.RetrieveAndGenerateConfiguration{
+			Type:                       types.RetrieveAndGenerateTypeKnowledgeBase,
+			KnowledgeBaseConfiguration: config,
+		},
+	}
+	if req.SessionID != "" {
+		input.SessionId = aws.String(req.SessionID)
+	}
+
+	resp, err := s.ragClient.RetrieveAndGenerate(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &RAGResponse{
+		ID:           GenerateMessageID(),
+		Object:       "rag.completion",
+		Created:      time.Now().Unix(),
+		Model:        req.Model,
+		FinishReason: "stop",
+		Citations:    []RAGCitation{},
+		SessionID:    aws.ToString(resp.SessionId),
+	}
+	if resp.Output != nil {
+		response.Answer = aws.ToString(resp.Output.Text)
+	}
+	if resp.GuardrailAction == types.GuadrailActionIntervened {
+		response.FinishReason = "content_filter"
+	}
+	for _, citation := range resp.Citations {
+		response.Citations = append(response.Citations, ragCitation(citation))
+	}
+	return response, nil
+}
+
+// ragCitation converts a citation of RetrieveAndGenerate's response
+func ragCitation(citation types.Citation) RAGCitation {
+	var result RAGCitation
+	if part := citation.GeneratedResponsePart; part != nil && part.TextResponsePart != nil {
+		result.Text = aws.ToString(part.TextResponsePart.Text)
+		if span := part.TextResponsePart.Span; span != nil {
+			result.Start, result.End = int(aws.ToInt32(span.Start)), int(aws.ToInt32(span.End))
+		}
+	}
+
+	result.Sources = make([]RAGSource, 0, len(citation.RetrievedReferences))
+	for _, reference := range citation.RetrievedReferences {
+		var source RAGSource
+		if reference.Content != nil {
+			source.Content = aws.ToString(reference.Content.Text)
+		}
+		if location := reference.Location; location != nil {
+			source.Type = strings.ToLower(string(location.Type))
+			source.Location = referenceLocation(location)
+		}
+		for key, value := range reference.Metadata {
+			var decoded interface{}
+			if err := value.UnmarshalSmithyDocument(&decoded); err != nil {
+				continue
+			}
+			if source.Metadata == nil {
+				source.Metadata = make(map[string]interface{})
+			}
+			source.Metadata[key] = decoded
+		}
+		result.Sources = append(result.Sources, source)
+	}
+	return result
+}
+
+// referenceLocation returns the URI, URL or identifier of a retrieved passage's source
+func referenceLocation(location *types.RetrievalResultLocation) string {
+	switch {
+	case location.S3Location != nil:
+		return aws.ToString(location.S3Location.Uri)
+	case location.WebLocation != nil:
+		return aws.ToString(location.WebLocation.Url)
+	case location.ConfluenceLocation != nil:
+		return aws.ToString(location.ConfluenceLocation.Url)
+	case location.SalesforceLocation != nil:
+		return aws.ToString(location.SalesforceLocation.Url)
+	case location.SharePointLocation != nil:
+		return aws.ToString(location.SharePointLocation.Url)
+	case location.KendraDocumentLocation != nil:
+		return aws.ToString(location.KendraDocumentLocation.Uri)
+	case location.CustomDocumentLocation != nil:
+		return aws.ToString(location.CustomDocumentLocation.Id)
+	case location.SqlLocation != nil:
+		return aws.ToString(location.SqlLocation.Query)
+	default:
+		return ""
+	}
+}
+
+// handleRAG answers a query from a knowledge base, the default KNOWLEDGE_BASE_ID or one the request selects
+// from KNOWLEDGE_BASE_IDS, returning the answer with its citations. Sessions can only be continued by the
+// caller that started them.
+func handleRAG(bedrockService *BedrockService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if AppConfig.KnowledgeBaseID == "" && len(AppConfig.KnowledgeBaseIDs) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "knowledge base answers are not enabled"})
+			return
+		}
+
+		var ragReq RAGRequest
+		if err := bindJSON(c, &ragReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := ragReq.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		principal := requestPrincipal(c)
+		knowledgeBaseID, allowed := knowledgeBase(ragReq, principal)
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("knowledge base %q is not allowed", knowledgeBaseID)})
+			return
+		}
+		if knowledgeBaseID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "knowledge_base_id is required, since KNOWLEDGE_BASE_ID is not configured"})
+			return
+		}
+		// Another caller's sessions are reported as missing, like unknown ones
+		if ragReq.SessionID != "" && !ragSessions.owns(ragReq.SessionID, principal) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no knowledge base session with id %q", ragReq.SessionID)})
+			return
+		}
+		if !checkModelAllowed(c, ragReq.Model) {
+			return
+		}
+		releaseSlot, ok := admit(c, ragReq.Model)
+		if !ok {
+			return
+		}
+		defer releaseSlot()
+
+		ctx, cancel := withOperationTimeout(c.Request.Context(), AppConfig.ChatTimeout)
+		defer cancel()
+
+		response, err := bedrockService.ProcessRAG(ctx, ragReq, knowledgeBaseID)
+		if err != nil {
+			log.Printf("Error answering from knowledge base %s: %v", knowledgeBaseID, err)
+			c.JSON(timeoutErrorStatus(err, awsErrorStatus(err)), gin.H{"error": err.Error()})
+			return
+		}
+		if ragReq.SessionID == "" && response.SessionID != "" {
+			ragSessions.set(response.SessionID, principal)
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	ragtypes "github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	"github.com/gin-gonic/gin"
+)
+
+// mockRAGClient is a RAGClient that records the request it is given and answers with one citation
+type mockRAGClient struct {
+	input *bedrockagentruntime.RetrieveAndGenerateInput
+}
+
+func (m *mockRAGClient) RetrieveAndGenerate(ctx context.Context, params *bedrockagentruntime.RetrieveAndGenerateInput, optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveAndGenerateOutput, error) {
+	m.input = params
+	return &bedrockagentruntime.RetrieveAndGenerateOutput{
+		Output:    &ragtypes.RetrieveAndGenerateOutput{Text: aws.String("Refunds take 5 days.")},
+		SessionId: aws.String("session-1"),
+		Citations: []ragtypes.Citation{{
+			GeneratedResponsePart: &ragtypes.GeneratedResponsePart{TextResponsePart: &ragtypes.TextResponsePart{
+				Text: aws.String("Refunds take 5 days."),
+				Span: &ragtypes.Span{Start: aws.Int32(0), End: aws.Int32(19)},
+			}},
+			RetrievedReferences: []ragtypes.RetrievedReference{{
+				Content: &ragtypes.RetrievalResultContent{Text: aws.String("Refunds are processed within 5 business days.")},
+				Location: &ragtypes.RetrievalResultLocation{
+					Type:       ragtypes.RetrievalResultLocationTypeS3,
+					S3Location: &ragtypes.RetrievalResultS3Location{Uri: aws.String("s3://docs/refunds.md")},
+				},
+			}},
+		}},
+	}, nil
+}
+
+func TestRAG(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.KnowledgeBaseID = "KB123"
+
+	ragClient := &mockRAGClient{}
+	service := &BedrockService{ragClient: ragClient, awsConfig: aws.Config{Region: "us-east-1"}}
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/rag", strings.NewReader(`{"model": "anthropic.claude-3-haiku-20240307-v1:0", "query": "How long do refunds take?", "number_of_results": 3}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handleRAG(service)(c)
+
+	var response RAGResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if recorder.Code != http.StatusOK || response.Answer != "Refunds take 5 days." || response.SessionID != "session-1" {
+		t.Fatalf("response = %d %+v, want the grounded answer", recorder.Code, response)
+	}
+	if len(response.Citations) != 1 || response.Citations[0].End != 19 || len(response.Citations[0].Sources) != 1 {
+		t.Fatalf("citations = %+v, want one citation with its source", response.Citations)
+	}
+	if source := response.Citations[0].Sources[0]; source.Type != "s3" || source.Location != "s3://docs/refunds.md" {
+		t.Errorf("source = %+v, want the S3 document", source)
+	}
+
+	config := ragClient.input.RetrieveAndGenerateConfiguration.KnowledgeBaseConfiguration
+	if aws.ToString(config.KnowledgeBaseId) != "KB123" || aws.ToString(config.ModelArn) != "arn:aws:bedrock:us-east-1::foundation-model/anthropic.claude-3-haiku-20240307-v1:0" {
+		t.Errorf("knowledge base configuration = %+v, want the configured knowledge base and a model ARN", config)
+	}
+}
+
+// stalledRAGClient is a RAGClient that never answers, failing once the request's context is done
+type stalledRAGClient struct{}
+
+func (stalledRAGClient) RetrieveAndGenerate(ctx context.Context, params *bedrockagentruntime.RetrieveAndGenerateInput, optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveAndGenerateOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRAGTimeout(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.KnowledgeBaseID, AppConfig.ChatTimeout = "KB123", 20*time.Millisecond
+
+	service := &BedrockService{ragClient: stalledRAGClient{}}
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/rag", strings.NewReader(`{"model": "anthropic.claude-3-haiku-20240307-v1:0", "query": "Hi"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handleRAG(service)(c)
+
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504 once CHAT_TIMEOUT runs out", recorder.Code)
+	}
+}
+
+func TestRAGKnowledgeBaseSelection(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.KnowledgeBaseID, AppConfig.KnowledgeBaseIDs = "KB123", []string{"TENANT-A"}
+
+	ragClient := &mockRAGClient{}
+	service := &BedrockService{ragClient: ragClient}
+	ask := func(knowledgeBaseID, key string) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		body := fmt.Sprintf(`{"model": "anthropic.claude-3-haiku-20240307-v1:0", "query": "Hi", "knowledge_base_id": %q}`, knowledgeBaseID)
+		c.Request = httptest.NewRequest(http.MethodPost, "/rag", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Request.Header.Set("Authorization", "Bearer "+key)
+		handleRAG(service)(c)
+		return recorder.Code
+	}
+
+	if status := ask("TENANT-A", "tenant-a-key"); status != http.StatusOK {
+		t.Errorf("status = %d, want 200 for an allowlisted knowledge base", status)
+	}
+	if got := aws.ToString(ragClient.input.RetrieveAndGenerateConfiguration.KnowledgeBaseConfiguration.KnowledgeBaseId); got != "TENANT-A" {
+		t.Errorf("queried knowledge base = %q, want the selected one", got)
+	}
+	if status := ask("TENANT-B", "tenant-a-key"); status != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 for a knowledge base outside the allowlist", status)
+	}
+
+	// With KNOWLEDGE_BASE_ACCESS, each key may only select the knowledge bases granted to it
+	AppConfig.KnowledgeBaseIDs = []string{"TENANT-A", "TENANT-B"}
+	AppConfig.KnowledgeBaseAccess = map[string]string{keyPrincipal("Bearer tenant-a-key"): "TENANT-A"}
+	if err := ValidateKnowledgeBaseAccess(AppConfig.KnowledgeBaseAccess); err != nil {
+		t.Fatal(err)
+	}
+	if status := ask("TENANT-A", "tenant-a-key"); status != http.StatusOK {
+		t.Errorf("status = %d, want 200 for a granted knowledge base", status)
+	}
+	if status := ask("TENANT-B", "tenant-a-key"); status != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 for another tenant's knowledge base", status)
+	}
+	if status := ask("TENANT-A", "other-key"); status != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 for a key without grants", status)
+	}
+	if status := ask("KB123", "other-key"); status != http.StatusOK {
+		t.Errorf("status = %d, want 200 for the default knowledge base", status)
+	}
+	if err := ValidateKnowledgeBaseAccess(map[string]string{keyPrincipal("Bearer tenant-c-key"): "TENANT-C"}); err == nil {
+		t.Error("expected an error for a grant outside KNOWLEDGE_BASE_IDS")
+	}
+
+	// Grants name keys by their full fingerprint, since the short one in the audit log can be brute-forced
+	if err := ValidateKnowledgeBaseAccess(map[string]string{auditPrincipal("Bearer tenant-a-key"): "TENANT-A"}); err == nil {
+		t.Error("expected an error for a grant naming the audit log fingerprint")
+	}
+}
+
+func TestRAGSessionOwnership(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.KnowledgeBaseID = "KB123"
+	saved := ragSessions
+	ragSessions = newSessionOwners(time.Hour)
+	t.Cleanup(func() { ragSessions = saved })
+
+	service := &BedrockService{ragClient: &mockRAGClient{}}
+	ask := func(sessionID, key string) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		body := fmt.Sprintf(`{"model": "anthropic.claude-3-haiku-20240307-v1:0", "query": "Hi", "session_id": %q}`, sessionID)
+		c.Request = httptest.NewRequest(http.MethodPost, "/rag", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Request.Header.Set("Authorization", "Bearer "+key)
+		handleRAG(service)(c)
+		return recorder.Code
+	}
+
+	// The mock starts session-1, which from then on belongs to the key that started it
+	if status := ask("", "owner-key"); status != http.StatusOK {
+		t.Fatalf("status = %d, want a new session", status)
+	}
+	if status := ask("session-1", "owner-key"); status != http.StatusOK {
+		t.Errorf("status = %d, want the owner to continue its session", status)
+	}
+	if status := ask("session-1", "other-key"); status != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 for another key's session", status)
+	}
+	if status := ask("session-unknown", "owner-key"); status != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 for an unknown session", status)
+	}
+}
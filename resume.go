@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/gin-gonic/gin"
+)
+
+// errStreamGone is reported when the frames a client asks to resume from are no longer buffered
+var errStreamGone = errors.New("stream can no longer be resumed from this position")
+
+// errUnknownFrame is reported when a client asks to resume after a frame that was never sent
+var errUnknownFrame = errors.New("Last-Event-ID is beyond the end of the stream")
+
+// resumableStream buffers the SSE data frames of one generation so clients can replay them after reconnecting.
+// Frames are numbered from zero; once the buffer exceeds its byte limit the oldest frames are dropped.
+type resumableStream struct {
+	mu       sync.Mutex
+	frames   [][]byte
+	offset   int // number of the first buffered frame
+	size     int
+	maxBytes int
+	done     bool
+	expires  time.Time
+	notify   chan struct{}
+}
+
+// append buffers a frame and wakes any clients waiting for it
+func (s *resumableStream) append(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.frames = append(s.frames, append([]byte(nil), data...))
+	s.size += len(data)
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.frames) > 1 {
+		s.size -= len(s.frames[0])
+		s.frames = s.frames[1:]
+		s.offset++
+	}
+
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// finish marks the generation complete; the buffer stays resumable for ttl afterwards
+func (s *resumableStream) finish(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.done = true
+	s.expires = time.Now().Add(ttl)
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// read returns the frames from number next onwards, whether the generation is complete,
+// and a channel closed when more frames arrive
+func (s *resumableStream) read(next int) ([][]byte, bool, <-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if next < s.offset {
+		return nil, s.done, s.notify, errStreamGone
+	}
+	if next > s.offset+len(s.frames) {
+		return nil, s.done, s.notify, errUnknownFrame
+	}
+	return s.frames[next-s.offset:], s.done, s.notify, nil
+}
+
+// expired reports whether the stream finished longer than its TTL ago
+func (s *resumableStream) expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done && now.After(s.expires)
+}
+
+// resumableStreamStore holds the buffers of resumable streams by token, bounded in number
+type resumableStreamStore struct {
+	mu      sync.Mutex
+	streams map[string]*resumableStream
+	order   []string // tokens from oldest to newest
+}
+
+// streamBuffers holds the buffers of all resumable streams in this process
+var streamBuffers = &resumableStreamStore{streams: make(map[string]*resumableStream)}
+
+// create registers a new buffer under a fresh token, evicting expired and, if still full, the oldest buffers
+func (st *resumableStreamStore) create() (string, *resumableStream, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to generate resumption token: %v", err)
+	}
+	token := hex.EncodeToString(raw)
+	stream := &resumableStream{maxBytes: AppConfig.StreamResumptionMaxBytes, notify: make(chan struct{})}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	kept := st.order[:0]
+	for _, t := range st.order {
+		if st.streams[t].expired(now) {
+			delete(st.streams, t)
+			continue
+		}
+		kept = append(kept, t)
+	}
+	st.order = kept
+	for len(st.order) > 0 && len(st.order) >= AppConfig.StreamResumptionMaxStreams {
+		delete(st.streams, st.order[0])
+		st.order = st.order[1:]
+	}
+
+	st.streams[token] = stream
+	st.order = append(st.order, token)
+	return token, stream, nil
+}
+
+// get returns the buffer for a token if it exists and has not expired
+func (st *resumableStreamStore) get(token string) (*resumableStream, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	stream, ok := st.streams[token]
+	if !ok || stream.expired(time.Now()) {
+		return nil, false
+	}
+	return stream, true
+}
+
+// tailStream sends a resumable stream's frames to the client from frame number next, following the
+// generation until it completes or the client disconnects. Each frame carries its number as the SSE id,
+// which clients send back as Last-Event-ID when they reconnect.
+func tailStream(c *gin.Context, stream *resumableStream, next int) {
+	for {
+		frames, done, notify, err := stream.read(next)
+		if err != nil {
+			w := newChatStreamWriter(c, "")
+			w.writeError(err, "stream_gone")
+			return
+		}
+
+		for _, frame := range frames {
+			fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", next, frame)
+			next++
+		}
+		if len(frames) > 0 {
+			c.Writer.Flush()
+		}
+		if done {
+			// No frames follow the finish, so everything has been sent
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// relayResumable generates a stream into buffer in the background and tails the buffer to the client, calling
+// done when the generation ends. The generation outlives the handler, and gin reuses c for another request once
+// the handler returns, so the writer is detached from c before the generation starts.
+func relayResumable(ctx context.Context, c *gin.Context, w *chatStreamWriter, buffer *resumableStream, stream *bedrockruntime.InvokeModelWithResponseStreamEventStream, req ChatRequest, done func()) {
+	w.buffer = buffer
+	w.c = nil
+	go func() {
+		defer done()
+		defer buffer.finish(AppConfig.StreamResumptionTTL)
+		relayStream(ctx, w, stream, req)
+	}()
+	tailStream(c, buffer, 0)
+}
+
+// handleResumeStream reconnects a client to a resumable stream, replaying the frames after Last-Event-ID
+func handleResumeStream() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stream, ok := streamBuffers.get(c.Param("token"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown or expired resumption token"})
+			return
+		}
+		if !supportsFlush(c.Writer) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming is not supported by this connection"})
+			return
+		}
+
+		next := 0
+		if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+			id, err := strconv.Atoi(lastEventID)
+			if err != nil || id < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Last-Event-ID must be a frame number"})
+				return
+			}
+			next = id + 1
+		}
+
+		if _, _, _, err := stream.read(next); err == errStreamGone {
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		setSSEHeaders(c)
+		tailStream(c, stream, next)
+	}
+}
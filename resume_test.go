@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestRelayResumableOutlivesHandler drops the client of a resumable stream while the model is still generating,
+// serves other requests while the generation finishes, then resumes the stream. Run under -race, it catches the
+// generation touching the handler's gin.Context after gin has recycled it for another request.
+func TestRelayResumableOutlivesHandler(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.StreamResumption = true
+	AppConfig.LogHeaders = []string{"X-Tenant"}
+
+	model := "anthropic.claude-3-haiku-20240307-v1:0"
+	stream := newFakeStream(true,
+		`{"type":"content_block_delta","delta":{"type":"text_delta","text":"Hello"}}`,
+		`{"type":"content_block_delta","delta":{"type":"text_delta","text":" world"}}`)
+	finished := make(chan struct{})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/chat/completions", func(c *gin.Context) {
+		token, buffer, err := streamBuffers.create()
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Writer.Header().Set("x-stream-resumption-token", token)
+		setSSEHeaders(c)
+		relayResumable(context.Background(), c, newChatStreamWriter(c, model), buffer, stream, ChatRequest{Model: model}, func() { close(finished) })
+	})
+	r.GET("/chat/completions/resume/:token", handleResumeStream())
+
+	// The client is already gone, so the handler returns as soon as it has tailed what is buffered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/chat/completions", nil).WithContext(ctx)
+	req.Header.Set("X-Tenant", "acme")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	token := recorder.Header().Get("x-stream-resumption-token")
+
+	// Once the model has sent everything, let the generation finish while gin hands its pooled contexts to other requests
+	buffer, _ := streamBuffers.get(token)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if frames, _, _, _ := buffer.read(0); len(frames) >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the model's chunks were never relayed")
+		}
+	}
+	stream.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/chat/completions/resume/unknown", nil)
+			req.Header.Set("X-Tenant", "other")
+			r.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation never finished")
+	}
+
+	resumed := httptest.NewRecorder()
+	r.ServeHTTP(resumed, httptest.NewRequest(http.MethodGet, "/chat/completions/resume/"+token, nil))
+	body := resumed.Body.String()
+	if !strings.Contains(body, `"content":"Hello"`) || !strings.Contains(body, `"content":" world"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("resumed stream = %s, want the whole generation through [DONE]", body)
+	}
+}
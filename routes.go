@@ -1,145 +1,568 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
-// SetupRoutes configures all the routes for the application
+// SetupRoutes configures all the routes for the application.
+// Handlers that invoke models wait their turn in the Bedrock request queues, once they know the model, when
+// MAX_CONCURRENT_REQUESTS or MODEL_CONCURRENCY_LIMITS is set.
 func SetupRoutes(r gin.IRouter, bedrockService *BedrockService) {
-	// Chat endpoint
+	// Chat endpoint; streams when the request sets stream: true, as in OpenAI's API
 	r.POST("/chat/completions", handleChat(bedrockService))
 
-	// Stream chat endpoint
+	// Legacy stream chat endpoint, kept for existing clients
 	r.POST("/chat/completions/stream", handleChatStream(bedrockService))
 
+	// Retrieve a completion stored with store: true
+	r.GET("/chat/completions/:id", handleGetChatCompletion())
+
+	// Stop an in-flight streamed generation by the id of its chunks
+	r.POST("/chat/completions/:id/cancel", handleCancelChatCompletion())
+
+	// Reconnect to a resumable stream by the token from its x-stream-resumption-token header
+	r.GET("/chat/completions/resume/:token", handleResumeStream())
+
+	// Dry-run endpoint that prepares a chat request without invoking the model
+	r.POST("/chat/completions/validate", handleValidateChat(bedrockService))
+
+	// Legacy text completions endpoint, for clients that predate the chat API
+	r.POST("/completions", handleCompletions(bedrockService))
+
 	// List models endpoint
 	r.GET("/models", handleListModels(bedrockService))
+
+	// Embeddings endpoints; the query variant defaults input_type for retrieval queries
+	r.POST("/embeddings", handleEmbeddings(bedrockService, "search_document"))
+	r.POST("/embeddings/query", handleEmbeddings(bedrockService, "search_query"))
+
+	// Bulk embeddings endpoint for newline-delimited input, embedded and returned as NDJSON in batches
+	r.POST("/embeddings/bulk", handleBulkEmbeddings(bedrockService, "search_document"))
+
+	// Batch inference: submit a job over a JSONL file in S3, then poll it by the job ARN
+	r.POST("/batch/jobs", handleCreateBatchJob(bedrockService))
+	r.GET("/batch/jobs/*id", handleGetBatchJob(bedrockService))
+
+	// Answers grounded in a Bedrock knowledge base, with citations
+	r.POST("/rag", handleRAG(bedrockService))
 }
 
-// handleChat handles the chat completion endpoint
+// handleChat handles the chat completion endpoint, streaming the response when the request sets stream: true
 func handleChat(bedrockService *BedrockService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var chatReq ChatRequest
-		if err := c.ShouldBindJSON(&chatReq); err != nil {
-			log.Printf("Error binding JSON: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		chatReq, ok := bindChatRequest(c)
+		if !ok {
 			return
 		}
-		log.Printf("Received chat request: %+v", chatReq)
-		response, err := bedrockService.ProcessChat(c.Request.Context(), chatReq)
-		if err != nil {
-			log.Printf("Error processing chat: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+
+		if chatReq.Stream {
+			streamChat(c, bedrockService, chatReq)
 			return
 		}
-
-		c.JSON(http.StatusOK, ChatResponse{
-			ID:      GenerateMessageID(),
-			Object:  "chat.completion",
-			Created: time.Now().Unix(),
-			Model:   chatReq.Model,
-			Choices: []Choice{
-				{
-					Index: 0,
-					Message: ChatResponseMessage{
-						Role:    "assistant",
-						Content: response,
-					},
-					FinishReason: "stop",
-				},
-			},
-			Usage: Usage{
-				PromptTokens:     1, // TODO: Implement actual token counting
-				CompletionTokens: 1,
-				TotalTokens:      2,
-			},
-		})
+		completeChat(c, bedrockService, chatReq)
 	}
 }
 
-// handleChatStream handles the streaming chat endpoint
+// handleChatStream handles the legacy streaming chat endpoint, which always streams regardless of the stream field
 func handleChatStream(bedrockService *BedrockService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var chatReq ChatRequest
-		if err := c.ShouldBindJSON(&chatReq); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		chatReq, ok := bindChatRequest(c)
+		if !ok {
 			return
 		}
 
-		// Set headers for SSE
-		c.Writer.Header().Set("Content-Type", "text/event-stream")
-		c.Writer.Header().Set("Cache-Control", "no-cache")
-		c.Writer.Header().Set("Connection", "keep-alive")
-		c.Writer.Header().Set("Transfer-Encoding", "chunked")
+		streamChat(c, bedrockService, chatReq)
+	}
+}
 
-		// Process chat with streaming
-		stream, err := bedrockService.ProcessChatStream(c.Request.Context(), chatReq)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+// bindChatRequest binds and validates a chat request, responding with 400 and returning false if it is invalid
+func bindChatRequest(c *gin.Context) (ChatRequest, bool) {
+	chatReq, err := parseChatRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return chatReq, false
+	}
+	if !checkModelAllowed(c, chatReq.Model) {
+		return chatReq, false
+	}
+	logRequest(c, "Received chat request: %s", SanitizeChatRequest(chatReq, AppConfig.Debug))
+
+	return chatReq, true
+}
+
+// parseChatRequest binds the request body into a ChatRequest, routes it and validates it. Routing comes first,
+// so a logical model name is validated as the model that serves it.
+func parseChatRequest(c *gin.Context) (ChatRequest, error) {
+	var chatReq ChatRequest
+	if err := bindJSON(c, &chatReq); err != nil {
+		log.Printf("Error binding JSON: %v", err)
+		return chatReq, err
+	}
+	applyModelRoute(c, &chatReq)
+	if err := chatReq.Validate(); err != nil {
+		return chatReq, err
+	}
+	chatReq.ApplySamplingProfile()
 
-		// Stream the response
-		for event := range stream.GetStream().Events() {
-			// Log the event type for debugging
-			log.Printf("Event type: %T", event)
+	return chatReq, nil
+}
 
-			// Try to extract bytes using reflection or type assertion
-			// This is a simplified approach - just print the event type and continue
-			c.Writer.Write([]byte("data: {\"content\": \"Streaming not fully implemented yet\"}\n\n"))
-			c.Writer.Flush()
+// bindJSON binds the request body into obj like ShouldBindJSON, once FIELD_ALIASES have been renamed. With
+// STRICT_REQUEST_VALIDATION, fields the request type doesn't have are rejected, naming the field, instead of
+// being silently ignored.
+func bindJSON(c *gin.Context, obj interface{}) error {
+	if err := applyFieldAliases(c.Request); err != nil {
+		return err
+	}
+	if !AppConfig.StrictRequestValidation {
+		return c.ShouldBindJSON(obj)
+	}
+	if c.Request == nil || c.Request.Body == nil {
+		return errors.New("invalid request")
+	}
+
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(obj); err != nil {
+		// encoding/json reports unknown fields as `json: unknown field "name"`
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return fmt.Errorf("unknown field %s", field)
 		}
+		return err
+	}
+	return binding.Validator.ValidateStruct(obj)
+}
+
+// checkModelAllowed responds with 403 and returns false if the model is not in the configured allowlist
+func checkModelAllowed(c *gin.Context, model string) bool {
+	if AppConfig.IsModelAllowed(model) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("model %q is not allowed", model)})
+	return false
+}
 
-		// Send the [DONE] message
-		c.Writer.Write([]byte("data: [DONE]\n\n"))
-		c.Writer.Flush()
+// applyModelRoute resolves a logical model name to its weighted target, reporting the route in the x-model-route
+// header; the chosen model is reported in the response's model field
+func applyModelRoute(c *gin.Context, chatReq *ChatRequest) {
+	if route := chatReq.ApplyModelRoute(); route != "" {
+		c.Header("x-model-route", route)
 	}
 }
 
-// handleListModels handles the list models endpoint
-func handleListModels(bedrockService *BedrockService) gin.HandlerFunc {
+// handleValidateChat runs binding, validation, model resolution and payload formatting for a chat request
+// and reports the outcome without invoking Bedrock
+func handleValidateChat(bedrockService *BedrockService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		models, err := bedrockService.ListBedrockModels(c.Request.Context())
+		chatReq, err := parseChatRequest(c)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"valid": false, "stage": "validation", "error": err.Error()})
+			return
+		}
+		if !AppConfig.IsModelAllowed(chatReq.Model) {
+			c.JSON(http.StatusForbidden, gin.H{"valid": false, "stage": "validation", "error": fmt.Sprintf("model %q is not allowed", chatReq.Model)})
 			return
 		}
 
-		// Format response in OpenAI-compatible format
-		modelList := make([]gin.H, len(models))
-		for i, model := range models {
-			modelList[i] = gin.H{
-				"id":       model,
-				"object":   "model",
-				"created":  1706745600,                   // You might want to adjust this timestamp
-				"owned_by": strings.Split(model, ".")[0], // Extract owner from model ID
-			}
+		serviceTier := chatReq.ApplyServiceTier()
+		chatReq, err = bedrockService.resolveApplicationProfile(c.Request.Context(), chatReq)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"valid": false, "stage": "model_resolution", "error": err.Error()})
+			return
+		}
+
+		if _, err := formatPayloadForModel(c.Request.Context(), chatReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"valid": false, "stage": "formatting", "error": err.Error()})
+			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"data": modelList})
+		promptTokens := EstimateMessageTokens(chatReq.Messages)
+		maxTokens := EffectiveMaxTokens(chatReq)
+		summary := gin.H{
+			"valid":                   true,
+			"model":                   chatReq.Model,
+			"invoked_model":           chatReq.InvocationModel(),
+			"format_model":            chatReq.FormatModel(),
+			"invocation_path":         InvocationPath(chatReq.InvocationModel()),
+			"estimated_prompt_tokens": promptTokens,
+			"max_tokens":              maxTokens,
+		}
+		if serviceTier != "" {
+			summary["service_tier"] = serviceTier
+		}
+		if capabilities, ok := LookupCapabilities(chatReq.FormatModel()); ok {
+			summary["context_window"] = capabilities.ContextWindow
+			summary["fits_context_window"] = promptTokens+maxTokens <= capabilities.ContextWindow
+		}
+
+		c.JSON(http.StatusOK, summary)
+	}
+}
+
+// completeChat invokes the model and writes a single chat.completion response
+func completeChat(c *gin.Context, bedrockService *BedrockService, chatReq ChatRequest) {
+	chatReq, result, serviceTier, ok := runChat(c, bedrockService, chatReq)
+	if !ok {
+		return
+	}
+
+	message := ChatResponseMessage{
+		Role:      "assistant",
+		ToolCalls: result.ToolCalls,
+	}
+	if result.Refusal != "" {
+		message.Refusal = &result.Refusal
+	} else {
+		message.Content = &result.Content
+	}
+	if AppConfig.ExposeReasoning {
+		message.ReasoningContent = result.ReasoningContent
+	}
+
+	response := ChatResponse{
+		ID:      GenerateMessageID(),
+		Object:  objectName(objectChatCompletion),
+		Created: result.Created.Unix(),
+		Model:   chatReq.Model,
+		Choices: []Choice{
+			{
+				Index:        0,
+				Message:      message,
+				FinishReason: result.FinishReason,
+			},
+		},
+		Usage:             result.Usage,
+		ServiceTier:       serviceTier,
+		SystemFingerprint: SystemFingerprint(chatReq),
+		Seed:              chatReq.Seed,
+	}
+
+	// Keep the response for later retrieval by ID when the client asks for it
+	if chatReq.Store && responseStore != nil {
+		responseStore.Put(requestPrincipal(c), response)
+	}
+
+	// Attach the raw Bedrock response for debugging when explicitly requested
+	if AppConfig.Debug && strings.EqualFold(c.GetHeader("x-include-raw-response"), "true") {
+		response.Raw = result.RawResponse
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// runChat routes and invokes a non-streaming chat request, records its usage and sets the billing headers.
+// It returns the resolved request, the result with a finish reason filled in, and the applied service tier;
+// on failure it responds with an error and returns false.
+func runChat(c *gin.Context, bedrockService *BedrockService, chatReq ChatRequest) (ChatRequest, *ChatResult, string, bool) {
+	// Route the request according to its service tier
+	serviceTier := chatReq.ApplyServiceTier()
+	setMaxTokensHeader(c, chatReq)
+
+	run := invokeChat(c.Request, bedrockService, chatReq)
+	run.setHeaders(c, chatReq.Model)
+	if run.err != nil {
+		c.JSON(chatErrorStatus(run.err), gin.H{"error": run.err.Error()})
+		return run.served, nil, serviceTier, false
+	}
+	return run.served, run.result, serviceTier, true
+}
+
+// chatRun is the outcome of one invocation by invokeChat
+type chatRun struct {
+	served ChatRequest // the request as it was served, by a fallback if the requested model failed
+	result *ChatResult
+	usage  UsageRecord
+	waited time.Duration // how long the request waited for its queue slots
+	err    error
+}
+
+// invokeChat admits a chat request, invokes the model with any fallbacks and records the usage. It only reads
+// the incoming request, so several can run at once; the handler reports the outcome with setHeaders.
+func invokeChat(r *http.Request, bedrockService *BedrockService, chatReq ChatRequest) chatRun {
+	ctx, queued, err := admitChat(r.Context(), bedrockService, chatReq)
+	if err != nil {
+		return chatRun{served: chatReq, err: err}
+	}
+	defer queued.release()
+
+	ctx, cancel := withOperationTimeout(ctx, AppConfig.ChatTimeout)
+	defer cancel()
+
+	served, result, err := bedrockService.ProcessChatWithFallback(ctx, chatReq)
+	run := chatRun{served: served, waited: queued.waited, err: err}
+	if err != nil {
+		log.Printf("Error processing chat: %v", err)
+		return run
+	}
+	if result.FinishReason == "" {
+		result.FinishReason = "stop"
+	}
+	run.result = result
+
+	run.usage = NewUsageRecord(served, result.Usage, false)
+	run.usage.Headers = capturedHeaders(r.Header)
+	LogUsage(run.usage)
+	return run
+}
+
+// setHeaders reports the queue wait of a run and, if it succeeded, its fallback, invocation path, latency,
+// retries and estimated cost for billing reconciliation
+func (run chatRun) setHeaders(c *gin.Context, requested string) {
+	if run.waited > 0 {
+		c.Writer.Header().Set("x-queue-wait-ms", strconv.FormatInt(run.waited.Milliseconds(), 10))
+	}
+	if run.err != nil {
+		return
+	}
+	setFallbackHeader(c, requested, run.served)
+	c.Header("x-bedrock-invocation-path", run.usage.InvocationPath)
+	c.Header("x-bedrock-latency-ms", strconv.FormatInt(run.result.BedrockLatency.Milliseconds(), 10))
+	c.Header("x-gateway-retries", strconv.Itoa(run.result.Retries))
+	if run.usage.EstimatedCostUSD != nil {
+		c.Header("x-estimated-cost-usd", fmt.Sprintf("%.6f", *run.usage.EstimatedCostUSD))
+	}
+}
+
+// streamChat invokes the model with response streaming and relays it to the client as chat.completion.chunk events
+func streamChat(c *gin.Context, bedrockService *BedrockService, chatReq ChatRequest) {
+	streamModel(c, bedrockService, chatReq, newChatStreamWriter)
+}
+
+// streamModel invokes the model with response streaming and relays it to the client as server-sent events,
+// using newWriter to choose the chunk format
+func streamModel(c *gin.Context, bedrockService *BedrockService, chatReq ChatRequest, newWriter func(*gin.Context, string) *chatStreamWriter) {
+	chatReq.ApplyServiceTier()
+
+	// Streaming is impossible if frames can't be flushed to the client as they are produced
+	if !supportsFlush(c.Writer) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming is not supported by this connection"})
+		return
+	}
+
+	ctx, queued, err := admitChat(c.Request.Context(), bedrockService, chatReq)
+	if err != nil {
+		c.JSON(chatErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	releaseSlot := queued.release
+
+	setMaxTokensHeader(c, chatReq)
+
+	// A resumable generation must keep running if the client disconnects, so it can reconnect and catch up
+	if AppConfig.StreamResumption {
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	// The timeout covers the whole stream, so it is released with the generation
+	ctx, cancelTimeout := withOperationTimeout(ctx, AppConfig.StreamTimeout)
+
+	// Register the generation under its completion ID so it can be cancelled out of band
+	w := newWriter(c, chatReq.Model)
+	storeStream(c, w, chatReq)
+	ctx, releaseRequest := activeRequests.register(ctx, w.id, requestPrincipal(c))
+	release := func() {
+		releaseRequest()
+		cancelTimeout()
+	}
+
+	// Process chat with streaming
+	requested := chatReq.Model
+	chatReq, stream, err := bedrockService.ProcessChatStreamWithFallback(ctx, chatReq)
+	queued.setWaitHeader(c)
+	if err != nil {
+		release()
+		releaseSlot()
+		failStream(c, w, chatErrorStatus(err), err)
+		return
+	}
+	c.Writer.Header().Set("x-bedrock-invocation-path", InvocationPath(chatReq.InvocationModel()))
+	c.Writer.Header().Set("x-gateway-retries", strconv.Itoa(sdkRetries(stream.ResultMetadata)))
+	setFallbackHeader(c, requested, chatReq)
+	w.model = chatReq.Model
+	w.systemFingerprint = SystemFingerprint(chatReq)
+
+	if !AppConfig.StreamResumption {
+		// Stream the response; SSE headers are only set once the invocation has succeeded
+		defer releaseSlot()
+		defer release()
+		setSSEHeaders(c)
+		relayStream(ctx, w, stream.GetStream(), chatReq)
+		return
+	}
+
+	// Generate into a buffer in the background and relay it, so a reconnecting client can pick up where it left off
+	token, buffer, err := streamBuffers.create()
+	if err != nil {
+		release()
+		releaseSlot()
+		stream.GetStream().Close()
+		failStream(c, w, http.StatusInternalServerError, err)
+		return
+	}
+	c.Writer.Header().Set("x-stream-resumption-token", token)
+	setSSEHeaders(c)
+
+	relayResumable(ctx, c, w, buffer, stream.GetStream(), chatReq, func() {
+		release()
+		releaseSlot()
+	})
+}
+
+// failStream reports a failure to start the stream the way streaming clients expect to read it: with the
+// error's status, an SSE error frame and the terminating frame
+func failStream(c *gin.Context, w *chatStreamWriter, status int, err error) {
+	setSSEHeaders(c)
+	c.Status(status)
+	w.writeError(err, streamErrorType(status))
+	w.writeDone()
+}
+
+// setMaxTokensHeader warns the client with x-max-tokens-clamped when its max_tokens exceeds the server cap
+func setMaxTokensHeader(c *gin.Context, chatReq ChatRequest) {
+	if MaxTokensClamped(chatReq) {
+		c.Writer.Header().Set("x-max-tokens-clamped", strconv.Itoa(AppConfig.ServerMaxOutputTokens))
 	}
 }
 
-// handleEmbeddings handles the embeddings endpoint
-func handleEmbeddings(bedrockService *BedrockService) gin.HandlerFunc {
+// setFallbackHeader reports in x-model-fallback-from the model a request asked for when a fallback served it instead
+func setFallbackHeader(c *gin.Context, requested string, served ChatRequest) {
+	if served.Model != requested {
+		c.Writer.Header().Set("x-model-fallback-from", requested)
+	}
+}
+
+// setSSEHeaders sets the response headers for a server-sent event stream.
+// Framing is left to net/http, which chunks flushed HTTP/1.1 responses and sends HTTP/2 responses as DATA frames;
+// connection-specific headers such as Connection are forbidden under HTTP/2, so they are only set for HTTP/1.x.
+func setSSEHeaders(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	if c.Request.ProtoMajor == 1 {
+		c.Writer.Header().Set("Connection", "keep-alive")
+	}
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+}
+
+// handleEmbeddings handles the embeddings endpoints, applying defaultInputType when the request omits input_type
+func handleEmbeddings(bedrockService *BedrockService, defaultInputType string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var embeddingsReq EmbeddingsRequest
-		if err := c.ShouldBindJSON(&embeddingsReq); err != nil {
+		if err := bindJSON(c, &embeddingsReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := embeddingsReq.Validate(); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if !checkModelAllowed(c, embeddingsReq.Model) {
+			return
+		}
+		releaseSlot, ok := admit(c, embeddingsReq.Model)
+		if !ok {
+			return
+		}
+		defer releaseSlot()
+		if embeddingsReq.InputType == "" {
+			embeddingsReq.InputType = defaultInputType
+		}
 
-		response, err := bedrockService.ProcessEmbeddings(c.Request.Context(), embeddingsReq)
+		// The Accept header selects the response encoding; only JSON and NDJSON honor the body's encoding_format
+		format := c.NegotiateFormat(embeddingsJSON, embeddingsNDJSON, embeddingsFloat32)
+		if format == "" {
+			c.JSON(http.StatusNotAcceptable, gin.H{"error": fmt.Sprintf("the embeddings endpoint responds with %s, %s or %s", embeddingsJSON, embeddingsNDJSON, embeddingsFloat32)})
+			return
+		}
+		if format == embeddingsFloat32 {
+			if embeddingsReq.AllowPartial {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "allow_partial is not supported with " + embeddingsFloat32 + ", which cannot represent null embeddings"})
+				return
+			}
+			embeddingsReq.EncodingFormat = "float"
+		}
+
+		ctx, cancel := withOperationTimeout(c.Request.Context(), AppConfig.EmbeddingsTimeout)
+		defer cancel()
+
+		response, err := bedrockService.ProcessEmbeddings(ctx, embeddingsReq)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(timeoutErrorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, response)
+		// Multi-Status tells clients that some embeddings are null and listed in failed_indices for retry
+		status := http.StatusOK
+		if len(response.FailedIndices) > 0 {
+			status = http.StatusMultiStatus
+		}
+
+		switch format {
+		case embeddingsNDJSON:
+			c.Header("Content-Type", embeddingsNDJSON)
+			c.Status(status)
+			if err := writeEmbeddingsNDJSON(c.Writer, response); err != nil {
+				log.Printf("Error writing embeddings: %v", err)
+			}
+		case embeddingsFloat32:
+			data, dimensions, err := encodeEmbeddingsFloat32(response)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.Header("x-embedding-count", strconv.Itoa(len(response.Data)))
+			c.Header("x-embedding-dimensions", strconv.Itoa(dimensions))
+			c.Header("x-prompt-tokens", strconv.Itoa(response.Usage.PromptTokens))
+			c.Data(http.StatusOK, embeddingsFloat32, data)
+		default:
+			c.JSON(status, response)
+		}
+	}
+}
+
+// chatErrorStatus returns the HTTP status for a failed chat request: 400 for request content found to be over
+// the size limits only once documents were fetched, models rejected by STRICT_MODEL_SUPPORT, prompts rejected by
+// the context overflow policy, conversations rejected by MESSAGE_ALTERNATION and documents sent to models that take
+// none; 429 for a model whose queue is full or kept the request waiting too long; 502 for strict json_schema
+// responses that do not match the schema and model responses that can't be parsed; 504 for timeouts; and 500 otherwise
+func chatErrorStatus(err error) int {
+	if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, errContentTooLarge) || errors.Is(err, errModelUnsupported) || errors.Is(err, errContextOverflow) ||
+		errors.Is(err, errAlternation) || errors.Is(err, errDocumentsUnsupported) || errors.Is(err, errSystemMessages) ||
+		errors.Is(err, errCostTagProfiles) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errStructuredOutput) || errors.Is(err, errMalformedResponse) {
+		return http.StatusBadGateway
+	}
+	return timeoutErrorStatus(err, http.StatusInternalServerError)
+}
+
+// withOperationTimeout bounds an operation's context by its CHAT_TIMEOUT, STREAM_TIMEOUT or EMBEDDINGS_TIMEOUT,
+// with errOperationTimeout as the cause; a zero timeout leaves it unbounded
+func withOperationTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, errOperationTimeout)
+}
+
+// timeoutErrorStatus returns 504 for an invocation that failed because its operation timed out, or else status
+func timeoutErrorStatus(err error, status int) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
 	}
+	return status
 }
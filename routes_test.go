@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestChatContentTypeFollowsStream(t *testing.T) {
+	service, _ := newTestService(`{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn"}`)
+	for _, stream := range []bool{false, true} {
+		body := fmt.Sprintf(`{"model": "anthropic.claude-3-haiku-20240307-v1:0", "stream": %t, "messages": [{"role": "user", "content": "Hi"}]}`, stream)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		handleChat(service)(c)
+
+		if !stream {
+			if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+				t.Errorf("Content-Type = %q, want JSON", contentType)
+			}
+			if recorder.Header().Get("Cache-Control") != "" || recorder.Header().Get("X-Accel-Buffering") != "" {
+				t.Errorf("SSE headers set on a JSON response: %v", recorder.Header())
+			}
+			continue
+		}
+
+		// The mock can't stream, so the streamed request fails to start and reports it as an SSE error frame
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "text/event-stream" {
+			t.Errorf("stream: Content-Type = %q, want text/event-stream", contentType)
+		}
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("stream: status = %d, want the error's status", recorder.Code)
+		}
+		frames := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n\n")
+		if len(frames) != 2 || !strings.HasPrefix(frames[0], `data: {"error":{"message":`) || frames[1] != "data: [DONE]" {
+			t.Errorf("stream: body = %q, want an error frame and [DONE]", recorder.Body.String())
+		}
+	}
+}
+
+func TestStrictRequestValidation(t *testing.T) {
+	restoreConfig(t)
+
+	parse := func(body string) error {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body))
+		_, err := parseChatRequest(c)
+		return err
+	}
+	misspelled := `{"model":"anthropic.claude-3-haiku-20240307-v1:0","messages":[{"role":"user","content":"Hi"}],"temprature":0.5}`
+
+	AppConfig.StrictRequestValidation = false
+	if err := parse(misspelled); err != nil {
+		t.Errorf("lenient parsing failed: %v", err)
+	}
+
+	AppConfig.StrictRequestValidation = true
+	if err := parse(misspelled); err == nil || err.Error() != `unknown field "temprature"` {
+		t.Errorf("got %v, want the unknown field named", err)
+	}
+	if err := parse(`{"model":"anthropic.claude-3-haiku-20240307-v1:0","messages":[{"role":"user","content":"Hi"}],"temperature":0.5}`); err != nil {
+		t.Errorf("strict parsing of a valid request failed: %v", err)
+	}
+	if err := parse(`{"messages":[{"role":"user","content":"Hi"}]}`); err == nil || !strings.Contains(err.Error(), "Model") {
+		t.Errorf("got %v, want the missing model reported", err)
+	}
+}
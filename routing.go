@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+// WeightedModel is one target of a model route, chosen in proportion to its weight
+type WeightedModel struct {
+	Model  string  `json:"model"`
+	Weight float64 `json:"weight"`
+}
+
+// LoadModelRoutes reads a JSON object mapping logical model names to the weighted models they route across,
+// e.g. {"chat-default": [{"model": "...haiku...", "weight": 70}, {"model": "...sonnet...", "weight": 30}]}.
+// An empty path yields no routes.
+func LoadModelRoutes(path string) (map[string][]WeightedModel, error) {
+	routes := make(map[string][]WeightedModel)
+	if path == "" {
+		return routes, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read model routes file: %v", err)
+	}
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("unable to parse model routes file: %v", err)
+	}
+
+	for name, targets := range routes {
+		var total float64
+		for _, target := range targets {
+			if target.Model == "" {
+				return nil, fmt.Errorf("model route %q has a target without a model", name)
+			}
+			if target.Weight < 0 {
+				return nil, fmt.Errorf("model route %q has a negative weight for %s", name, target.Model)
+			}
+			total += target.Weight
+		}
+		if total <= 0 {
+			return nil, fmt.Errorf("model route %q needs at least one target with a positive weight", name)
+		}
+	}
+
+	return routes, nil
+}
+
+// pickWeightedModel chooses a target at random in proportion to the weights; roll is in [0, 1)
+func pickWeightedModel(targets []WeightedModel, roll float64) string {
+	var total float64
+	for _, target := range targets {
+		total += target.Weight
+	}
+
+	threshold := roll * total
+	for _, target := range targets {
+		if threshold < target.Weight {
+			return target.Model
+		}
+		threshold -= target.Weight
+	}
+
+	// Rounding can leave the threshold just past the last bucket
+	for i := len(targets) - 1; i >= 0; i-- {
+		if targets[i].Weight > 0 {
+			return targets[i].Model
+		}
+	}
+	return targets[len(targets)-1].Model
+}
+
+// ApplyModelRoute replaces a logical model name configured in ModelRoutes with one of its targets, chosen by weight,
+// and returns the logical name. Requests for models without a route are left unchanged and return "".
+func (r *ChatRequest) ApplyModelRoute() string {
+	targets, ok := AppConfig.ModelRoutes[r.Model]
+	if !ok {
+		return ""
+	}
+
+	route := r.Model
+	r.Model = pickWeightedModel(targets, rand.Float64())
+	return route
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPickWeightedModel(t *testing.T) {
+	targets := []WeightedModel{{Model: "haiku", Weight: 70}, {Model: "sonnet", Weight: 30}, {Model: "opus", Weight: 0}}
+	tests := []struct {
+		roll float64
+		want string
+	}{
+		{roll: 0, want: "haiku"},
+		{roll: 0.69, want: "haiku"},
+		{roll: 0.7, want: "sonnet"},
+		{roll: 0.999, want: "sonnet"},
+	}
+
+	for _, tt := range tests {
+		if got := pickWeightedModel(targets, tt.roll); got != tt.want {
+			t.Errorf("pickWeightedModel(%v) = %q, want %q", tt.roll, got, tt.want)
+		}
+	}
+}
+
+func TestParseChatRequestRoutesBeforeValidating(t *testing.T) {
+	restoreConfig(t)
+	haiku := "anthropic.claude-3-haiku-20240307-v1:0"
+	AppConfig.ModelRoutes = map[string][]WeightedModel{"fast": {{Model: haiku, Weight: 1}}}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	body := `{"model": "fast", "logprobs": true, "messages": [{"role": "user", "content": "Hi"}]}`
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body))
+	_, err := parseChatRequest(c)
+	if err == nil || !strings.Contains(err.Error(), haiku) {
+		t.Errorf("err = %v, want the request validated for the routed model %s", err, haiku)
+	}
+}
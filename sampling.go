@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// SamplingProfile is a named set of sampling parameters that a request can select instead of raw values
+type SamplingProfile struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+}
+
+// defaultSamplingProfiles are available even without a profiles file; the file may override them. Each sets only
+// the temperature, since models such as Claude's newer ones reject requests that set both it and top_p.
+var defaultSamplingProfiles = map[string]SamplingProfile{
+	"creative": {Temperature: float32Value(1.0)},
+	"balanced": {Temperature: float32Value(0.7)},
+	"precise":  {Temperature: float32Value(0.2)},
+}
+
+// float32Value returns a pointer to v, for optional sampling parameters
+func float32Value(v float32) *float32 {
+	return &v
+}
+
+// LoadSamplingProfiles reads a JSON object mapping profile names to sampling parameters.
+// An empty path yields an empty set, leaving only the default profiles.
+func LoadSamplingProfiles(path string) (map[string]SamplingProfile, error) {
+	profiles := make(map[string]SamplingProfile)
+	if path == "" {
+		return profiles, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sampling profiles file: %v", err)
+	}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("unable to parse sampling profiles file: %v", err)
+	}
+
+	return profiles, nil
+}
+
+// LookupSamplingProfile returns a configured profile, falling back to the defaults
+func LookupSamplingProfile(name string) (SamplingProfile, bool) {
+	if profile, ok := AppConfig.SamplingProfiles[name]; ok {
+		return profile, true
+	}
+	profile, ok := defaultSamplingProfiles[name]
+	return profile, ok
+}
+
+// ApplySamplingProfile fills in the sampling parameters of the request's sampling_profile.
+// Parameters the client set explicitly take precedence over the profile's.
+func (r *ChatRequest) ApplySamplingProfile() {
+	profile, ok := LookupSamplingProfile(r.SamplingProfile)
+	if !ok {
+		return
+	}
+	if r.Temperature == nil {
+		r.Temperature = profile.Temperature
+	}
+	if r.TopP == nil {
+		r.TopP = profile.TopP
+	}
+	if r.TopK == nil {
+		r.TopK = profile.TopK
+	}
+}
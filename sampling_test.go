@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestApplySamplingProfile(t *testing.T) {
+	req := ChatRequest{SamplingProfile: "precise", TopP: float32Ptr(0.8)}
+	req.ApplySamplingProfile()
+
+	if req.Temperature == nil || *req.Temperature != 0.2 {
+		t.Errorf("temperature = %v, want the profile's 0.2", formatOptional(req.Temperature))
+	}
+	if *req.TopP != 0.8 {
+		t.Errorf("top_p = %v, want the explicit 0.8", *req.TopP)
+	}
+	if err := (ChatRequest{SamplingProfile: "wild"}).Validate(); err == nil {
+		t.Error("expected an error for an unknown sampling profile")
+	}
+}
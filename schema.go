@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ValidateJSONSchema checks a decoded JSON value against a JSON Schema.
+// It supports the subset of keywords used in function parameter schemas: type, properties,
+// required, additionalProperties, items, enum, const, anyOf and oneOf. Unknown keywords are ignored.
+func ValidateJSONSchema(schema json.RawMessage, value interface{}) error {
+	if len(schema) == 0 {
+		return nil
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(schema, &decoded); err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+
+	return validateSchemaNode(decoded, value, "$")
+}
+
+// validateSchemaNode validates value against a single schema object at the given JSON path
+func validateSchemaNode(schema map[string]interface{}, value interface{}, path string) error {
+	if expected, ok := schema["type"]; ok {
+		if !matchesSchemaType(expected, value) {
+			return fmt.Errorf("%s: expected type %v, got %s", path, expected, jsonTypeName(value))
+		}
+	}
+
+	if allowed, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, candidate := range allowed {
+			if jsonEqual(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+
+	if constant, ok := schema["const"]; ok && !jsonEqual(constant, value) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	if options, ok := schema["anyOf"].([]interface{}); ok && countMatchingSchemas(options, value, path) == 0 {
+		return fmt.Errorf("%s: value does not match any schema in anyOf", path)
+	}
+	if options, ok := schema["oneOf"].([]interface{}); ok && countMatchingSchemas(options, value, path) != 1 {
+		return fmt.Errorf("%s: value must match exactly one schema in oneOf", path)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						return fmt.Errorf("%s: missing required property %q", path, key)
+					}
+				}
+			}
+		}
+		for key, propertyValue := range v {
+			if propertySchema, ok := properties[key].(map[string]interface{}); ok {
+				if err := validateSchemaNode(propertySchema, propertyValue, path+"."+key); err != nil {
+					return err
+				}
+				continue
+			}
+			if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				return fmt.Errorf("%s: unexpected property %q", path, key)
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateSchemaNode(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// countMatchingSchemas returns how many of the given schemas the value satisfies
+func countMatchingSchemas(options []interface{}, value interface{}, path string) int {
+	matches := 0
+	for _, option := range options {
+		if optionSchema, ok := option.(map[string]interface{}); ok {
+			if validateSchemaNode(optionSchema, value, path) == nil {
+				matches++
+			}
+		}
+	}
+	return matches
+}
+
+// matchesSchemaType reports whether value satisfies a schema type, which may be a name or a list of names
+func matchesSchemaType(expected interface{}, value interface{}) bool {
+	switch t := expected.(type) {
+	case string:
+		actual := jsonTypeName(value)
+		if t == "integer" {
+			number, ok := value.(float64)
+			return ok && number == math.Trunc(number)
+		}
+		return strings.EqualFold(t, actual)
+	case []interface{}:
+		for _, option := range t {
+			if matchesSchemaType(option, value) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// jsonEqual compares two decoded JSON values by their serialized form
+func jsonEqual(a, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(encodedA) == string(encodedB)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ResponseStore keeps completed chat responses for later retrieval by ID, only by the principal that created
+// them; implementations must be safe for concurrent use
+type ResponseStore interface {
+	Put(principal string, response ChatResponse)
+	Get(principal, id string) (ChatResponse, bool)
+}
+
+// responseStore holds stored responses when ENABLE_RESPONSE_STORE is set; nil disables storage and retrieval
+var responseStore ResponseStore
+
+// storedResponseKey identifies a stored response by its owner and ID
+type storedResponseKey struct {
+	principal string
+	id        string
+}
+
+// storedResponse is a response held by MemoryResponseStore with its expiry
+type storedResponse struct {
+	response ChatResponse
+	expires  time.Time
+}
+
+// MemoryResponseStore is an in-memory ResponseStore with a TTL that holds at most maxEntries responses,
+// evicting the oldest first; a maxEntries of zero or less means no limit
+type MemoryResponseStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	responses  map[storedResponseKey]storedResponse
+	order      []storedResponseKey // from oldest to newest
+}
+
+// NewMemoryResponseStore creates an in-memory response store
+func NewMemoryResponseStore(ttl time.Duration, maxEntries int) *MemoryResponseStore {
+	return &MemoryResponseStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		responses:  make(map[storedResponseKey]storedResponse),
+	}
+}
+
+// Put stores a response for principal under its ID, dropping expired responses and the oldest ones beyond the limit
+func (s *MemoryResponseStore) Put(principal string, response ChatResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for len(s.order) > 0 {
+		oldest := s.order[0]
+		stored, ok := s.responses[oldest]
+		if ok && now.Before(stored.expires) && (s.maxEntries <= 0 || len(s.order) < s.maxEntries) {
+			break
+		}
+		delete(s.responses, oldest)
+		s.order = s.order[1:]
+	}
+
+	key := storedResponseKey{principal: principal, id: response.ID}
+	s.responses[key] = storedResponse{response: response, expires: now.Add(s.ttl)}
+	s.order = append(s.order, key)
+}
+
+// Get returns the response principal stored with the given ID if it has not expired
+func (s *MemoryResponseStore) Get(principal, id string) (ChatResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.responses[storedResponseKey{principal: principal, id: id}]
+	if !ok || time.Now().After(stored.expires) {
+		return ChatResponse{}, false
+	}
+	return stored.response, true
+}
+
+// handleGetChatCompletion returns a chat completion stored with store: true
+func handleGetChatCompletion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if responseStore == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "response storage is not enabled"})
+			return
+		}
+
+		// Another caller's completions are reported as missing, like unknown ones
+		response, ok := responseStore.Get(requestPrincipal(c), c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no stored chat completion with id %q", c.Param("id"))})
+			return
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// streamedResponse collects a streamed chat completion, as its client receives it, to store once it finishes
+type streamedResponse struct {
+	principal string
+	content   strings.Builder
+	reasoning strings.Builder
+	toolCalls []ToolCall // by stream index
+}
+
+// storeStream sets the writer up to store the stream for the caller once it finishes, when the request asks for it
+func storeStream(c *gin.Context, w *chatStreamWriter, req ChatRequest) {
+	if req.Store && responseStore != nil && !w.textCompletion {
+		w.stored = &streamedResponse{principal: requestPrincipal(c)}
+	}
+}
+
+// add records a delta sent to the client
+func (r *streamedResponse) add(delta ChunkDelta) {
+	r.content.WriteString(delta.Content)
+	r.reasoning.WriteString(delta.ReasoningContent)
+	for _, call := range delta.ToolCalls {
+		for len(r.toolCalls) <= call.Index {
+			r.toolCalls = append(r.toolCalls, ToolCall{Type: "function"})
+		}
+		stored := &r.toolCalls[call.Index]
+		if call.ID != "" {
+			stored.ID = call.ID
+		}
+		if call.Function.Name != "" {
+			stored.Function.Name = call.Function.Name
+		}
+		stored.Function.Arguments += call.Function.Arguments
+	}
+}
+
+// put stores the finished stream as the chat completion a non-streaming request would have returned, under the
+// stream's ID and creation time
+func (r *streamedResponse) put(w *chatStreamWriter, req ChatRequest, finishReason string, usage Usage) {
+	content := r.content.String()
+	responseStore.Put(r.principal, ChatResponse{
+		ID:      w.id,
+		Object:  objectName(objectChatCompletion),
+		Created: w.created,
+		Model:   w.model,
+		Choices: []Choice{{
+			Message: ChatResponseMessage{
+				Role:             "assistant",
+				Content:          &content,
+				ReasoningContent: r.reasoning.String(),
+				ToolCalls:        r.toolCalls,
+			},
+			FinishReason: finishReason,
+		}},
+		Usage:             usage,
+		SystemFingerprint: w.systemFingerprint,
+		Seed:              req.Seed,
+	})
+}
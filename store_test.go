@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useResponseStore enables a fresh in-memory response store until the test ends
+func useResponseStore(t *testing.T) {
+	t.Helper()
+	saved := responseStore
+	responseStore = NewMemoryResponseStore(time.Hour, 0)
+	t.Cleanup(func() { responseStore = saved })
+}
+
+func TestMemoryResponseStore(t *testing.T) {
+	store := NewMemoryResponseStore(time.Hour, 2)
+	store.Put("key:a", ChatResponse{ID: "chatcmpl-1"})
+	if _, ok := store.Get("key:a", "chatcmpl-1"); !ok {
+		t.Error("expected the owner to retrieve its response")
+	}
+	if _, ok := store.Get("key:b", "chatcmpl-1"); ok {
+		t.Error("expected another principal not to retrieve the response")
+	}
+
+	// Beyond the limit the oldest response is evicted
+	store.Put("key:a", ChatResponse{ID: "chatcmpl-2"})
+	store.Put("key:b", ChatResponse{ID: "chatcmpl-3"})
+	if _, ok := store.Get("key:a", "chatcmpl-1"); ok {
+		t.Error("expected the oldest response to be evicted")
+	}
+	if _, ok := store.Get("key:b", "chatcmpl-3"); !ok {
+		t.Error("expected the newest response to be kept")
+	}
+
+	expired := NewMemoryResponseStore(0, 0)
+	expired.Put("key:a", ChatResponse{ID: "chatcmpl-1"})
+	if _, ok := expired.Get("key:a", "chatcmpl-1"); ok {
+		t.Error("expected an expired response to be gone")
+	}
+}
+
+func TestStoredChatCompletion(t *testing.T) {
+	useResponseStore(t)
+	service, _ := newTestService(`{"content":[{"type":"text","text":"Stored"}],"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":1}}`)
+	router := gin.New()
+	SetupRoutes(router, service)
+	send := func(key, method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	created := send("owner-key", http.MethodPost, "/chat/completions",
+		`{"model": "anthropic.claude-3-haiku-20240307-v1:0", "store": true, "messages": [{"role": "user", "content": "Hi"}]}`)
+	var response ChatResponse
+	if err := json.Unmarshal(created.Body.Bytes(), &response); err != nil || created.Code != http.StatusOK {
+		t.Fatalf("create = %d %s", created.Code, created.Body)
+	}
+
+	retrieved := send("owner-key", http.MethodGet, "/chat/completions/"+response.ID, "")
+	if retrieved.Code != http.StatusOK || !strings.Contains(retrieved.Body.String(), `"content":"Stored"`) {
+		t.Errorf("get = %d %s, want the stored completion", retrieved.Code, retrieved.Body)
+	}
+	if other := send("other-key", http.MethodGet, "/chat/completions/"+response.ID, ""); other.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 for another key's completion", other.Code)
+	}
+}
+
+func TestStoreStreamedCompletion(t *testing.T) {
+	useResponseStore(t)
+	model := "anthropic.claude-3-haiku-20240307-v1:0"
+	relay := func(hold bool) *chatStreamWriter {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+		c.Request.Header.Set("Authorization", "Bearer owner-key")
+		w := newChatStreamWriter(c, model)
+		req := ChatRequest{Model: model, Store: true}
+		storeStream(c, w, req)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		relayStream(ctx, w, newFakeStream(hold,
+			`{"type":"message_start","message":{"usage":{"input_tokens":3}}}`,
+			`{"type":"content_block_delta","delta":{"type":"text_delta","text":"Hello"}}`,
+			`{"type":"content_block_delta","delta":{"type":"text_delta","text":" world"}}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+		), req)
+		return w
+	}
+
+	w := relay(false)
+	stored, ok := responseStore.Get(keyPrincipal("Bearer owner-key"), w.id)
+	if !ok {
+		t.Fatal("expected the finished stream to be stored")
+	}
+	if choice := stored.Choices[0]; *choice.Message.Content != "Hello world" || choice.FinishReason != "stop" || stored.Object != "chat.completion" {
+		t.Errorf("stored = %+v, want the streamed text as a chat completion", stored)
+	}
+
+	// A stream that never finishes is not stored
+	w = relay(true)
+	if _, ok := responseStore.Get(keyPrincipal("Bearer owner-key"), w.id); ok {
+		t.Error("expected an unfinished stream not to be stored")
+	}
+}
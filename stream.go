@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/gin-gonic/gin"
+)
+
+// ChatCompletionChunk represents a single streamed chunk in OpenAI's chat.completion.chunk format
+type ChatCompletionChunk struct {
+	ID                string        `json:"id"`
+	Object            string        `json:"object"`
+	Created           int64         `json:"created"`
+	Model             string        `json:"model"`
+	SystemFingerprint string        `json:"system_fingerprint,omitempty"`
+	Choices           []ChunkChoice `json:"choices"`
+	Usage             *Usage        `json:"usage,omitempty"`
+}
+
+// ChunkChoice represents a choice in a streamed chunk
+type ChunkChoice struct {
+	Index        int        `json:"index"`
+	Delta        ChunkDelta `json:"delta"`
+	FinishReason *string    `json:"finish_reason"`
+}
+
+// ChunkDelta represents the incremental message content of a streamed chunk
+type ChunkDelta struct {
+	Role             string          `json:"role,omitempty"`
+	Content          string          `json:"content,omitempty"`
+	ReasoningContent string          `json:"reasoning_content,omitempty"`
+	ToolCalls        []ChunkToolCall `json:"tool_calls,omitempty"`
+}
+
+// ChunkToolCall represents a tool call, or a fragment of one, in a streamed chunk. The first chunk of a call
+// carries its ID, type and function name; its arguments are the concatenation of those of all its chunks.
+type ChunkToolCall struct {
+	Index    int               `json:"index"`
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Function ChunkToolFunction `json:"function"`
+}
+
+// ChunkToolFunction is the function name and arguments fragment of a streamed tool call
+type ChunkToolFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// StreamError represents an error object sent to the client in an SSE frame
+type StreamError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// chatStreamWriter writes chat.completion.chunk frames, or legacy text_completion.chunk frames, for one streamed response
+type chatStreamWriter struct {
+	c       *gin.Context
+	id      string
+	model   string
+	created int64
+
+	// systemFingerprint is attached to every chunk
+	systemFingerprint string
+
+	// textCompletion selects the legacy completions chunk shape
+	textCompletion bool
+
+	// buffer, when set, receives frames instead of the client so a resumable stream can outlive the connection
+	buffer *resumableStream
+
+	// headers are the LOG_HEADERS captured for the usage record when the writer is created, since the request
+	// may be gone by the time a resumable stream finishes
+	headers map[string]string
+
+	// stored, when set, collects the stream to keep in the response store once it finishes
+	stored *streamedResponse
+}
+
+// newChatStreamWriter creates a writer for a streamed response to the given model
+func newChatStreamWriter(c *gin.Context, model string) *chatStreamWriter {
+	return &chatStreamWriter{
+		c:       c,
+		id:      GenerateMessageID(),
+		model:   model,
+		created: time.Now().Unix(),
+		headers: capturedHeaders(c.Request.Header),
+	}
+}
+
+// newTextCompletionStreamWriter creates a writer for a streamed legacy completions response to the given model
+func newTextCompletionStreamWriter(c *gin.Context, model string) *chatStreamWriter {
+	w := newChatStreamWriter(c, model)
+	w.id = GenerateCompletionID()
+	w.textCompletion = true
+	return w
+}
+
+// writeFrame writes a value as a single SSE data frame
+func (w *chatStreamWriter) writeFrame(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshaling stream frame: %v", err)
+		return
+	}
+	w.writeData(data)
+}
+
+// writeData sends one SSE data frame, flushing it to the client or appending it to the resumable buffer
+func (w *chatStreamWriter) writeData(data []byte) {
+	if w.buffer != nil {
+		w.buffer.append(data)
+		return
+	}
+	w.c.Writer.Write([]byte("data: "))
+	w.c.Writer.Write(data)
+	w.c.Writer.Write([]byte("\n\n"))
+	w.c.Writer.Flush()
+}
+
+// writeChunk writes a content chunk with a single choice carrying the given delta and a null finish reason.
+// Deltas longer than STREAM_MAX_DELTA_BYTES, counting content, reasoning and tool call arguments, are split
+// across several chunks, which concatenate back to the original text; the usage goes on the last of them.
+func (w *chatStreamWriter) writeChunk(delta ChunkDelta, usage *Usage) {
+	if w.stored != nil {
+		w.stored.add(delta)
+	}
+	limit := AppConfig.StreamMaxDeltaBytes
+	for limit > 0 && deltaSize(delta) > limit {
+		head := ChunkDelta{Role: delta.Role}
+		room := limit
+		head.Content, delta.Content = splitText(delta.Content, room, true)
+		room -= len(head.Content)
+		head.ReasoningContent, delta.ReasoningContent = splitText(delta.ReasoningContent, room, room == limit)
+		room -= len(head.ReasoningContent)
+		for len(delta.ToolCalls) > 0 {
+			call := delta.ToolCalls[0]
+			var rest string
+			call.Function.Arguments, rest = splitText(call.Function.Arguments, room, room == limit)
+			room -= len(call.Function.Arguments)
+			head.ToolCalls = append(head.ToolCalls, call)
+			if rest == "" {
+				delta.ToolCalls = delta.ToolCalls[1:]
+				continue
+			}
+			// Fragments after the first carry only the call's index and the rest of its arguments
+			delta.ToolCalls = append([]ChunkToolCall{{Index: call.Index, Function: ChunkToolFunction{Arguments: rest}}}, delta.ToolCalls[1:]...)
+			break
+		}
+		delta.Role = ""
+		w.writeSingleChunk(head, nil, nil)
+	}
+	w.writeSingleChunk(delta, nil, usage)
+}
+
+// deltaSize returns the bytes of text a delta carries towards STREAM_MAX_DELTA_BYTES
+func deltaSize(delta ChunkDelta) int {
+	size := len(delta.Content) + len(delta.ReasoningContent)
+	for _, call := range delta.ToolCalls {
+		size += len(call.Function.Arguments)
+	}
+	return size
+}
+
+// writeFinish writes the terminal chunk of the choice: an empty delta carrying the finish reason, as in
+// OpenAI's stream, where the change from a null to a non-null finish_reason marks the choice complete
+func (w *chatStreamWriter) writeFinish(finishReason string, usage *Usage) {
+	w.writeSingleChunk(ChunkDelta{}, &finishReason, usage)
+}
+
+// splitText splits text into a head of at most limit bytes, cut on a UTF-8 boundary, and the rest. With progress
+// set, the head is at least the first rune even when that is over the limit, so a split always advances.
+func splitText(text string, limit int, progress bool) (string, string) {
+	if len(text) <= limit {
+		return text, ""
+	}
+	cut := max(limit, 0)
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if cut == 0 && progress {
+		// A limit smaller than the first rune still has to make progress
+		_, cut = utf8.DecodeRuneInString(text)
+	}
+	return text[:cut], text[cut:]
+}
+
+// writeSingleChunk writes one chunk frame with a single choice carrying the given delta and finish reason
+func (w *chatStreamWriter) writeSingleChunk(delta ChunkDelta, finishReason *string, usage *Usage) {
+	if w.textCompletion {
+		// Legacy completions have no roles or reasoning; only text and the finish reason are relayed
+		if delta.Content == "" && finishReason == nil {
+			return
+		}
+		w.writeFrame(TextCompletionResponse{
+			ID:                w.id,
+			Object:            objectName(objectTextCompletionChunk),
+			Created:           w.created,
+			Model:             w.model,
+			SystemFingerprint: w.systemFingerprint,
+			Choices:           []TextCompletionChoice{{Index: 0, Text: delta.Content, FinishReason: finishReason}},
+			Usage:             usage,
+		})
+		return
+	}
+
+	w.writeFrame(ChatCompletionChunk{
+		ID:                w.id,
+		Object:            objectName(objectChatCompletionChunk),
+		Created:           w.created,
+		Model:             w.model,
+		SystemFingerprint: w.systemFingerprint,
+		Choices:           []ChunkChoice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+		Usage:             usage,
+	})
+}
+
+// writeUsage writes a choice-less chunk carrying the final usage
+func (w *chatStreamWriter) writeUsage(usage Usage) {
+	if w.textCompletion {
+		w.writeFrame(TextCompletionResponse{
+			ID:                w.id,
+			Object:            objectName(objectTextCompletionChunk),
+			Created:           w.created,
+			Model:             w.model,
+			SystemFingerprint: w.systemFingerprint,
+			Choices:           []TextCompletionChoice{},
+			Usage:             &usage,
+		})
+		return
+	}
+
+	w.writeFrame(ChatCompletionChunk{
+		ID:                w.id,
+		Object:            objectName(objectChatCompletionChunk),
+		Created:           w.created,
+		Model:             w.model,
+		SystemFingerprint: w.systemFingerprint,
+		Choices:           []ChunkChoice{},
+		Usage:             &usage,
+	})
+}
+
+// writeError writes an error object frame
+func (w *chatStreamWriter) writeError(err error, errType string) {
+	w.writeFrame(gin.H{"error": StreamError{Message: err.Error(), Type: errType}})
+}
+
+// streamErrorType returns the OpenAI error type for an error with the given HTTP status
+func streamErrorType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 400 && status < 500:
+		return "invalid_request_error"
+	default:
+		return "api_error"
+	}
+}
+
+// writeDone writes the terminating frame: OpenAI's [DONE] sentinel, or {"done": true} for clients that need JSON
+func (w *chatStreamWriter) writeDone() {
+	if AppConfig.StreamJSONDone {
+		w.writeFrame(gin.H{"done": true})
+		return
+	}
+	w.writeData([]byte("[DONE]"))
+}
+
+// supportsFlush reports whether the connection underneath gin's writer can flush partial responses.
+// gin's writer always has a Flush method, so the wrapped http.ResponseWriter is checked instead.
+func supportsFlush(w gin.ResponseWriter) bool {
+	if unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		_, ok := unwrapper.Unwrap().(http.Flusher)
+		return ok
+	}
+	_, ok := w.(http.Flusher)
+	return ok
+}
+
+// errStreamDurationExceeded is the cancellation cause of a stream cut off by MAX_STREAM_DURATION_SECONDS
+var errStreamDurationExceeded = errors.New("stream exceeded the maximum duration")
+
+// errOperationTimeout is the cancellation cause of operations that run past CHAT_TIMEOUT, STREAM_TIMEOUT or
+// EMBEDDINGS_TIMEOUT
+var errOperationTimeout = errors.New("the request timed out")
+
+// relayStream relays a Bedrock response stream to the client as OpenAI-compatible SSE frames.
+// If the stream fails after it has started, a final chunk with finish_reason "error" and the usage
+// accumulated so far is sent, followed by an error frame, so clients can tell the output is incomplete.
+// A generation stopped through the cancel endpoint ends with finish_reason "cancelled" instead, and one
+// cut off by MAX_STREAM_DURATION_SECONDS with STREAM_DURATION_FINISH_REASON, while one that runs past
+// STREAM_TIMEOUT fails with a timeout_error frame. Under STREAM_TOOL_VALIDATION, a
+// tool call whose arguments are invalid once complete ends the stream the same way as a failure.
+func relayStream(ctx context.Context, w *chatStreamWriter, stream *bedrockruntime.InvokeModelWithResponseStreamEventStream, req ChatRequest) {
+	defer stream.Close()
+
+	if AppConfig.MaxStreamDurationSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, time.Duration(AppConfig.MaxStreamDurationSeconds)*time.Second, errStreamDurationExceeded)
+		defer cancel()
+	}
+
+	// Closing the stream on cancellation ends the event loop below and stops generation on Bedrock's side
+	stop := context.AfterFunc(ctx, func() { stream.Close() })
+	defer stop()
+
+	var usage Usage
+	var finishReason string
+
+	// Running estimate of the completion, reported per chunk when the client opts in
+	estimateUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsageEstimate
+	var generatedChars int
+	runningUsage := func(text string) *Usage {
+		if !estimateUsage {
+			return nil
+		}
+		generatedChars += utf8.RuneCountInString(text)
+		completion := EstimateTokensFromChars(generatedChars)
+		return &Usage{
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: completion,
+			TotalTokens:      usage.PromptTokens + completion,
+			Estimated:        true,
+		}
+	}
+
+	// Announce the assistant role before any content
+	w.writeChunk(ChunkDelta{Role: "assistant"}, nil)
+
+	toolCalls := newStreamToolCalls(req)
+	var toolCallErr error
+
+	parse := streamParserFor(req.FormatModel())
+events:
+	for event := range stream.Events() {
+		chunk, ok := event.(*types.ResponseStreamMemberChunk)
+		if !ok {
+			log.Printf("Unexpected stream event type: %T", event)
+			continue
+		}
+
+		delta, err := parse(chunk.Value.Bytes)
+		if err != nil {
+			log.Printf("Error parsing stream event: %v", err)
+			continue
+		}
+
+		if delta.PromptTokens != nil {
+			usage.PromptTokens = *delta.PromptTokens
+		}
+		if delta.CompletionTokens != nil {
+			usage.CompletionTokens = *delta.CompletionTokens
+		}
+		if delta.Text != "" {
+			w.writeChunk(ChunkDelta{Content: delta.Text}, runningUsage(delta.Text))
+		}
+		if delta.Thinking != "" && AppConfig.ExposeReasoning {
+			w.writeChunk(ChunkDelta{ReasoningContent: delta.Thinking}, runningUsage(delta.Thinking))
+		}
+		if delta.ToolCall != nil {
+			toolCalls.add(w, *delta.ToolCall)
+		}
+		if delta.BlockEnd != nil {
+			if toolCallErr = toolCalls.end(w, *delta.BlockEnd); toolCallErr != nil {
+				break events
+			}
+		}
+		if delta.FinishReason != "" {
+			finishReason = ConvertFinishReason(delta.FinishReason)
+		}
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	usageRecord := NewUsageRecord(req, usage, true)
+	usageRecord.Headers = w.headers
+	LogUsage(usageRecord)
+
+	switch context.Cause(ctx) {
+	case errRequestCancelled:
+		w.writeFinish("cancelled", &usage)
+		w.writeDone()
+		return
+	case errStreamDurationExceeded:
+		log.Printf("Stream %s cut off after %ds", w.id, AppConfig.MaxStreamDurationSeconds)
+		w.writeFinish(AppConfig.StreamDurationFinishReason, &usage)
+		w.writeDone()
+		return
+	case errOperationTimeout:
+		log.Printf("Stream %s exceeded STREAM_TIMEOUT of %v", w.id, AppConfig.StreamTimeout)
+		w.writeFinish("error", &usage)
+		w.writeError(errOperationTimeout, "timeout_error")
+		w.writeDone()
+		return
+	}
+
+	if err := stream.Err(); err != nil {
+		log.Printf("Error during chat stream: %v", err)
+		w.writeFinish("error", &usage)
+		w.writeError(err, "stream_error")
+		w.writeDone()
+		return
+	}
+
+	// Invalid tool calls are never sent, so clients can't execute them
+	if toolCallErr == nil {
+		toolCallErr = toolCalls.finish(w)
+	}
+	if toolCallErr != nil {
+		log.Printf("Ending chat stream %s at an invalid tool call: %v", w.id, toolCallErr)
+		w.writeFinish("error", &usage)
+		w.writeError(toolCallErr, "invalid_tool_call")
+		w.writeDone()
+		return
+	}
+
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	w.writeFinish(finishReason, nil)
+	if w.stored != nil && ctx.Err() == nil {
+		// A stream whose client went away may have been cut short, so only complete ones are stored
+		w.stored.put(w, req, finishReason, usage)
+	}
+
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		w.writeUsage(usage)
+	}
+
+	w.writeDone()
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/gin-gonic/gin"
+)
+
+// fakeStreamReader replays canned chunks as a Bedrock response stream
+type fakeStreamReader struct {
+	events    chan types.ResponseStream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newFakeStream returns a Bedrock response stream that sends the given chunks. With hold set, the stream then
+// stays open until closed, like a model that is still generating.
+func newFakeStream(hold bool, chunks ...string) *bedrockruntime.InvokeModelWithResponseStreamEventStream {
+	r := &fakeStreamReader{events: make(chan types.ResponseStream), closed: make(chan struct{})}
+	go func() {
+		defer close(r.events)
+		for _, chunk := range chunks {
+			select {
+			case r.events <- &types.ResponseStreamMemberChunk{Value: types.PayloadPart{Bytes: []byte(chunk)}}:
+			case <-r.closed:
+				return
+			}
+		}
+		if hold {
+			<-r.closed
+		}
+	}()
+	return bedrockruntime.NewInvokeModelWithResponseStreamEventStream(func(es *bedrockruntime.InvokeModelWithResponseStreamEventStream) {
+		es.Reader = r
+	})
+}
+
+func (r *fakeStreamReader) Events() <-chan types.ResponseStream { return r.events }
+
+func (r *fakeStreamReader) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return nil
+}
+
+func (r *fakeStreamReader) Err() error { return nil }
+
+// streamFrames returns the data of each SSE frame written to the recorder
+func streamFrames(recorder *httptest.ResponseRecorder) []string {
+	var frames []string
+	for _, frame := range strings.Split(strings.TrimSpace(recorder.Body.String()), "\n\n") {
+		frames = append(frames, strings.TrimPrefix(frame, "data: "))
+	}
+	return frames
+}
+
+// TestStreamOverHTTP2 streams chunks to an HTTP/2 client, which rejects connection-specific headers
+func TestStreamOverHTTP2(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/stream", func(c *gin.Context) {
+		if !supportsFlush(c.Writer) {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		setSSEHeaders(c)
+		w := newChatStreamWriter(c, "anthropic.claude-3-haiku-20240307-v1:0")
+		w.writeChunk(ChunkDelta{Role: "assistant"}, nil)
+		w.writeChunk(ChunkDelta{Content: "Hello"}, nil)
+		w.writeDone()
+	})
+
+	server := httptest.NewUnstartedServer(r)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tt := range []struct {
+		name      string
+		http2     bool
+		wantProto int
+	}{
+		{name: "HTTP/2", http2: true, wantProto: 2},
+		{name: "HTTP/1.1", wantProto: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := server.Client()
+			transport := client.Transport.(*http.Transport).Clone()
+			if !tt.http2 {
+				transport.ForceAttemptHTTP2 = false
+				transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+			}
+			client.Transport = transport
+
+			resp, err := client.Get(server.URL + "/stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.ProtoMajor != tt.wantProto {
+				t.Fatalf("protocol = %s, want HTTP/%d", resp.Proto, tt.wantProto)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if len(resp.TransferEncoding) > 0 && tt.http2 {
+				t.Errorf("transfer encoding %v under HTTP/2", resp.TransferEncoding)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading stream: %v", err)
+			}
+			if !strings.Contains(string(body), `"content":"Hello"`) || !strings.HasSuffix(string(body), "data: [DONE]\n\n") {
+				t.Errorf("unexpected stream body: %s", body)
+			}
+		})
+	}
+}
+
+func TestWriteChunkSplitsOversizedDeltas(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.StreamMaxDeltaBytes = 10
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	w := newChatStreamWriter(c, "anthropic.claude-3-haiku-20240307-v1:0")
+
+	content := `{"query": "héllo wörld", "limit": 10}`
+	w.writeChunk(ChunkDelta{Content: content}, nil)
+	w.writeFinish("stop", nil)
+
+	var reassembled string
+	frames := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n\n")
+	for i, frame := range frames {
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(frame, "data: ")), &chunk); err != nil {
+			t.Fatalf("frame %d is not valid JSON: %v", i, err)
+		}
+		delta := chunk.Choices[0].Delta.Content
+		if last := i == len(frames)-1; last && delta != "" {
+			t.Errorf("final frame carries content %q, want an empty delta", delta)
+		}
+		if len(delta) > 10 {
+			t.Errorf("frame %d carries %d bytes, over the limit", i, len(delta))
+		}
+		if last := i == len(frames)-1; (chunk.Choices[0].FinishReason != nil) != last {
+			t.Errorf("frame %d: finish_reason = %v, want it only on the last frame", i, chunk.Choices[0].FinishReason)
+		}
+		reassembled += delta
+	}
+
+	if len(frames) < 4 || reassembled != content {
+		t.Errorf("got %d frames reassembling to %q, want %q split up", len(frames), reassembled, content)
+	}
+}
+
+func TestWriteChunkSplitsMixedDeltas(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.StreamMaxDeltaBytes = 10
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	w := newChatStreamWriter(c, "anthropic.claude-3-haiku-20240307-v1:0")
+
+	// The content fills the first frame exactly, which must leave no room for any reasoning
+	arguments := `{"city": "Zürich", "units": "metric"}`
+	w.writeChunk(ChunkDelta{
+		Content:          "0123456789",
+		ReasoningContent: "über",
+		ToolCalls:        []ChunkToolCall{{Index: 0, ID: "toolu_1", Type: "function", Function: ChunkToolFunction{Name: "get_weather", Arguments: arguments}}},
+	}, nil)
+
+	var content, reasoning, reassembled string
+	var ids []string
+	for i, frame := range streamFrames(recorder) {
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(frame), &chunk); err != nil {
+			t.Fatalf("frame %d is not valid JSON: %v", i, err)
+		}
+		delta := chunk.Choices[0].Delta
+		size := len(delta.Content) + len(delta.ReasoningContent)
+		for _, call := range delta.ToolCalls {
+			size += len(call.Function.Arguments)
+			reassembled += call.Function.Arguments
+			if call.ID != "" {
+				ids = append(ids, call.ID)
+			}
+		}
+		if size > 10 {
+			t.Errorf("frame %d carries %d bytes, over the limit", i, size)
+		}
+		content += delta.Content
+		reasoning += delta.ReasoningContent
+	}
+
+	if content != "0123456789" || reasoning != "über" || reassembled != arguments {
+		t.Errorf("reassembled content %q, reasoning %q and arguments %q", content, reasoning, reassembled)
+	}
+	if len(ids) != 1 {
+		t.Errorf("tool call ids %v, want the id on the first fragment only", ids)
+	}
+}
+
+func TestRelayStreamMaxDuration(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.MaxStreamDurationSeconds = 1
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	w := newChatStreamWriter(c, "anthropic.claude-3-haiku-20240307-v1:0")
+
+	stream := newFakeStream(true, `{"type":"content_block_delta","delta":{"type":"text_delta","text":"and on"}}`)
+	start := time.Now()
+	relayStream(context.Background(), w, stream, ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0"})
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("stream ran for %v, past the maximum duration", elapsed)
+	}
+
+	frames := streamFrames(recorder)
+	if frames[len(frames)-1] != "[DONE]" {
+		t.Fatalf("last frame = %s, want [DONE]", frames[len(frames)-1])
+	}
+	var chunk ChatCompletionChunk
+	if err := json.Unmarshal([]byte(frames[len(frames)-2]), &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if reason := chunk.Choices[0].FinishReason; reason == nil || *reason != AppConfig.StreamDurationFinishReason {
+		t.Errorf("finish_reason = %v, want %q", reason, AppConfig.StreamDurationFinishReason)
+	}
+}
+
+func TestRelayStreamToolCalls(t *testing.T) {
+	restoreConfig(t)
+
+	toolCall := func(arguments ...string) []string {
+		chunks := []string{`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather"}}`}
+		for _, fragment := range arguments {
+			encoded, _ := json.Marshal(fragment)
+			chunks = append(chunks, `{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":`+string(encoded)+`}}`)
+		}
+		return append(chunks, `{"type":"content_block_stop","index":0}`, `{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":5}}`)
+	}
+	relay := func(chunks []string) (string, string, string) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+		w := newChatStreamWriter(c, "anthropic.claude-3-haiku-20240307-v1:0")
+		relayStream(context.Background(), w, newFakeStream(false, chunks...), ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0"})
+
+		var arguments, finishReason, errorType string
+		for _, frame := range streamFrames(recorder) {
+			var chunk struct {
+				ChatCompletionChunk
+				Error *StreamError `json:"error"`
+			}
+			if json.Unmarshal([]byte(frame), &chunk) != nil {
+				continue
+			}
+			if chunk.Error != nil {
+				errorType = chunk.Error.Type
+			}
+			for _, choice := range chunk.Choices {
+				for _, call := range choice.Delta.ToolCalls {
+					arguments += call.Function.Arguments
+				}
+				if choice.FinishReason != nil {
+					finishReason = *choice.FinishReason
+				}
+			}
+		}
+		return arguments, finishReason, errorType
+	}
+
+	tests := []struct {
+		mode          string
+		arguments     []string
+		wantArguments string
+		wantFinish    string
+		wantError     string
+	}{
+		{StreamToolValidationOff, []string{`{"city": "Pa`, `ris"}`}, `{"city": "Paris"}`, "tool_calls", ""},
+		{StreamToolValidationOff, []string{`{"city": "Pa`}, `{"city": "Pa`, "tool_calls", ""},
+		{StreamToolValidationError, []string{`{"city": "Pa`, `ris"}`}, `{"city": "Paris"}`, "tool_calls", ""},
+		{StreamToolValidationError, nil, `{}`, "tool_calls", ""},
+		{StreamToolValidationError, []string{`{"city": "Pa`}, "", "error", "invalid_tool_call"},
+		{StreamToolValidationRepair, []string{`{"cities": ["Pa`}, `{"cities": ["Pa"]}`, "tool_calls", ""},
+		{StreamToolValidationRepair, []string{`{"city"`}, "", "error", "invalid_tool_call"},
+	}
+	for _, tt := range tests {
+		AppConfig.StreamToolValidation = tt.mode
+		arguments, finishReason, errorType := relay(toolCall(tt.arguments...))
+		if arguments != tt.wantArguments || finishReason != tt.wantFinish || errorType != tt.wantError {
+			t.Errorf("%s %q: got arguments %q, finish_reason %q and error %q; want %q, %q and %q",
+				tt.mode, tt.arguments, arguments, finishReason, errorType, tt.wantArguments, tt.wantFinish, tt.wantError)
+		}
+	}
+}
+
+func TestRelayStreamSplitsValidatedToolCalls(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.StreamToolValidation = StreamToolValidationError
+	AppConfig.StreamMaxDeltaBytes = 8
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	w := newChatStreamWriter(c, "anthropic.claude-3-haiku-20240307-v1:0")
+	relayStream(context.Background(), w, newFakeStream(false,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"city\": \"Paris\", \"units\": \"metric\"}"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":5}}`,
+	), ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0"})
+
+	var arguments string
+	fragments := 0
+	for _, frame := range streamFrames(recorder) {
+		var chunk ChatCompletionChunk
+		if json.Unmarshal([]byte(frame), &chunk) != nil {
+			continue
+		}
+		for _, call := range chunk.Choices[0].Delta.ToolCalls {
+			if len(call.Function.Arguments) > 8 {
+				t.Errorf("fragment %q is over the limit", call.Function.Arguments)
+			}
+			arguments += call.Function.Arguments
+			fragments++
+		}
+	}
+	if arguments != `{"city": "Paris", "units": "metric"}` || fragments < 5 {
+		t.Errorf("got arguments %q in %d fragments, want the validated call split up", arguments, fragments)
+	}
+}
+
+func TestRelayStreamTimeout(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.StreamTimeout = 50 * time.Millisecond
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	w := newChatStreamWriter(c, "anthropic.claude-3-haiku-20240307-v1:0")
+
+	ctx, cancel := withOperationTimeout(context.Background(), AppConfig.StreamTimeout)
+	defer cancel()
+	stream := newFakeStream(true, `{"type":"content_block_delta","delta":{"type":"text_delta","text":"and on"}}`)
+	relayStream(ctx, w, stream, ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0"})
+
+	frames := streamFrames(recorder)
+	if len(frames) < 3 || frames[len(frames)-1] != "[DONE]" || !strings.Contains(frames[len(frames)-2], `"type":"timeout_error"`) {
+		t.Fatalf("frames = %v, want a timeout_error frame before [DONE]", frames)
+	}
+	if status := chatErrorStatus(fmt.Errorf("invoking model: %w", context.DeadlineExceeded)); status != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504 for an invocation that timed out", status)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import "encoding/json"
+
+// streamDelta is the model-independent content of one streamed response chunk
+type streamDelta struct {
+	Text         string
+	Thinking     string
+	FinishReason string // the model's own stop reason, converted with ConvertFinishReason
+
+	// Token counts are set only by chunks that report them
+	PromptTokens     *int
+	CompletionTokens *int
+
+	// ToolCall is set by chunks that start a tool call or continue its arguments, and BlockEnd, to the block's
+	// index, by chunks that end a content block, which may be a tool call's
+	ToolCall *streamToolCall
+	BlockEnd *int
+}
+
+// streamToolCall is a piece of a streamed tool call: its start, with the call's ID and function name, or a
+// fragment of its arguments
+type streamToolCall struct {
+	Index     int // the content block of the call
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// streamParser decodes one InvokeModelWithResponseStream chunk of a model family
+type streamParser func(data []byte) (streamDelta, error)
+
+// streamParserFor returns the chunk parser of a model's formatter, defaulting to Claude's format for unknown models
+func streamParserFor(model string) streamParser {
+	return formatterFor(model).ParseStreamChunk
+}
+
+// invocationMetrics is the usage summary Bedrock appends to the final chunk of every model's stream
+type invocationMetrics struct {
+	Metrics *struct {
+		InputTokenCount  int `json:"inputTokenCount"`
+		OutputTokenCount int `json:"outputTokenCount"`
+	} `json:"amazon-bedrock-invocationMetrics"`
+}
+
+// applyInvocationMetrics sets the delta's token counts from Bedrock's invocation metrics, when the chunk has them
+func applyInvocationMetrics(data []byte, delta *streamDelta) {
+	var metrics invocationMetrics
+	if err := json.Unmarshal(data, &metrics); err != nil || metrics.Metrics == nil {
+		return
+	}
+	delta.PromptTokens = &metrics.Metrics.InputTokenCount
+	delta.CompletionTokens = &metrics.Metrics.OutputTokenCount
+}
+
+// claudeStreamEvent represents a streaming event emitted by Claude's messages API
+type claudeStreamEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message struct {
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	} `json:"message"`
+	ContentBlock struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		Thinking    string `json:"thinking"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// parseClaudeStreamChunk parses Claude's message_start, content block and message_delta events
+func parseClaudeStreamChunk(data []byte) (streamDelta, error) {
+	var event claudeStreamEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return streamDelta{}, err
+	}
+
+	var delta streamDelta
+	switch event.Type {
+	case "message_start":
+		delta.PromptTokens = &event.Message.Usage.InputTokens
+		delta.CompletionTokens = &event.Message.Usage.OutputTokens
+	case "content_block_start":
+		if event.ContentBlock.Type == "tool_use" {
+			delta.ToolCall = &streamToolCall{Index: event.Index, ID: event.ContentBlock.ID, Name: event.ContentBlock.Name}
+		}
+	case "content_block_delta":
+		delta.Text = event.Delta.Text
+		delta.Thinking = event.Delta.Thinking
+		if event.Delta.Type == "input_json_delta" {
+			delta.ToolCall = &streamToolCall{Index: event.Index, Arguments: event.Delta.PartialJSON}
+		}
+	case "content_block_stop":
+		delta.BlockEnd = &event.Index
+	case "message_delta":
+		delta.FinishReason = event.Delta.StopReason
+		delta.CompletionTokens = &event.Usage.OutputTokens
+	}
+	return delta, nil
+}
+
+// parseTitanStreamChunk parses Amazon Titan Text chunks, which carry outputText deltas and a completionReason
+func parseTitanStreamChunk(data []byte) (streamDelta, error) {
+	var chunk struct {
+		OutputText                string  `json:"outputText"`
+		CompletionReason          *string `json:"completionReason"`
+		InputTextTokenCount       *int    `json:"inputTextTokenCount"`
+		TotalOutputTextTokenCount *int    `json:"totalOutputTextTokenCount"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return streamDelta{}, err
+	}
+
+	delta := streamDelta{
+		Text:             chunk.OutputText,
+		PromptTokens:     chunk.InputTextTokenCount,
+		CompletionTokens: chunk.TotalOutputTextTokenCount,
+	}
+	if chunk.CompletionReason != nil {
+		delta.FinishReason = *chunk.CompletionReason
+	}
+	applyInvocationMetrics(data, &delta)
+	return delta, nil
+}
+
+// parseLlamaStreamChunk parses Meta Llama chunks, which carry generation deltas and a stop_reason
+func parseLlamaStreamChunk(data []byte) (streamDelta, error) {
+	var chunk struct {
+		Generation           string  `json:"generation"`
+		PromptTokenCount     *int    `json:"prompt_token_count"`
+		GenerationTokenCount *int    `json:"generation_token_count"`
+		StopReason           *string `json:"stop_reason"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return streamDelta{}, err
+	}
+
+	delta := streamDelta{Text: chunk.Generation, PromptTokens: chunk.PromptTokenCount, CompletionTokens: chunk.GenerationTokenCount}
+	if chunk.StopReason != nil {
+		delta.FinishReason = *chunk.StopReason
+	}
+	applyInvocationMetrics(data, &delta)
+	return delta, nil
+}
+
+// parseMistralStreamChunk parses Mistral chunks, which carry an outputs array of text deltas
+func parseMistralStreamChunk(data []byte) (streamDelta, error) {
+	var chunk struct {
+		Outputs []struct {
+			Text       string  `json:"text"`
+			StopReason *string `json:"stop_reason"`
+		} `json:"outputs"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return streamDelta{}, err
+	}
+
+	var delta streamDelta
+	for _, output := range chunk.Outputs {
+		delta.Text += output.Text
+		if output.StopReason != nil {
+			delta.FinishReason = *output.StopReason
+		}
+	}
+	applyInvocationMetrics(data, &delta)
+	return delta, nil
+}
+
+// parseNovaStreamChunk parses Amazon Nova chunks, which follow the Converse stream event shapes
+func parseNovaStreamChunk(data []byte) (streamDelta, error) {
+	var chunk struct {
+		ContentBlockDelta *struct {
+			Delta struct {
+				Text string `json:"text"`
+			} `json:"delta"`
+		} `json:"contentBlockDelta"`
+		MessageStop *struct {
+			StopReason string `json:"stopReason"`
+		} `json:"messageStop"`
+		Metadata *struct {
+			Usage struct {
+				InputTokens  int `json:"inputTokens"`
+				OutputTokens int `json:"outputTokens"`
+			} `json:"usage"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return streamDelta{}, err
+	}
+
+	var delta streamDelta
+	if chunk.ContentBlockDelta != nil {
+		delta.Text = chunk.ContentBlockDelta.Delta.Text
+	}
+	if chunk.MessageStop != nil {
+		delta.FinishReason = chunk.MessageStop.StopReason
+	}
+	if chunk.Metadata != nil {
+		delta.PromptTokens = &chunk.Metadata.Usage.InputTokens
+		delta.CompletionTokens = &chunk.Metadata.Usage.OutputTokens
+	}
+	applyInvocationMetrics(data, &delta)
+	return delta, nil
+}
+
+// parseCohereStreamChunk parses Cohere Command R chunks, which carry text-generation events and a final stream-end
+func parseCohereStreamChunk(data []byte) (streamDelta, error) {
+	var chunk struct {
+		EventType    string `json:"event_type"`
+		Text         string `json:"text"`
+		FinishReason string `json:"finish_reason"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return streamDelta{}, err
+	}
+
+	var delta streamDelta
+	switch chunk.EventType {
+	case "text-generation":
+		delta.Text = chunk.Text
+	case "stream-end":
+		delta.FinishReason = chunk.FinishReason
+	}
+	applyInvocationMetrics(data, &delta)
+	return delta, nil
+}
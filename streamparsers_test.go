@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// replayStreamFixture feeds each line of a recorded stream fixture through the model's parser
+// and returns the accumulated text, the converted finish reason and the final usage
+func replayStreamFixture(t *testing.T, model, fixture string) (string, string, Usage) {
+	t.Helper()
+	file, err := os.Open(filepath.Join("testdata", "stream", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	parse := streamParserFor(model)
+	var text, finishReason string
+	var usage Usage
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		delta, err := parse(scanner.Bytes())
+		if err != nil {
+			t.Fatalf("%s: parsing %s: %v", fixture, scanner.Text(), err)
+		}
+		text += delta.Text
+		if delta.FinishReason != "" {
+			finishReason = ConvertFinishReason(delta.FinishReason)
+		}
+		if delta.PromptTokens != nil {
+			usage.PromptTokens = *delta.PromptTokens
+		}
+		if delta.CompletionTokens != nil {
+			usage.CompletionTokens = *delta.CompletionTokens
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return text, finishReason, usage
+}
+
+func TestStreamParsers(t *testing.T) {
+	tests := []struct {
+		model            string
+		fixture          string
+		wantFinishReason string
+	}{
+		{model: "anthropic.claude-3-haiku-20240307-v1:0", fixture: "claude.jsonl", wantFinishReason: "stop"},
+		{model: "us.anthropic.claude-3-5-sonnet-20240620-v1:0", fixture: "claude.jsonl", wantFinishReason: "stop"},
+		{model: "amazon.titan-text-express-v1", fixture: "titan.jsonl", wantFinishReason: "stop"},
+		{model: "meta.llama3-1-8b-instruct-v1:0", fixture: "llama.jsonl", wantFinishReason: "stop"},
+		{model: "mistral.mistral-7b-instruct-v0:2", fixture: "mistral.jsonl", wantFinishReason: "length"},
+		{model: "amazon.nova-lite-v1:0", fixture: "nova.jsonl", wantFinishReason: "stop"},
+		{model: "cohere.command-r-v1:0", fixture: "cohere.jsonl", wantFinishReason: "length"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			text, finishReason, usage := replayStreamFixture(t, tt.model, tt.fixture)
+			if text != "Hello there!" {
+				t.Errorf("text = %q, want %q", text, "Hello there!")
+			}
+			if finishReason != tt.wantFinishReason {
+				t.Errorf("finish reason = %q, want %q", finishReason, tt.wantFinishReason)
+			}
+			if usage.PromptTokens != 12 || usage.CompletionTokens != 4 {
+				t.Errorf("usage = %d prompt, %d completion; want 12 and 4", usage.PromptTokens, usage.CompletionTokens)
+			}
+		})
+	}
+}
+
+func TestStreamParserForUnknownModel(t *testing.T) {
+	delta, err := streamParserFor("acme.model-v1")([]byte(`{"type":"content_block_delta","delta":{"type":"text_delta","text":"hi"}}`))
+	if err != nil || delta.Text != "hi" {
+		t.Errorf("unknown models should fall back to Claude's stream format, got %+v, %v", delta, err)
+	}
+}
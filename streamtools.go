@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Validation modes for the tool calls of streamed responses
+const (
+	StreamToolValidationOff    = "off"    // relay argument fragments as they arrive, unchecked
+	StreamToolValidationError  = "error"  // relay each call once complete, ending the stream at an invalid one
+	StreamToolValidationRepair = "repair" // like error, but first close the brackets and strings of truncated arguments
+)
+
+// streamToolValidationModes are the valid STREAM_TOOL_VALIDATION modes
+var streamToolValidationModes = map[string]bool{
+	StreamToolValidationOff:    true,
+	StreamToolValidationError:  true,
+	StreamToolValidationRepair: true,
+}
+
+// pendingToolCall is a tool call of a stream whose arguments are still arriving
+type pendingToolCall struct {
+	index     int // the call's position among the response's tool calls
+	id        string
+	name      string
+	arguments strings.Builder
+	done      bool
+}
+
+// streamToolCalls relays the tool calls of a stream to the client: as they arrive, or, when
+// STREAM_TOOL_VALIDATION is set, in one chunk per call once its arguments are complete and valid
+type streamToolCalls struct {
+	mode string
+
+	// schemas are the functions' parameter schemas when TOOL_ARGUMENT_VALIDATION checks arguments against them
+	schemas map[string]json.RawMessage
+
+	calls map[int]*pendingToolCall // by content block index
+}
+
+// newStreamToolCalls creates the tool call relay of a streamed request
+func newStreamToolCalls(req ChatRequest) *streamToolCalls {
+	t := &streamToolCalls{mode: AppConfig.StreamToolValidation, calls: make(map[int]*pendingToolCall)}
+	if t.mode == "" {
+		t.mode = StreamToolValidationOff
+	}
+	if mode := AppConfig.ToolArgumentValidation; mode == "annotate" || mode == "repair" {
+		t.schemas = make(map[string]json.RawMessage)
+		for _, function := range requestFunctions(req) {
+			t.schemas[function.Name] = function.Parameters
+		}
+	}
+	return t
+}
+
+// add records the start of a tool call or a fragment of its arguments, relaying it unless calls are validated
+func (t *streamToolCalls) add(w *chatStreamWriter, piece streamToolCall) {
+	call, ok := t.calls[piece.Index]
+	if !ok {
+		call = &pendingToolCall{index: len(t.calls), id: piece.ID, name: piece.Name}
+		t.calls[piece.Index] = call
+		if t.mode == StreamToolValidationOff {
+			w.writeChunk(ChunkDelta{ToolCalls: []ChunkToolCall{{
+				Index:    call.index,
+				ID:       call.id,
+				Type:     "function",
+				Function: ChunkToolFunction{Name: call.name},
+			}}}, nil)
+		}
+	}
+	if piece.Arguments == "" {
+		return
+	}
+
+	call.arguments.WriteString(piece.Arguments)
+	if t.mode == StreamToolValidationOff {
+		w.writeChunk(ChunkDelta{ToolCalls: []ChunkToolCall{{Index: call.index, Function: ChunkToolFunction{Arguments: piece.Arguments}}}}, nil)
+	}
+}
+
+// end completes the tool call of a content block, if it is one, relaying it when it is valid
+func (t *streamToolCalls) end(w *chatStreamWriter, block int) error {
+	call, ok := t.calls[block]
+	if !ok || call.done {
+		return nil
+	}
+	call.done = true
+	if t.mode == StreamToolValidationOff {
+		return nil
+	}
+
+	arguments, err := t.check(call)
+	if err != nil {
+		return err
+	}
+	w.writeChunk(ChunkDelta{ToolCalls: []ChunkToolCall{{
+		Index:    call.index,
+		ID:       call.id,
+		Type:     "function",
+		Function: ChunkToolFunction{Name: call.name, Arguments: arguments},
+	}}}, nil)
+	return nil
+}
+
+// finish completes the tool calls whose content blocks never ended, in order, before the stream's final chunk
+func (t *streamToolCalls) finish(w *chatStreamWriter) error {
+	blocks := make([]int, 0, len(t.calls))
+	for block := range t.calls {
+		blocks = append(blocks, block)
+	}
+	sort.Ints(blocks)
+	for _, block := range blocks {
+		if err := t.end(w, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns the complete arguments of a tool call, repaired in repair mode, or why they are invalid
+func (t *streamToolCalls) check(call *pendingToolCall) (string, error) {
+	arguments := call.arguments.String()
+	if strings.TrimSpace(arguments) == "" {
+		// Claude streams no fragments for calls without arguments
+		arguments = "{}"
+	}
+	if !json.Valid([]byte(arguments)) && t.mode == StreamToolValidationRepair {
+		if repaired, ok := closeJSON(arguments); ok {
+			log.Printf("Repaired truncated arguments of streamed tool call %s", call.id)
+			arguments = repaired
+		}
+	}
+	if !json.Valid([]byte(arguments)) {
+		return "", fmt.Errorf("tool call %s to %q has arguments that are not valid JSON", call.id, call.name)
+	}
+
+	if t.schemas != nil {
+		toolCall := ToolCall{ID: call.id, Type: "function", Function: ToolCallFunction{Name: call.name, Arguments: arguments}}
+		if err := validateToolArguments(toolCall, t.schemas); err != nil {
+			return "", fmt.Errorf("tool call %s to %q has invalid arguments: %v", call.id, call.name, err)
+		}
+	}
+	return arguments, nil
+}
+
+// closeJSON completes JSON cut off part way, as arguments are when a stream stops at max_tokens, by closing its
+// open string, arrays and objects. It reports false if the result still isn't valid JSON.
+func closeJSON(s string) (string, bool) {
+	var open []byte // the closers of the open arrays and objects, innermost last
+	inString, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{':
+			open = append(open, '}')
+		case c == '[':
+			open = append(open, ']')
+		case (c == '}' || c == ']') && len(open) > 0:
+			open = open[:len(open)-1]
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(s)
+	if inString {
+		if escaped {
+			b.WriteByte('\\')
+		}
+		b.WriteByte('"')
+	}
+	closed := strings.TrimRight(b.String(), " \t\r\n,")
+	if strings.HasSuffix(closed, ":") {
+		closed += "null"
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		closed += string(open[i])
+	}
+	return closed, json.Valid([]byte(closed))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// structuredOutputTool is the name of the tool Claude is made to call in order to answer with a
+// response_format json_schema; its input becomes the message content
+const structuredOutputTool = "json_schema_response"
+
+// errStructuredOutput is reported when a strict json_schema response does not match the schema
+var errStructuredOutput = errors.New("model response does not match the json_schema response format")
+
+// ResponseFormat is OpenAI's response_format: "text", "json_object", or "json_schema" with a schema to follow
+type ResponseFormat struct {
+	Type       string            `json:"type,omitempty"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat is the schema of a json_schema response format
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+
+	// Strict fails the request when the response does not match the schema, instead of returning it anyway
+	Strict bool `json:"strict,omitempty"`
+}
+
+// jsonSchemaFormat returns the request's json_schema response format, or nil if it asks for another format
+func (r ChatRequest) jsonSchemaFormat() *JSONSchemaFormat {
+	if r.ResponseFormat == nil || r.ResponseFormat.Type != "json_schema" {
+		return nil
+	}
+	return r.ResponseFormat.JSONSchema
+}
+
+// validateResponseFormat checks the request's response_format
+func validateResponseFormat(r ChatRequest) error {
+	if r.ResponseFormat == nil {
+		return nil
+	}
+	switch r.ResponseFormat.Type {
+	case "", "text", "json_object":
+		return nil
+	case "json_schema":
+	default:
+		return fmt.Errorf("invalid response_format type %q, must be one of text, json_object, json_schema", r.ResponseFormat.Type)
+	}
+
+	format := r.ResponseFormat.JSONSchema
+	if format == nil || format.Name == "" {
+		return errors.New("response_format json_schema must set json_schema.name")
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(format.Schema, &schema); err != nil || schema == nil {
+		return errors.New("response_format json_schema.schema must be a JSON Schema object")
+	}
+	if r.Stream {
+		return errors.New("response_format json_schema is not supported with stream")
+	}
+	for _, function := range requestFunctions(r) {
+		if function.Name == structuredOutputTool {
+			return fmt.Errorf("function name %q is reserved for response_format json_schema", structuredOutputTool)
+		}
+	}
+	return nil
+}
+
+// structuredOutputClaudeTool returns the tool whose input schema is the response format's schema
+func structuredOutputClaudeTool(format *JSONSchemaFormat) claudeTool {
+	description := fmt.Sprintf("Respond with %s. Always call this tool to give the final answer.", format.Name)
+	if format.Description != "" {
+		description = format.Description + " " + description
+	}
+	return claudeTool{
+		Name:        structuredOutputTool,
+		Description: description,
+		InputSchema: format.Schema,
+	}
+}
+
+// structuredToolChoice returns the tool_choice that makes Claude answer through the structured output tool.
+// Without other tools it is forced; with them, any tool must be called unless the client named one. Extended
+// thinking does not allow a forced tool, so there the choice is left to the model.
+func structuredToolChoice(req ChatRequest) map[string]interface{} {
+	if _, thinking := thinkingBudgets[req.ReasoningEffort]; thinking {
+		return map[string]interface{}{"type": "auto"}
+	}
+
+	choice, _ := parseToolChoice(req)
+	if len(requestFunctions(req)) == 0 || choice["type"] == "none" {
+		return map[string]interface{}{"type": "tool", "name": structuredOutputTool}
+	}
+	if choice["type"] == "tool" {
+		return choice
+	}
+	return map[string]interface{}{"type": "any"}
+}
+
+// checkStructuredOutput verifies, for a strict json_schema response format, that the answer is JSON matching
+// the schema. Refusals and calls to the client's own tools are returned as they are.
+func checkStructuredOutput(req ChatRequest, result *ChatResult) error {
+	format := req.jsonSchemaFormat()
+	if format == nil || !format.Strict || result.Refusal != "" || len(result.ToolCalls) > 0 {
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(result.Content), &value); err != nil {
+		return fmt.Errorf("%w: content is not valid JSON", errStructuredOutput)
+	}
+	if err := ValidateJSONSchema(format.Schema, value); err != nil {
+		return fmt.Errorf("%w: %v", errStructuredOutput, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestProcessChatJSONSchema(t *testing.T) {
+	format := &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{
+		Name:   "weather",
+		Schema: json.RawMessage(`{"type":"object","properties":{"temp":{"type":"number"}},"required":["temp"]}`),
+		Strict: true,
+	}}
+	req := ChatRequest{Model: "anthropic.claude-3-haiku-20240307-v1:0", Messages: []Message{{Role: "user", Content: "Weather?"}}, ResponseFormat: format}
+	if err := req.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	service, invoker := newTestService(
+		`{"content":[{"type":"text","text":"Here it is."},{"type":"tool_use","id":"t1","name":"json_schema_response","input":{"temp":21.5}}],"stop_reason":"tool_use"}`,
+		`{"content":[{"type":"tool_use","id":"t2","name":"json_schema_response","input":{"temperature":"warm"}}],"stop_reason":"tool_use"}`,
+	)
+	result, err := service.ProcessChat(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != `{"temp":21.5}` || result.FinishReason != "stop" || len(result.ToolCalls) != 0 {
+		t.Errorf("result = %q (%s, %d tool calls), want the tool input as content", result.Content, result.FinishReason, len(result.ToolCalls))
+	}
+
+	payload := invoker.payload(t, 0)
+	tools := payload["tools"].([]interface{})
+	if len(tools) != 1 || tools[0].(map[string]interface{})["name"] != structuredOutputTool {
+		t.Errorf("tools = %v, want the structured output tool", tools)
+	}
+	if choice := payload["tool_choice"].(map[string]interface{}); choice["type"] != "tool" || choice["name"] != structuredOutputTool {
+		t.Errorf("tool_choice = %v, want the structured output tool forced", choice)
+	}
+
+	if _, err := service.ProcessChat(context.Background(), req); !errors.Is(err, errStructuredOutput) {
+		t.Errorf("err = %v, want a schema mismatch", err)
+	} else if chatErrorStatus(err) != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", chatErrorStatus(err))
+	}
+
+	req.Stream = true
+	if err := req.Validate(); err == nil {
+		t.Error("expected an error for json_schema with stream")
+	}
+}
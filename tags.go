@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+)
+
+// maxCostTags is the most tags a request may carry, matching the limit on Bedrock request metadata
+const maxCostTags = 16
+
+// costTagPattern matches the keys and values Bedrock accepts as request metadata
+var costTagPattern = regexp.MustCompile(`^[a-zA-Z0-9\s:_@$#=/+,.-]{0,256}$`)
+
+// awsTagValuePattern matches the values AWS accepts as resource tags, which COST_TAG_PROFILES attaches them as
+var awsTagValuePattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]{0,256}$`)
+
+// validateCostTags checks a request's metadata against the configured cost tag keys.
+// Metadata is only treated as cost tags when COST_TAG_KEYS is set.
+func validateCostTags(metadata map[string]string) error {
+	if len(AppConfig.CostTagKeys) == 0 {
+		return nil
+	}
+	if len(metadata) > maxCostTags {
+		return fmt.Errorf("metadata may carry at most %d tags, got %d", maxCostTags, len(metadata))
+	}
+
+	for key, value := range metadata {
+		if !slices.Contains(AppConfig.CostTagKeys, key) {
+			return fmt.Errorf("metadata key %q is not an allowed cost tag; allowed keys are %v", key, AppConfig.CostTagKeys)
+		}
+		if !costTagPattern.MatchString(value) {
+			return fmt.Errorf("metadata value for %q must be at most 256 letters, digits, spaces or :_@$#=/+,.- characters", key)
+		}
+		if AppConfig.CostTagProfiles && !awsTagValuePattern.MatchString(value) {
+			return fmt.Errorf("metadata value for %q must be at most 256 letters, digits, spaces or _.:/=+-@ characters to be forwarded as an AWS tag", key)
+		}
+	}
+	return nil
+}
+
+// CostTags returns the cost allocation tags of a request: the configured defaults overridden by the request's metadata
+func (r ChatRequest) CostTags() map[string]string {
+	if len(AppConfig.DefaultCostTags) == 0 && (len(AppConfig.CostTagKeys) == 0 || len(r.Metadata) == 0) {
+		return nil
+	}
+
+	tags := make(map[string]string, len(AppConfig.DefaultCostTags)+len(r.Metadata))
+	for key, value := range AppConfig.DefaultCostTags {
+		tags[key] = value
+	}
+	if len(AppConfig.CostTagKeys) > 0 {
+		for key, value := range r.Metadata {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// maxCostTagProfiles is the most cost tag profiles one gateway instance creates, so callers sending distinct tag
+// values can't exhaust the account's quota of application inference profiles
+const maxCostTagProfiles = 100
+
+// errCostTagProfiles is reported for requests whose cost tags would need a profile beyond maxCostTagProfiles
+var errCostTagProfiles = fmt.Errorf("cost tags can't be forwarded: the gateway has already created its limit of %d cost tag profiles", maxCostTagProfiles)
+
+// CostTagProfileClient is the subset of the Bedrock control plane client used to find and create the application
+// inference profiles that carry cost tags. It is satisfied by *bedrock.Client and lets tests substitute fakes.
+type CostTagProfileClient interface {
+	CreateInferenceProfile(ctx context.Context, params *bedrock.CreateInferenceProfileInput, optFns ...func(*bedrock.Options)) (*bedrock.CreateInferenceProfileOutput, error)
+	bedrock.ListInferenceProfilesAPIClient
+}
+
+// applyCostTagProfile forwards a request's cost tags to AWS with COST_TAG_PROFILES, by invoking the model through
+// an application inference profile tagged with them: InvokeModel takes no tags of its own, and Bedrock attributes
+// the cost of invocations through a tagged profile to its tags in Cost Explorer and the cost and usage report.
+// Requests without tags, and models addressed by ARN, such as an operator's own application profiles, are
+// returned unchanged.
+func (s *BedrockService) applyCostTagProfile(ctx context.Context, req ChatRequest) (ChatRequest, error) {
+	tags := req.CostTags()
+	source := req.InvocationModel()
+	if !AppConfig.CostTagProfiles || len(tags) == 0 || strings.HasPrefix(source, "arn:") {
+		return req, nil
+	}
+
+	name := costTagProfileName(source, tags)
+	arn, err, _ := s.inflight.Do("cost-tag-profile:"+name, func() (interface{}, error) {
+		return s.costTagProfile(ctx, name, source, tags)
+	})
+	if err != nil {
+		return req, err
+	}
+	req.baseModel = req.FormatModel()
+	req.targetModel = arn.(string)
+	return req, nil
+}
+
+// costTagProfileName names the profile for a model and tag set, the same on every gateway instance so they share it
+func costTagProfileName(source string, tags map[string]string) string {
+	hash := sha256.New()
+	hash.Write([]byte(source))
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		fmt.Fprintf(hash, "\x00%s=%s", key, tags[key])
+	}
+	return "gateway-cost-" + hex.EncodeToString(hash.Sum(nil))[:24]
+}
+
+// costTagProfile returns the ARN of the named cost tag profile, creating it from the source model with the tags
+// if it doesn't exist yet
+func (s *BedrockService) costTagProfile(ctx context.Context, name, source string, tags map[string]string) (string, error) {
+	if arn, ok := s.costTagProfiles.Load(name); ok {
+		return arn.(string), nil
+	}
+	if s.costTagProfileCount.Load() >= maxCostTagProfiles {
+		return "", errCostTagProfiles
+	}
+
+	copyFrom, err := s.modelARN(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	var awsTags []types.Tag
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		awsTags = append(awsTags, types.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	created, err := s.costTagClient.CreateInferenceProfile(ctx, &bedrock.CreateInferenceProfileInput{
+		InferenceProfileName: aws.String(name),
+		Description:          aws.String("Created by the gateway to attribute the cost of " + source + " to cost allocation tags"),
+		ModelSource:          &types.InferenceProfileModelSourceMemberCopyFrom{Value: copyFrom},
+		Tags:                 awsTags,
+	})
+
+	var arn string
+	var conflict *types.ConflictException
+	switch {
+	case err == nil:
+		arn = aws.ToString(created.InferenceProfileArn)
+	case errors.As(err, &conflict):
+		// Another gateway instance, or an earlier run of this one, has already created it
+		arn, err = s.findCostTagProfile(ctx, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to create the cost tag profile for %s: %w", source, err)
+	}
+
+	s.costTagProfiles.Store(name, arn)
+	s.costTagProfileCount.Add(1)
+	return arn, nil
+}
+
+// findCostTagProfile returns the ARN of the application inference profile with the given name
+func (s *BedrockService) findCostTagProfile(ctx context.Context, name string) (string, error) {
+	pages := bedrock.NewListInferenceProfilesPaginator(s.costTagClient, &bedrock.ListInferenceProfilesInput{
+		TypeEquals: types.InferenceProfileTypeApplication,
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, profile := range page.InferenceProfileSummaries {
+			if aws.ToString(profile.InferenceProfileName) == name {
+				return aws.ToString(profile.InferenceProfileArn), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("inference profile %s already exists but can't be found", name)
+}
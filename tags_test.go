@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock"
+	bedrocktypes "github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+)
+
+func TestCostTags(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.CostTagKeys = []string{"team", "feature"}
+	AppConfig.DefaultCostTags = map[string]string{"team": "platform", "env": "prod"}
+
+	req := ChatRequest{Metadata: map[string]string{"team": "search"}}
+	if err := validateCostTags(req.Metadata); err != nil {
+		t.Fatal(err)
+	}
+	tags := req.CostTags()
+	if tags["team"] != "search" || tags["env"] != "prod" {
+		t.Errorf("tags = %v, want request metadata merged over the defaults", tags)
+	}
+
+	if err := validateCostTags(map[string]string{"owner": "me"}); err == nil {
+		t.Error("expected a key outside COST_TAG_KEYS to be rejected")
+	}
+	if err := validateCostTags(map[string]string{"team": "a\x00b"}); err == nil {
+		t.Error("expected a value with invalid characters to be rejected")
+	}
+
+	// Values forwarded as AWS tags are held to AWS's tag character set
+	AppConfig.CostTagProfiles = true
+	if err := validateCostTags(map[string]string{"team": "a#b"}); err == nil {
+		t.Error("expected a value AWS doesn't accept as a tag to be rejected")
+	}
+}
+
+// fakeCostTagClient creates application inference profiles, recording the requests, and lists those it holds
+type fakeCostTagClient struct {
+	created  []*bedrock.CreateInferenceProfileInput
+	conflict bool // whether creating fails because the profile exists
+	existing []bedrocktypes.InferenceProfileSummary
+}
+
+func (f *fakeCostTagClient) CreateInferenceProfile(ctx context.Context, params *bedrock.CreateInferenceProfileInput, optFns ...func(*bedrock.Options)) (*bedrock.CreateInferenceProfileOutput, error) {
+	f.created = append(f.created, params)
+	if f.conflict {
+		return nil, &bedrocktypes.ConflictException{Message: aws.String("already exists")}
+	}
+	arn := "arn:aws:bedrock:us-east-1:123456789012:application-inference-profile/" + aws.ToString(params.InferenceProfileName)
+	return &bedrock.CreateInferenceProfileOutput{InferenceProfileArn: aws.String(arn)}, nil
+}
+
+func (f *fakeCostTagClient) ListInferenceProfiles(ctx context.Context, params *bedrock.ListInferenceProfilesInput, optFns ...func(*bedrock.Options)) (*bedrock.ListInferenceProfilesOutput, error) {
+	return &bedrock.ListInferenceProfilesOutput{InferenceProfileSummaries: f.existing}, nil
+}
+
+func TestCostTagProfiles(t *testing.T) {
+	restoreConfig(t)
+	AppConfig.CostTagKeys = []string{"team"}
+	AppConfig.CostTagProfiles = true
+	model := "anthropic.claude-3-haiku-20240307-v1:0"
+	ok := `{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`
+
+	service, invoker := newTestService(ok, ok, ok)
+	service.awsConfig = aws.Config{Region: "us-east-1"}
+	profiles := &fakeCostTagClient{}
+	service.costTagClient = profiles
+	req := ChatRequest{Model: model, Metadata: map[string]string{"team": "search"}, Messages: []Message{{Role: "user", Content: "Hi"}}}
+
+	// A tagged request is invoked through a profile created from its model with its tags, and reports its model
+	for i := 0; i < 2; i++ {
+		served, _, err := service.ProcessChatWithFallback(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if served.Model != model || served.FormatModel() != model {
+			t.Errorf("served model %s formatted as %s, want %s", served.Model, served.FormatModel(), model)
+		}
+	}
+	if len(profiles.created) != 1 {
+		t.Fatalf("%d profiles created, want one shared by requests with the same tags", len(profiles.created))
+	}
+	created := profiles.created[0]
+	if source := created.ModelSource.(*bedrocktypes.InferenceProfileModelSourceMemberCopyFrom).Value; source != "arn:aws:bedrock:us-east-1::foundation-model/"+model {
+		t.Errorf("profile copied from %s, want the foundation model", source)
+	}
+	if len(created.Tags) != 1 || aws.ToString(created.Tags[0].Key) != "team" || aws.ToString(created.Tags[0].Value) != "search" {
+		t.Errorf("profile tags = %+v, want team=search", created.Tags)
+	}
+	wantARN := "arn:aws:bedrock:us-east-1:123456789012:application-inference-profile/" + aws.ToString(created.InferenceProfileName)
+	if invoked := aws.ToString(invoker.inputs[1].ModelId); invoked != wantARN {
+		t.Errorf("invoked %s, want the cost tag profile %s", invoked, wantARN)
+	}
+
+	// A profile that already exists, created by another instance, is found by its name
+	service.costTagProfiles.Clear()
+	profiles.conflict = true
+	profiles.existing = []bedrocktypes.InferenceProfileSummary{{InferenceProfileName: created.InferenceProfileName, InferenceProfileArn: aws.String(wantARN)}}
+	if _, _, err := service.ProcessChatWithFallback(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if invoked := aws.ToString(invoker.inputs[2].ModelId); invoked != wantARN {
+		t.Errorf("invoked %s, want the existing profile %s", invoked, wantARN)
+	}
+
+	// Untagged requests are invoked as they are
+	untagged := req
+	untagged.Metadata = nil
+	if served, _ := service.applyCostTagProfile(context.Background(), untagged); served.InvocationModel() != model {
+		t.Errorf("untagged request invokes %s, want %s", served.InvocationModel(), model)
+	}
+}
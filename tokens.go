@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// charsPerToken approximates how many characters Bedrock model tokenizers fit into one token for typical text
+const charsPerToken = 4
+
+// EstimateTokens returns a heuristic token count for text. It is not exact for any model's tokenizer
+// and is only meant for budgeting and progress reporting; authoritative counts come from the model.
+func EstimateTokens(text string) int {
+	return EstimateTokensFromChars(utf8.RuneCountInString(text))
+}
+
+// EstimateTokensFromChars returns the heuristic token count for a text of the given length in characters
+func EstimateTokensFromChars(chars int) int {
+	return (chars + charsPerToken - 1) / charsPerToken
+}
+
+// EstimateMessageTokens returns a heuristic token count for a conversation, including a small per-message overhead
+func EstimateMessageTokens(messages []Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += 4 // role and message framing
+		switch c := msg.Content.(type) {
+		case string:
+			total += EstimateTokens(c)
+		case nil:
+		default:
+			// Content blocks are estimated from their serialized form
+			data, _ := json.Marshal(c)
+			total += EstimateTokens(string(data))
+		}
+	}
+	return total
+}
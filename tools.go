@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// claudeTool is a tool definition in Claude's messages API format
+type claudeTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// requestFunctions returns the function definitions of a request from either tools or legacy functions
+func requestFunctions(req ChatRequest) []Function {
+	functions := make([]Function, 0, len(req.Tools)+len(req.Functions))
+	for _, tool := range req.Tools {
+		if tool.Type == "" || tool.Type == "function" {
+			functions = append(functions, tool.Function)
+		}
+	}
+	return append(functions, req.Functions...)
+}
+
+// formatClaudeTools converts OpenAI tool and function definitions into Claude tools
+func formatClaudeTools(req ChatRequest) []claudeTool {
+	functions := requestFunctions(req)
+	if len(functions) == 0 {
+		return nil
+	}
+
+	tools := make([]claudeTool, len(functions))
+	for i, function := range functions {
+		schema := function.Parameters
+		if len(schema) == 0 || string(schema) == "null" {
+			// Claude requires an input schema even for functions without parameters
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		tools[i] = claudeTool{
+			Name:        function.Name,
+			Description: function.Description,
+			InputSchema: schema,
+		}
+	}
+
+	return tools
+}
+
+// formatClaudeToolChoice translates OpenAI's tool_choice, or the legacy function_call, into Claude's tool_choice.
+// It returns nil when the client leaves the choice to the model's default; invalid choices are rejected by Validate.
+func formatClaudeToolChoice(req ChatRequest) interface{} {
+	choice, err := parseToolChoice(req)
+	if err != nil || choice == nil {
+		return nil
+	}
+	return choice
+}
+
+// parseToolChoice reads OpenAI's tool_choice, or the legacy function_call, as Claude's tool_choice:
+// "auto", "none" and "required" map to the auto, none and any types, and a named function to the tool type.
+// It returns nil when the request sets neither field.
+func parseToolChoice(req ChatRequest) (map[string]interface{}, error) {
+	field, choice := "tool_choice", req.ToolChoice
+	if choice == nil {
+		field, choice = "function_call", req.FunctionCall
+	}
+
+	switch c := choice.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		switch c {
+		case "auto":
+			return map[string]interface{}{"type": "auto"}, nil
+		case "none":
+			return map[string]interface{}{"type": "none"}, nil
+		case "required":
+			if len(requestFunctions(req)) == 0 {
+				return nil, fmt.Errorf("%s \"required\" needs at least one tool", field)
+			}
+			return map[string]interface{}{"type": "any"}, nil
+		}
+		return nil, fmt.Errorf("invalid %s %q, must be one of auto, none, required, or a named function", field, c)
+	case map[string]interface{}:
+		// Tools name the function under "function"; the legacy function_call names it directly
+		if t, ok := c["type"]; ok && t != "function" {
+			return nil, fmt.Errorf("unsupported %s type %v, only \"function\" is supported", field, t)
+		}
+		named := c
+		if function, ok := c["function"].(map[string]interface{}); ok {
+			named = function
+		}
+		name, _ := named["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("%s must name a function", field)
+		}
+		for _, function := range requestFunctions(req) {
+			if function.Name == name {
+				return map[string]interface{}{"type": "tool", "name": name}, nil
+			}
+		}
+		return nil, fmt.Errorf("%s names function %q, which is not among the request's tools", field, name)
+	}
+	return nil, fmt.Errorf("%s must be a string or an object, got %s", field, jsonTypeName(choice))
+}
+
+// validateToolCalls checks tool call arguments against the declared function schemas.
+// In "annotate" mode invalid calls are marked with a validation error; in "repair" mode the model
+// is asked once to correct its call, and any call still invalid afterwards is annotated.
+func (s *BedrockService) validateToolCalls(ctx context.Context, req ChatRequest, result *ChatResult) (*ChatResult, error) {
+	mode := AppConfig.ToolArgumentValidation
+	if mode != "annotate" && mode != "repair" {
+		return result, nil
+	}
+
+	schemas := make(map[string]json.RawMessage)
+	for _, function := range requestFunctions(req) {
+		schemas[function.Name] = function.Parameters
+	}
+
+	invalid := annotateToolCalls(result.ToolCalls, schemas)
+	if invalid == 0 || mode != "repair" {
+		return result, nil
+	}
+
+	log.Printf("Requesting repair of %d tool call(s) with invalid arguments", invalid)
+	repairReq := req
+	repairReq.Messages = append(append([]Message{}, req.Messages...), toolRepairMessages(result.ToolCalls)...)
+
+	repaired, err := s.invokeModel(ctx, repairReq)
+	if err != nil {
+		// Keep the annotated original rather than failing the whole request
+		log.Printf("Tool call repair failed: %v", err)
+		return result, nil
+	}
+	annotateToolCalls(repaired.ToolCalls, schemas)
+	repaired.BedrockLatency += result.BedrockLatency
+	repaired.Retries += result.Retries
+
+	return repaired, nil
+}
+
+// annotateToolCalls validates each tool call, recording failures on the call, and returns how many failed
+func annotateToolCalls(toolCalls []ToolCall, schemas map[string]json.RawMessage) int {
+	invalid := 0
+	for i := range toolCalls {
+		if err := validateToolArguments(toolCalls[i], schemas); err != nil {
+			toolCalls[i].ValidationError = err.Error()
+			invalid++
+		}
+	}
+	return invalid
+}
+
+// validateToolArguments checks that a tool call names a declared function and that its arguments match the schema
+func validateToolArguments(toolCall ToolCall, schemas map[string]json.RawMessage) error {
+	schema, ok := schemas[toolCall.Function.Name]
+	if !ok {
+		return fmt.Errorf("unknown function %q", toolCall.Function.Name)
+	}
+
+	var arguments interface{}
+	if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &arguments); err != nil {
+		return fmt.Errorf("arguments are not valid JSON: %v", err)
+	}
+
+	return ValidateJSONSchema(schema, arguments)
+}
+
+// toolRepairMessages builds the Claude-format assistant tool_use turn and the user tool_result turn that
+// report each invalid call's validation error back to the model
+func toolRepairMessages(toolCalls []ToolCall) []Message {
+	var uses, results []interface{}
+	for _, toolCall := range toolCalls {
+		var input interface{} = map[string]interface{}{}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &input); err != nil {
+			input = map[string]interface{}{}
+		}
+		uses = append(uses, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    toolCall.ID,
+			"name":  toolCall.Function.Name,
+			"input": input,
+		})
+
+		content := "Arguments are valid."
+		if toolCall.ValidationError != "" {
+			content = "Invalid arguments: " + toolCall.ValidationError + ". Call the tool again with arguments that match its input schema."
+		}
+		results = append(results, map[string]interface{}{
+			"type":        "tool_result",
+			"tool_use_id": toolCall.ID,
+			"content":     content,
+			"is_error":    toolCall.ValidationError != "",
+		})
+	}
+
+	return []Message{
+		{Role: "assistant", Content: uses},
+		{Role: "user", Content: results},
+	}
+}
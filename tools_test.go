@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseToolChoice(t *testing.T) {
+	tools := []Tool{{Type: "function", Function: Function{Name: "get_weather"}}}
+	tests := []struct {
+		choice  interface{}
+		tools   []Tool
+		want    string
+		wantErr string
+	}{
+		{choice: nil, want: "map[]"},
+		{choice: "auto", want: "map[type:auto]"},
+		{choice: "none", want: "map[type:none]"},
+		{choice: "required", tools: tools, want: "map[type:any]"},
+		{choice: "required", wantErr: "at least one tool"},
+		{choice: map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_weather"}}, tools: tools, want: "map[name:get_weather type:tool]"},
+		{choice: map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_time"}}, tools: tools, wantErr: "not among the request's tools"},
+		{choice: map[string]interface{}{"type": "file_search"}, tools: tools, wantErr: "only \"function\""},
+		{choice: "any", wantErr: "invalid tool_choice"},
+		{choice: 3.0, wantErr: "must be a string or an object"},
+	}
+
+	for _, tt := range tests {
+		got, err := parseToolChoice(ChatRequest{ToolChoice: tt.choice, Tools: tt.tools})
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%v: error = %v, want it to mention %q", tt.choice, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.choice, err)
+		} else if fmt.Sprint(map[string]interface{}(got)) != tt.want {
+			t.Errorf("%v: got %v, want %s", tt.choice, got, tt.want)
+		}
+	}
+}